@@ -3,9 +3,9 @@ package main
 import (
 	"bitbucket.org/ctessum/cdf"
 	"encoding/csv"
+	"flag"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -31,45 +31,70 @@ type outputComp struct {
 	GEOShour    int
 	lat         int
 	lon         int
+	// The station information from the measurement csv, which is written
+	// out so that the results can be grouped later.
+	location  string
+	city      string
+	country   string
+	latitude  string
+	longitude string
+	// local is the local time of the measurement, with its UTC offset.
+	local string
+	// cell is the model cell of the station, which is written out for the
+	// cell averages and the area weighting.
+	cell modelCell
 }
 
 type ms struct {
-	csvPath string
-	ncfPath string
+	// obsPath is where the observations for the day are read from, and
+	// readObs reads them.
+	obsPath string
+	readObs func() ([]observation, error)
+	model   modelDay
 	date    time.Time
 	results []outputComp
 }
 
-func varReading(hour, lat, lon int, f *cdf.File, pol string) float32 {
-
-	lev := 0
-	// This can't be right:
-	indexx := int(lon + lat*47 + lev*144)
-
-	dims := f.Header.Lengths(pol)
+// varReading reads pol in a grid cell at the given time index, averaged
+// over the levels chosen by vertical and with its surface correction, or
+// from its near-surface variable (see levelOptions.source).
+func varReading(hour, lat, lon int, f modelFile, pol string) (float32, error) {
+	pol, o, err := vertical.source(f, pol)
+	if err != nil {
+		return 0, err
+	}
+	dims := f.Lengths(pol)
 	if len(dims) == 0 {
-		panic(fmt.Errorf("%v isn't on file", pol))
+		return 0, fmt.Errorf("%v isn't on file", pol)
 	}
-	dims = dims[1:]
-	// This is done because the 0th entry in dims is 0.
-	nread := 1
-	for _, dim := range dims {
-		nread *= dim
+	levs, err := o.levels(pol, dims)
+	if err != nil {
+		return 0, err
 	}
-
-	start, end := make([]int, len(dims)+1), make([]int, len(dims)+1)
-	start[0], end[0] = hour, hour+1
-
-	r := f.Reader(pol, start, end)
-	buf := r.Zero(nread)
-	_, err := r.Read(buf)
+	// Only the cell is read, a level at a time. Its position in the
+	// variable is given by the start of each dimension, so it doesn't
+	// depend on the size of the grid or the number of levels.
+	var sum float32
+	for _, lev := range levs {
+		start := []int{hour, lat, lon}
+		if len(dims) == 4 {
+			start = []int{hour, lev, lat, lon}
+		}
+		end := make([]int, len(start))
+		for i := range end {
+			end[i] = start[i] + 1
+		}
+		v, err := f.Read(pol, start, end)
+		if err != nil {
+			return 0, err
+		}
+		sum += v[0]
+	}
+	factor, err := o.factor(f, hour, lat, lon)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	// The following ought to be passed to ms.
-	// fmt.Println(indexx)
-	return buf.([]float32)[indexx]
-
+	return factor * sum / float32(len(levs)), nil
 }
 
 func listFiles(csvFolder string) ([]string, error) {
@@ -94,125 +119,158 @@ func listFiles(csvFolder string) ([]string, error) {
 	return csvList, nil
 }
 
-func initMs(csvFolder string, ncfFolder string) []ms {
-
-	if !strings.HasSuffix(ncfFolder, "/") {
-		ncfFolder = ncfFolder + "/"
+// dayMs sets up the pairing of the observations of each day in the source
+// with the GEOS-Chem output for the day in ncfFolder (see modelRun). A day
+// without model output is kept, with the error, so that it is reported
+// when the day is paired.
+func dayMs(src ObservationSource, ncfFolder string) ([]ms, error) {
+	run, err := findModelRun(ncfFolder)
+	if err != nil {
+		return nil, err
 	}
-
-	csvList, err := listFiles(csvFolder)
+	days, err := src.Days()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	var sliceMs []ms
-
-	for _, file := range csvList {
-
-		dateHyphen := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
-		t, err := time.Parse("2006-01-02", dateHyphen)
-		if err != nil {
-			fmt.Println(err)
-		}
-
-		ncfFormat := ncfFolder + "ts." + t.Format("20060102.150405") + ".nc"
-
-		newMs := ms{
-			csvPath: file,
+	sliceMs := make([]ms, len(days))
+	for i, t := range days {
+		t := t
+		sliceMs[i] = ms{
+			obsPath: src.Path(t),
+			readObs: func() ([]observation, error) { return src.Observations(t) },
 			date:    t,
-			ncfPath: ncfFormat,
+			model:   run.day(t),
 		}
-		sliceMs = append(sliceMs, newMs)
-
 	}
-	return sliceMs
+	return sliceMs, nil
 }
 
 // *************************************************************************
 // *************************************************************************
-//                          READING THE CSV FILE
+//                     PAIRING THE OBSERVATIONS AND MODEL
 // *************************************************************************
 // *************************************************************************
 
 func initResults(mh ms) ([]outputComp, error) {
 	var outputResults []outputComp
 
-	ff, err := os.Open(mh.ncfPath)
+	f, err := mh.model.open()
 	if err != nil {
-		return nil, fmt.Errorf("%s cannot be opened: %v", mh.ncfPath, err)
+		return nil, err
 	}
-	defer ff.Close()
-	f, err := cdf.Open(ff)
+	defer f.Close()
+	cells, err := newModelCells(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", mh.model.output.paths[0], err)
+	}
+
+	observations, err := mh.readObs()
 	if err != nil {
-		return nil, fmt.Errorf("%s cannot be opened: %v", mh.ncfPath, err)
-	}
-
-	csvf, errOpen := os.Open(mh.csvPath)
-	if errOpen != nil {
-		return nil, fmt.Errorf("The csv %s cannot be opened: %v", mh.csvPath, errOpen)
-	}
-	r := csv.NewReader(csvf)
-	lines, errRead := r.ReadAll()
-	if errRead != nil {
-		return nil, fmt.Errorf("reading %s isn't working: %v", mh.csvPath, errRead)
-	}
-	//  We remove the header information. Ideally, we would like to use this
-	//  information to allow for differently structured data.
-	lines = lines[1:]
-	//  For each line, we want to save out the time, GEOStime, lat and lon.
-	//  But, we only want to select those that are PM2.5 measurements, for
-	//  now.
-	for _, line := range lines {
-		foundTime, errTime := findTime(line[3][12:13])
-		foundLat, errLat := findLatLon(line[8], lats)
-		foundLon, errLon := findLatLon(line[9], lons)
-
-		if line[5] == "pm25" && errTime == nil && errLat == nil && errLon == nil {
-
-			ASOA1 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ASOA1")
-			ASOA2 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ASOA2")
-			ASOA3 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ASOA3")
-			//ASOAN := ppb_ugm3*MWaer[7]*varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ASOAN")
-			ISOA1 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ISOA1")
-			ISOA2 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ISOA2")
-			ISOA3 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__ISOA3")
-			TSOA0 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__TSOA0")
-			TSOA1 := ppb_ugm3 * MWaer[7] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__TSOA1")
-			TSOA2 := ppb_ugm3 * MWaer[6] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__TSOA2")
-			TSOA3 := ppb_ugm3 * MWaer[6] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__TSOA3")
-			DST1 := ppb_ugm3 * MWaer[5] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__DST1")
-			DST2 := ppb_ugm3 * MWaer[5] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__DST2")
-			SALA := ppb_ugm3 * MWaer[6] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__SALA")
-			OCPI := ppb_ugm3 * MWaer[2] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__OCPI")
-			OCPO := ppb_ugm3 * MWaer[2] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__OCPO")
-			BCPI := ppb_ugm3 * MWaer[1] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__BCPI")
-			BCPO := ppb_ugm3 * MWaer[1] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__BCPO")
-			SO4 := ppb_ugm3 * MWaer[4] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__SO4")
-			NIT := ppb_ugm3 * MWaer[3] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__NIT")
-			NH4 := ppb_ugm3 * MWaer[0] * varReading(foundTime, foundLat, foundLon, f, "IJ_AVG_S__NH4")
-
-			// Below is the correct ms.PM25 value. However, I forgot to write
-			// out ASOAN. So I have commented this out and added a new PM2.5
-			// value without ASOAN for now.
-			//ms.PM25 = 1.33*(ms.NH4+ms.NIT+ms.SO4) + ms.BCPI + ms.BCPO +
-			//2.1*(ms.OCPO+1.16*ms.OCPI) + ms.DST1 + 0.38*ms.DST2 + 1.86*ms.SALA + 1.16*(ms.TSOA0+ms.TSOA1+ms.TSOA2+ms.TSOA3+ms.ISOA1+ms.ISOA2+ms.ISOA3+ms.ASOAN+ms.ASOA1+ms.ASOA2+ms.ASOA3)
-			simPM := 1.33*(NH4+NIT+SO4) + BCPI + BCPO + 2.1*(OCPO+1.16*OCPI) + DST1 + 0.38*DST2 + 1.86*SALA + 1.16*(TSOA0+TSOA1+TSOA2+TSOA3+ISOA1+ISOA2+ISOA3+ASOA1+ASOA2+ASOA3)
-			simPM = simPM * 150 / 28.97
-
-			result := outputComp{
-				time:        line[3],
-				measuredPM:  line[6],
-				GEOShour:    foundTime,
-				lat:         foundLat,
-				lon:         foundLon,
-				simulatedPM: fmt.Sprintf("%f", simPM),
+		return nil, err
+	}
+	//  For each observation, we want to save out the time, GEOStime, lat
+	//  and lon. But, we only want to select those that are PM2.5
+	//  measurements, for now, in µg/m³. Those without model output at their
+	//  time are counted, and reported with the first reason.
+	var pm25 []observation
+	for _, ob := range observations {
+		if ob.parameter == "pm25" {
+			pm25 = append(pm25, ob)
+		}
+	}
+	var unmatched int
+	var unmatchedErr error
+	// The cells are read once every observation has its cell and times, in
+	// the order of the times (see byTime).
+	type job struct {
+		ob    observation
+		time  int
+		cell  modelCell
+		times []int
+	}
+	var jobs []job
+	for _, ob := range inMicrograms(pm25, mh.obsPath) {
+		// Samples of a day or more are paired with the mean of the day's
+		// model output, as in pairSpecies, and shorter ones with the
+		// output at their time. GEOShour is -1 for the daily mean.
+		foundTime, errTime := -1, error(nil)
+		if ob.period < 24*time.Hour {
+			foundTime, errTime = mh.model.timeIndex(ob.utc)
+		} else if len(mh.model.indices) == 0 {
+			errTime = fmt.Errorf("there is no model output for %s", mh.date.Format("2006-01-02"))
+		}
+		if errTime != nil {
+			if unmatched == 0 {
+				unmatchedErr = errTime
 			}
-			outputResults = append(outputResults, result)
+			unmatched++
+			continue
+		}
+		cell, errCell := cells.find(ob.lon, ob.lat)
+		if errCell != nil {
+			continue
+		}
+
+		times := mh.model.indices
+		if foundTime >= 0 {
+			times = []int{foundTime}
+		}
+		jobs = append(jobs, job{ob, foundTime, cell, times})
+	}
+	times := make([][]int, len(jobs))
+	for j := range jobs {
+		times[j] = jobs[j].times
+	}
+	sums := make([]float32, len(jobs))
+	err = byTime(times, func(j, t int) error {
+		v, err := modelPM25(f, t, jobs[j].cell.row, jobs[j].cell.col)
+		sums[j] += v
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", mh.model.output.paths[0], err)
+	}
+	for j, jb := range jobs {
+		ob := jb.ob
+		simPM := sums[j] / float32(len(jb.times))
+		result := outputComp{
+			time:        ob.utc.Format(time.RFC3339),
+			measuredPM:  strconv.FormatFloat(ob.value, 'f', -1, 64),
+			GEOShour:    jb.time,
+			lat:         jb.cell.row,
+			lon:         jb.cell.col,
+			simulatedPM: fmt.Sprintf("%f", simPM),
+			location:    ob.location,
+			city:        ob.city,
+			country:     ob.country,
+			latitude:    strconv.FormatFloat(ob.lat, 'f', -1, 64),
+			longitude:   strconv.FormatFloat(ob.lon, 'f', -1, 64),
+			local:       ob.local,
+			cell:        jb.cell,
 		}
+		outputResults = append(outputResults, result)
+	}
+	if unmatched > 0 {
+		fmt.Printf("%d PM2.5 observations have no model output at their time, e.g. %v\n", unmatched, unmatchedErr)
 	}
 	return outputResults, nil
 }
 
+// openNcf opens a netCDF file. The returned file should be
+// closed once the netCDF file has been read.
+func openNcf(path string) (*os.File, *cdf.File, error) {
+	ff, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	f, err := cdf.Open(ff)
+	if err != nil {
+		ff.Close()
+		return nil, nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	return ff, f, nil
+}
+
 func findTime(measuredHour string) (int, error) {
 	f, err := strconv.Atoi(measuredHour)
 	if err != nil {
@@ -238,31 +296,6 @@ func findTime(measuredHour string) (int, error) {
 	}
 	return 0, fmt.Errorf("%d is not an integer between 0 and 24", f)
 }
-func findLatLon(measuredLat string, lat []float64) (int, error) {
-
-	f, err := strconv.ParseFloat(measuredLat, 64)
-	if err != nil {
-		return 0, fmt.Errorf("The lat/lon is either absent or not parseable: %s", measuredLat)
-	}
-
-	if math.Abs(f) > lat[len(lat)-1] {
-		return 0, fmt.Errorf("the latitude or longitude is out of bounds: %s", measuredLat)
-	}
-	i := len(lat) - 1
-	for f < lat[i] {
-		i -= 1
-	}
-	return i, nil
-}
-
-// lats and lons are the grid cell latitudes and longitudes,
-// respectively. They should be ordered from smallest to largest. These
-// correspond to GEOS-Chem simulations at 2x2.5. Ideally, they should be
-// selected by the user depending on the run specification.
-var lats = []float64{-89.5, -88, -86, -84, -82, -80, -78, -76, -74, -72, -70, -68, -66, -64, -62, -60, -58, -56, -54, -52, -50, -48, -46, -44, -42, -40, -38, -36, -34, -32, -30, -28, -26, -24, -22, -20, -18, -16, -14, -12, -10, -8, -6, -4, -2, 0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20, 22, 24, 26, 28, 30, 32, 34, 36, 38, 40, 42, 44, 46, 48, 50, 52, 54, 56, 58, 60, 62, 64, 66, 68, 70, 72, 74, 76, 78, 80, 82, 84, 86, 88, 89.5}
-
-var lons = []float64{-180, -177.5, -175, -172.5, -170, -167.5, -165, -162.5, -160, -157.5, -155, -152.5, -150, -147.5, -145, -142.5, -140, -137.5, -135, -132.5, -130, -127.5, -125, -122.5, -120, -117.5, -115, -112.5, -110, -107.5, -105, -102.5, -100, -97.5, -95, -92.5, -90, -87.5, -85, -82.5, -80, -77.5, -75, -72.5, -70, -67.5, -65, -62.5, -60, -57.5, -55, -52.5, -50, -47.5, -45, -42.5, -40, -37.5, -35, -32.5, -30, -27.5, -25, -22.5, -20, -17.5, -15, -12.5, -10, -7.5, -5, -2.5, 0, 2.5, 5, 7.5, 10, 12.5, 15, 17.5, 20, 22.5, 25, 27.5, 30, 32.5, 35, 37.5, 40, 42.5, 45, 47.5, 50, 52.5, 55, 57.5, 60, 62.5, 65, 67.5, 70, 72.5, 75, 77.5, 80, 82.5, 85, 87.5, 90, 92.5, 95, 97.5, 100, 102.5, 105, 107.5, 110, 112.5, 115, 117.5, 120, 122.5, 125, 127.5, 130, 132.5, 135, 137.5, 140, 142.5, 145, 147.5, 150, 152.5, 155, 157.5, 160, 162.5, 165, 167.5, 170, 172.5, 175, 177.5}
-
 func csvWriter(filename string, tWrt []XY) error {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -287,24 +320,49 @@ func csvWriter(filename string, tWrt []XY) error {
 // *************************************************************************
 // *************************************************************************
 
-func main() {
-
-	// For some folder, list the files. The definition of the folder, as
-	// of now, ends with a backslash. Ideally, this would allow for this to
-	// be missing.
-
-	csvFolder := "/home/marshall/sthakrar/2015openaqdata/csvfiles"
-	// Test folder is the following:
-	//csvFolder := "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/testfiles/"
-	ncfFolder := "/home/hill0408/sthakrar/Runs/globnosoan/"
-
-	outputFolder := "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/output/"
-	// Test output folder is the following:
-	//outputFolder := "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/testoutput/"
+// For some folder, list the files. The definition of the folder, as
+// of now, ends with a backslash. Ideally, this would allow for this to
+// be missing.
+var defaultCsvFolder = "/home/marshall/sthakrar/2015openaqdata/csvfiles"
+
+// Test folder is the following:
+// var defaultCsvFolder = "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/testfiles/"
+var defaultNcfFolder = "/home/hill0408/sthakrar/Runs/globnosoan/"
+
+var defaultOutputFolder = "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/output/"
+
+// Test output folder is the following:
+//var defaultOutputFolder = "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/testoutput/"
+
+// commands are the modes that can be selected with the first argument,
+// e.g. "aqcomp signif". With no argument, the default pairing run in main
+// is done.
+var commands = map[string]func(args []string) error{
+	"pair":       pairCmd,
+	"fetch":      fetchCmd,
+	"signif":     signifCmd,
+	"stratify":   stratifyCmd,
+	"cells":      cellsCmd,
+	"taylor":     taylorCmd,
+	"scatter":    scatterCmd,
+	"timeseries": timeseriesCmd,
+	"map":        mapCmd,
+	"cycle":      cycleCmd,
+	"dist":       distCmd,
+	"figures":    figuresCmd,
+	"report":     reportCmd,
+	"speciate":   speciateCmd,
+	"grid":       gridCmd,
+	"regrid":     regridCmd,
+	"compare":    compareCmd,
+	"concat":     concatCmd,
+}
 
-	mss := initMs(csvFolder, ncfFolder)
+// writePairs pairs the observations of every day with the model, and
+// writes the paired results for each day to outputFolder.
+func writePairs(mss []ms, outputFolder string) error {
 	for _, i := range mss {
-		fmt.Println("Getting results for: %s", i.csvPath)
+		fmt.Printf("Getting results for: %s\n", i.obsPath)
 		var tWrt []XY
 		results, err := initResults(i)
 		if err != nil {
@@ -312,13 +370,78 @@ func main() {
 		}
 		i.results = results
 		for _, vals := range i.results {
-			tWrt = append(tWrt, XY{vals.simulatedPM, vals.measuredPM})
+			c := vals.cell
+			tWrt = append(tWrt, XY{vals.simulatedPM, vals.measuredPM, vals.time, vals.location, vals.city, vals.country, vals.latitude, vals.longitude, vals.local,
+				strconv.Itoa(c.index), ff(c.lat), ff(c.lon), ff(c.area)})
 		}
 		errWrite := csvWriter(outputFolder+i.date.Format("20060102")+".csv", tWrt)
 		if errWrite != nil {
-			log.Fatal(errWrite)
+			return errWrite
+		}
+	}
+	return nil
+}
+
+// pairCmd is the "pair" mode, which does the pairing of main with the
+// observation source and folders given as flags. The flags are recorded
+// in the provenance file of the output folder.
+func pairCmd(args []string) error {
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	observations := observationFlags(fs, "pm25")
+	ncfFolder := fs.String("ncf", defaultNcfFolder, "folder of GEOS-Chem netCDF files")
+	outputFolder := fs.String("out", defaultOutputFolder, "folder for the paired results")
+	levelFlags(fs)
+	modelFileFlags(fs)
+	fs.Parse(args)
+
+	src, err := observations()
+	if err != nil {
+		return err
+	}
+	mss, err := dayMs(src, *ncfFolder)
+	if err != nil {
+		return err
+	}
+	out := *outputFolder
+	if !strings.HasSuffix(out, "/") {
+		out += "/"
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	if err := writeProvenance(out, fs); err != nil {
+		return err
+	}
+	return writePairs(mss, out)
+}
+
+func main() {
+
+	if len(os.Args) > 1 {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command: %s", os.Args[1])
+		}
+		if err := cmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
+	csvFolder := defaultCsvFolder
+	ncfFolder := defaultNcfFolder
+	outputFolder := defaultOutputFolder
+
+	src, err := openOpenAQCSVFolder(csvFolder)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mss, err := dayMs(src, ncfFolder)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writePairs(mss, outputFolder); err != nil {
+		log.Fatal(err)
 	}
 
 	// *************************************************************************
@@ -327,16 +450,20 @@ func main() {
 	// *************************************************************************
 	// *************************************************************************
 
-	xys, err := readDataConcat(outputFolder)
+	pairs, err := readPairs(datasetOptions{folder: outputFolder})
 	if err != nil {
 		log.Fatalf("could not read data.txt: %v", err)
 	}
 
-	err = plotData(outputFolder+"out.pdf", xys)
+	err = plotData(outputFolder+"out.pdf", pairs, defaultScatterOptions, figOptions{})
 	if err != nil {
 		log.Fatalf("could not plot data: %v", err)
 	}
 
+	// The statistics are unweighted: every pair counts equally, as in the
+	// scatter plot. The stratify mode has the weighted statistics (-weight).
+	xys := pairXYs(pairs)
+
 	mb, errStat := meanBias(xys)
 	me, _ := meanError(xys)
 	rmserr, _ := rmse(xys)
@@ -349,9 +476,14 @@ func main() {
 	upa, _ := unpairedPeakAcc(xys)
 	ioa, _ := indexOfAgr(xys)
 	cod, _ := coefDeterm(xys)
+	ks, _ := ksStatistic(xys)
+	p50, _ := percentileBias(50)(xys)
+	p90, _ := percentileBias(90)(xys)
+	p98, _ := percentileBias(98)(xys)
 	if errStat != nil {
 		fmt.Println(errStat)
 	}
-	fmt.Printf("Mean bias: %f\n Mean error: %f\n RMSE:%f\n Fractional bias: %f\n Fractional error: %f\n Normalised mean bias: %f\n Normalised mean error: %f\n Mean normalised bias: %f\n Mean normalised error: %f\n Unpaired peak accuracy: %f\n Index of Agreement:%f\n Coefficient of determination: %f\n", mb, me, rmserr, fracB, fracE, nmb, nme, mnb, mne, upa, ioa, cod)
+	fmt.Println("Statistics of every pair, unweighted:")
+	fmt.Printf("Mean bias: %f\n Mean error: %f\n RMSE:%f\n Fractional bias: %f\n Fractional error: %f\n Normalised mean bias: %f\n Normalised mean error: %f\n Mean normalised bias: %f\n Mean normalised error: %f\n Unpaired peak accuracy: %f\n Index of Agreement:%f\n Coefficient of determination: %f\n KS statistic: %f\n 50th percentile bias: %f\n 90th percentile bias: %f\n 98th percentile bias: %f\n", mb, me, rmserr, fracB, fracE, nmb, nme, mnb, mne, upa, ioa, cod, ks, p50, p90, p98)
 
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                          OPENAQ BULK ARCHIVE
+// *************************************************************************
+// *************************************************************************
+
+// The OpenAQ bulk archive is read from a local mirror of the S3 buckets,
+// in either of its layouts:
+//
+//	realtime-gzipped/2015-11-20/*.ndjson.gz
+//	    one JSON measurement per line, as in the v2 API, for every fetch
+//	records/csv.gz/locationid=2178/year=2022/month=05/location-2178-20220503.csv.gz
+//	    csv files with the columns location_id, sensors_id, location,
+//	    datetime, lat, lon, parameter, units and value, for each location
+//	    and local day
+//
+// Uncompressed .ndjson and .csv files are read too. The files are streamed
+// and filtered as they are read, and never unpacked to disk. A file without
+// a date in its path is an error, and rows that can't be read are counted
+// and skipped, as for the files of the monitoring networks.
+
+// boundingBox is a longitude and latitude range.
+type boundingBox struct {
+	minLon, minLat, maxLon, maxLat float64
+}
+
+// parseBoundingBox parses a bounding box given as minlon,minlat,maxlon,maxlat.
+// An empty string is the whole world.
+func parseBoundingBox(s string) (boundingBox, error) {
+	if s == "" {
+		return boundingBox{-180, -90, 180, 90}, nil
+	}
+	v, err := parseFloats(s)
+	if err != nil || len(v) != 4 {
+		return boundingBox{}, fmt.Errorf("the bounding box %q should be minlon,minlat,maxlon,maxlat", s)
+	}
+	return boundingBox{v[0], v[1], v[2], v[3]}, nil
+}
+
+func (b boundingBox) contains(lon, lat float64) bool {
+	return lon >= b.minLon && lon <= b.maxLon && lat >= b.minLat && lat <= b.maxLat
+}
+
+// openaqArchive reads observations of one parameter in a bounding box from
+// a mirror of the OpenAQ archive.
+type openaqArchive struct {
+	dir       string
+	parameter string
+	bbox      boundingBox
+	// files are the archive files by the date in their path. The date is
+	// the fetch date or the local day, so a file can hold measurements
+	// from the UTC days either side of it.
+	files map[time.Time][]string
+}
+
+var (
+	archiveDay     = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+	archiveFileDay = regexp.MustCompile(`-(\d{8})\.(nd)?(json|csv)`)
+)
+
+// openOpenAQArchive finds the archive files in dir, and dates them.
+func openOpenAQArchive(dir, parameter string, bbox boundingBox) (*openaqArchive, error) {
+	a := &openaqArchive{dir: dir, parameter: parameter, bbox: bbox, files: make(map[time.Time][]string)}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(info.Name(), ".gz")
+		if info.IsDir() || !(strings.HasSuffix(name, ".ndjson") || strings.HasSuffix(name, ".csv")) {
+			return nil
+		}
+		var t time.Time
+		if m := archiveFileDay.FindStringSubmatch(info.Name()); m != nil {
+			t, err = time.Parse("20060102", m[1])
+		} else if d := archiveDay.FindString(path); d != "" {
+			t, err = time.Parse("2006-01-02", d)
+		} else {
+			err = fmt.Errorf("there is no date in the path")
+		}
+		if err != nil {
+			return fmt.Errorf("%s can't be dated: %v", path, err)
+		}
+		a.files[t] = append(a.files[t], path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading the archive files in %s isn't working: %v", dir, err)
+	}
+	if len(a.files) == 0 {
+		return nil, fmt.Errorf("there are no OpenAQ archive files in %s", dir)
+	}
+	return a, nil
+}
+
+// Days returns the dates of the archive files.
+func (a *openaqArchive) Days() ([]time.Time, error) {
+	days := make([]time.Time, 0, len(a.files))
+	for t := range a.files {
+		days = append(days, t)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+func (a *openaqArchive) Path(day time.Time) string {
+	return fmt.Sprintf("%s (%s)", a.dir, day.Format("2006-01-02"))
+}
+
+// Observations streams the archive files dated the day before, on and
+// after day, and returns the measurements of the parameter in the bounding
+// box that were made on that UTC day. Measurements repeated in more than
+// one fetch are only returned once.
+func (a *openaqArchive) Observations(day time.Time) ([]observation, error) {
+	var obs []observation
+	seen := make(map[string]bool)
+	keep := func(ob observation) {
+		if ob.parameter != a.parameter || !a.bbox.contains(ob.lon, ob.lat) {
+			return
+		}
+		if ob.utc.Before(day) || !ob.utc.Before(day.AddDate(0, 0, 1)) {
+			return
+		}
+		key := fmt.Sprintf("%s|%g|%g|%s", ob.location, ob.lat, ob.lon, ob.utc.Format(time.RFC3339))
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		obs = append(obs, ob)
+	}
+	for d := -1; d <= 1; d++ {
+		for _, path := range a.files[day.AddDate(0, 0, d)] {
+			if err := streamArchiveFile(path, keep); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return obs, nil
+}
+
+// streamArchiveFile reads the observations in an archive file one at a
+// time, decompressing it as it is read if it is gzipped. The rows that
+// can't be read are counted in the log.
+func streamArchiveFile(path string, fn func(observation)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s isn't gzipped: %v", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var nBad int
+	var firstErr error
+	skip := func(err error) {
+		if nBad == 0 {
+			firstErr = err
+		}
+		nBad++
+	}
+	if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".ndjson") {
+		err = streamNDJSON(r, fn, skip)
+	} else {
+		err = streamArchiveCSV(r, fn, skip)
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s isn't working: %v", path, err)
+	}
+	if nBad > 0 {
+		fmt.Printf("%s: skipped %d rows that couldn't be read, the first because %v\n", path, nBad, firstErr)
+	}
+	return nil
+}
+
+// streamNDJSON reads measurements in the v2 API format, one per line.
+// Measurements without a time, value or coordinates are passed to skip.
+func streamNDJSON(r io.Reader, fn func(observation), skip func(error)) error {
+	// The records carry their own location, so no locations are needed.
+	var noLocations openaqCache
+	dec := json.NewDecoder(r)
+	for {
+		var rec openaqRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ob, err := noLocations.observation(rec, -1)
+		if err != nil {
+			skip(err)
+			continue
+		}
+		fn(ob)
+	}
+}
+
+// streamArchiveCSV reads the per-location csv files, finding the columns
+// from the header. Rows that can't be read are passed to skip.
+func streamArchiveCSV(r io.Reader, fn func(observation), skip func(error)) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	for _, h := range []string{"location", "datetime", "lat", "lon", "parameter", "value"} {
+		if _, ok := col[h]; !ok {
+			return fmt.Errorf("there is no %s column", h)
+		}
+	}
+	for {
+		line, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(line) < len(header) {
+			skip(fmt.Errorf("there are %d columns", len(line)))
+			continue
+		}
+		ob := observation{
+			location:  line[col["location"]],
+			local:     line[col["datetime"]],
+			parameter: strings.ToLower(line[col["parameter"]]),
+		}
+		if i, ok := col["units"]; ok {
+			ob.unit = line[i]
+		}
+		t, err := time.Parse(time.RFC3339, ob.local)
+		if err != nil {
+			skip(err)
+			continue
+		}
+		ob.utc = t.UTC()
+		var errs [3]error
+		ob.value, errs[0] = strconv.ParseFloat(line[col["value"]], 64)
+		ob.lat, errs[1] = strconv.ParseFloat(line[col["lat"]], 64)
+		ob.lon, errs[2] = strconv.ParseFloat(line[col["lon"]], 64)
+		if errs[0] != nil || errs[1] != nil || errs[2] != nil {
+			for _, err := range errs {
+				if err != nil {
+					skip(err)
+					break
+				}
+			}
+			continue
+		}
+		fn(ob)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchiveFile writes the lines to path in dir, gzipping them if the
+// path ends in .gz.
+func writeArchiveFile(t *testing.T, dir, path string, lines ...string) {
+	path = filepath.Join(dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := []byte(strings.Join(lines, "\n") + "\n")
+	if strings.HasSuffix(path, ".gz") {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+		b = buf.Bytes()
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ndjsonRecord is a v2 measurement of PM2.5 in Beijing at a UTC time.
+func ndjsonRecord(location, utc string, value string) string {
+	return `{"location": "` + location + `", "city": "Beijing", "country": "CN", "parameter": "pm25", "value": ` + value +
+		`, "unit": "µg/m³", "date": {"utc": "` + utc + `", "local": "` + utc + `"}, "coordinates": {"latitude": 39.95, "longitude": 116.47}}`
+}
+
+// archiveLocations are the locations and UTC times of the observations.
+func archiveLocations(obs []observation) []string {
+	var out []string
+	for _, ob := range obs {
+		out = append(out, ob.location+" "+ob.utc.Format(time.RFC3339))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestOpenAQArchiveRealtime(t *testing.T) {
+	dir := t.TempDir()
+	// Each fetch repeats the measurements of the last few hours, and the
+	// fetch of the 21st has the last hours of the 20th.
+	writeArchiveFile(t, dir, "realtime-gzipped/2015-11-20/1448000000.ndjson.gz",
+		ndjsonRecord("a", "2015-11-20T10:00:00Z", "10"),
+		ndjsonRecord("b", "2015-11-20T10:00:00Z", "20"),
+		`{"location": "no value", "parameter": "pm25", "date": {"utc": "2015-11-20T10:00:00Z"}}`,
+		strings.Replace(ndjsonRecord("a", "2015-11-20T10:00:00Z", "3"), "pm25", "no2", 1),
+		strings.Replace(ndjsonRecord("outside", "2015-11-20T10:00:00Z", "3"), "116.47", "2.35", 1))
+	writeArchiveFile(t, dir, "realtime-gzipped/2015-11-20/1448010000.ndjson.gz",
+		ndjsonRecord("a", "2015-11-20T10:00:00Z", "10"),
+		ndjsonRecord("a", "2015-11-20T13:00:00Z", "12"))
+	writeArchiveFile(t, dir, "realtime-gzipped/2015-11-21/1448070000.ndjson",
+		ndjsonRecord("a", "2015-11-20T23:00:00Z", "14"),
+		ndjsonRecord("a", "2015-11-21T01:00:00Z", "16"))
+	writeArchiveFile(t, dir, "realtime-gzipped/2015-11-23/1448250000.ndjson.gz",
+		ndjsonRecord("a", "2015-11-23T01:00:00Z", "16"))
+
+	a, err := openOpenAQArchive(dir, "pm25", boundingBox{100, 20, 130, 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	days, err := a.Days()
+	if err != nil || len(days) != 3 || !days[0].Equal(time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("the archive has the days %v (%v)", days, err)
+	}
+	obs, err := a.Observations(time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The repeated measurement is kept once, and the one of the 21st is
+	// left out, as are the measurements without a value, of another
+	// parameter and outside the bounding box.
+	want := []string{"a 2015-11-20T10:00:00Z", "a 2015-11-20T13:00:00Z", "a 2015-11-20T23:00:00Z", "b 2015-11-20T10:00:00Z"}
+	if got := archiveLocations(obs); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("the observations of the 20th are %v, not %v", got, want)
+	}
+	// The day before the 21st is read for the 21st too.
+	obs, err = a.Observations(time.Date(2015, 11, 21, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(obs) != 1 || obs[0].value != 16 {
+		t.Errorf("the observations of the 21st are %v (%v)", archiveLocations(obs), err)
+	}
+}
+
+func TestOpenAQArchiveRecords(t *testing.T) {
+	dir := t.TempDir()
+	header := "location_id,sensors_id,location,datetime,lat,lon,parameter,units,value"
+	// The files are of local days in Ulaanbaatar, at UTC+8, so that the
+	// morning of the 21st is the 20th in UTC.
+	writeArchiveFile(t, dir, "records/csv.gz/locationid=2178/year=2015/month=11/location-2178-20151121.csv.gz", header,
+		`2178,3917,Bukhiin urguu,2015-11-21T01:00:00+08:00,47.9176056,106.9373611,pm25,µg/m³,115`,
+		`2178,3917,Bukhiin urguu,2015-11-21T07:45:00+08:00,47.9176056,106.9373611,pm25,µg/m³,120`,
+		`2178,3917,Bukhiin urguu,2015-11-21T09:00:00+08:00,47.9176056,106.9373611,pm25,µg/m³,130`,
+		`2178,3918,Bukhiin urguu,2015-11-21T07:45:00+08:00,47.9176056,106.9373611,pm10,µg/m³,200`,
+		`2178,3917,Bukhiin urguu,not a time,47.9176056,106.9373611,pm25,µg/m³,120`,
+		`2178,3917,Bukhiin urguu,2015-11-21T10:00:00+08:00,47.9176056,106.9373611,pm25,µg/m³,n/a`)
+	writeArchiveFile(t, dir, "records/csv.gz/locationid=2178/year=2015/month=11/location-2178-20151120.csv", header,
+		`2178,3917,Bukhiin urguu,2015-11-20T23:00:00+08:00,47.9176056,106.9373611,pm25,µg/m³,110`)
+
+	a, err := openOpenAQArchive(dir, "pm25", boundingBox{-180, -90, 180, 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, err := a.Observations(time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Bukhiin urguu 2015-11-20T15:00:00Z", "Bukhiin urguu 2015-11-20T17:00:00Z", "Bukhiin urguu 2015-11-20T23:45:00Z"}
+	if got := archiveLocations(obs); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("the observations of the 20th are %v, not %v", got, want)
+	}
+	for _, ob := range obs {
+		if ob.utc.Hour() == 23 && (ob.value != 120 || ob.local != "2015-11-21T07:45:00+08:00" || ob.unit != "µg/m³" || ob.lat != 47.9176056) {
+			t.Errorf("the measurement at 23:45 is %+v", ob)
+		}
+	}
+	obs, err = a.Observations(time.Date(2015, 11, 21, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(obs) != 1 || obs[0].value != 130 {
+		t.Errorf("the observations of the 21st are %v (%v)", archiveLocations(obs), err)
+	}
+}
+
+func TestOpenAQArchiveErrors(t *testing.T) {
+	// A file that can't be dated is an error, rather than left out.
+	dir := t.TempDir()
+	writeArchiveFile(t, dir, "realtime-gzipped/latest.ndjson", ndjsonRecord("a", "2015-11-20T10:00:00Z", "10"))
+	if _, err := openOpenAQArchive(dir, "pm25", boundingBox{-180, -90, 180, 90}); err == nil {
+		t.Error("an archive file without a date should be rejected")
+	}
+
+	// So are files that aren't gzipped or have no header.
+	dir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "2015-11-20"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2015-11-20", "1.ndjson.gz"), []byte("not gzipped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := openOpenAQArchive(dir, "pm25", boundingBox{-180, -90, 180, 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Observations(time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("a file that isn't gzipped should be an error")
+	}
+	dir = t.TempDir()
+	writeArchiveFile(t, dir, "location-1-20151120.csv.gz", "a,b,c", "1,2,3")
+	if a, err = openOpenAQArchive(dir, "pm25", boundingBox{-180, -90, 180, 90}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Observations(time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("a csv file without the columns should be an error")
+	}
+}
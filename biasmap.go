@@ -0,0 +1,361 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"sort"
+
+	"github.com/SumilThakr/aqcomp/regrid"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/moreland"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                               BIAS MAPS
+// *************************************************************************
+// *************************************************************************
+
+// coastlineGeoJSON is a low resolution outline of the continents and the
+// larger islands, as GeoJSON LineStrings. It is only meant to show where
+// the stations are, so a more detailed coastline (e.g. Natural Earth) can
+// be given with the -coast flag instead.
+//
+//go:embed coastline.geojson
+var coastlineGeoJSON []byte
+
+// readCoastline reads the LineString and MultiLineString features (and
+// the boundaries of any Polygon features) of a GeoJSON FeatureCollection.
+func readCoastline(b []byte) ([][][2]float64, error) {
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		return nil, err
+	}
+	var lines [][][2]float64
+	for _, f := range fc.Features {
+		var err error
+		switch f.Geometry.Type {
+		case "LineString":
+			var l [][2]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &l)
+			lines = append(lines, l)
+		case "MultiLineString", "Polygon":
+			var ls [][][2]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &ls)
+			lines = append(lines, ls...)
+		case "MultiPolygon":
+			var polys [][][][2]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &polys)
+			for _, p := range polys {
+				lines = append(lines, p...)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lines, nil
+}
+
+// coastline draws the lines in longitude, latitude coordinates.
+type coastline struct {
+	lines [][][2]float64
+	draw.LineStyle
+}
+
+func (cl coastline) Plot(c draw.Canvas, plt *plot.Plot) {
+	trX, trY := plt.Transforms(&c)
+	lines := make([][]vg.Point, len(cl.lines))
+	for i, l := range cl.lines {
+		lines[i] = make([]vg.Point, len(l))
+		for j, pt := range l {
+			lines[i][j] = vg.Point{X: trX(pt[0]), Y: trY(pt[1])}
+		}
+	}
+	c.StrokeLines(cl.LineStyle, c.ClipLinesXY(lines...)...)
+}
+
+// stationStat is the bias at one station.
+type stationStat struct {
+	location string
+	lat, lon float64
+	n        int
+	mb, nmb  float64
+}
+
+// stationStats computes the mean bias and normalised mean bias at every
+// station.
+func stationStats(pairs []pair) []stationStat {
+	groups := make(map[string][]pair)
+	for _, p := range pairs {
+		if p.hasStation() {
+			k := stationKey(p)
+			groups[k] = append(groups[k], p)
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	stats := make([]stationStat, 0, len(keys))
+	for _, k := range keys {
+		g := groups[k]
+		data := pairXYs(g)
+		mb, err := meanBias(data)
+		if err != nil {
+			continue
+		}
+		nmb, _ := normMeanBias(data)
+		stats = append(stats, stationStat{location: g[0].location, lat: g[0].lat, lon: g[0].lon, n: len(g), mb: mb, nmb: nmb})
+	}
+	return stats
+}
+
+// modelField is one level of a model variable on a latitude-longitude
+// grid, as a plotter.GridXYZ.
+type modelField struct {
+	lats, lons []float64 // cell centres
+	values     []float32 // lat major
+}
+
+func (f modelField) Dims() (c, r int)      { return len(f.lons), len(f.lats) }
+func (f modelField) Z(c, r int) float64    { return float64(f.values[r*len(f.lons)+c]) }
+func (f modelField) X(c int) float64       { return f.lons[c] }
+func (f modelField) Y(r int) float64       { return f.lats[r] }
+func (f modelField) Min() (float64, error) { return f.extreme(math.Min) }
+func (f modelField) Max() (float64, error) { return f.extreme(math.Max) }
+
+func (f modelField) extreme(fn func(a, b float64) float64) (float64, error) {
+	if len(f.values) == 0 {
+		return 0, fmt.Errorf("the field is empty")
+	}
+	v := float64(f.values[0])
+	for _, fv := range f.values {
+		v = fn(v, float64(fv))
+	}
+	return v, nil
+}
+
+// readField reads pol at the given time index from the GEOS-Chem netCDF
+// file at path.
+func readField(path, pol string, hour int) (modelField, error) {
+	f, err := openModel(path)
+	if err != nil {
+		return modelField{}, err
+	}
+	defer f.Close()
+	g, err := modelGrid(f, pol)
+	if err != nil {
+		return modelField{}, fmt.Errorf("%s: %v", path, err)
+	}
+	r, ok := g.(*regrid.Rectilinear)
+	if !ok {
+		return modelField{}, fmt.Errorf("%s: %s isn't on a latitude-longitude grid, so it can't be drawn behind the map", path, pol)
+	}
+	values, err := fieldReading(f, pol, hour)
+	if err != nil {
+		return modelField{}, err
+	}
+	fieldLats, fieldLons := r.Centres()
+	return modelField{lats: fieldLats, lons: fieldLons, values: values}, nil
+}
+
+// fieldReading reads pol at the given time index, on its grid (see
+// modelGrid), at the levels chosen by vertical and with its surface
+// correction.
+func fieldReading(f modelFile, pol string, hour int) ([]float32, error) {
+	pol, o, err := vertical.source(f, pol)
+	if err != nil {
+		return nil, err
+	}
+	field, err := levelField(f, pol, hour, o)
+	if err != nil {
+		return nil, err
+	}
+	factors, err := o.factorField(f, hour, len(field))
+	if err != nil {
+		return nil, err
+	}
+	for c := range field {
+		field[c] *= factors[c]
+	}
+	return field, nil
+}
+
+// grays is a light gray palette, so that a model field can be shown
+// behind the stations.
+type grays int
+
+func (g grays) Colors() []color.Color {
+	c := make([]color.Color, g)
+	for i := range c {
+		c[i] = color.Gray{Y: uint8(245 - 100*i/int(g))}
+	}
+	return c
+}
+
+// mapOptions are the settings for biasMap.
+type mapOptions struct {
+	stat      string  // "nmb" or "mb"
+	limit     float64 // color scale limit; 0 is the largest absolute value
+	coastFile string  // GeoJSON coastline to use instead of the bundled one
+	field     *modelField
+}
+
+// biasMap draws the stations colored by their bias on a diverging color
+// scale centred on zero, with a color bar below the map.
+func biasMap(path string, stats []stationStat, opts mapOptions, fig figOptions) error {
+	if len(stats) == 0 {
+		return fmt.Errorf("there are no stations to map")
+	}
+	value := func(s stationStat) float64 { return s.nmb }
+	label := "Normalised mean bias (%)"
+	if opts.stat == "mb" {
+		value = func(s stationStat) float64 { return s.mb }
+		label = "Mean bias (μg/m³)"
+	} else if opts.stat != "nmb" {
+		return fmt.Errorf("can't map %q: should be nmb or mb", opts.stat)
+	}
+	limit := opts.limit
+	if limit <= 0 {
+		for _, s := range stats {
+			if v := math.Abs(value(s)); v > limit && !math.IsInf(v, 0) {
+				limit = v
+			}
+		}
+		if limit == 0 {
+			limit = 1
+		}
+	}
+	cm := moreland.SmoothBlueRed()
+	cm.SetMin(-limit)
+	cm.SetMax(limit)
+
+	coast := coastlineGeoJSON
+	if opts.coastFile != "" {
+		var err error
+		if coast, err = ioutil.ReadFile(opts.coastFile); err != nil {
+			return err
+		}
+	}
+	lines, err := readCoastline(coast)
+	if err != nil {
+		return fmt.Errorf("reading the coastline isn't working: %v", err)
+	}
+
+	p, err := plot.New()
+	if err != nil {
+		return fmt.Errorf("could not create plot: %v", err)
+	}
+	p.X.Label.Text = "Longitude"
+	p.Y.Label.Text = "Latitude"
+	if opts.field != nil {
+		p.Add(plotter.NewHeatMap(*opts.field, grays(64)))
+	}
+	p.Add(coastline{lines: lines, LineStyle: draw.LineStyle{Color: color.Gray{Y: 90}, Width: vg.Points(0.5)}})
+
+	pts := make(plotter.XYs, len(stats))
+	for i, s := range stats {
+		pts[i] = plotter.XY{X: s.lon, Y: s.lat}
+	}
+	sc, err := plotter.NewScatter(pts)
+	if err != nil {
+		return fmt.Errorf("could not create scatter: %v", err)
+	}
+	sc.GlyphStyleFunc = func(i int) draw.GlyphStyle {
+		v := math.Max(-limit, math.Min(limit, value(stats[i])))
+		clr, err := cm.At(v)
+		if err != nil {
+			clr = color.Black
+		}
+		return draw.GlyphStyle{Color: clr, Radius: vg.Points(2), Shape: draw.CircleGlyph{}}
+	}
+	p.Add(sc)
+	p.X.Min, p.X.Max = -180, 180
+	p.Y.Min, p.Y.Max = -90, 90
+
+	cb, err := plot.New()
+	if err != nil {
+		return fmt.Errorf("could not create plot: %v", err)
+	}
+	cb.Add(&plotter.ColorBar{ColorMap: cm})
+	cb.HideY()
+	cb.X.Label.Text = label
+	cb.X.Padding = 0
+
+	fig.applyFonts(p)
+	fig.applyFonts(cb)
+	return saveMap(path, p, cb, fig)
+}
+
+// saveMap draws the map with the color bar below it.
+func saveMap(path string, p, cb *plot.Plot, fig figOptions) error {
+	w, h := fig.size(10*vg.Inch, 6*vg.Inch)
+	return fig.save(path, w, h, func(dc draw.Canvas) {
+		barHeight := h / 8
+		p.Draw(draw.Crop(dc, 0, 0, barHeight, 0))
+		cb.Draw(draw.Crop(dc, w/8, -w/8, 0, barHeight-h))
+	})
+}
+
+// mapCmd is the "map" mode, which maps the bias at every station.
+func mapCmd(args []string) error {
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	outFile := fs.String("out", "biasmap.pdf", "output file")
+	opts := mapOptions{}
+	fs.StringVar(&opts.stat, "stat", "nmb", "statistic to map: nmb or mb")
+	fs.Float64Var(&opts.limit, "limit", 0, "color scale limit, or 0 for the largest absolute value")
+	fs.StringVar(&opts.coastFile, "coast", "", "GeoJSON coastline to use instead of the bundled low resolution one")
+	fieldFile := fs.String("field", "", "optional GEOS-Chem netCDF file to show a model field from")
+	fieldVar := fs.String("var", "IJ_AVG_S__SO4", "variable of the model field")
+	fieldHour := fs.Int("hour", 0, "time index of the model field")
+	statsFile := fs.String("stats", "", "optional csv file for the station statistics")
+	fig := figFlags(fs)
+	levelFlags(fs)
+	fs.Parse(args)
+
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	stats := stationStats(pairs)
+	if *statsFile != "" {
+		tWrt := []XY{{"location", "latitude", "longitude", "n", "mean_bias", "normalised_mean_bias"}}
+		for _, s := range stats {
+			tWrt = append(tWrt, XY{s.location, ff(s.lat), ff(s.lon), fmt.Sprint(s.n), ff(s.mb), ff(s.nmb)})
+		}
+		if err := csvWriter(*statsFile, tWrt); err != nil {
+			return err
+		}
+	}
+	if *fieldFile != "" {
+		field, err := readField(*fieldFile, *fieldVar, *fieldHour)
+		if err != nil {
+			return err
+		}
+		opts.field = &field
+	}
+	return biasMap(*outFile, stats, opts, *fig)
+}
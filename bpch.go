@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                         GEOS-CHEM BPCH FILES
+// *************************************************************************
+// *************************************************************************
+
+// A bpch (binary punch) file is a sequence of big-endian Fortran
+// unformatted records: the file type and title, then for every data block
+// a header with the model grid, a header with the diagnostic category,
+// tracer number, time range and dimensions, and the data, with longitude
+// varying fastest. The tracer names come from the tracerinfo.dat and
+// diaginfo.dat files written with the run.
+
+const bpchFileType = "CTM bin 02"
+
+// bpchTau0 is the origin of the bpch times, which are in hours.
+var bpchTau0 = time.Date(1985, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// tracerInfo is a line of tracerinfo.dat.
+type tracerInfo struct {
+	name, fullName string
+	molWt          float64 // kg/mol
+	carbon         int     // carbon atoms per molecule, for hydrocarbons
+	number         int     // tracer number, including the category offset
+	scale          float64
+	unit           string
+}
+
+// readTracerInfo reads tracerinfo.dat, with the format
+// (a8,1x,a30,es10.0,i3,i9,es10.3,1x,a40). Lines starting with # are
+// comments.
+func readTracerInfo(path string) (map[int]tracerInfo, error) {
+	info := make(map[int]tracerInfo)
+	err := eachInfoLine(path, func(line string) error {
+		field := func(from, to int) string {
+			if from >= len(line) {
+				return ""
+			}
+			if to > len(line) {
+				to = len(line)
+			}
+			return strings.TrimSpace(line[from:to])
+		}
+		var t tracerInfo
+		var err error
+		t.name, t.fullName = field(0, 8), field(9, 39)
+		if t.molWt, err = strconv.ParseFloat(field(39, 49), 64); err != nil {
+			return fmt.Errorf("bad molecular weight: %v", err)
+		}
+		if t.carbon, err = strconv.Atoi(field(49, 52)); err != nil {
+			return fmt.Errorf("bad carbon number: %v", err)
+		}
+		if t.number, err = strconv.Atoi(field(52, 61)); err != nil {
+			return fmt.Errorf("bad tracer number: %v", err)
+		}
+		if t.scale, err = strconv.ParseFloat(field(61, 71), 64); err != nil {
+			return fmt.Errorf("bad scale factor: %v", err)
+		}
+		t.unit = field(72, len(line))
+		info[t.number] = t
+		return nil
+	})
+	return info, err
+}
+
+// readDiagInfo reads diaginfo.dat, with the format (i8,1x,a40,1x,a), and
+// returns the tracer number offset of every category.
+func readDiagInfo(path string) (map[string]int, error) {
+	offsets := make(map[string]int)
+	err := eachInfoLine(path, func(line string) error {
+		if len(line) < 9 {
+			return fmt.Errorf("the line is too short")
+		}
+		offset, err := strconv.Atoi(strings.TrimSpace(line[:8]))
+		if err != nil {
+			return fmt.Errorf("bad offset: %v", err)
+		}
+		end := 49
+		if end > len(line) {
+			end = len(line)
+		}
+		offsets[strings.TrimSpace(line[9:end])] = offset
+		return nil
+	})
+	return offsets, err
+}
+
+func eachInfoLine(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for i := 1; s.Scan(); i++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s line %d: %v", path, i, err)
+		}
+	}
+	return s.Err()
+}
+
+// bpchVarName is the netCDF name of a tracer of a category, as written
+// when converting bpch files: IJ-AVG-$ and SO4 are IJ_AVG_S__SO4.
+func bpchVarName(category, tracer string) string {
+	r := strings.NewReplacer("-", "_", "$", "S", "=", "_", " ", "_")
+	return r.Replace(category) + "__" + tracer
+}
+
+// bpchBlock is where a data block is in the file.
+type bpchBlock struct {
+	tau0, tau1 float64 // the start and end of the averaging period
+	unit       string
+	ni, nj, nl int
+	offset     int64 // of the data, after the record length
+}
+
+// bpchFile is a bpch file opened as a modelFile. Only the block headers
+// are read when it is opened; the data are read as they are needed.
+type bpchFile struct {
+	path   string
+	f      *os.File
+	title  string
+	blocks map[string][]bpchBlock // by variable, in time order
+	// lats and lons are the cell centres of the first block.
+	lats, lons []float64
+}
+
+// openBpch reads the block headers of a bpch file, naming the tracers from
+// the tracerinfo.dat and diaginfo.dat in the same folder.
+func openBpch(path string) (*bpchFile, error) {
+	dir := filepath.Dir(path)
+	tracers, err := readTracerInfo(filepath.Join(dir, "tracerinfo.dat"))
+	if err != nil {
+		return nil, fmt.Errorf("the tracers of %s can't be named: %v", path, err)
+	}
+	offsets, err := readDiagInfo(filepath.Join(dir, "diaginfo.dat"))
+	if err != nil {
+		return nil, fmt.Errorf("the tracers of %s can't be named: %v", path, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	b := &bpchFile{path: path, f: f, blocks: make(map[string][]bpchBlock)}
+	if err := b.readHeaders(tracers, offsets); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return b, nil
+}
+
+// fortranRecord reads the next Fortran record, or skips it if buf is nil,
+// and returns its length and where its data start.
+func fortranRecord(r io.ReadSeeker, buf []byte) (int, int64, error) {
+	var n int32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, 0, err
+	}
+	at, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, 0, err
+	}
+	if buf != nil {
+		if int(n) != len(buf) {
+			return 0, 0, fmt.Errorf("a record at byte %d has %d bytes, not %d", at, n, len(buf))
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, 0, err
+		}
+	} else if _, err := r.Seek(int64(n), io.SeekCurrent); err != nil {
+		return 0, 0, err
+	}
+	var m int32
+	if err := binary.Read(r, binary.BigEndian, &m); err != nil {
+		return 0, 0, err
+	}
+	if m != n {
+		return 0, 0, fmt.Errorf("the record at byte %d isn't terminated properly", at)
+	}
+	return int(n), at, nil
+}
+
+func (b *bpchFile) readHeaders(tracers map[int]tracerInfo, offsets map[string]int) error {
+	b.f.Seek(0, io.SeekStart)
+	fileType := make([]byte, 40)
+	if _, _, err := fortranRecord(b.f, fileType); err != nil {
+		return fmt.Errorf("reading the file type isn't working: %v", err)
+	}
+	if !strings.HasPrefix(string(fileType), bpchFileType) {
+		return fmt.Errorf("%q isn't a bpch file type", strings.TrimSpace(string(fileType)))
+	}
+	title := make([]byte, 80)
+	if _, _, err := fortranRecord(b.f, title); err != nil {
+		return fmt.Errorf("reading the title isn't working: %v", err)
+	}
+	b.title = strings.TrimSpace(string(title))
+
+	grid := make([]byte, 36)
+	head := make([]byte, 168)
+	for {
+		if _, _, err := fortranRecord(b.f, grid); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading a block header isn't working: %v", err)
+		}
+		if _, _, err := fortranRecord(b.f, head); err != nil {
+			return fmt.Errorf("reading a block header isn't working: %v", err)
+		}
+		category := strings.TrimSpace(string(head[0:40]))
+		tracer := int(int32(binary.BigEndian.Uint32(head[40:44])))
+		blk := bpchBlock{
+			tau0: math.Float64frombits(binary.BigEndian.Uint64(head[84:92])),
+			tau1: math.Float64frombits(binary.BigEndian.Uint64(head[92:100])),
+			unit: strings.TrimSpace(string(head[44:84])),
+		}
+		dim := func(i int) int { return int(int32(binary.BigEndian.Uint32(head[140+4*i:]))) }
+		blk.ni, blk.nj, blk.nl = dim(0), dim(1), dim(2)
+		if b.lats == nil {
+			b.lats, b.lons = bpchCentres(grid, blk.ni, blk.nj, dim(3), dim(4))
+		}
+		n, at, err := fortranRecord(b.f, nil)
+		if err != nil {
+			return fmt.Errorf("reading the data of %s tracer %d isn't working: %v", category, tracer, err)
+		}
+		if n != 4*blk.ni*blk.nj*blk.nl {
+			return fmt.Errorf("%s tracer %d has %d bytes of data, not %d", category, tracer, n, 4*blk.ni*blk.nj*blk.nl)
+		}
+		blk.offset = at
+
+		offset, ok := offsets[category]
+		if !ok {
+			return fmt.Errorf("the category %s isn't in diaginfo.dat", category)
+		}
+		info, ok := tracers[tracer+offset]
+		if !ok {
+			return fmt.Errorf("tracer %d of %s isn't in tracerinfo.dat", tracer+offset, category)
+		}
+		name := bpchVarName(category, info.name)
+		b.blocks[name] = append(b.blocks[name], blk)
+	}
+	for name, blks := range b.blocks {
+		sort.SliceStable(blks, func(i, j int) bool { return blks[i].tau0 < blks[j].tau0 })
+		for _, blk := range blks[1:] {
+			if blk.ni != blks[0].ni || blk.nj != blks[0].nj || blk.nl != blks[0].nl {
+				return fmt.Errorf("the blocks of %s don't all have the same dimensions", name)
+			}
+		}
+	}
+	return nil
+}
+
+// bpchCentres returns the cell centres of a block of ni by nj cells from
+// its grid header: the model name, the longitude and latitude resolution,
+// whether the polar cells are half as tall as the others, and whether the
+// first longitude is centred on 180°W. ifirst and jfirst are the Fortran
+// indices of the first cell of the block on the global grid.
+func bpchCentres(grid []byte, ni, nj, ifirst, jfirst int) (lats, lons []float64) {
+	dlon := float64(math.Float32frombits(binary.BigEndian.Uint32(grid[20:24])))
+	dlat := float64(math.Float32frombits(binary.BigEndian.Uint32(grid[24:28])))
+	halfPolar := binary.BigEndian.Uint32(grid[28:32]) != 0
+	centre180 := binary.BigEndian.Uint32(grid[32:36]) != 0
+	nlat := int(math.Round(180 / dlat))
+	if halfPolar {
+		nlat++
+	}
+	for j := jfirst - 1; j < jfirst-1+nj; j++ {
+		lat := -90 + (float64(j)+0.5)*dlat
+		if halfPolar {
+			lat = -90 + float64(j)*dlat
+			if j == 0 {
+				lat = -90 + dlat/4
+			} else if j == nlat-1 {
+				lat = 90 - dlat/4
+			}
+		}
+		lats = append(lats, lat)
+	}
+	for i := ifirst - 1; i < ifirst-1+ni; i++ {
+		lon := -180 + (float64(i)+0.5)*dlon
+		if centre180 {
+			lon = -180 + float64(i)*dlon
+		}
+		lons = append(lons, lon)
+	}
+	return lats, lons
+}
+
+// bpchTime and bpchBounds are the names of the time variables of a bpch
+// file: the start of each averaging period, in hours since bpchTau0, as in
+// the netCDF files converted from bpch, and the start and end of the
+// periods, as in a CF time_bnds variable.
+const (
+	bpchTime   = "time"
+	bpchBounds = "time_bnds"
+)
+
+// bpchLat and bpchLon are the names of the cell centres of a bpch file,
+// as in the netCDF files converted from bpch.
+const (
+	bpchLat = "lat"
+	bpchLon = "lon"
+)
+
+// periods are the distinct averaging periods of the blocks, in time
+// order.
+func (b *bpchFile) periods() [][2]float64 {
+	seen := make(map[float64]bool)
+	var out [][2]float64
+	for _, blks := range b.blocks {
+		for _, blk := range blks {
+			if !seen[blk.tau0] {
+				seen[blk.tau0] = true
+				out = append(out, [2]float64{blk.tau0, blk.tau1})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// readTimes reads bpchTime or bpchBounds.
+func (b *bpchFile) readTimes(v string, start, end []int) ([]float64, error) {
+	periods := b.periods()
+	if len(start) != len(b.Lengths(v)) || start[0] < 0 || end[0] > len(periods) {
+		return nil, fmt.Errorf("can't read %s of %s from %v to %v", v, b.path, start, end)
+	}
+	var out []float64
+	for _, p := range periods[start[0]:end[0]] {
+		if v == bpchTime {
+			out = append(out, p[0])
+			continue
+		}
+		for k := start[1]; k < end[1]; k++ {
+			out = append(out, p[k])
+		}
+	}
+	return out, nil
+}
+
+// Lengths is (time, lev, lat, lon), or (time, lat, lon) for a variable
+// with one level.
+func (b *bpchFile) Lengths(v string) []int {
+	switch v {
+	case bpchTime:
+		return []int{len(b.periods())}
+	case bpchBounds:
+		return []int{len(b.periods()), 2}
+	case bpchLat:
+		return []int{len(b.lats)}
+	case bpchLon:
+		return []int{len(b.lons)}
+	}
+	blks := b.blocks[v]
+	if len(blks) == 0 {
+		return nil
+	}
+	if blks[0].nl == 1 {
+		return []int{len(blks), blks[0].nj, blks[0].ni}
+	}
+	return []int{len(blks), blks[0].nl, blks[0].nj, blks[0].ni}
+}
+
+// Read reads the values as they are stored, without the scale factor of
+// tracerinfo.dat, as when converting the files to netCDF.
+func (b *bpchFile) Read(v string, start, end []int) ([]float32, error) {
+	if v == bpchTime || v == bpchBounds {
+		times, err := b.readTimes(v, start, end)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]float32, len(times))
+		for i, t := range times {
+			out[i] = float32(t)
+		}
+		return out, nil
+	}
+	if v == bpchLat || v == bpchLon {
+		c := b.lats
+		if v == bpchLon {
+			c = b.lons
+		}
+		if len(start) != 1 || start[0] < 0 || end[0] > len(c) {
+			return nil, fmt.Errorf("can't read %s of %s from %v to %v", v, b.path, start, end)
+		}
+		out := make([]float32, 0, end[0]-start[0])
+		for _, x := range c[start[0]:end[0]] {
+			out = append(out, float32(x))
+		}
+		return out, nil
+	}
+	dims := b.Lengths(v)
+	if dims == nil {
+		return nil, fmt.Errorf("%s isn't in %s", v, b.path)
+	}
+	if len(start) != len(dims) || len(end) != len(dims) {
+		return nil, fmt.Errorf("%s has %d dimensions, not %d", v, len(dims), len(start))
+	}
+	for i := range dims {
+		if start[i] < 0 || end[i] > dims[i] || start[i] >= end[i] {
+			return nil, fmt.Errorf("can't read %s from %v to %v: its dimensions are %v", v, start, end, dims)
+		}
+	}
+	// The levels, latitudes and longitudes of a block, with a single
+	// level for (time, lat, lon) variables.
+	lo, hi := []int{0, start[1], start[2]}, []int{1, end[1], end[2]}
+	if len(dims) == 4 {
+		lo, hi = start[1:], end[1:]
+	}
+	var out []float32
+	for t := start[0]; t < end[0]; t++ {
+		blk := b.blocks[v][t]
+		row := make([]byte, 4*(hi[2]-lo[2]))
+		for l := lo[0]; l < hi[0]; l++ {
+			for j := lo[1]; j < hi[1]; j++ {
+				at := blk.offset + 4*int64((l*blk.nj+j)*blk.ni+lo[2])
+				if _, err := b.f.ReadAt(row, at); err != nil {
+					return nil, fmt.Errorf("reading %s from %s isn't working: %v", v, b.path, err)
+				}
+				for i := 0; i < len(row); i += 4 {
+					out = append(out, math.Float32frombits(binary.BigEndian.Uint32(row[i:])))
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// ReadFloat64 reads the times at double precision, as they are stored,
+// and the other variables as Read does.
+func (b *bpchFile) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	if v == bpchTime || v == bpchBounds {
+		return b.readTimes(v, start, end)
+	}
+	return widen(b.Read(v, start, end))
+}
+
+// Times returns the start time of each time index of v.
+func (b *bpchFile) Times(v string) []time.Time {
+	var out []time.Time
+	for _, blk := range b.blocks[v] {
+		out = append(out, bpchTau0.Add(time.Duration(blk.tau0*float64(time.Hour))))
+	}
+	return out
+}
+
+func (b *bpchFile) Units(v string) string {
+	if v == bpchTime || v == bpchBounds {
+		return "hours since " + bpchTau0.Format("2006-01-02 15:04:05")
+	}
+	switch v {
+	case bpchLat:
+		return "degrees_north"
+	case bpchLon:
+		return "degrees_east"
+	}
+	if blks := b.blocks[v]; len(blks) > 0 {
+		return blks[0].unit
+	}
+	return ""
+}
+
+func (b *bpchFile) Close() error { return b.f.Close() }
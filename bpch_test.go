@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// record frames data as a big-endian Fortran record.
+func record(data []byte) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, int32(len(data)))
+	b.Write(data)
+	binary.Write(&b, binary.BigEndian, int32(len(data)))
+	return b.Bytes()
+}
+
+func padded(s string, n int) []byte {
+	return []byte(fmt.Sprintf("%-*s", n, s))
+}
+
+// testBlock is a data block of a test bpch file.
+type testBlock struct {
+	category   string
+	tracer     int32
+	unit       string
+	tau0, tau1 float64
+	ni, nj, nl int
+	value      func(i, j, l int) float32
+}
+
+// writeBpch writes a bpch file with its tracerinfo.dat and diaginfo.dat
+// to dir.
+func writeBpch(t *testing.T, dir string, blocks []testBlock) string {
+	t.Helper()
+	tracerinfo := "# tracerinfo.dat\n" +
+		fmt.Sprintf("%-8s %-30s%10.3E%3d%9d%10.3E %s\n", "NH4", "Ammonium", 18e-3, 0, 1, 1e9, "ppbv") +
+		fmt.Sprintf("%-8s %-30s%10.3E%3d%9d%10.3E %s\n", "SO4", "Sulfate", 96e-3, 0, 2, 1e9, "ppbv") +
+		fmt.Sprintf("%-8s %-30s%10.3E%3d%9d%10.3E %s\n", "PSURF", "Surface pressure", 0.0, 0, 1001, 1.0, "hPa")
+	diaginfo := "# diaginfo.dat\n" +
+		fmt.Sprintf("%8d %-40s %s\n", 0, "IJ-AVG-$", "Tracer concentration") +
+		fmt.Sprintf("%8d %-40s %s\n", 1000, "PEDGE-$", "Pressure at level edges")
+	if err := os.WriteFile(filepath.Join(dir, "tracerinfo.dat"), []byte(tracerinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "diaginfo.dat"), []byte(diaginfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	b.Write(record(padded(bpchFileType, 40)))
+	b.Write(record(padded("test file", 80)))
+	for _, blk := range blocks {
+		var grid bytes.Buffer
+		grid.Write(padded("GEOS5_47L", 20))
+		binary.Write(&grid, binary.BigEndian, []float32{5, 4})
+		binary.Write(&grid, binary.BigEndian, []int32{1, 1})
+		b.Write(record(grid.Bytes()))
+
+		var head bytes.Buffer
+		head.Write(padded(blk.category, 40))
+		binary.Write(&head, binary.BigEndian, blk.tracer)
+		head.Write(padded(blk.unit, 40))
+		binary.Write(&head, binary.BigEndian, []float64{blk.tau0, blk.tau1})
+		head.Write(padded("", 40))
+		binary.Write(&head, binary.BigEndian, []int32{int32(blk.ni), int32(blk.nj), int32(blk.nl), 1, 1, 1})
+		binary.Write(&head, binary.BigEndian, int32(4*blk.ni*blk.nj*blk.nl))
+		b.Write(record(head.Bytes()))
+
+		var data bytes.Buffer
+		for l := 0; l < blk.nl; l++ {
+			for j := 0; j < blk.nj; j++ {
+				for i := 0; i < blk.ni; i++ {
+					binary.Write(&data, binary.BigEndian, blk.value(i, j, l))
+				}
+			}
+		}
+		b.Write(record(data.Bytes()))
+	}
+	path := filepath.Join(dir, "ts.20151120.000000.bpch")
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadTracerInfo(t *testing.T) {
+	dir := t.TempDir()
+	writeBpch(t, dir, nil)
+	info, err := readTracerInfo(filepath.Join(dir, "tracerinfo.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]tracerInfo{
+		1:    {name: "NH4", fullName: "Ammonium", molWt: 18e-3, number: 1, scale: 1e9, unit: "ppbv"},
+		2:    {name: "SO4", fullName: "Sulfate", molWt: 96e-3, number: 2, scale: 1e9, unit: "ppbv"},
+		1001: {name: "PSURF", fullName: "Surface pressure", number: 1001, scale: 1, unit: "hPa"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("the tracers are %+v, not %+v", info, want)
+	}
+
+	for _, bad := range []string{
+		"SO4      Sulfate                        bad       0        2 1.000E+09 ppbv",
+		"SO4      Sulfate                         9.600E-02  0      two 1.000E+09 ppbv",
+	} {
+		path := filepath.Join(dir, "bad.dat")
+		os.WriteFile(path, []byte(bad+"\n"), 0644)
+		if _, err := readTracerInfo(path); err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Errorf("%q should be rejected with its line number, not %v", bad, err)
+		}
+	}
+}
+
+func TestReadDiagInfo(t *testing.T) {
+	dir := t.TempDir()
+	writeBpch(t, dir, nil)
+	offsets, err := readDiagInfo(filepath.Join(dir, "diaginfo.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"IJ-AVG-$": 0, "PEDGE-$": 1000}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("the offsets are %v, not %v", offsets, want)
+	}
+	path := filepath.Join(dir, "bad.dat")
+	os.WriteFile(path, []byte("# comment\n     abc IJ-AVG-$\n"), 0644)
+	if _, err := readDiagInfo(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("a bad offset should be rejected with its line number, not %v", err)
+	}
+}
+
+func TestFortranRecord(t *testing.T) {
+	good := record([]byte("abcd"))
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		buf     []byte
+		n       int
+		wantErr bool
+	}{
+		{"read", good, make([]byte, 4), 4, false},
+		{"skip", good, nil, 4, false},
+		{"wrong length", good, make([]byte, 5), 0, true},
+		{"unterminated", append(good[:len(good)-4:len(good)-4], 0, 0, 0, 5), make([]byte, 4), 0, true},
+		{"truncated", good[:6], make([]byte, 4), 0, true},
+	} {
+		r := bytes.NewReader(test.data)
+		n, at, err := fortranRecord(r, test.buf)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: the error is %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if n != test.n || at != 4 {
+			t.Errorf("%s: the record has %d bytes from byte %d, not %d from 4", test.name, n, at, test.n)
+		}
+		if test.buf != nil && string(test.buf) != "abcd" {
+			t.Errorf("%s: the record is %q", test.name, test.buf)
+		}
+		if pos, _ := r.Seek(0, 1); pos != int64(len(good)) {
+			t.Errorf("%s: the record ends at byte %d, not %d", test.name, pos, len(good))
+		}
+	}
+}
+
+func TestBpchFile(t *testing.T) {
+	dir := t.TempDir()
+	so4 := func(tau float64) func(i, j, l int) float32 {
+		return func(i, j, l int) float32 { return float32(tau) + float32(100*l+10*j+i) }
+	}
+	var blocks []testBlock
+	for _, tau := range []float64{270723, 270720} {
+		blocks = append(blocks,
+			testBlock{"IJ-AVG-$", 2, "ppbv", tau, tau + 3, 4, 3, 2, so4(tau)},
+			testBlock{"PEDGE-$", 1, "hPa", tau, tau + 3, 4, 3, 1, func(i, j, l int) float32 { return 1000 }},
+		)
+	}
+	path := writeBpch(t, dir, blocks)
+	b, err := openBpch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.title != "test file" {
+		t.Errorf("the title is %q", b.title)
+	}
+	if got := b.Lengths("IJ_AVG_S__SO4"); !reflect.DeepEqual(got, []int{2, 2, 3, 4}) {
+		t.Errorf("SO4 is %v", got)
+	}
+	if got := b.Lengths("PEDGE_S__PSURF"); !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Errorf("PSURF is %v", got)
+	}
+	if b.Lengths("IJ_AVG_S__NH4") != nil {
+		t.Error("NH4 isn't in the file")
+	}
+	if u := b.Units("IJ_AVG_S__SO4"); u != "ppbv" {
+		t.Errorf("the units of SO4 are %q", u)
+	}
+
+	// The blocks are in time order, whatever their order in the file.
+	got, err := b.Read("IJ_AVG_S__SO4", []int{0, 1, 1, 2}, []int{2, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float32{270720 + 112, 270720 + 113, 270720 + 122, 270720 + 123, 270723 + 112, 270723 + 113, 270723 + 122, 270723 + 123}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SO4 is %v, not %v", got, want)
+	}
+	if _, err := b.Read("IJ_AVG_S__SO4", []int{0, 0, 0, 0}, []int{3, 1, 1, 1}); err == nil {
+		t.Error("reading past the last time should be an error")
+	}
+
+	// The time axis is the start of the periods, and the bounds their
+	// start and end.
+	times, err := b.Read(bpchTime, []int{0}, b.Lengths(bpchTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(times, []float32{270720, 270723}) {
+		t.Errorf("the times are %v", times)
+	}
+	bounds, err := b.Read(bpchBounds, []int{0, 0}, b.Lengths(bpchBounds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bounds, []float32{270720, 270723, 270723, 270726}) {
+		t.Errorf("the time bounds are %v", bounds)
+	}
+	if !strings.HasPrefix(b.Units(bpchTime), "hours since 1985-01-01") {
+		t.Errorf("the time units are %q", b.Units(bpchTime))
+	}
+	// The cells are the first of the 4x5 grid, whose polar cells are half
+	// as tall as the others.
+	lat, _ := b.Read(bpchLat, []int{0}, b.Lengths(bpchLat))
+	lon, _ := b.Read(bpchLon, []int{0}, b.Lengths(bpchLon))
+	if !reflect.DeepEqual(lat, []float32{-89, -86, -82}) || !reflect.DeepEqual(lon, []float32{-180, -175, -170, -165}) {
+		t.Errorf("the cell centres are %v and %v", lat, lon)
+	}
+	if start := b.Times("IJ_AVG_S__SO4")[0]; start.Format("2006-01-02 15:04") != "2015-11-20 00:00" {
+		t.Errorf("the first time is %v", start)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                       GRID CELL AVERAGED COMPARISON
+// *************************************************************************
+// *************************************************************************
+
+// Several stations are often in the same model grid cell, and so are all
+// paired with the same simulated value. A grid cell average of the
+// measurements is a fairer comparison with the cell average that the model
+// simulates.
+
+// cellPair is the mean of the pairs in one grid cell and time window.
+type cellPair struct {
+	xy
+	cell      int       // index of the model cell, as recorded at pairing
+	lat, lon  float64   // centre of the cell
+	time      time.Time // start of the time window
+	nStations int
+	nObs      int
+	// The spread of the measured values in the cell.
+	obsSD, obsMin, obsMax float64
+}
+
+type cellKey struct {
+	cell int
+	time time.Time
+}
+
+// cellPairs averages the pairs in each model grid cell, as recorded at
+// pairing time, and time window. Windows start at multiples of window from
+// midnight UTC, so a 3 hour window matches the 3-hourly GEOS-Chem output.
+func cellPairs(pairs []pair, window time.Duration) ([]cellPair, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("the time window must be positive, not %v", window)
+	}
+	groups := make(map[cellKey][]pair)
+	var order []cellKey
+	for _, p := range pairs {
+		if p.area <= 0 {
+			return nil, errNoCell
+		}
+		k := cellKey{p.cell, p.time.UTC().Truncate(window)}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], p)
+	}
+
+	cells := make([]cellPair, len(order))
+	for i, k := range order {
+		first := groups[k][0]
+		c := cellPair{cell: k.cell, lat: first.cellLat, lon: first.cellLon, time: k.time, obsMin: math.Inf(1), obsMax: math.Inf(-1)}
+		stations := make(map[string]bool)
+		for _, p := range groups[k] {
+			c.x += p.x
+			c.y += p.y
+			c.obsMin = math.Min(c.obsMin, p.y)
+			c.obsMax = math.Max(c.obsMax, p.y)
+			stations[stationKey(p)] = true
+		}
+		c.nObs = len(groups[k])
+		c.nStations = len(stations)
+		c.x /= float64(c.nObs)
+		c.y /= float64(c.nObs)
+		for _, p := range groups[k] {
+			c.obsSD += (p.y - c.y) * (p.y - c.y)
+		}
+		c.obsSD = math.Sqrt(c.obsSD / float64(c.nObs))
+		cells[i] = c
+	}
+	return cells, nil
+}
+
+// cellXYs returns the simulated and measured values of cells.
+func cellXYs(cells []cellPair) []xy {
+	data := make([]xy, len(cells))
+	for i, c := range cells {
+		data[i] = c.xy
+	}
+	return data
+}
+
+// writeCellPairs writes the cell averaged pairs, with the index of the
+// model cell and the latitude and longitude of its centre.
+func writeCellPairs(filename string, cells []cellPair) error {
+	tWrt := []XY{{"simulated", "measured", "time", "cell", "lat", "lon", "n_stations", "n_obs", "obs_sd", "obs_min", "obs_max"}}
+	for _, c := range cells {
+		tWrt = append(tWrt, XY{
+			ff(c.x), ff(c.y), c.time.Format(time.RFC3339),
+			strconv.Itoa(c.cell), ff(c.lat), ff(c.lon),
+			strconv.Itoa(c.nStations), strconv.Itoa(c.nObs),
+			ff(c.obsSD), ff(c.obsMin), ff(c.obsMax),
+		})
+	}
+	return csvWriter(filename, tWrt)
+}
+
+// parseWindow parses a time window such as "3h", or "day".
+func parseWindow(s string) (time.Duration, error) {
+	switch s {
+	case "hour":
+		return time.Hour, nil
+	case "day":
+		return 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// cellsCmd is the "cells" mode. It averages the paired results in each
+// grid cell and time window, writes the cell level pairs, and prints the
+// statistics for them.
+func cellsCmd(args []string) error {
+	fs := flag.NewFlagSet("cells", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	windowFlag := fs.String("window", "3h", "time window to average over, e.g. hour, 3h or day")
+	outFile := fs.String("out", "cells.csv", "output file for the cell averaged pairs")
+	fs.Parse(args)
+
+	window, err := parseWindow(*windowFlag)
+	if err != nil {
+		return err
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	cells, err := cellPairs(pairs, window)
+	if err != nil {
+		return err
+	}
+	if err := writeCellPairs(*outFile, cells); err != nil {
+		return err
+	}
+
+	data := cellXYs(cells)
+	fmt.Printf("%d pairs averaged into %d grid cells and time windows\n", len(pairs), len(cells))
+	for _, m := range metrics {
+		v, err := m.f(data)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf(" %s: %f\n", m.name, v)
+	}
+	return nil
+}
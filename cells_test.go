@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCellPairs(t *testing.T) {
+	// Two stations in cell 7 are averaged in each hour, whatever their
+	// positions, and a station in cell 12 has its own cell.
+	h := time.Date(2015, 11, 20, 3, 0, 0, 0, time.UTC)
+	pairs := []pair{
+		{xy: xy{10, 4}, time: h, location: "a", lat: 10, lon: 20, cell: 7, cellLat: 11, cellLon: 21, area: 100},
+		{xy: xy{10, 8}, time: h.Add(30 * time.Minute), location: "b", lat: 12.9, lon: 22.4, cell: 7, cellLat: 11, cellLon: 21, area: 100},
+		{xy: xy{10, 6}, time: h.Add(time.Hour), location: "a", lat: 10, lon: 20, cell: 7, cellLat: 11, cellLon: 21, area: 100},
+		{xy: xy{5, 5}, time: h, location: "c", lat: 10.1, lon: 20.1, cell: 12, cellLat: 9, cellLon: 21, area: 100},
+	}
+	cells, err := cellPairs(pairs, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 3 {
+		t.Fatalf("there are %d cells and hours, not 3: %+v", len(cells), cells)
+	}
+	c := cells[0]
+	if c.cell != 7 || c.lat != 11 || c.lon != 21 || !c.time.Equal(h) || c.x != 10 || c.y != 6 || c.nStations != 2 || c.nObs != 2 || c.obsSD != 2 {
+		t.Errorf("the first cell and hour is %+v", c)
+	}
+	if c := cells[2]; c.cell != 12 || c.nObs != 1 || c.y != 5 {
+		t.Errorf("the station in its own cell is %+v", c)
+	}
+
+	// Results paired without the cells can't be averaged by cell.
+	if _, err := cellPairs(append(pairs, pair{location: "d", lat: 10}), time.Hour); err == nil {
+		t.Error("a pair without its cell should be rejected")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/SumilThakr/aqcomp/regrid"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                          MODEL TO MODEL COMPARISON
+// *************************************************************************
+// *************************************************************************
+
+// modelSurface is the mean surface PM2.5 of a model run on its own grid.
+type modelSurface struct {
+	name   string
+	grid   regrid.Grid
+	values []float64
+	// start is the date of the first model file averaged, or zero if it
+	// isn't known, as for InMAP.
+	start time.Time
+	loc   *regrid.Locator
+}
+
+// readModelSurface reads a model run to compare: either a folder of
+// GEOS-Chem ts files, whose PM2.5 is averaged over the dates from from to
+// to, or an InMAP result exported to GeoJSON in longitude and latitude,
+// with the PM2.5 in the inmapVar property of each cell.
+func readModelSurface(name, path, inmapVar string, from, to time.Time) (*modelSurface, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &modelSurface{name: name}
+	switch {
+	case info.IsDir():
+		days, err := modelDays(path, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if m.values, m.grid, err = meanModelField(days, "pm25", speciation{}); err != nil {
+			return nil, err
+		}
+		m.start = days[0].date
+	case strings.HasSuffix(path, ".geojson") || strings.HasSuffix(path, ".json"):
+		if m.grid, m.values, err = readInMAP(path, inmapVar); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("can't read a model from %s: should be a folder of GEOS-Chem files or an InMAP .geojson file", path)
+	}
+	m.loc = regrid.NewLocator(m.grid)
+	return m, nil
+}
+
+// readInMAP reads the cells of an InMAP result and the variable v of each
+// cell from a GeoJSON FeatureCollection.
+func readInMAP(path, v string) (regrid.Polygons, []float64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		return nil, nil, fmt.Errorf("reading %s isn't working: %v", path, err)
+	}
+	cells := make(regrid.Polygons, 0, len(fc.Features))
+	values := make([]float64, 0, len(fc.Features))
+	for i, f := range fc.Features {
+		var poly [][][2]float64
+		switch f.Geometry.Type {
+		case "Polygon":
+			err = json.Unmarshal(f.Geometry.Coordinates, &poly)
+		case "MultiPolygon":
+			var multi [][][][2]float64
+			if err = json.Unmarshal(f.Geometry.Coordinates, &multi); err == nil {
+				if len(multi) != 1 {
+					return nil, nil, fmt.Errorf("%s: cell %d has %d polygons", path, i, len(multi))
+				}
+				poly = multi[0]
+			}
+		default:
+			return nil, nil, fmt.Errorf("%s: cell %d is a %s, not a polygon", path, i, f.Geometry.Type)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: cell %d: %v", path, i, err)
+		}
+		if len(poly) == 0 {
+			return nil, nil, fmt.Errorf("%s: cell %d has no outline", path, i)
+		}
+		val, ok := f.Properties[v].(float64)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: cell %d has no numeric %s property", path, i, v)
+		}
+		cells = append(cells, poly[0])
+		values = append(values, val)
+	}
+	if len(cells) == 0 {
+		return nil, nil, fmt.Errorf("there are no cells in %s", path)
+	}
+	return cells, values, nil
+}
+
+// at returns the model value in the cell containing a point, or NaN if
+// the point is outside the grid.
+func (m *modelSurface) at(lon, lat float64) float64 {
+	c, ok := m.loc.Find(lon, lat)
+	if !ok {
+		return math.NaN()
+	}
+	return m.values[c]
+}
+
+// stationLocations returns one observation for every station measuring
+// PM2.5 in the source, in the order they are first seen.
+func stationLocations(src ObservationSource) ([]observation, error) {
+	days, err := src.Days()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var stations []observation
+	for _, day := range days {
+		obs, err := src.Observations(day)
+		if err != nil {
+			return nil, err
+		}
+		for _, ob := range obs {
+			k := fmt.Sprintf("%s|%g|%g", ob.location, ob.lat, ob.lon)
+			if ob.parameter != "pm25" || seen[k] {
+				continue
+			}
+			seen[k] = true
+			stations = append(stations, ob)
+		}
+	}
+	if len(stations) == 0 {
+		return nil, fmt.Errorf("there are no PM2.5 stations in the observations")
+	}
+	return stations, nil
+}
+
+// stationPairs samples both models at every station, with a as the model
+// and b as the reference. The pairs have the cell of a. Stations outside
+// either grid are left out.
+func stationPairs(a, b *modelSurface, stations []observation, t time.Time) []pair {
+	var pairs []pair
+	for _, s := range stations {
+		c, ok := a.loc.Find(s.lon, s.lat)
+		vb := b.at(s.lon, s.lat)
+		if !ok || math.IsNaN(a.values[c]) || math.IsNaN(vb) {
+			continue
+		}
+		p := pair{xy: xy{a.values[c], vb}, time: t, location: s.location, city: s.city, country: s.country, lat: s.lat, lon: s.lon,
+			cell: c, area: regrid.CellArea(a.grid, c)}
+		p.cellLon, p.cellLat = a.grid.Centre(c)
+		pairs = append(pairs, p)
+	}
+	return pairs
+}
+
+// gridPairs averages both models conservatively onto the common grid and
+// pairs them in every cell that both cover, with a as the model and b as
+// the reference. The pairs carry the area of their cell, for the area
+// weighting.
+func gridPairs(a, b *modelSurface, common regrid.Grid, cacheDir string, t time.Time) ([]pair, error) {
+	var onGrid [2][]float64
+	var area []float64
+	for i, m := range []*modelSurface{a, b} {
+		w, err := regrid.Cached(cacheDir, m.grid, common, regrid.Conservative)
+		if err != nil {
+			return nil, err
+		}
+		area = w.DstArea
+		if onGrid[i], err = w.Apply(m.values); err != nil {
+			return nil, fmt.Errorf("%s: %v", m.name, err)
+		}
+	}
+	var pairs []pair
+	for c := 0; c < common.Len(); c++ {
+		va, vb := onGrid[0][c], onGrid[1][c]
+		if math.IsNaN(va) || math.IsNaN(vb) {
+			continue
+		}
+		lon, lat := common.Centre(c)
+		pairs = append(pairs, pair{xy: xy{va, vb}, time: t, location: "cell " + strconv.Itoa(c), lat: lat, lon: lon,
+			cell: c, cellLat: lat, cellLon: lon, area: area[c]})
+	}
+	return pairs, nil
+}
+
+// compareCmd is the "compare" mode, which compares two model runs without
+// observations, e.g. GEOS-Chem with InMAP, or two GEOS-Chem runs. The
+// second run (-b) is treated as the reference, so the bias metrics are of
+// the first run (-a) against it.
+func compareCmd(args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	aPath := fs.String("a", defaultNcfFolder, "model run to evaluate: a folder of GEOS-Chem files or an InMAP .geojson file")
+	bPath := fs.String("b", "", "reference model run, as for -a")
+	aName := fs.String("aname", "A", "name of the -a run in the outputs")
+	bName := fs.String("bname", "B", "name of the -b run in the outputs")
+	inmapVar := fs.String("inmapvar", "TotalPM25", "PM2.5 property of the cells of InMAP results")
+	from := fs.String("modelfrom", "", "first date of the GEOS-Chem files to average, as 2006-01-02")
+	to := fs.String("modelto", "", "last date of the GEOS-Chem files to average, as 2006-01-02")
+	sampling := fs.String("at", "stations", "where to compare the runs: stations (every PM2.5 station in the observations) or grid")
+	observations := observationFlags(fs, "pm25")
+	gridFlag := fs.String("grid", "2x2.5", "common grid for -at grid: a resolution, a GeoJSON file of cells or a netCDF file")
+	latVar := fs.String("latvar", "lat", "latitude variable of a netCDF common grid")
+	lonVar := fs.String("lonvar", "lon", "longitude variable of a netCDF common grid")
+	cacheDir := fs.String("regridcache", "regrid-cache", "directory of cached regridding weights")
+	by := fs.String("by", "all", "comma separated list of groupings: all, country, region, class, bin")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	classFile := fs.String("classes", "", "csv file of location,class for each station, e.g. urban or rural")
+	bins := fs.String("bins", "0,10,25,50,100,1000", "concentration bin edges")
+	weighting := fs.String("weight", "", "weighting: none, station, cell or area (default none at stations and area on a grid)")
+	outFile := fs.String("out", "compare.csv", "output csv file of the paired values")
+	statsFile := fs.String("stats", "compare_stats.csv", "output table of the metrics of each group")
+	mapFile := fs.String("map", "compare_map.pdf", "output map of the differences, or empty for none")
+	ncOut := fs.String("nc", "", "optional netCDF file of both runs and their difference, if the common grid is a latitude-longitude grid")
+	opts := mapOptions{}
+	fs.StringVar(&opts.stat, "stat", "mb", "statistic to map: mb (difference) or nmb (normalised difference)")
+	fs.Float64Var(&opts.limit, "limit", 0, "color scale limit, or 0 for the largest absolute value")
+	fs.StringVar(&opts.coastFile, "coast", "", "GeoJSON coastline to use instead of the bundled low resolution one")
+	fig := figFlags(fs)
+	levelFlags(fs)
+	modelFileFlags(fs)
+	fs.Parse(args)
+
+	if *bPath == "" {
+		return fmt.Errorf("compare: the reference run (-b) is required")
+	}
+	var t0, t1 time.Time
+	var err error
+	if *from != "" {
+		if t0, err = time.Parse("2006-01-02", *from); err != nil {
+			return fmt.Errorf("bad -modelfrom date: %v", err)
+		}
+	}
+	if *to != "" {
+		if t1, err = time.Parse("2006-01-02", *to); err != nil {
+			return fmt.Errorf("bad -modelto date: %v", err)
+		}
+	}
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, *classFile, *bins)
+	if err != nil {
+		return err
+	}
+	a, err := readModelSurface(*aName, *aPath, *inmapVar, t0, t1)
+	if err != nil {
+		return err
+	}
+	b, err := readModelSurface(*bName, *bPath, *inmapVar, t0, t1)
+	if err != nil {
+		return err
+	}
+
+	// The pairs carry the start of the averaging period, so that they are
+	// treated as having station information.
+	t := a.start
+	if t.IsZero() {
+		t = b.start
+	}
+	if t.IsZero() {
+		t = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	var pairs []pair
+	var common regrid.Grid
+	switch *sampling {
+	case "stations":
+		src, err := observations()
+		if err != nil {
+			return err
+		}
+		stations, err := stationLocations(src)
+		if err != nil {
+			return err
+		}
+		pairs = stationPairs(a, b, stations, t)
+		if *weighting == "" {
+			*weighting = "none"
+		}
+	case "grid":
+		if common, err = gridSpec(*gridFlag, *latVar, *lonVar); err != nil {
+			return err
+		}
+		if pairs, err = gridPairs(a, b, common, *cacheDir, t); err != nil {
+			return err
+		}
+		if *weighting == "" {
+			*weighting = "area"
+		}
+	default:
+		return fmt.Errorf("can't compare at %q: should be stations or grid", *sampling)
+	}
+	if len(pairs) == 0 {
+		return fmt.Errorf("%s and %s have no locations in common", a.name, b.name)
+	}
+
+	tWrt := []XY{{"location", "city", "country", "latitude", "longitude", a.name, b.name, "difference"}}
+	for _, p := range pairs {
+		tWrt = append(tWrt, XY{p.location, p.city, p.country, ff(p.lat), ff(p.lon), ff(p.x), ff(p.y), ff(p.x - p.y)})
+	}
+	if err := csvWriter(*outFile, tWrt); err != nil {
+		return err
+	}
+	stats, err := stratify(pairs, groupers, *weighting)
+	if err != nil {
+		return err
+	}
+	if err := writeGroupStats(*statsFile, stats); err != nil {
+		return err
+	}
+	if *ncOut != "" {
+		rect, ok := common.(*regrid.Rectilinear)
+		if !ok {
+			return fmt.Errorf("the netCDF output needs -at grid with a latitude-longitude common grid")
+		}
+		fa, fb, diff := make([]float64, common.Len()), make([]float64, common.Len()), make([]float64, common.Len())
+		for c := range fa {
+			fa[c], fb[c], diff[c] = math.NaN(), math.NaN(), math.NaN()
+		}
+		for _, p := range pairs {
+			fa[p.cell], fb[p.cell], diff[p.cell] = p.x, p.y, p.x-p.y
+		}
+		fields := []gridField{
+			{"a", "ug/m3", "mean PM2.5 of " + a.name, fa},
+			{"b", "ug/m3", "mean PM2.5 of " + b.name, fb},
+			{"difference", "ug/m3", a.name + " minus " + b.name + " PM2.5", diff},
+		}
+		if err := writeGridNetCDF(*ncOut, rect, fields); err != nil {
+			return err
+		}
+	}
+	if *mapFile == "" {
+		return nil
+	}
+	return biasMap(*mapFile, stationStats(pairs), opts, *fig)
+}
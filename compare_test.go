@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/SumilThakr/aqcomp/regrid"
+)
+
+func TestGridPairs(t *testing.T) {
+	g, err := regrid.NewRectilinear([]float64{10, 12}, []float64{20, 22.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &modelSurface{name: "a", grid: g, values: []float64{1, 2, math.NaN(), 4}}
+	b := &modelSurface{name: "b", grid: g, values: []float64{1, 1, 1, 1}}
+	pairs, err := gridPairs(a, b, g, t.TempDir(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cell without a value in a is left out, and the others keep their
+	// index on the common grid.
+	cells := []int{0, 1, 3}
+	if len(pairs) != len(cells) {
+		t.Fatalf("there are %d pairs, not %d", len(pairs), len(cells))
+	}
+	for i, p := range pairs {
+		c := cells[i]
+		lon, lat := g.Centre(c)
+		if p.cell != c || p.x != a.values[c] || p.y != 1 || p.cellLat != lat || p.cellLon != lon || math.Abs(p.area-g.Area(c)) > 1e-6*p.area {
+			t.Errorf("pair %d is %+v, not of cell %d", i, p, c)
+		}
+	}
+}
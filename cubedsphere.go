@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SumilThakr/aqcomp/regrid"
+	"math"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                        GCHP CUBED-SPHERE GRIDS
+// *************************************************************************
+// *************************************************************************
+
+// GCHP writes its output on a cubed-sphere grid, with the horizontal
+// dimensions (nf, Ydim, Xdim): six faces of Ydim by Xdim cells. The cell
+// centres are in the lons and lats variables and the cell corners in
+// corner_lons and corner_lats, with the dimensions (nf, YCdim, XCdim).
+//
+// A cubed-sphere file is read as if the faces were stacked into one
+// (nf*Ydim, Xdim) grid, so that a cell has a row and a column as on the
+// lats and lons grid. Since the faces are stored one after the other, this
+// doesn't change the order of the values.
+
+// cubedSphere is a modelFile on a cubed-sphere grid.
+type cubedSphere struct {
+	modelFile
+	nf, ny, nx int
+	grid       cubedGrid
+	loc        *regrid.Locator
+}
+
+// cubedGrid is the cells of a cubed sphere, with row major order over
+// the stacked faces.
+type cubedGrid struct {
+	cells    regrid.Polygons
+	lon, lat []float64
+	// corners are the corners of every cell as unit vectors, for testing
+	// whether a point is in the cell on the sphere.
+	corners [][4][3]float64
+}
+
+func (g cubedGrid) Len() int                        { return len(g.cells) }
+func (g cubedGrid) Cell(i int) [][2]float64         { return g.cells.Cell(i) }
+func (g cubedGrid) Centre(i int) (lon, lat float64) { return g.lon[i], g.lat[i] }
+
+// Area is the area of a cell on the sphere, in km², as the spherical excess
+// of the two triangles either side of its diagonal.
+func (g cubedGrid) Area(i int) float64 {
+	c := g.corners[i]
+	return (sphericalTriangle(c[0], c[1], c[2]) + sphericalTriangle(c[0], c[2], c[3])) * regrid.EarthRadius * regrid.EarthRadius
+}
+
+// sphericalTriangle is the area of a triangle on the unit sphere.
+func sphericalTriangle(a, b, c [3]float64) float64 {
+	dot := func(u, v [3]float64) float64 { return u[0]*v[0] + u[1]*v[1] + u[2]*v[2] }
+	bc := [3]float64{b[1]*c[2] - b[2]*c[1], b[2]*c[0] - b[0]*c[2], b[0]*c[1] - b[1]*c[0]}
+	return 2 * math.Abs(math.Atan2(dot(a, bc), 1+dot(a, b)+dot(b, c)+dot(c, a)))
+}
+
+// openCubedSphere returns f as a cubedSphere if it has the corners of a
+// cubed-sphere grid, or f itself if it hasn't.
+func openCubedSphere(f modelFile) (modelFile, error) {
+	dims := f.Lengths("corner_lons")
+	if len(dims) != 3 || f.Lengths("corner_lats") == nil {
+		return f, nil
+	}
+	c := &cubedSphere{modelFile: f, nf: dims[0], ny: dims[1] - 1, nx: dims[2] - 1}
+	read := func(v string, ny, nx int) ([]float32, error) {
+		values, err := f.Read(v, []int{0, 0, 0}, []int{c.nf, ny, nx})
+		if err != nil {
+			return nil, fmt.Errorf("reading the cubed-sphere grid isn't working: %v", err)
+		}
+		return values, nil
+	}
+	cornerLon, err := read("corner_lons", c.ny+1, c.nx+1)
+	if err != nil {
+		return nil, err
+	}
+	cornerLat, err := read("corner_lats", c.ny+1, c.nx+1)
+	if err != nil {
+		return nil, err
+	}
+	corner := func(face, y, x int) [2]float64 {
+		k := (face*(c.ny+1)+y)*(c.nx+1) + x
+		return [2]float64{float64(cornerLon[k]), float64(cornerLat[k])}
+	}
+
+	n := c.nf * c.ny * c.nx
+	g := cubedGrid{cells: make(regrid.Polygons, n), lon: make([]float64, n), lat: make([]float64, n), corners: make([][4][3]float64, n)}
+	for face := 0; face < c.nf; face++ {
+		for y := 0; y < c.ny; y++ {
+			for x := 0; x < c.nx; x++ {
+				i := (face*c.ny+y)*c.nx + x
+				ring := [][2]float64{corner(face, y, x), corner(face, y, x+1), corner(face, y+1, x+1), corner(face, y+1, x)}
+				for k, p := range ring {
+					g.corners[i][k] = unitVector(p[0], p[1])
+				}
+				g.cells[i] = cubedCell(ring)
+			}
+		}
+	}
+	// The centres are used for the cells that can't be drawn in longitude
+	// and latitude. They are the mean of the corners if the file doesn't
+	// have them.
+	centreLon, err1 := read("lons", c.ny, c.nx)
+	centreLat, err2 := read("lats", c.ny, c.nx)
+	for i := range g.cells {
+		if err1 == nil && err2 == nil && len(centreLon) == n && len(centreLat) == n {
+			g.lon[i], g.lat[i] = float64(centreLon[i]), float64(centreLat[i])
+			continue
+		}
+		g.lon[i], g.lat[i] = cornerMean(g.cells[i])
+	}
+	c.grid = g
+	c.loc = regrid.NewLocator(g)
+	return c, nil
+}
+
+// cubedCell returns the outline of a cell from its corners, with the
+// longitudes made continuous across the date line. The cells around the
+// poles can't be drawn in longitude and latitude, and are given an empty
+// outline, so that stations in them are found by their nearest centre.
+func cubedCell(corners [][2]float64) [][2]float64 {
+	minLon, maxLon := corners[0][0], corners[0][0]
+	for k := 1; k < len(corners); k++ {
+		for corners[k][0]-corners[0][0] > 180 {
+			corners[k][0] -= 360
+		}
+		for corners[k][0]-corners[0][0] < -180 {
+			corners[k][0] += 360
+		}
+		minLon, maxLon = math.Min(minLon, corners[k][0]), math.Max(maxLon, corners[k][0])
+	}
+	if maxLon-minLon > 90 {
+		c := corners[0]
+		return [][2]float64{c, c, c}
+	}
+	return corners
+}
+
+func cornerMean(ring [][2]float64) (lon, lat float64) {
+	for _, c := range ring {
+		lon += c[0] / float64(len(ring))
+		lat += c[1] / float64(len(ring))
+	}
+	return lon, lat
+}
+
+// merged is whether a variable with the dimensions dims is on the cubed
+// sphere.
+func (c *cubedSphere) merged(dims []int) bool {
+	k := len(dims)
+	return k >= 3 && dims[k-3] == c.nf && dims[k-2] == c.ny && dims[k-1] == c.nx
+}
+
+// Lengths has the faces stacked into rows for the variables on the cubed
+// sphere: (time, lev, nf*Ydim, Xdim).
+func (c *cubedSphere) Lengths(v string) []int {
+	dims := c.modelFile.Lengths(v)
+	if !c.merged(dims) {
+		return dims
+	}
+	k := len(dims)
+	return append(append([]int{}, dims[:k-3]...), c.nf*c.ny, c.nx)
+}
+
+func (c *cubedSphere) Read(v string, start, end []int) ([]float32, error) {
+	if !c.merged(c.modelFile.Lengths(v)) {
+		return c.modelFile.Read(v, start, end)
+	}
+	// The faces of the rows are read whole, and the rows needed are
+	// taken from them for every index of the other dimensions.
+	k := len(start) - 2
+	j0, j1 := start[k], end[k]
+	f0, f1 := j0/c.ny, (j1-1)/c.ny+1
+	s := append(append([]int{}, start[:k]...), f0, 0, start[k+1])
+	e := append(append([]int{}, end[:k]...), f1, c.ny, end[k+1])
+	block, err := c.modelFile.Read(v, s, e)
+	if err != nil {
+		return nil, err
+	}
+	nx := end[k+1] - start[k+1]
+	rows := (f1 - f0) * c.ny
+	first := j0 - f0*c.ny
+	out := make([]float32, 0, len(block)/rows*(j1-j0))
+	for base := 0; base < len(block); base += rows * nx {
+		out = append(out, block[base+first*nx:base+(first+j1-j0)*nx]...)
+	}
+	return out, nil
+}
+
+// ReadFloat64 reads the variables that aren't on the faces, such as the
+// times, at double precision. Those on the faces are read as float32.
+func (c *cubedSphere) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	if !c.merged(c.modelFile.Lengths(v)) {
+		return c.modelFile.ReadFloat64(v, start, end)
+	}
+	return widen(c.Read(v, start, end))
+}
+
+// locate returns the row and column of the cell containing a point. The
+// cell edges are great circles, which the outlines in longitude and
+// latitude used by the index only approximate, so the cells found in the
+// index and the cell with the nearest centre are checked on the sphere,
+// with their neighbours on the same face. If none of them contains the
+// point, as can happen at the edges of the faces, every cell is checked,
+// and the cell with the nearest centre is used if none contains it.
+func (c *cubedSphere) locate(lon, lat float64) (row, col int, err error) {
+	nearest, ok := c.loc.Nearest(lon, lat)
+	if !ok {
+		return 0, 0, fmt.Errorf("there is no cubed-sphere cell for %g, %g", lon, lat)
+	}
+	starts := []int{nearest}
+	if i, ok := c.loc.Find(lon, lat); ok {
+		starts = append([]int{i}, starts...)
+	}
+	p := unitVector(lon, lat)
+	for _, i := range starts {
+		face, y, x := i/(c.ny*c.nx), i/c.nx%c.ny, i%c.nx
+		for _, d := range [][2]int{{0, 0}, {-1, 0}, {1, 0}, {0, -1}, {0, 1}, {-1, -1}, {-1, 1}, {1, -1}, {1, 1}} {
+			yy, xx := y+d[0], x+d[1]
+			if yy < 0 || yy >= c.ny || xx < 0 || xx >= c.nx {
+				continue
+			}
+			if j := (face*c.ny+yy)*c.nx + xx; inSphericalCell(c.grid.corners[j], p) {
+				return j / c.nx, j % c.nx, nil
+			}
+		}
+	}
+	for j := range c.grid.corners {
+		if inSphericalCell(c.grid.corners[j], p) {
+			return j / c.nx, j % c.nx, nil
+		}
+	}
+	return nearest / c.nx, nearest % c.nx, nil
+}
+
+func unitVector(lon, lat float64) [3]float64 {
+	lon, lat = lon*math.Pi/180, lat*math.Pi/180
+	return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+// inSphericalCell is whether p is on the same side of every edge of the
+// cell, taken as great circles, whichever way round the corners go, and
+// on the same side of the sphere as the cell.
+func inSphericalCell(corners [4][3]float64, p [3]float64) bool {
+	var dot float64
+	for _, c := range corners {
+		dot += c[0]*p[0] + c[1]*p[1] + c[2]*p[2]
+	}
+	if dot <= 0 {
+		return false
+	}
+	var pos, neg bool
+	for k := range corners {
+		a, b := corners[k], corners[(k+1)%4]
+		n := [3]float64{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+		d := n[0]*p[0] + n[1]*p[1] + n[2]*p[2]
+		pos = pos || d > 0
+		neg = neg || d < 0
+	}
+	return !(pos && neg)
+}
+
+// modelCells finds the model cells of stations on the grid of a model
+// file (see modelGrid): the grid of its PM25, or of the SO4 tracer if it
+// has no PM25.
+type modelCells struct {
+	cs   *cubedSphere
+	grid regrid.Grid
+	nlon int // columns of the grid, as the cells are read by row and column
+	loc  *regrid.Locator
+}
+
+func newModelCells(f modelFile) (*modelCells, error) {
+	if c, ok := f.(*cubedSphere); ok {
+		return &modelCells{cs: c, grid: c.grid, nlon: c.nx}, nil
+	}
+	v := "IJ_AVG_S__SO4"
+	if f.Lengths("PM25") != nil {
+		v = "PM25"
+	}
+	g, err := modelGrid(f, v)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := g.(*regrid.Rectilinear)
+	if !ok {
+		return nil, fmt.Errorf("the grid of %s isn't a latitude-longitude grid", v)
+	}
+	return &modelCells{grid: r, nlon: len(r.LonEdges) - 1, loc: regrid.NewLocator(r)}, nil
+}
+
+// modelCell is a cell of the model grid, with its row and column, its
+// index on the grid, and its centre and area in km².
+type modelCell struct {
+	row, col, index int
+	lon, lat, area  float64
+}
+
+// find returns the model cell containing a station.
+func (m *modelCells) find(lon, lat float64) (modelCell, error) {
+	var i int
+	if m.cs != nil {
+		row, col, err := m.cs.locate(lon, lat)
+		if err != nil {
+			return modelCell{}, err
+		}
+		i = row*m.nlon + col
+	} else {
+		var ok bool
+		if i, ok = m.loc.Find(lon, lat); !ok {
+			return modelCell{}, fmt.Errorf("%g, %g isn't on the model grid", lon, lat)
+		}
+	}
+	c := modelCell{row: i / m.nlon, col: i % m.nlon, index: i, area: regrid.CellArea(m.grid, i)}
+	c.lon, c.lat = m.grid.Centre(i)
+	return c, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/SumilThakr/aqcomp/regrid"
+)
+
+// cubeFaces are the centres and the x and y directions of the faces of the
+// GCHP cubed sphere, in its order: faces 1, 2, 4 and 5 around the equator,
+// centred on 350°, 80°, 170° and 260°, and faces 3 and 6 over the north
+// and south poles.
+var cubeFaces = func() [6][3][3]float64 {
+	s, c := math.Sin(-10*math.Pi/180), math.Cos(-10*math.Pi/180)
+	equator := func(lon float64) [3][3]float64 {
+		s, c := math.Sin(lon*math.Pi/180), math.Cos(lon*math.Pi/180)
+		return [3][3]float64{{c, s, 0}, {-s, c, 0}, {0, 0, 1}}
+	}
+	return [6][3][3]float64{
+		equator(-10), equator(80),
+		{{0, 0, 1}, {-s, c, 0}, {-c, -s, 0}},
+		equator(170), equator(260),
+		{{0, 0, -1}, {-s, c, 0}, {c, s, 0}},
+	}
+}()
+
+// cubePoint is the longitude (from 0 to 360°, as in GCHP files) and
+// latitude of the point at the angles a and b from the centre of a face.
+func cubePoint(face int, a, b float64) (lon, lat float64) {
+	f := cubeFaces[face]
+	u, v := math.Tan(a), math.Tan(b)
+	var p [3]float64
+	for k := range p {
+		p[k] = f[0][k] + u*f[1][k] + v*f[2][k]
+	}
+	r := math.Sqrt(p[0]*p[0] + p[1]*p[1] + p[2]*p[2])
+	lon = math.Atan2(p[1], p[0]) * 180 / math.Pi
+	if lon < 0 {
+		lon += 360
+	}
+	return lon, math.Asin(p[2]/r) * 180 / math.Pi
+}
+
+// cubedModel is a fakeModel of an equiangular cubed sphere of n by n cells
+// on each face, with the corners and centres of the cells and the variable
+// v of dimensions (time, nf, Ydim, Xdim), whose value is 100*face + 10*y +
+// x.
+func cubedModel(n int) fakeModel {
+	f := fakeModel{values: map[string][]float32{}, dims: map[string][]int{
+		"corner_lons": {6, n + 1, n + 1}, "corner_lats": {6, n + 1, n + 1},
+		"lons": {6, n, n}, "lats": {6, n, n}, "v": {1, 6, n, n},
+	}}
+	angle := func(i float64) float64 { return -math.Pi/4 + i*math.Pi/2/float64(n) }
+	for face := 0; face < 6; face++ {
+		for y := 0; y <= n; y++ {
+			for x := 0; x <= n; x++ {
+				lon, lat := cubePoint(face, angle(float64(x)), angle(float64(y)))
+				f.values["corner_lons"] = append(f.values["corner_lons"], float32(lon))
+				f.values["corner_lats"] = append(f.values["corner_lats"], float32(lat))
+				if y == n || x == n {
+					continue
+				}
+				lon, lat = cubePoint(face, angle(float64(x)+0.5), angle(float64(y)+0.5))
+				f.values["lons"] = append(f.values["lons"], float32(lon))
+				f.values["lats"] = append(f.values["lats"], float32(lat))
+				f.values["v"] = append(f.values["v"], float32(100*face+10*y+x))
+			}
+		}
+	}
+	return f
+}
+
+// cubedCellsAt are the cells of the cubed sphere of n by n cells per face
+// that are next to a point, found by projecting points just around it onto
+// the face whose centre they are nearest, as rows and columns of the
+// stacked faces.
+func cubedCellsAt(n int, lon, lat float64) map[[2]int]bool {
+	cells := make(map[[2]int]bool)
+	centre := unitVector(lon, lat)
+	for d := 0; d < 27; d++ {
+		p := centre
+		for k, s := range [3]int{d % 3, d / 3 % 3, d / 9} {
+			p[k] += float64(s-1) * 1e-9
+		}
+		face, best := 0, -2.0
+		for k, f := range cubeFaces {
+			if dot := p[0]*f[0][0] + p[1]*f[0][1] + p[2]*f[0][2]; dot > best {
+				face, best = k, dot
+			}
+		}
+		f := cubeFaces[face]
+		index := func(e [3]float64) int {
+			a := math.Atan((p[0]*e[0] + p[1]*e[1] + p[2]*e[2]) / best)
+			i := int(math.Floor((a + math.Pi/4) / (math.Pi / 2) * float64(n)))
+			return int(math.Max(0, math.Min(float64(n-1), float64(i))))
+		}
+		cells[[2]int{face*n + index(f[2]), index(f[1])}] = true
+	}
+	return cells
+}
+
+func TestCubedSphereRead(t *testing.T) {
+	f, err := openCubedSphere(cubedModel(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := f.(*cubedSphere)
+	if !ok {
+		t.Fatal("the file isn't read as a cubed sphere")
+	}
+	if dims := c.Lengths("v"); len(dims) != 3 || dims[0] != 1 || dims[1] != 24 || dims[2] != 4 {
+		t.Errorf("v has the dimensions %v, not [1 24 4]", dims)
+	}
+	if dims := c.Lengths("corner_lons"); len(dims) != 3 || dims[1] != 5 {
+		t.Errorf("the corners have the dimensions %v, not those on file", dims)
+	}
+
+	// The rows of the stacked faces run on from the last row of a face to
+	// the first of the next.
+	v, err := c.Read("v", []int{0, 3, 1}, []int{1, 6, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float32{31, 32, 101, 102, 111, 112}
+	if len(v) != len(want) {
+		t.Fatalf("rows 3 to 5 are %v, not %v", v, want)
+	}
+	for i := range v {
+		if v[i] != want[i] {
+			t.Errorf("rows 3 to 5 are %v, not %v", v, want)
+			break
+		}
+	}
+	// The last row of the last face.
+	if v, err := c.Read("v", []int{0, 23, 0}, []int{1, 24, 4}); err != nil || len(v) != 4 || v[0] != 530 || v[3] != 533 {
+		t.Errorf("row 23 is %v (%v), not [530 531 532 533]", v, err)
+	}
+
+	// The cells of the faces cover the sphere.
+	var area float64
+	for i := 0; i < c.grid.Len(); i++ {
+		area += regrid.CellArea(c.grid, i)
+	}
+	if want := 4 * math.Pi * regrid.EarthRadius * regrid.EarthRadius; math.Abs(area-want) > 1e-9*want {
+		t.Errorf("the cells have an area of %g km², not %g km²", area, want)
+	}
+}
+
+func TestCubedSphereLocate(t *testing.T) {
+	const n = 12
+	f, err := openCubedSphere(cubedModel(n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := f.(*cubedSphere)
+	// The corner of faces 1, 2 and 3 of the cube.
+	corner := math.Atan(1/math.Sqrt2) * 180 / math.Pi
+	for _, test := range []struct {
+		name     string
+		lon, lat float64
+		face     int
+	}{
+		{"the centre of face 1", -10, 0, 0},
+		{"the centre of face 2", 80, 0, 1},
+		{"the centre of face 4", 170, 0, 3},
+		{"the centre of face 5", -100, 0, 4},
+		{"the centre of face 5, east of 180°", 260, 0, 4},
+		{"the north pole", 0, 90, 2},
+		{"near the north pole", 123, 89.99, 2},
+		{"the south pole", 0, -90, 5},
+		{"near the south pole", -57, -89.99, 5},
+		{"west of the date line", 179.99, 20, 3},
+		{"east of the date line", -179.99, 20, 3},
+		{"on the date line", 180, -30, 3},
+		{"on the prime meridian", 0, 10, 0},
+		{"west of the edge of faces 1 and 2", 34.99, 0, 0},
+		{"east of the edge of faces 1 and 2", 35.01, 0, 1},
+		{"on the edge of faces 1 and 2", 35, 0, -1},
+		{"on the edge of faces 2 and 3", 80, 45, -1},
+		{"on the edge of faces 5 and 6", -100, -45, -1},
+		{"on the corner of faces 1, 2 and 3", 35, corner, -1},
+		{"on the corner of faces 4, 5 and 6", 215, -corner, -1},
+		{"next to the corner of faces 1, 2 and 3", 35, corner + 0.01, 2},
+	} {
+		row, col, err := c.locate(test.lon, test.lat)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want := cubedCellsAt(n, test.lon, test.lat)
+		if !want[[2]int{row, col}] {
+			t.Errorf("%s (%g, %g) is in row %d, column %d, not one of %v", test.name, test.lon, test.lat, row, col, want)
+		}
+		if test.face >= 0 && row/n != test.face {
+			t.Errorf("%s (%g, %g) is on face %d, not %d", test.name, test.lon, test.lat, row/n+1, test.face+1)
+		}
+	}
+
+	// Every cell is found from its own centre.
+	for i := range c.grid.lon {
+		row, col, err := c.locate(c.grid.lon[i], c.grid.lat[i])
+		if err != nil || row*n+col != i {
+			t.Errorf("the centre of cell %d is in cell %d (%v)", i, row*n+col, err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/color"
+	"math"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                       DIURNAL AND SEASONAL CYCLES
+// *************************************************************************
+// *************************************************************************
+
+// localTime returns the local time of the measurement in p. With tz "auto"
+// the UTC offset from the measurement file is used if it is known, and
+// otherwise the offset is estimated from the station longitude as one hour
+// every 15 degrees. With "lon" the longitude is always used, and with "tz"
+// pairs without a UTC offset are left out (ok is false).
+func localTime(p pair, tz string) (t time.Time, ok bool) {
+	if (tz == "auto" || tz == "tz") && !p.local.IsZero() {
+		return p.local, true
+	}
+	if tz == "tz" {
+		return t, false
+	}
+	offset := time.Duration(math.Round(p.lon/15)) * time.Hour
+	return p.time.UTC().Add(offset), true
+}
+
+// cyclePoint is the mean measured and simulated value at one local hour
+// (0-23) or month (1-12).
+type cyclePoint struct {
+	key      int
+	obs, sim float64
+	n        int
+}
+
+// cycle composites the pairs by local hour of day ("diurnal") or by month
+// ("seasonal").
+func cycle(pairs []pair, kind, tz string) ([]cyclePoint, error) {
+	var n int
+	var key func(t time.Time) int
+	switch kind {
+	case "diurnal":
+		n, key = 24, func(t time.Time) int { return t.Hour() }
+	case "seasonal":
+		n, key = 12, func(t time.Time) int { return int(t.Month()) - 1 }
+	default:
+		return nil, fmt.Errorf("unknown cycle %q: should be diurnal or seasonal", kind)
+	}
+	if tz != "auto" && tz != "lon" && tz != "tz" {
+		return nil, fmt.Errorf("unknown local time option %q: should be auto, lon or tz", tz)
+	}
+	sums := make([]cyclePoint, n)
+	for _, p := range pairs {
+		if !p.hasStation() {
+			continue
+		}
+		t, ok := localTime(p, tz)
+		if !ok {
+			continue
+		}
+		k := key(t)
+		sums[k].obs += p.y
+		sums[k].sim += p.x
+		sums[k].n++
+	}
+	var points []cyclePoint
+	for i, s := range sums {
+		if s.n == 0 {
+			continue
+		}
+		key := i
+		if kind == "seasonal" {
+			key++
+		}
+		points = append(points, cyclePoint{key: key, obs: s.obs / float64(s.n), sim: s.sim / float64(s.n), n: s.n})
+	}
+	return points, nil
+}
+
+// plotCycle plots the measured and simulated cycles.
+func plotCycle(title, kind string, points []cyclePoint) (*plot.Plot, error) {
+	p, err := plot.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not create plot: %v", err)
+	}
+	p.Title.Text = title
+	p.Y.Label.Text = "PM2.5 (μg/m³)"
+	if kind == "diurnal" {
+		p.X.Label.Text = "Local hour"
+		p.X.Min, p.X.Max = 0, 23
+		var ticks []plot.Tick
+		for h := 0; h < 24; h += 3 {
+			ticks = append(ticks, plot.Tick{Value: float64(h), Label: fmt.Sprint(h)})
+		}
+		p.X.Tick.Marker = plot.ConstantTicks(ticks)
+	} else {
+		p.X.Label.Text = "Month"
+		p.X.Min, p.X.Max = 1, 12
+		var ticks []plot.Tick
+		for m := 1; m <= 12; m++ {
+			ticks = append(ticks, plot.Tick{Value: float64(m), Label: time.Month(m).String()[:1]})
+		}
+		p.X.Tick.Marker = plot.ConstantTicks(ticks)
+	}
+	if len(points) == 0 {
+		return p, nil
+	}
+
+	obs := make(plotter.XYs, len(points))
+	sim := make(plotter.XYs, len(points))
+	for i, cp := range points {
+		obs[i] = plotter.XY{X: float64(cp.key), Y: cp.obs}
+		sim[i] = plotter.XY{X: float64(cp.key), Y: cp.sim}
+	}
+	for _, l := range []struct {
+		name string
+		xys  plotter.XYs
+		clr  color.Color
+	}{
+		{"Measured", obs, color.Black},
+		{"Simulated", sim, color.RGBA{R: 200, A: 255}},
+	} {
+		line, pts, err := plotter.NewLinePoints(l.xys)
+		if err != nil {
+			return nil, fmt.Errorf("could not create new line: %v", err)
+		}
+		line.Color = l.clr
+		pts.Color = l.clr
+		pts.Radius = vg.Points(2)
+		p.Add(line, pts)
+		p.Legend.Add(l.name, line, pts)
+	}
+	p.Legend.Top = true
+	return p, nil
+}
+
+// plotTiles draws the plots in a grid with cols columns.
+func plotTiles(plots []*plot.Plot, cols int) ([][]*plot.Plot, draw.Tiles) {
+	rows := (len(plots) + cols - 1) / cols
+	grid := make([][]*plot.Plot, rows)
+	for i := range grid {
+		grid[i] = make([]*plot.Plot, cols)
+		for j := range grid[i] {
+			if k := i*cols + j; k < len(plots) {
+				grid[i][j] = plots[k]
+			}
+		}
+	}
+	t := draw.Tiles{
+		Rows: rows, Cols: cols,
+		PadX: vg.Millimeter * 4, PadY: vg.Millimeter * 4,
+		PadTop: vg.Millimeter * 2, PadBottom: vg.Millimeter * 2,
+		PadLeft: vg.Millimeter * 2, PadRight: vg.Millimeter * 2,
+	}
+	return grid, t
+}
+
+// cycleCmd is the "cycle" mode, which plots the composite diurnal or
+// seasonal cycle for every group, e.g. every region.
+func cycleCmd(args []string) error {
+	fs := flag.NewFlagSet("cycle", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	kind := fs.String("kind", "diurnal", "cycle: diurnal or seasonal")
+	tz := fs.String("tz", "auto", "local time from the measurement UTC offset (tz), the station longitude (lon), or the offset if known and otherwise the longitude (auto)")
+	by := fs.String("by", "all", "grouping: all, country, region, month, season, class or bin")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	classFile := fs.String("classes", "", "csv file of location,class for each station")
+	bins := fs.String("bins", "0,10,25,50,100,1000", "concentration bin edges")
+	outFile := fs.String("out", "cycle.pdf", "output file")
+	fig := figFlags(fs)
+	fs.Parse(args)
+
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, *classFile, *bins)
+	if err != nil {
+		return err
+	}
+	if len(groupers) != 1 {
+		return fmt.Errorf("cycle: a single grouping is needed, not %q", *by)
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	return cycleFigure(*outFile, pairs, groupers[0], *kind, *tz, *fig)
+}
+
+// cycleFigure plots the cycle for every group of the pairs, in a grid of
+// panels.
+func cycleFigure(path string, pairs []pair, g grouper, kind, tz string, fig figOptions) error {
+	keys, groups := groupPairs(pairs, g)
+	if len(keys) == 0 {
+		return fmt.Errorf("cycle: there is nothing to plot")
+	}
+	plots := make([]*plot.Plot, len(keys))
+	for i, k := range keys {
+		points, err := cycle(groups[k], kind, tz)
+		if err != nil {
+			return err
+		}
+		if plots[i], err = plotCycle(k, kind, points); err != nil {
+			return err
+		}
+		fig.applyFonts(plots[i])
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(len(plots)))))
+	grid, t := plotTiles(plots, cols)
+	w := vg.Length(cols) * 4 * vg.Inch
+	h := vg.Length(len(grid)) * 3 * vg.Inch
+	return fig.save(path, w, h, func(dc draw.Canvas) {
+		canvases := plot.Align(grid, t, dc)
+		for i := range grid {
+			for j, p := range grid[i] {
+				if p != nil {
+					p.Draw(canvases[i][j])
+				}
+			}
+		}
+	})
+}
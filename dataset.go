@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                          SELECTING PAIRED RESULTS
+// *************************************************************************
+// *************************************************************************
+
+// datasetOptions selects the paired result files to read from a folder.
+type datasetOptions struct {
+	folder string
+	// pattern is a glob pattern (as in filepath.Match) for the file names,
+	// e.g. "201506*.csv". If it is empty, the daily files of the pairing
+	// are read, and not the other csv files that the modes write, such as
+	// cells.csv.
+	pattern string
+	// from and to are the first and last dates of the files to read,
+	// from the file names (20060102.csv as written by main, or
+	// 2006-01-02.csv). Zero times don't limit the range.
+	from, to time.Time
+}
+
+// datasetFlags adds the flags for selecting the paired results to fs. The
+// returned function checks the flags once they are parsed.
+func datasetFlags(fs *flag.FlagSet) func() (datasetOptions, error) {
+	folder := fs.String("pairs", defaultOutputFolder, "folder of paired results")
+	pattern := fs.String("pattern", "", "pattern of the paired result file names, e.g. 201506*.csv (default: the daily files, 20060102.csv or 2006-01-02.csv)")
+	from := fs.String("from", "", "first date of the paired result files to read, as 2006-01-02")
+	to := fs.String("to", "", "last date of the paired result files to read, as 2006-01-02")
+	return func() (datasetOptions, error) {
+		opts := datasetOptions{folder: *folder, pattern: *pattern}
+		if _, err := filepath.Match(opts.pattern, ""); err != nil {
+			return opts, fmt.Errorf("bad file pattern %q: %v", opts.pattern, err)
+		}
+		var err error
+		if *from != "" {
+			if opts.from, err = time.Parse("2006-01-02", *from); err != nil {
+				return opts, fmt.Errorf("bad -from date: %v", err)
+			}
+		}
+		if *to != "" {
+			if opts.to, err = time.Parse("2006-01-02", *to); err != nil {
+				return opts, fmt.Errorf("bad -to date: %v", err)
+			}
+		}
+		return opts, nil
+	}
+}
+
+// fileDate returns the date in a file name such as 20150601.csv or
+// 2015-06-01.csv.
+func fileDate(path string) (time.Time, bool) {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, layout := range []string{"20060102", "2006-01-02"} {
+		if t, err := time.Parse(layout, name); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// files returns the sorted paths of the files in the folder and its
+// subfolders that match the options. Files without a date in their name
+// are only read if no date range is given.
+func (opts datasetOptions) files() ([]string, error) {
+	pattern := opts.pattern
+	if pattern == "" {
+		pattern = "*.csv"
+	}
+	var paths []string
+	err := filepath.Walk(opts.folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if ok, _ := filepath.Match(pattern, info.Name()); !ok {
+			return nil
+		}
+		if _, ok := fileDate(path); !ok && opts.pattern == "" {
+			return nil
+		}
+		if !opts.from.IsZero() || !opts.to.IsZero() {
+			t, ok := fileDate(path)
+			if !ok || (!opts.from.IsZero() && t.Before(opts.from)) || (!opts.to.IsZero() && t.After(opts.to)) {
+				return nil
+			}
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing the files in %s isn't working: %v", opts.folder, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("there are no files matching %s in %s for the dates selected", opts.describePattern(), opts.folder)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// describePattern describes the file names that are read.
+func (opts datasetOptions) describePattern() string {
+	if opts.pattern == "" {
+		return "the daily files (20060102.csv or 2006-01-02.csv)"
+	}
+	return fmt.Sprintf("%q", opts.pattern)
+}
+
+// readDataConcat reads the simulated and measured values from every
+// selected file of paired results.
+func readDataConcat(opts datasetOptions) ([]xy, error) {
+	pairs, err := readPairs(opts)
+	if err != nil {
+		return nil, err
+	}
+	return pairXYs(pairs), nil
+}
+
+// concatCmd is the "concat" mode, which writes the selected paired
+// results to a single csv file.
+func concatCmd(args []string) error {
+	fs := flag.NewFlagSet("concat", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	outFile := fs.String("out", "concatResults.csv", "output file")
+	xyOnly := fs.Bool("xy", false, "only write the simulated and measured values")
+	fs.Parse(args)
+
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	if *xyOnly {
+		return writeDataConcat(*outFile, pairXYs(pairs))
+	}
+	var tWrt []XY
+	for _, p := range pairs {
+		tWrt = append(tWrt, pairRecord(p))
+	}
+	return csvWriter(*outFile, tWrt)
+}
+
+// provenanceFile is written by the pair mode next to the paired results,
+// with the command and every flag of the pairing, so that the report can
+// show where the observations and model output came from. It isn't a csv
+// file, so it isn't read as paired results.
+const provenanceFile = "pairing.txt"
+
+// writeProvenance writes the command and the flags of fs, with their
+// values or defaults, to the provenance file in folder, a tab separated
+// name and value on each line.
+func writeProvenance(folder string, fs *flag.FlagSet) error {
+	lines := []string{"command\t" + strings.Join(os.Args, " ")}
+	fs.VisitAll(func(f *flag.Flag) {
+		lines = append(lines, "-"+f.Name+"\t"+f.Value.String())
+	})
+	return os.WriteFile(filepath.Join(folder, provenanceFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// provenance is the pairing recorded in a provenance file.
+type provenance struct {
+	folder  string
+	command string
+	flags   [][2]string // name and value, in the order written
+}
+
+// readProvenance reads the provenance files in the folder of the paired
+// results and its subfolders.
+func readProvenance(folder string) ([]provenance, error) {
+	var out []provenance
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != provenanceFile {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		p := provenance{folder: filepath.Dir(path)}
+		for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			kv := strings.SplitN(line, "\t", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%s: %q isn't a name and a value", path, line)
+			}
+			if kv[0] == "command" {
+				p.command = kv[1]
+				continue
+			}
+			p.flags = append(p.flags, [2]string{kv[0], kv[1]})
+		}
+		out = append(out, p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading the pairing provenance in %s isn't working: %v", folder, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProvenance(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "run2")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []string{dir, sub} {
+		fs := flag.NewFlagSet("pair", flag.ContinueOnError)
+		fs.String("obs", "csv", "")
+		fs.String("ncf", "", "")
+		if err := fs.Parse([]string{"-ncf", folder + "/model"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeProvenance(folder, fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prov, err := readProvenance(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prov) != 2 {
+		t.Fatalf("there are %d provenance files, not 2", len(prov))
+	}
+	for i, folder := range []string{dir, sub} {
+		want := [][2]string{{"-ncf", folder + "/model"}, {"-obs", "csv"}}
+		if prov[i].folder != folder || prov[i].command == "" || !reflect.DeepEqual(prov[i].flags, want) {
+			t.Errorf("the pairing of %s is %+v, not with the flags %v", folder, prov[i], want)
+		}
+	}
+}
+
+func TestDatasetFiles(t *testing.T) {
+	// The daily files of a pairing, with the outputs of other modes and a
+	// provenance file next to them.
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "run2")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"20151120.csv", "20151121.csv", "cells.csv", "stratified.csv", "concatResults.csv", "2015_stats.csv", "pairing.txt", "run2/2015-11-22.csv", "run2/speciated.csv"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("1,2\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := func(opts datasetOptions) []string {
+		paths, err := opts.files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, p := range paths {
+			paths[i], _ = filepath.Rel(dir, p)
+		}
+		return paths
+	}
+	if got, want := files(datasetOptions{folder: dir}), []string{"20151120.csv", "20151121.csv", "run2/2015-11-22.csv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the daily files are %v, not %v", got, want)
+	}
+	if got, want := files(datasetOptions{folder: dir, pattern: "*.csv"}), 8; len(got) != want {
+		t.Errorf("*.csv matches %v, not %d files", got, want)
+	}
+	from := time.Date(2015, 11, 21, 0, 0, 0, 0, time.UTC)
+	if got, want := files(datasetOptions{folder: dir, from: from}), []string{"20151121.csv", "run2/2015-11-22.csv"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the files from 2015-11-21 are %v, not %v", got, want)
+	}
+	if _, err := (datasetOptions{folder: sub, pattern: "2014*.csv"}).files(); err == nil {
+		t.Error("a pattern matching no files should be an error")
+	}
+}
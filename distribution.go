@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/color"
+	"math"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                  QUANTILE-QUANTILE AND DISTRIBUTION PLOTS
+// *************************************************************************
+// *************************************************************************
+
+// quantiles returns the simulated and measured values at the percentiles
+// ps of the data.
+func quantiles(Data []xy, ps []float64) (sim, obs []float64, err error) {
+	sumW, err := checkData(Data, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := sortedValues(Data, nil, true)
+	o := sortedValues(Data, nil, false)
+	sim, obs = make([]float64, len(ps)), make([]float64, len(ps))
+	for i, p := range ps {
+		sim[i] = weightedPercentile(m, sumW, p)
+		obs[i] = weightedPercentile(o, sumW, p)
+	}
+	return sim, obs, nil
+}
+
+// percentileSteps returns the percentiles from 0 to 100 in steps of step.
+func percentileSteps(step float64) []float64 {
+	var ps []float64
+	for p := 0.0; p <= 100; p += step {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// qqPlot plots the quantiles of the simulated values against the
+// quantiles of the measured values, with a 1:1 line. The 50th, 90th and
+// 98th percentiles are marked.
+func qqPlot(title string, Data []xy) (*plot.Plot, error) {
+	p, err := plot.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not create plot: %v", err)
+	}
+	p.Title.Text = title
+	p.X.Label.Text = "Simulated PM2.5 quantile (μg/m³)"
+	p.Y.Label.Text = "Measured PM2.5 quantile (μg/m³)"
+	if len(Data) == 0 {
+		return p, nil
+	}
+
+	sim, obs, err := quantiles(Data, percentileSteps(1))
+	if err != nil {
+		return nil, err
+	}
+	qs := make(plotter.XYs, len(sim))
+	hi := 0.0
+	for i := range sim {
+		qs[i] = plotter.XY{X: sim[i], Y: obs[i]}
+		hi = math.Max(hi, math.Max(sim[i], obs[i]))
+	}
+	lo := math.Min(0, math.Min(sim[0], obs[0]))
+
+	oneToOne, err := plotter.NewLine(plotter.XYs{{X: lo, Y: lo}, {X: hi, Y: hi}})
+	if err != nil {
+		return nil, fmt.Errorf("could not create new line: %v", err)
+	}
+	oneToOne.Color = color.Gray{Y: 100}
+	p.Add(oneToOne)
+	p.Legend.Add("1:1", oneToOne)
+
+	line, pts, err := plotter.NewLinePoints(qs)
+	if err != nil {
+		return nil, fmt.Errorf("could not create new line: %v", err)
+	}
+	line.Color = color.RGBA{R: 200, A: 255}
+	pts.Color = line.Color
+	pts.Radius = vg.Points(1)
+	p.Add(line, pts)
+	p.Legend.Add("Percentiles 0-100", line, pts)
+
+	marked := []float64{50, 90, 98}
+	msim, mobs, err := quantiles(Data, marked)
+	if err != nil {
+		return nil, err
+	}
+	for i, pc := range marked {
+		s, err := plotter.NewScatter(plotter.XYs{{X: msim[i], Y: mobs[i]}})
+		if err != nil {
+			return nil, fmt.Errorf("could not create scatter: %v", err)
+		}
+		s.GlyphStyle = draw.GlyphStyle{Color: color.Black, Radius: vg.Points(3.5), Shape: markerShapes[i]}
+		p.Add(s)
+		p.Legend.Add(fmt.Sprintf("%gth percentile", pc), s)
+	}
+	p.Legend.Top = true
+	p.Legend.Left = true
+	p.X.Min, p.X.Max = lo, hi
+	p.Y.Min, p.Y.Max = lo, hi
+	return p, nil
+}
+
+var markerShapes = []draw.GlyphDrawer{draw.CircleGlyph{}, draw.SquareGlyph{}, draw.TriangleGlyph{}}
+
+// cdfPlot overlays the empirical cumulative distributions of the measured
+// and simulated values.
+func cdfPlot(title string, Data []xy) (*plot.Plot, error) {
+	p, err := plot.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not create plot: %v", err)
+	}
+	p.Title.Text = title
+	p.X.Label.Text = "PM2.5 (μg/m³)"
+	p.Y.Label.Text = "Cumulative fraction"
+	p.Y.Min, p.Y.Max = 0, 1
+	if len(Data) == 0 {
+		return p, nil
+	}
+
+	ps := percentileSteps(0.5)
+	sim, obs, err := quantiles(Data, ps)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range []struct {
+		name string
+		vals []float64
+		clr  color.Color
+	}{
+		{"Measured", obs, color.Black},
+		{"Simulated", sim, color.RGBA{R: 200, A: 255}},
+	} {
+		xys := make(plotter.XYs, len(ps))
+		for i, pc := range ps {
+			xys[i] = plotter.XY{X: l.vals[i], Y: pc / 100}
+		}
+		line, err := plotter.NewLine(xys)
+		if err != nil {
+			return nil, fmt.Errorf("could not create new line: %v", err)
+		}
+		line.Color = l.clr
+		line.Width = vg.Points(1)
+		p.Add(line)
+		p.Legend.Add(l.name, line)
+	}
+	ks, err := ksStatistic(Data)
+	if err == nil {
+		p.Legend.Add(fmt.Sprintf("KS = %.3f", ks))
+	}
+	return p, nil
+}
+
+// distributionFigure plots the Q-Q plot ("qq") or the cumulative
+// distributions ("cdf") for every group of the pairs, in a grid of panels.
+func distributionFigure(path string, pairs []pair, g grouper, kind string, fig figOptions) error {
+	var plotFn func(title string, Data []xy) (*plot.Plot, error)
+	switch kind {
+	case "qq":
+		plotFn = qqPlot
+	case "cdf":
+		plotFn = cdfPlot
+	default:
+		return fmt.Errorf("unknown distribution plot %q: should be qq or cdf", kind)
+	}
+	keys, groups := groupPairs(pairs, g)
+	if len(keys) == 0 {
+		return fmt.Errorf("dist: there is nothing to plot")
+	}
+	plots := make([]*plot.Plot, len(keys))
+	for i, k := range keys {
+		var err error
+		if plots[i], err = plotFn(k, pairXYs(groups[k])); err != nil {
+			return err
+		}
+		fig.applyFonts(plots[i])
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(len(plots)))))
+	grid, t := plotTiles(plots, cols)
+	w := vg.Length(cols) * 4 * vg.Inch
+	h := vg.Length(len(grid)) * 4 * vg.Inch
+	return fig.save(path, w, h, func(dc draw.Canvas) {
+		canvases := plot.Align(grid, t, dc)
+		for i := range grid {
+			for j, p := range grid[i] {
+				if p != nil {
+					p.Draw(canvases[i][j])
+				}
+			}
+		}
+	})
+}
+
+// distCmd is the "dist" mode, which plots the distributions of the
+// measured and simulated values for every group, e.g. every region.
+func distCmd(args []string) error {
+	fs := flag.NewFlagSet("dist", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	kind := fs.String("kind", "qq", "plot: qq (quantile-quantile) or cdf (cumulative distributions)")
+	by := fs.String("by", "all", "grouping: all, country, region, month, season, hour (local), utchour, class or bin")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	classFile := fs.String("classes", "", "csv file of location,class for each station")
+	bins := fs.String("bins", "0,10,25,50,100,1000", "concentration bin edges")
+	outFile := fs.String("out", "dist.pdf", "output file")
+	fig := figFlags(fs)
+	fs.Parse(args)
+
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, *classFile, *bins)
+	if err != nil {
+		return err
+	}
+	if len(groupers) != 1 {
+		return fmt.Errorf("dist: a single grouping is needed, not %q", *by)
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	return distributionFigure(*outFile, pairs, groupers[0], *kind, *fig)
+}
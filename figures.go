@@ -0,0 +1,289 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                      FIGURE FORMATS AND BATCH MODE
+// *************************************************************************
+// *************************************************************************
+
+// figOptions are the output settings shared by every plot type. Zero
+// values mean the default for the plot type.
+type figOptions struct {
+	// format is one of pdf, png, svg, eps, jpg or tiff. If it is empty the
+	// format is taken from the file extension.
+	format        string
+	width, height vg.Length
+	dpi           int       // resolution of png, jpg and tiff images
+	fontSize      vg.Length // size of the axis labels and legend text
+}
+
+// figFlags adds the figure option flags to fs.
+func figFlags(fs *flag.FlagSet) *figOptions {
+	fig := &figOptions{}
+	fs.StringVar(&fig.format, "format", "", "output format: pdf, png, svg, eps, jpg or tiff (default from the file extension)")
+	fs.Var(lengthFlag{&fig.width}, "width", "figure width, e.g. 6in or 15cm (default depends on the plot)")
+	fs.Var(lengthFlag{&fig.height}, "height", "figure height, e.g. 6in or 15cm (default depends on the plot)")
+	fs.IntVar(&fig.dpi, "dpi", 300, "resolution of png, jpg and tiff images")
+	fs.Var(lengthFlag{&fig.fontSize}, "fontsize", "font size of the labels, e.g. 12pt (default depends on the plot)")
+	return fig
+}
+
+// lengthFlag is a flag.Value for a vg.Length with a unit: pt, in, cm or mm.
+// A number without a unit is in points.
+type lengthFlag struct{ l *vg.Length }
+
+func (f lengthFlag) String() string {
+	if f.l == nil || *f.l == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%gpt", f.l.Points())
+}
+
+func (f lengthFlag) Set(s string) error {
+	units := []struct {
+		suffix string
+		unit   vg.Length
+	}{{"pt", vg.Inch / 72}, {"in", vg.Inch}, {"cm", vg.Centimeter}, {"mm", vg.Millimeter}}
+	unit := vg.Inch / 72
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.unit
+			break
+		}
+	}
+	var v float64
+	if _, err := fmt.Sscanf(s, "%g", &v); err != nil {
+		return fmt.Errorf("%q isn't a length: %v", s, err)
+	}
+	*f.l = vg.Length(v) * unit
+	return nil
+}
+
+// path returns path with the extension changed to the figure format, if
+// one was chosen.
+func (fig figOptions) path(path string) string {
+	if fig.format == "" {
+		return path
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "." + fig.format
+}
+
+// size returns the figure size, with the default for the plot type where
+// it wasn't set.
+func (fig figOptions) size(defW, defH vg.Length) (w, h vg.Length) {
+	w, h = fig.width, fig.height
+	if w == 0 {
+		w = defW
+	}
+	if h == 0 {
+		h = defH
+	}
+	return w, h
+}
+
+// applyFonts sets the font sizes of p, with the title a little larger and
+// the tick labels a little smaller than the other labels.
+func (fig figOptions) applyFonts(p *plot.Plot) {
+	if fig.fontSize <= 0 {
+		return
+	}
+	p.Title.Font.Size = fig.fontSize * 1.2
+	p.X.Label.Font.Size = fig.fontSize
+	p.Y.Label.Font.Size = fig.fontSize
+	p.X.Tick.Label.Font.Size = fig.fontSize * 0.85
+	p.Y.Tick.Label.Font.Size = fig.fontSize * 0.85
+	p.Legend.TextStyle.Font.Size = fig.fontSize
+}
+
+// canvas returns a canvas to draw the figure on in the format of path.
+func (fig figOptions) canvas(path string, w, h vg.Length) (vg.CanvasWriterTo, error) {
+	format := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	dpi := fig.dpi
+	if dpi <= 0 {
+		dpi = 300
+	}
+	switch format {
+	case "png":
+		return vgimg.PngCanvas{Canvas: vgimg.NewWith(vgimg.UseWH(w, h), vgimg.UseDPI(dpi))}, nil
+	case "jpg", "jpeg":
+		return vgimg.JpegCanvas{Canvas: vgimg.NewWith(vgimg.UseWH(w, h), vgimg.UseDPI(dpi))}, nil
+	case "tif", "tiff":
+		return vgimg.TiffCanvas{Canvas: vgimg.NewWith(vgimg.UseWH(w, h), vgimg.UseDPI(dpi))}, nil
+	case "pdf", "svg", "eps":
+		return draw.NewFormattedCanvas(w, h, format)
+	}
+	return nil, fmt.Errorf("%s: unsupported image format %q", path, format)
+}
+
+// save writes a figure made of one or more plots. drawFn draws the plots
+// on the canvas. defW and defH are the default size for the plot type.
+func (fig figOptions) save(path string, defW, defH vg.Length, drawFn func(dc draw.Canvas)) error {
+	path = fig.path(path)
+	w, h := fig.size(defW, defH)
+	c, err := fig.canvas(path, w, h)
+	if err != nil {
+		return err
+	}
+	drawFn(draw.New(c))
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", path, err)
+	}
+	if _, err := c.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write to %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close %s: %v", path, err)
+	}
+	return nil
+}
+
+// savePlot writes a single plot.
+func (fig figOptions) savePlot(path string, p *plot.Plot, defW, defH vg.Length) error {
+	fig.applyFonts(p)
+	return fig.save(path, defW, defH, p.Draw)
+}
+
+// figuresCmd is the "figures" mode. It renders the full set of figures for
+// the paired results into one directory.
+func figuresCmd(args []string) error {
+	fs := flag.NewFlagSet("figures", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	dir := fs.String("dir", defaultOutputFolder, "directory to write the figures to")
+	regionFile := fs.String("regions", "", "optional GeoJSON file of region polygons, to add figures by region")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	weighting := fs.String("weight", "none", "weighting of the scatter plot statistics: none, station, cell or area")
+	fig := figFlags(fs)
+	fs.Parse(args)
+	if fig.format == "" {
+		fig.format = "pdf"
+	}
+
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	by := "country"
+	if *regionFile != "" {
+		by = "region"
+	}
+	groupers, err := groupersFromFlags(by, *regionFile, *regionName, "", "")
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, r := range renderFigures(*dir, pairs, groupers[0], *weighting, *fig) {
+		if r.err != nil {
+			fmt.Printf("%s: %v\n", r.name, r.err)
+			failed = append(failed, r.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d figures couldn't be made: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// renderedFigure is one figure of the full set, with the error if it
+// couldn't be made.
+type renderedFigure struct {
+	name, title string
+	path        string
+	err         error
+}
+
+// renderFigures writes every plot type for the pairs to dir, with the
+// statistics of the scatter plots weighted by weighting. Figures that can't
+// be made, e.g. because there are too few pairs, are skipped and their
+// errors returned with the others.
+func renderFigures(dir string, pairs []pair, g grouper, weighting string, fig figOptions) []renderedFigure {
+	var figs []renderedFigure
+	add := func(name, title string, save func(path string) error) {
+		path := fig.path(filepath.Join(dir, name+".pdf"))
+		figs = append(figs, renderedFigure{name: name, title: title, path: path, err: save(path)})
+	}
+	scatter := defaultScatterOptions
+	scatter.weighting = weighting
+
+	add("scatter", "Scatter plot", func(path string) error {
+		return plotData(path, pairs, scatter, fig)
+	})
+	add("scatter_log", "Scatter plot, log axes", func(path string) error {
+		opts := scatter
+		opts.logAxes = true
+		return plotData(path, pairs, opts, fig)
+	})
+
+	add("taylor_"+g.name, "Taylor diagram by "+g.name, func(path string) error {
+		points := taylorPoints("model", pairs, allPairs())
+		points = append(points, taylorPoints("model", pairs, g)...)
+		if len(points) == 0 {
+			return fmt.Errorf("there are no groups with enough data")
+		}
+		p, err := taylorDiagram(points)
+		if err != nil {
+			return err
+		}
+		return fig.savePlot(path, p, 6*vg.Inch, 6*vg.Inch)
+	})
+
+	stats := stationStats(pairs)
+	for _, stat := range []string{"nmb", "mb"} {
+		stat := stat
+		add("map_"+stat, "Station "+strings.ToUpper(stat), func(path string) error {
+			return biasMap(path, stats, mapOptions{stat: stat}, fig)
+		})
+	}
+
+	for _, agg := range []string{"day", "month"} {
+		agg := agg
+		add("timeseries_"+agg, "Time series by "+agg, func(path string) error {
+			series, err := timeSeries(pairs, agg)
+			if err != nil {
+				return err
+			}
+			p, err := plotTimeSeries("All stations", series)
+			if err != nil {
+				return err
+			}
+			return fig.savePlot(path, p, 10*vg.Inch, 4*vg.Inch)
+		})
+	}
+
+	for _, c := range []struct{ kind, title string }{{"diurnal", "Diurnal"}, {"seasonal", "Seasonal"}} {
+		kind := c.kind
+		add(kind+"_"+g.name, c.title+" cycle by "+g.name, func(path string) error {
+			return cycleFigure(path, pairs, g, kind, "auto", fig)
+		})
+	}
+
+	for _, c := range []struct{ kind, title string }{{"qq", "Quantile-quantile plots"}, {"cdf", "Cumulative distributions"}} {
+		kind := c.kind
+		add(kind+"_"+g.name, c.title+" by "+g.name, func(path string) error {
+			return distributionFigure(path, pairs, g, kind, fig)
+		})
+	}
+	return figs
+}
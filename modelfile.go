@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bitbucket.org/ctessum/cdf"
+	"bytes"
+	"fmt"
+	"github.com/SumilThakr/aqcomp/regrid"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                              MODEL FILES
+// *************************************************************************
+// *************************************************************************
+
+// modelFile is an opened GEOS-Chem output file. The variables are named
+// as in the netCDF files converted from bpch, e.g. IJ_AVG_S__SO4, with the
+// dimensions (time, lev, lat, lon) or (time, lat, lon).
+type modelFile interface {
+	// Lengths returns the length of each dimension of v, or nil if v isn't
+	// on file.
+	Lengths(v string) []int
+	// Read reads v from start up to end in every dimension, with the last
+	// dimension varying fastest.
+	Read(v string, start, end []int) ([]float32, error)
+	// ReadFloat64 reads v as Read does, but at double precision, which the
+	// times need.
+	ReadFloat64(v string, start, end []int) ([]float64, error)
+	// Units returns the units of v, or "" if they aren't known.
+	Units(v string) string
+	// Close closes the file.
+	Close() error
+}
+
+// openModel opens a GEOS-Chem output file, which is netCDF, netCDF-4 or
+// bpch. The tracers can be read by the names of the bpch diagnostics
+// whatever the model version (see geosChemNames), and a file of a GEOS-Chem
+// 12+ collection is opened with the other collections of the same time.
+// GCHP files are read on their cubed-sphere grid (see cubedSphere).
+func openModel(path string) (modelFile, error) {
+	if strings.HasPrefix(filepath.Base(path), "GEOSChem.") {
+		paths, err := sameTimeCollections(path)
+		if err != nil {
+			return nil, err
+		}
+		return openModelOutput(paths)
+	}
+	return openModelOutput([]string{path})
+}
+
+// openModelOutput opens a GEOS-Chem output file as openModel does, or the
+// files of the collections of the same time as one if there are more than
+// one.
+func openModelOutput(paths []string) (modelFile, error) {
+	var f modelFile
+	var err error
+	if len(paths) == 1 {
+		f, err = openModelFile(paths[0])
+	} else {
+		f, err = openCollections(paths)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cs, err := openCubedSphere(geosChemNames{f})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", paths[0], err)
+	}
+	return cs, nil
+}
+
+// openModelFile opens a single netCDF, netCDF-4 or bpch file.
+func openModelFile(path string) (modelFile, error) {
+	bpch, err := isBpch(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	if bpch {
+		return openBpch(path)
+	}
+	nc4, err := isNetCDF4(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	if nc4 {
+		return openNetCDF4(path)
+	}
+	ff, f, err := openNcf(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ncfModel{ff: ff, f: f}, nil
+}
+
+// byTime calls read for every time index of every job, where times[j]
+// are the indices of job j, in the order of the time index. A netCDF-4
+// file keeps only the last time read of a variable (see nc4Model), so the
+// cells of the stations are read a time at a time rather than a station
+// at a time.
+func byTime(times [][]int, read func(j, t int) error) error {
+	var reads [][2]int
+	for j, ts := range times {
+		for _, t := range ts {
+			reads = append(reads, [2]int{t, j})
+		}
+	}
+	sort.SliceStable(reads, func(a, b int) bool { return reads[a][0] < reads[b][0] })
+	for _, r := range reads {
+		if err := read(r[1], r[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modelPM25 is the simulated PM2.5 in a cell: the PM25 of the model if the
+// file has it, as the AerosolMass collection of GEOS-Chem 12 and later
+// does, or else the PM2.5 computed from the tracers.
+func modelPM25(f modelFile, hour, lat, lon int) (float32, error) {
+	if f.Lengths("PM25") != nil {
+		return varReading(hour, lat, lon, f, "PM25")
+	}
+	m, err := readModelSpecies(f, hour, lat, lon)
+	return m.pm25(), err
+}
+
+// modelGrid returns the grid of the variable v: the cubed sphere of a
+// GCHP file, or the grid of the lat and lon cell centres of the file. A
+// global GEOS-Chem grid is recognised from its centres, so that its polar
+// cells are half as tall as the others.
+func modelGrid(f modelFile, v string) (regrid.Grid, error) {
+	if c, ok := f.(*cubedSphere); ok {
+		return c.grid, nil
+	}
+	dims := f.Lengths(v)
+	if len(dims) < 3 {
+		return nil, fmt.Errorf("%s isn't on file as a gridded variable", v)
+	}
+	nlat, nlon := dims[len(dims)-2], dims[len(dims)-1]
+	centres := func(name string, n int) ([]float64, error) {
+		if d := f.Lengths(name); len(d) != 1 || d[0] != n {
+			return nil, fmt.Errorf("the file has no %s variable of the %d cells of %s", name, n, v)
+		}
+		values, err := f.Read(name, []int{0}, []int{n})
+		if err != nil {
+			return nil, err
+		}
+		out := make([]float64, n)
+		for i, x := range values {
+			out[i] = float64(x)
+		}
+		return out, nil
+	}
+	lat, err := centres("lat", nlat)
+	if err != nil {
+		return nil, err
+	}
+	lon, err := centres("lon", nlon)
+	if err != nil {
+		return nil, err
+	}
+	if nlat > 1 && nlon > 0 {
+		g := regrid.GEOSChem(180/float64(nlat-1), 360/float64(nlon))
+		if g.Len() == nlat*nlon && sameCentres(g, lat, lon) {
+			return g, nil
+		}
+	}
+	return regrid.NewRectilinear(lat, lon)
+}
+
+// sameCentres is whether the cells of g are centred on the lat and lon.
+func sameCentres(g *regrid.Rectilinear, lat, lon []float64) bool {
+	for j := range lat {
+		for i := range lon {
+			x, y := g.Centre(j*len(lon) + i)
+			if math.Abs(x-lon[i]) > 1e-3 || math.Abs(y-lat[j]) > 1e-3 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isBpch is whether the file at path starts with the bpch file type
+// record.
+func isBpch(path string) (bool, error) {
+	ff, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer ff.Close()
+	b := make([]byte, 4+len(bpchFileType))
+	if _, err := io.ReadFull(ff, b); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(b[4:], []byte(bpchFileType)), nil
+}
+
+// ncfModel is a modelFile read from netCDF.
+type ncfModel struct {
+	ff *os.File
+	f  *cdf.File
+}
+
+func (m *ncfModel) Lengths(v string) []int { return m.f.Header.Lengths(v) }
+
+// read reads v from start up to end, in the type it has on file.
+func (m *ncfModel) read(v string, start, end []int) (interface{}, error) {
+	n := 1
+	for i := range start {
+		n *= end[i] - start[i]
+	}
+	r := m.f.Reader(v, start, end)
+	buf := r.Zero(n)
+	if _, err := r.Read(buf); err != nil {
+		return nil, fmt.Errorf("reading %s isn't working: %v", v, err)
+	}
+	return buf, nil
+}
+
+func (m *ncfModel) Read(v string, start, end []int) ([]float32, error) {
+	buf, err := m.read(v, start, end)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := buf.([]float32); ok {
+		return b, nil
+	}
+	values, err := float64s(v, buf)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]float32, len(values))
+	for i, x := range values {
+		out[i] = float32(x)
+	}
+	return out, nil
+}
+
+func (m *ncfModel) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	buf, err := m.read(v, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return float64s(v, buf)
+}
+
+// float64s converts the values of v, as read from a netCDF file, to
+// float64. Integer variables are converted too, as times often are.
+func float64s(v string, buf interface{}) ([]float64, error) {
+	var out []float64
+	switch b := buf.(type) {
+	case []float64:
+		return b, nil
+	case []float32:
+		for _, x := range b {
+			out = append(out, float64(x))
+		}
+	case []int16:
+		for _, x := range b {
+			out = append(out, float64(x))
+		}
+	case []int32:
+		for _, x := range b {
+			out = append(out, float64(x))
+		}
+	case []int64:
+		for _, x := range b {
+			out = append(out, float64(x))
+		}
+	default:
+		return nil, fmt.Errorf("%s is a %T, not a numeric variable", v, buf)
+	}
+	return out, nil
+}
+
+// widen converts values read by Read to float64, for the files that only
+// hold float32 values.
+func widen(values []float32, err error) ([]float64, error) {
+	if err != nil {
+		return nil, err
+	}
+	out := make([]float64, len(values))
+	for i, x := range values {
+		out[i] = float64(x)
+	}
+	return out, nil
+}
+
+func (m *ncfModel) Units(v string) string {
+	switch u := m.f.Header.GetAttribute(v, "units").(type) {
+	case string:
+		return u
+	case []byte:
+		return string(u)
+	}
+	return ""
+}
+
+func (m *ncfModel) Close() error { return m.ff.Close() }
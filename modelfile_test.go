@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/SumilThakr/aqcomp/regrid"
+)
+
+// gridModel is a fakeModel with a variable v on the grid of the lat and
+// lon centres.
+func gridModel(lat, lon []float32) fakeModel {
+	return fakeModel{
+		values: map[string][]float32{"lat": lat, "lon": lon},
+		dims:   map[string][]int{"lat": {len(lat)}, "lon": {len(lon)}, "v": {1, len(lat), len(lon)}},
+	}
+}
+
+func TestModelGrid(t *testing.T) {
+	var lat, lon []float32
+	for j := 0; j < 46; j++ {
+		lat = append(lat, float32(-90+4*j))
+	}
+	lat[0], lat[45] = -89, 89
+	for i := 0; i < 72; i++ {
+		lon = append(lon, float32(-180+5*i))
+	}
+	// The global 4x5 grid has polar cells half as tall as the others.
+	g, err := modelGrid(gridModel(lat, lon), "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := g.(*regrid.Rectilinear)
+	if r.Len() != 46*72 || r.LatEdges[0] != -90 || r.LatEdges[1] != -88 || r.LonEdges[0] != -182.5 {
+		t.Errorf("the 4x5 grid has %d cells and the edges %v..., %v...", r.Len(), r.LatEdges[:2], r.LonEdges[:1])
+	}
+
+	// A regional grid has its edges half way between the centres.
+	g, err = modelGrid(gridModel([]float32{10, 10.5, 11}, []float32{100, 100.625, 101.25, 101.875}), "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = g.(*regrid.Rectilinear)
+	if r.Len() != 12 || math.Abs(r.LatEdges[0]-9.75) > 1e-9 || math.Abs(r.LonEdges[4]-102.1875) > 1e-9 {
+		t.Errorf("the regional grid has %d cells and the edges %v, %v", r.Len(), r.LatEdges, r.LonEdges)
+	}
+
+	// The centres have to be on file for every cell.
+	f := gridModel([]float32{10, 10.5}, []float32{100, 100.625, 101.25, 101.875})
+	f.dims["v"] = []int{1, 3, 4}
+	if _, err := modelGrid(f, "v"); err == nil {
+		t.Error("a grid without all its latitudes should be rejected")
+	}
+	if _, err := modelGrid(f, "lat"); err == nil {
+		t.Error("a variable that isn't gridded should be rejected")
+	}
+}
+
+func TestModelCells(t *testing.T) {
+	// The global 4x5 grid, whose cells are found by their own edges rather
+	// than those of the 2x2.5 grid.
+	var lat, lon []float32
+	for j := 0; j < 46; j++ {
+		lat = append(lat, float32(-90+4*j))
+	}
+	lat[0], lat[45] = -89, 89
+	for i := 0; i < 72; i++ {
+		lon = append(lon, float32(-180+5*i))
+	}
+	f := gridModel(lat, lon)
+	f.dims["PM25"] = f.dims["v"]
+	cells, err := newModelCells(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		lon, lat float64
+		row, col int
+	}{
+		{2.4, 1.9, 23, 36},
+		{-93.26, 44.98, 34, 17},
+		// Near the date line, either side of it, in the cell centred on
+		// 180°W.
+		{179, 0, 22, 0},
+		{-179, 0, 22, 0},
+		{177.4, 0, 22, 71},
+		// The polar cells.
+		{10, 89.9, 45, 38},
+		{-45, -90, 0, 27},
+	} {
+		c, err := cells.find(test.lon, test.lat)
+		if err != nil {
+			t.Errorf("%g, %g: %v", test.lon, test.lat, err)
+			continue
+		}
+		if c.row != test.row || c.col != test.col || c.index != test.row*72+test.col {
+			t.Errorf("%g, %g is in row %d, column %d (cell %d), not %d, %d", test.lon, test.lat, c.row, c.col, c.index, test.row, test.col)
+		}
+	}
+
+	// The cell south of the equator at 180° is 4° by 5°.
+	c, err := cells.find(179, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	area := regrid.EarthRadius * regrid.EarthRadius * 5 * math.Pi / 180 * math.Sin(4*math.Pi/180)
+	if c.lon != -180 || c.lat != -2 || math.Abs(c.area-area) > 1e-6*area {
+		t.Errorf("the cell at 179, 0 is centred on %g, %g with the area %g km², not -180, -2 and %g km²", c.lon, c.lat, c.area, area)
+	}
+	if _, err := cells.find(0, 95); err == nil {
+		t.Error("a latitude past the pole should be rejected")
+	}
+}
+
+func TestByTime(t *testing.T) {
+	// Two daily means and an hourly sample are read a time at a time.
+	var reads [][2]int
+	err := byTime([][]int{{0, 1, 2}, {2}, {0, 1, 2}}, func(j, t int) error {
+		reads = append(reads, [2]int{t, j})
+		return nil
+	})
+	want := [][2]int{{0, 0}, {0, 2}, {1, 0}, {1, 2}, {2, 0}, {2, 1}, {2, 2}}
+	if err != nil || fmt.Sprint(reads) != fmt.Sprint(want) {
+		t.Errorf("the reads are %v (%v), not %v", reads, err, want)
+	}
+}
+
+func TestFloat64s(t *testing.T) {
+	// Integer times, as some files have, are read as well as floats.
+	for _, buf := range []interface{}{[]int32{0, 3600, 7200}, []int64{0, 3600, 7200}, []float32{0, 3600, 7200}, []float64{0, 3600, 7200}} {
+		if v, err := float64s("time", buf); err != nil || fmt.Sprint(v) != "[0 3600 7200]" {
+			t.Errorf("%T is read as %v (%v)", buf, v, err)
+		}
+	}
+	if _, err := float64s("name", []byte("abc")); err == nil {
+		t.Error("a character variable should be rejected")
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                           FINDING MODEL FILES
+// *************************************************************************
+// *************************************************************************
+
+// The GEOS-Chem files in a folder are found from templates of their names,
+// such as GEOSChem.{collection}.%Y%m%d_%H%Mz.nc4. The date fields are as
+// in strftime (%Y, %y, %m, %b, %d, %j, %H, %M and %S, and %% for a %), or
+// a Go time layout as {date:20060102}; {collection} is any GEOS-Chem 12+
+// collection, and the collections of the same time are opened together.
+//
+// A file can hold any number of days, e.g. ts.%Y%m.bpch for monthly files.
+// The days in a file are found from the averaging periods of its outputs:
+// the time_bnds variable if it has one, as the bpch files do, or else the
+// time variable, whose times are the start, middle or end of the periods
+// (-modeltime). A file without a time axis is taken to hold the day, month
+// or year of its name.
+
+// defaultModelNames are the names looked for if -modelname isn't given:
+// netCDF converted from bpch, bpch, and the collections of GEOS-Chem 12 and
+// later. If a day is in more than one file, the file with the most output
+// for the day is read, and of those the one with the first template.
+const defaultModelNames = "ts.%Y%m%d.%H%M%S.nc,ts.%Y%m%d.%H%M%S.bpch,GEOSChem.{collection}.%Y%m%d_%H%Mz.nc4"
+
+// modelNames are the comma separated templates of the model file names. It
+// is set from the flags of each mode, as vertical is.
+var modelNames = defaultModelNames
+
+// modelStamp is where in its averaging period the time of an output is,
+// for files without time bounds: "start", "mid" or "end".
+var modelStamp = "start"
+
+// modelFileFlags adds the flags choosing the model file names and how
+// their times are read to fs.
+func modelFileFlags(fs *flag.FlagSet) {
+	fs.StringVar(&modelNames, "modelname", defaultModelNames, "comma separated templates of the GEOS-Chem file names, with strftime dates such as %Y%m%d, {date:<Go layout>} and {collection}")
+	fs.StringVar(&modelStamp, "modeltime", "start", "where the model output times are in their averaging periods, if the files have no time_bnds: start, mid or end")
+}
+
+// strftime are the Go layouts and patterns of the strftime fields.
+var strftime = map[byte][2]string{
+	'Y': {"2006", `\d{4}`},
+	'y': {"06", `\d{2}`},
+	'm': {"01", `\d{2}`},
+	'b': {"Jan", `[A-Za-z]{3}`},
+	'd': {"02", `\d{2}`},
+	'j': {"002", `\d{3}`},
+	'H': {"15", `\d{2}`},
+	'M': {"04", `\d{2}`},
+	'S': {"05", `\d{2}`},
+}
+
+// modelTemplate is a parsed template of model file names.
+type modelTemplate struct {
+	text string
+	re   *regexp.Regexp
+	// fields are the Go layouts of the date fields, in the order they are
+	// matched, with "" for the collection.
+	fields []string
+	// period is what a file without a time axis holds, from the date
+	// fields: "day", "month" or "year", or "" for names without a date.
+	period string
+}
+
+func parseModelTemplate(text string) (modelTemplate, error) {
+	m := modelTemplate{text: text}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for s := text; s != ""; {
+		switch {
+		case strings.HasPrefix(s, "%%"):
+			pattern.WriteString("%")
+			s = s[2:]
+		case s[0] == '%':
+			if len(s) < 2 {
+				return m, fmt.Errorf("the model file name %q ends with a %%", text)
+			}
+			f, ok := strftime[s[1]]
+			if !ok {
+				return m, fmt.Errorf("the model file name %q has an unknown field %q", text, s[:2])
+			}
+			m.fields = append(m.fields, f[0])
+			pattern.WriteString("(" + f[1] + ")")
+			s = s[2:]
+		case strings.HasPrefix(s, "{collection}"):
+			m.fields = append(m.fields, "")
+			pattern.WriteString("(.+?)")
+			s = s[len("{collection}"):]
+		case strings.HasPrefix(s, "{date:"):
+			end := strings.Index(s, "}")
+			if end < 0 {
+				return m, fmt.Errorf("the model file name %q has an unterminated {date:", text)
+			}
+			layout := s[len("{date:"):end]
+			m.fields = append(m.fields, layout)
+			// The numeric fields of Go layouts are as long as the values.
+			pattern.WriteString(fmt.Sprintf("(.{%d})", len(layout)))
+			s = s[end+1:]
+		default:
+			n := strings.IndexAny(s[1:], "%{") + 1
+			if n == 0 {
+				n = len(s)
+			}
+			pattern.WriteString(regexp.QuoteMeta(s[:n]))
+			s = s[n:]
+		}
+	}
+	pattern.WriteString("$")
+	var err error
+	if m.re, err = regexp.Compile(pattern.String()); err != nil {
+		return m, fmt.Errorf("the model file name %q can't be matched: %v", text, err)
+	}
+	layouts := strings.Join(m.fields, "|")
+	switch {
+	case strings.Contains(layouts, "02"):
+		m.period = "day"
+	case strings.Contains(layouts, "01") || strings.Contains(layouts, "Jan"):
+		m.period = "month"
+	case strings.Contains(layouts, "06"):
+		m.period = "year"
+	}
+	return m, nil
+}
+
+// match returns the date of a file name, if it is named by the template,
+// and the name without its collection, which is the same for the files of
+// the collections of the same time.
+func (m modelTemplate) match(name string) (t time.Time, key string, ok bool) {
+	at := m.re.FindStringSubmatchIndex(name)
+	if at == nil {
+		return t, "", false
+	}
+	key = name
+	var layouts, values []string
+	for i, f := range m.fields {
+		from, to := at[2*i+2], at[2*i+3]
+		if f == "" {
+			key = name[:from] + name[to:]
+			continue
+		}
+		layouts = append(layouts, f)
+		values = append(values, name[from:to])
+	}
+	if len(layouts) == 0 {
+		return t, key, true
+	}
+	t, err := time.Parse(strings.Join(layouts, "|"), strings.Join(values, "|"))
+	return t, key, err == nil
+}
+
+// modelOutput is a model file, or the collections of the same time, with
+// the times of its output.
+type modelOutput struct {
+	paths    []string
+	template int
+	// name is the date in the name, which is zero if there isn't one.
+	name time.Time
+	// start and end are the averaging periods of the outputs, read when
+	// they are first needed. They are nil if the file doesn't have a time
+	// axis.
+	start, end []time.Time
+	loaded     bool
+	err        error
+	period     string
+}
+
+// load reads the time axis of the file.
+func (o *modelOutput) load() error {
+	if o.loaded {
+		return o.err
+	}
+	o.loaded = true
+	f, err := openModelOutput(o.paths)
+	if err != nil {
+		o.err = err
+		return err
+	}
+	defer f.Close()
+	if o.start, o.end, err = modelPeriods(f); err != nil {
+		o.err = fmt.Errorf("%s: %v", o.paths[0], err)
+	}
+	return o.err
+}
+
+// outputs returns the time indices of the output of the day t: those
+// whose averaging periods are centred in the day. Without a time axis, a
+// file named for a day has the eight 3-hour periods of findTime, and the
+// days of a longer file can't be told apart.
+func (o *modelOutput) outputs(t time.Time) ([]int, error) {
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	var out []int
+	if o.start == nil {
+		switch {
+		case o.period == "day" && t.Equal(o.name):
+			for i := 1; i <= 8; i++ {
+				out = append(out, i)
+			}
+		case o.period == "" || o.period != "day" && !t.Before(o.name) && t.Before(o.until()):
+			return nil, fmt.Errorf("%s has no time axis, so the days in it can't be told apart", o.paths[0])
+		}
+		return out, nil
+	}
+	for i := range o.start {
+		if o.day(i).Equal(t) {
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
+
+// day is the day of the middle of the period of output i.
+func (o *modelOutput) day(i int) time.Time {
+	return o.start[i].Add(o.end[i].Sub(o.start[i]) / 2).Truncate(24 * time.Hour)
+}
+
+// until is the end of the period of the name of a file without a time
+// axis.
+func (o *modelOutput) until() time.Time {
+	switch o.period {
+	case "month":
+		return o.name.AddDate(0, 1, 0)
+	case "year":
+		return o.name.AddDate(1, 0, 0)
+	}
+	return o.name.AddDate(0, 0, 1)
+}
+
+// days returns the days with output in the file.
+func (o *modelOutput) days() []time.Time {
+	if o.load() != nil {
+		return nil
+	}
+	if o.start == nil {
+		if o.period == "day" {
+			return []time.Time{o.name}
+		}
+		return nil
+	}
+	var out []time.Time
+	seen := make(map[time.Time]bool)
+	for i := range o.start {
+		if d := o.day(i); !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// has is whether t is one of the days of the file.
+func (o *modelOutput) has(t time.Time) bool {
+	for _, d := range o.days() {
+		if d.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// modelDay is the model output of a day.
+type modelDay struct {
+	date   time.Time
+	output *modelOutput
+	// indices are the time indices of the output of the day.
+	indices []int
+	// err is why the day can't be read, if it can't.
+	err error
+}
+
+// timeIndex returns the time index of the model output whose averaging
+// period contains t, which has to be in the day. Without a time axis, it is
+// the index findTime gives.
+func (d modelDay) timeIndex(t time.Time) (int, error) {
+	if t.Before(d.date) || !t.Before(d.date.AddDate(0, 0, 1)) {
+		return 0, fmt.Errorf("%s isn't on %s, the day of the model output", t.Format(time.RFC3339), d.date.Format("2006-01-02"))
+	}
+	if d.output.start == nil {
+		return findTime(strconv.Itoa(t.Hour()))
+	}
+	for _, i := range d.indices {
+		if !t.Before(d.output.start[i]) && t.Before(d.output.end[i]) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%s has no model output for %s", d.output.paths[0], t.Format(time.RFC3339))
+}
+
+// open opens the file of the day.
+func (d modelDay) open() (modelFile, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return openModelOutput(d.output.paths)
+}
+
+// modelRun is the GEOS-Chem output in a folder.
+type modelRun struct {
+	folder  string
+	outputs []*modelOutput // by the date in their names
+}
+
+// findModelRun finds the files in folder named by the modelNames.
+func findModelRun(folder string) (*modelRun, error) {
+	var templates []modelTemplate
+	for _, text := range strings.Split(modelNames, ",") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		m, err := parseModelTemplate(text)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, m)
+	}
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, fmt.Errorf("the GEOS-Chem folder can't be read: %v", err)
+	}
+	r := &modelRun{folder: folder}
+	// The collections of a file are the files of the same template and
+	// date.
+	byName := make(map[string]*modelOutput)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		for i, m := range templates {
+			t, key, ok := m.match(e.Name())
+			if !ok {
+				continue
+			}
+			key = fmt.Sprintf("%d|%s", i, key)
+			o, ok := byName[key]
+			if !ok {
+				o = &modelOutput{template: i, name: t, period: m.period}
+				byName[key] = o
+				r.outputs = append(r.outputs, o)
+			}
+			o.paths = append(o.paths, filepath.Join(folder, e.Name()))
+			break
+		}
+	}
+	sort.SliceStable(r.outputs, func(i, j int) bool {
+		a, b := r.outputs[i], r.outputs[j]
+		if !a.name.Equal(b.name) {
+			return a.name.Before(b.name)
+		}
+		return a.template < b.template
+	})
+	return r, nil
+}
+
+// day returns the model output of the day t: the file with the most output
+// for the day. Only the files named from a year before the day are
+// searched, unless none of them has it.
+func (r *modelRun) day(t time.Time) modelDay {
+	d := modelDay{date: t}
+	best := func(all bool) {
+		for _, o := range r.outputs {
+			if !all && !o.name.IsZero() && (o.name.After(t.AddDate(0, 0, 1)) || o.name.Before(t.AddDate(-1, 0, 0))) {
+				continue
+			}
+			indices, err := o.outputs(t)
+			if err != nil && d.err == nil {
+				d.err = err
+			}
+			if !o.has(t) {
+				continue
+			}
+			if len(indices) > len(d.indices) || len(indices) == len(d.indices) && len(indices) > 0 && o.template < d.output.template {
+				d.output, d.indices = o, indices
+			}
+		}
+	}
+	best(false)
+	if d.output == nil {
+		best(true)
+	}
+	if d.output == nil {
+		if d.err == nil {
+			d.err = fmt.Errorf("there is no GEOS-Chem output for %s in %s%s", t.Format("2006-01-02"), r.folder, r.coverage())
+		}
+		return d
+	}
+	d.err = nil
+	return d
+}
+
+// coverage describes the days in the files, for the errors about days
+// without output.
+func (r *modelRun) coverage() string {
+	var first, last time.Time
+	for _, o := range r.outputs {
+		for _, d := range o.days() {
+			if first.IsZero() || d.Before(first) {
+				first = d
+			}
+			if d.After(last) {
+				last = d
+			}
+		}
+	}
+	if first.IsZero() {
+		return fmt.Sprintf(": there are no files named %s there", modelNames)
+	}
+	return fmt.Sprintf(": the files named %s there are for %s to %s", modelNames, first.Format("2006-01-02"), last.Format("2006-01-02"))
+}
+
+// modelDays returns the model output of every day from from to to in
+// folder, in date order. Zero times don't limit the range.
+func modelDays(folder string, from, to time.Time) ([]modelDay, error) {
+	r, err := findModelRun(folder)
+	if err != nil {
+		return nil, err
+	}
+	dates := make(map[time.Time]bool)
+	for _, o := range r.outputs {
+		if !o.name.IsZero() && (!from.IsZero() && o.name.Before(from.AddDate(-1, 0, 0)) || !to.IsZero() && o.name.After(to)) {
+			continue
+		}
+		for _, d := range o.days() {
+			if (from.IsZero() || !d.Before(from)) && (to.IsZero() || !d.After(to)) {
+				dates[d] = true
+			}
+		}
+	}
+	var times []time.Time
+	for t := range dates {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	var out []modelDay
+	for _, t := range times {
+		d := r.day(t)
+		if d.err != nil {
+			return nil, d.err
+		}
+		out = append(out, d)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("there are no GEOS-Chem files in %s for the dates selected%s", folder, r.coverage())
+	}
+	return out, nil
+}
+
+// modelPeriods reads the averaging periods of the outputs of a model file,
+// from its time_bnds variable, or from its time variable as set by
+// modelStamp. It returns nil if the file doesn't have a time axis. A single
+// output without bounds is taken to be the mean of a day.
+func modelPeriods(f modelFile) (start, end []time.Time, err error) {
+	dims := f.Lengths("time")
+	if len(dims) != 1 {
+		return nil, nil, nil
+	}
+	units := f.Units("time")
+	if b := f.Lengths("time_bnds"); len(b) == 2 && b[0] == dims[0] && b[1] == 2 {
+		bounds, err := modelTimes(f, "time_bnds", b, units)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := 0; i < len(bounds); i += 2 {
+			start = append(start, bounds[i])
+			end = append(end, bounds[i+1])
+		}
+		return start, end, nil
+	}
+	times, err := modelTimes(f, "time", dims, units)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, end = make([]time.Time, len(times)), make([]time.Time, len(times))
+	for i, t := range times {
+		// The step is to the next output, or from the one before for the
+		// last.
+		step := 24 * time.Hour
+		if i+1 < len(times) {
+			step = times[i+1].Sub(t)
+		} else if i > 0 {
+			step = t.Sub(times[i-1])
+		}
+		switch modelStamp {
+		case "start":
+			start[i], end[i] = t, t.Add(step)
+		case "mid":
+			start[i], end[i] = t.Add(-step/2), t.Add(step/2)
+		case "end":
+			start[i], end[i] = t.Add(-step), t
+		default:
+			return nil, nil, fmt.Errorf("-modeltime should be start, mid or end, not %q", modelStamp)
+		}
+	}
+	return start, end, nil
+}
+
+// modelTimes reads a time variable with units such as "hours since
+// 1985-01-01 00:00:00". The times are read at double precision and
+// rounded to the second.
+func modelTimes(f modelFile, v string, dims []int, units string) ([]time.Time, error) {
+	values, err := f.ReadFloat64(v, make([]int, len(dims)), dims)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(units)
+	if len(fields) < 3 || fields[1] != "since" {
+		return nil, fmt.Errorf("the time units %q aren't as \"hours since 1985-01-01 00:00:00\"", units)
+	}
+	var step time.Duration
+	switch strings.ToLower(fields[0]) {
+	case "seconds", "second", "s":
+		step = time.Second
+	case "minutes", "minute", "min":
+		step = time.Minute
+	case "hours", "hour", "h":
+		step = time.Hour
+	case "days", "day", "d":
+		step = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("the time unit %q isn't known", fields[0])
+	}
+	ref, err := parseTimeOrigin(fields[2:])
+	if err != nil {
+		return nil, err
+	}
+	out := make([]time.Time, len(values))
+	for i, v := range values {
+		d := time.Duration(math.Round(v*float64(step)/float64(time.Second))) * time.Second
+		out[i] = ref.Add(d)
+	}
+	return out, nil
+}
+
+// parseTimeOrigin parses the origin of netCDF time units, which can be
+// written as 1985-1-1 00:00:0.0 or 2015-11-20T00:00:00Z.
+func parseTimeOrigin(fields []string) (time.Time, error) {
+	s := strings.Join(fields, " ")
+	s = strings.TrimSuffix(strings.TrimSuffix(s, " UTC"), "Z")
+	parts := strings.Fields(strings.Replace(s, "T", " ", 1))
+	date, err := time.Parse("2006-1-2", parts[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the time origin %q can't be read: %v", s, err)
+	}
+	if len(parts) > 1 {
+		for i, x := range strings.Split(parts[1], ":") {
+			v, err := strconv.ParseFloat(x, 64)
+			if err != nil || i > 2 {
+				return time.Time{}, fmt.Errorf("the time origin %q can't be read", s)
+			}
+			date = date.Add(time.Duration(v * float64([]time.Duration{time.Hour, time.Minute, time.Second}[i])))
+		}
+	}
+	return date, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestModelTemplate(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, test := range []struct {
+		template, name string
+		ok             bool
+		date           time.Time
+		key            string
+		period         string
+	}{
+		{"ts.%Y%m%d.%H%M%S.nc", "ts.20151120.000000.nc", true, date("2015-11-20 00:00"), "ts.20151120.000000.nc", "day"},
+		{"ts.%Y%m%d.%H%M%S.nc", "ts.20151120.000000.bpch", false, time.Time{}, "", "day"},
+		{"ts.%Y%m%d.%H%M%S.nc", "ts.2015112.000000.nc", false, time.Time{}, "", "day"},
+		{"GEOSChem.{collection}.%Y%m%d_%H%Mz.nc4", "GEOSChem.SpeciesConc.20151120_0130z.nc4", true, date("2015-11-20 01:30"), "GEOSChem..20151120_0130z.nc4", "day"},
+		{"GEOSChem.{collection}.%Y%m%d_%H%Mz.nc4", "GEOSChem.AerosolMass.20151120_0130z.nc4", true, date("2015-11-20 01:30"), "GEOSChem..20151120_0130z.nc4", "day"},
+		{"ts.%Y%m.bpch", "ts.201511.bpch", true, date("2015-11-01 00:00"), "ts.201511.bpch", "month"},
+		{"ts.{date:200601}.bpch", "ts.201511.bpch", true, date("2015-11-01 00:00"), "ts.201511.bpch", "month"},
+		{"run_%y_%j.nc", "run_15_324.nc", true, date("2015-11-20 00:00"), "run_15_324.nc", "day"},
+		{"run_%b%Y.nc", "run_Nov2015.nc", true, date("2015-11-01 00:00"), "run_Nov2015.nc", "month"},
+		{"annual.%Y.nc", "annual.2015.nc", true, date("2015-01-01 00:00"), "annual.2015.nc", "year"},
+		{"100%%_{collection}.nc", "100%_PM.nc", true, time.Time{}, "100%_.nc", ""},
+	} {
+		m, err := parseModelTemplate(test.template)
+		if err != nil {
+			t.Errorf("%s: %v", test.template, err)
+			continue
+		}
+		if m.period != test.period {
+			t.Errorf("%s holds a %q, not a %q", test.template, m.period, test.period)
+		}
+		d, key, ok := m.match(test.name)
+		if ok != test.ok {
+			t.Errorf("%s matching %s is %v, not %v", test.template, test.name, ok, test.ok)
+			continue
+		}
+		if ok && (!d.Equal(test.date) || key != test.key) {
+			t.Errorf("%s matching %s gives %v and %q, not %v and %q", test.template, test.name, d, key, test.date, test.key)
+		}
+	}
+	for _, bad := range []string{"ts.%Q.nc", "ts.%", "ts.{date:2006.nc"} {
+		if _, err := parseModelTemplate(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestDayOutputsWithoutTimeAxis(t *testing.T) {
+	day := time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)
+	o := &modelOutput{paths: []string{"ts.20151120.000000.nc"}, name: day, period: "day", loaded: true}
+	got, err := o.outputs(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every index findTime gives for the hours of the day, once each.
+	var want []int
+	seen := make(map[int]bool)
+	for h := 0; h <= 24; h++ {
+		i, err := findTime(strconv.Itoa(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !seen[i] {
+			seen[i] = true
+			want = append(want, i)
+		}
+	}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(got, []int{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("the outputs of the day are %v, not %v", got, want)
+	}
+	if got, _ := o.outputs(day.AddDate(0, 0, 1)); len(got) != 0 {
+		t.Errorf("the file of %v has outputs for the next day: %v", day, got)
+	}
+	monthly := &modelOutput{paths: []string{"ts.201511.nc"}, name: day.AddDate(0, 0, -19), period: "month", loaded: true}
+	if _, err := monthly.outputs(day); err == nil {
+		t.Error("the days of a monthly file without a time axis can't be told apart")
+	}
+}
+
+// fakeModel is a modelFile of variables held in memory. The variables in
+// float64s are held at double precision, as times can be.
+type fakeModel struct {
+	values   map[string][]float32
+	float64s map[string][]float64
+	dims     map[string][]int
+	units    map[string]string
+}
+
+func (f fakeModel) Lengths(v string) []int { return f.dims[v] }
+func (f fakeModel) Units(v string) string  { return f.units[v] }
+func (f fakeModel) Close() error           { return nil }
+
+func (f fakeModel) Read(v string, start, end []int) ([]float32, error) {
+	var out []float32
+	for _, at := range f.indices(v, start, end) {
+		if values, ok := f.float64s[v]; ok {
+			out = append(out, float32(values[at]))
+		} else {
+			out = append(out, f.values[v][at])
+		}
+	}
+	return out, nil
+}
+
+func (f fakeModel) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	var out []float64
+	for _, at := range f.indices(v, start, end) {
+		if values, ok := f.float64s[v]; ok {
+			out = append(out, values[at])
+		} else {
+			out = append(out, float64(f.values[v][at]))
+		}
+	}
+	return out, nil
+}
+
+// indices are the indices in the values of v from start up to end.
+func (f fakeModel) indices(v string, start, end []int) []int {
+	dims := f.dims[v]
+	var out []int
+	var index func(k, at int)
+	index = func(k, at int) {
+		if k == len(dims) {
+			out = append(out, at)
+			return
+		}
+		for i := start[k]; i < end[k]; i++ {
+			index(k+1, at*dims[k]+i)
+		}
+	}
+	index(0, 0)
+	return out
+}
+
+func TestModelPeriods(t *testing.T) {
+	day := time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)
+	at := func(h float64) time.Time { return day.Add(time.Duration(h * float64(time.Hour))) }
+	// 3-hourly times from midnight, in minutes since the day.
+	f := fakeModel{
+		values: map[string][]float32{"time": {0, 180, 360, 540}},
+		dims:   map[string][]int{"time": {4}},
+		units:  map[string]string{"time": "minutes since 2015-11-20 00:00:00 UTC"},
+	}
+	defer func(s string) { modelStamp = s }(modelStamp)
+	for _, test := range []struct {
+		stamp      string
+		start, end time.Time
+	}{
+		{"start", at(0), at(3)},
+		{"mid", at(-1.5), at(1.5)},
+		{"end", at(-3), at(0)},
+	} {
+		modelStamp = test.stamp
+		start, end, err := modelPeriods(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(start) != 4 || !start[0].Equal(test.start) || !end[0].Equal(test.end) || end[3].Sub(start[3]) != 3*time.Hour {
+			t.Errorf("%s: the periods are %v to %v", test.stamp, start, end)
+		}
+	}
+	modelStamp = "sometime"
+	if _, _, err := modelPeriods(f); err == nil {
+		t.Error("an unknown -modeltime should be rejected")
+	}
+
+	// The bounds are used if there are any, whatever -modeltime is.
+	f.values["time_bnds"] = []float32{0, 180, 180, 360, 360, 540, 540, 720}
+	f.dims["time_bnds"] = []int{4, 2}
+	start, end, err := modelPeriods(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !start[1].Equal(at(3)) || !end[1].Equal(at(6)) {
+		t.Errorf("the second period is %v to %v", start[1], end[1])
+	}
+
+	if start, _, err := modelPeriods(fakeModel{}); start != nil || err != nil {
+		t.Errorf("a file without a time axis has the periods %v, %v", start, err)
+	}
+}
+
+func TestModelTimes(t *testing.T) {
+	// Seconds since 1970 and hours since 1985 are too large to be read
+	// to the second as float32.
+	for _, test := range []struct {
+		units string
+		value float64
+		want  time.Time
+	}{
+		{"seconds since 1970-01-01 00:00:00", 1448000017, time.Unix(1448000017, 0).UTC()},
+		{"hours since 1985-01-01 00:00:00", 269257.5, time.Date(2015, 9, 20, 1, 30, 0, 0, time.UTC)},
+		{"hours since 1985-01-01 00:00:00", 269257 + 1/3600.0, time.Date(2015, 9, 20, 1, 0, 1, 0, time.UTC)},
+	} {
+		f := fakeModel{float64s: map[string][]float64{"time": {test.value}}, dims: map[string][]int{"time": {1}}}
+		times, err := modelTimes(f, "time", []int{1}, test.units)
+		if err != nil || len(times) != 1 || !times[0].Equal(test.want) {
+			t.Errorf("%v %s is %v (%v), not %v", test.value, test.units, times, err, test.want)
+		}
+	}
+}
+
+func TestDayTimeIndex(t *testing.T) {
+	day := time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC)
+	at := func(h float64) time.Time { return day.Add(time.Duration(h * float64(time.Hour))) }
+	// A monthly file of 3-hour means, from the 19th to the 22nd with the
+	// 21st missing.
+	o := &modelOutput{paths: []string{"ts.201511.bpch"}, loaded: true}
+	for h := -24.0; h < 72; h += 3 {
+		if h >= 24 && h < 48 {
+			continue
+		}
+		o.start = append(o.start, at(h))
+		o.end = append(o.end, at(h+3))
+	}
+	days := o.days()
+	if len(days) != 3 || !days[1].Equal(day) {
+		t.Fatalf("the days of the file are %v", days)
+	}
+	indices, err := o.outputs(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indices, []int{8, 9, 10, 11, 12, 13, 14, 15}) {
+		t.Fatalf("the outputs of the day are %v", indices)
+	}
+	if gap, _ := o.outputs(day.AddDate(0, 0, 1)); len(gap) != 0 {
+		t.Errorf("the missing day has the outputs %v", gap)
+	}
+	d := modelDay{date: day, output: o, indices: indices}
+	for _, test := range []struct {
+		t    time.Time
+		want int
+		ok   bool
+	}{
+		{at(0), 8, true},
+		{at(2.99), 8, true},
+		{at(3), 9, true},
+		{at(22), 15, true},
+		{at(23.5), 15, true},
+		{at(-0.5), 0, false}, // the day before
+		{at(24), 0, false},   // the day after, which isn't in the file
+		{at(30), 0, false},
+	} {
+		i, err := d.timeIndex(test.t)
+		if (err == nil) != test.ok || test.ok && i != test.want {
+			t.Errorf("the output for %v is %d (%v), not %d", test.t, i, err, test.want)
+		}
+	}
+
+	// Without a time axis, observations of other days aren't paired
+	// either.
+	noAxis := modelDay{date: day, output: &modelOutput{paths: []string{"ts.20151120.000000.nc"}, name: day, period: "day", loaded: true}, indices: []int{1, 2, 3, 4, 5, 6, 7, 8}}
+	if i, err := noAxis.timeIndex(at(1)); err != nil || i != 1 {
+		t.Errorf("the output for 01:00 is %d, %v", i, err)
+	}
+	if _, err := noAxis.timeIndex(at(-1)); err == nil {
+		t.Error("an observation of the day before shouldn't be paired")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/batchatco/go-native-netcdf/netcdf"
+	"github.com/batchatco/go-native-netcdf/netcdf/api"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                    NETCDF-4 AND GEOS-CHEM 12+ OUTPUT
+// *************************************************************************
+// *************************************************************************
+
+// GEOS-Chem 12 and later write netCDF-4 (HDF5) files, such as
+// GEOSChem.SpeciesConc.20151120_0000z.nc4 and
+// GEOSChem.AerosolMass.20151120_0000z.nc4, which the cdf package can't
+// read. They are read with go-native-netcdf, which is pure Go. The
+// tracers are SpeciesConc_SO4 etc. in mol/mol, rather than IJ_AVG_S__SO4
+// in ppbv, and the AerosolMass collection has the PM25 of the model.
+
+// hdf5Signature starts every netCDF-4 file.
+var hdf5Signature = []byte("\x89HDF\r\n\x1a\n")
+
+// isNetCDF4 is whether the file at path is a netCDF-4 (HDF5) file.
+func isNetCDF4(path string) (bool, error) {
+	ff, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer ff.Close()
+	b := make([]byte, len(hdf5Signature))
+	if _, err := io.ReadFull(ff, b); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(b, hdf5Signature), nil
+}
+
+// nc4Model is a modelFile read from netCDF-4. go-native-netcdf reads a
+// variable a slice of its first (time) dimension at a time, so the last
+// slice read of each variable is kept for reading single cells, which are
+// read in the order of the times (see byTime).
+type nc4Model struct {
+	path    string
+	g       api.Group
+	lengths map[string][]int
+	slices  map[string]nc4Slice
+}
+
+type nc4Slice struct {
+	t      int
+	values reflect.Value
+}
+
+func openNetCDF4(path string) (*nc4Model, error) {
+	g, err := netcdf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	return &nc4Model{path: path, g: g, lengths: make(map[string][]int), slices: make(map[string]nc4Slice)}, nil
+}
+
+// slice reads time index t of v, as nested slices without the time
+// dimension.
+func (m *nc4Model) slice(v string, t int) (reflect.Value, error) {
+	if s, ok := m.slices[v]; ok && s.t == t {
+		return s.values, nil
+	}
+	vg, err := m.g.GetVarGetter(v)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("%s isn't in %s: %v", v, m.path, err)
+	}
+	if int64(t) >= vg.Len() {
+		return reflect.Value{}, fmt.Errorf("%s has %d times, so time index %d can't be read", v, vg.Len(), t)
+	}
+	data, err := vg.GetSlice(int64(t), int64(t+1))
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("reading %s from %s isn't working: %v", v, m.path, err)
+	}
+	values := reflect.ValueOf(data)
+	if values.Kind() != reflect.Slice || values.Len() != 1 {
+		return reflect.Value{}, fmt.Errorf("%s in %s isn't an array with a time dimension", v, m.path)
+	}
+	m.slices[v] = nc4Slice{t, values.Index(0)}
+	return values.Index(0), nil
+}
+
+func (m *nc4Model) Lengths(v string) []int {
+	if l, ok := m.lengths[v]; ok {
+		return l
+	}
+	vg, err := m.g.GetVarGetter(v)
+	if err != nil || vg.Len() == 0 {
+		return nil
+	}
+	l := []int{int(vg.Len())}
+	s, err := m.slice(v, 0)
+	if err != nil {
+		return nil
+	}
+	for s.Kind() == reflect.Slice {
+		l = append(l, s.Len())
+		if s.Len() == 0 {
+			break
+		}
+		s = s.Index(0)
+	}
+	m.lengths[v] = l
+	return l
+}
+
+func (m *nc4Model) Read(v string, start, end []int) ([]float32, error) {
+	var out []float32
+	err := m.read(v, start, end, func(x float64) { out = append(out, float32(x)) })
+	return out, err
+}
+
+func (m *nc4Model) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	var out []float64
+	err := m.read(v, start, end, func(x float64) { out = append(out, x) })
+	return out, err
+}
+
+// read calls add with every value of v from start up to end.
+func (m *nc4Model) read(v string, start, end []int, add func(float64)) error {
+	for t := start[0]; t < end[0]; t++ {
+		s, err := m.slice(v, t)
+		if err != nil {
+			return err
+		}
+		if err := eachValue(s, start[1:], end[1:], add); err != nil {
+			return fmt.Errorf("%s in %s: %v", v, m.path, err)
+		}
+	}
+	return nil
+}
+
+// eachValue calls add with the values of nested slices from start up to
+// end in every dimension. Integer values, as of some time variables, are
+// converted too.
+func eachValue(s reflect.Value, start, end []int, add func(float64)) error {
+	if len(start) == 0 {
+		switch s.Kind() {
+		case reflect.Float32, reflect.Float64:
+			add(s.Float())
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+			add(float64(s.Int()))
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+			add(float64(s.Uint()))
+		default:
+			return fmt.Errorf("the values are %v, not numbers", s.Type())
+		}
+		return nil
+	}
+	if s.Kind() != reflect.Slice || end[0] > s.Len() {
+		return fmt.Errorf("can't read from %v to %v", start, end)
+	}
+	for i := start[0]; i < end[0]; i++ {
+		if err := eachValue(s.Index(i), start[1:], end[1:], add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *nc4Model) Units(v string) string {
+	vg, err := m.g.GetVarGetter(v)
+	if err != nil {
+		return ""
+	}
+	u, ok := vg.Attributes().Get("units")
+	if !ok {
+		return ""
+	}
+	return fmt.Sprint(u)
+}
+
+func (m *nc4Model) Close() error {
+	m.g.Close()
+	return nil
+}
+
+// geosChemNames lets the tracers of GEOS-Chem 12 and later be read by the
+// names of the bpch diagnostics used elsewhere: IJ_AVG_S__SO4 is read
+// from SpeciesConc_SO4, in ppbv, if the file doesn't have it.
+type geosChemNames struct {
+	modelFile
+}
+
+// name returns the variable that v is read from, and the factor
+// converting it to the units of v.
+func (g geosChemNames) name(v string) (string, float32) {
+	if g.modelFile.Lengths(v) != nil || !strings.HasPrefix(v, "IJ_AVG_S__") {
+		return v, 1
+	}
+	alt := "SpeciesConc_" + strings.TrimPrefix(v, "IJ_AVG_S__")
+	if g.modelFile.Lengths(alt) == nil {
+		return v, 1
+	}
+	// SpeciesConc is in mol mol-1 dry air.
+	if strings.HasPrefix(strings.ToLower(g.modelFile.Units(alt)), "ppb") {
+		return alt, 1
+	}
+	return alt, 1e9
+}
+
+func (g geosChemNames) Lengths(v string) []int {
+	n, _ := g.name(v)
+	return g.modelFile.Lengths(n)
+}
+
+func (g geosChemNames) Read(v string, start, end []int) ([]float32, error) {
+	n, scale := g.name(v)
+	values, err := g.modelFile.Read(n, start, end)
+	if err != nil || scale == 1 {
+		return values, err
+	}
+	for i := range values {
+		values[i] *= scale
+	}
+	return values, nil
+}
+
+func (g geosChemNames) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	n, scale := g.name(v)
+	values, err := g.modelFile.ReadFloat64(n, start, end)
+	if err != nil || scale == 1 {
+		return values, err
+	}
+	for i := range values {
+		values[i] *= float64(scale)
+	}
+	return values, nil
+}
+
+func (g geosChemNames) Units(v string) string {
+	n, scale := g.name(v)
+	if scale != 1 {
+		return "ppbv"
+	}
+	return g.modelFile.Units(n)
+}
+
+// collections are the files of the GEOS-Chem 12+ collections of the same
+// time, e.g. GEOSChem.SpeciesConc.20151120_0000z.nc4 and
+// GEOSChem.AerosolMass.20151120_0000z.nc4, read as one file. A variable
+// is read from the first file that has it.
+type collections []modelFile
+
+// sameTimeCollections returns path and the files of the other collections
+// of the same time in its folder.
+func sameTimeCollections(path string) ([]string, error) {
+	parts := strings.SplitN(filepath.Base(path), ".", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%s isn't named as a GEOS-Chem collection, GEOSChem.<collection>.<time>.nc4", path)
+	}
+	others, err := filepath.Glob(filepath.Join(filepath.Dir(path), "GEOSChem.*."+parts[2]))
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{path}
+	for _, p := range others {
+		if p != path {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// openCollections opens the files of the collections of the same time.
+func openCollections(paths []string) (collections, error) {
+	var c collections
+	for _, p := range paths {
+		f, err := openModelFile(p)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = append(c, f)
+	}
+	return c, nil
+}
+
+func (c collections) file(v string) modelFile {
+	for _, f := range c {
+		if f.Lengths(v) != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (c collections) Lengths(v string) []int {
+	if f := c.file(v); f != nil {
+		return f.Lengths(v)
+	}
+	return nil
+}
+
+func (c collections) Read(v string, start, end []int) ([]float32, error) {
+	f := c.file(v)
+	if f == nil {
+		return nil, fmt.Errorf("%s isn't in any of the GEOS-Chem collections", v)
+	}
+	return f.Read(v, start, end)
+}
+
+func (c collections) ReadFloat64(v string, start, end []int) ([]float64, error) {
+	f := c.file(v)
+	if f == nil {
+		return nil, fmt.Errorf("%s isn't in any of the GEOS-Chem collections", v)
+	}
+	return f.ReadFloat64(v, start, end)
+}
+
+func (c collections) Units(v string) string {
+	if f := c.file(v); f != nil {
+		return f.Units(v)
+	}
+	return ""
+}
+
+func (c collections) Close() error {
+	var err error
+	for _, f := range c {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                      REGULATORY MONITORING NETWORKS
+// *************************************************************************
+// *************************************************************************
+
+// The monitoring networks publish their data in large files, by year or by
+// hour, rather than by day. The files are streamed once, keeping only the
+// measurements of the parameter in the bounding box and date range, and
+// then handed out a day at a time. The readers are:
+//
+//	aqs      EPA AQS pre-generated hourly_*.csv and daily_*.csv files
+//	airnow   AirNow HourlyData_*.dat files, with the site locations from
+//	         monitoring_site_locations.dat (or its V2 version)
+//	eea      EEA e-reporting (E1a/E2a) csv files from the download service,
+//	         with the station coordinates from the metadata csv
+//	improve  IMPROVE speciated data exported from FED in the long format,
+//	         one row per site, day and parameter
+//
+// Parameters are named as in OpenAQ (pm25, pm10, o3, no2, ...), and the
+// IMPROVE species by their lower case codes without the fine suffix (so4,
+// no3, oc, ec, ...).
+
+// networkSource holds the observations read from a network's files.
+type networkSource struct {
+	name      string
+	patterns  string
+	paths     []string
+	read      func(path string, fn func(observation)) error
+	parameter string
+	bbox      boundingBox
+	days      daysBetween
+	byDay     map[time.Time][]observation
+}
+
+// openNetwork sets up the reader for the network files matching the comma
+// separated glob patterns. sites is the site locations file that AirNow
+// and EEA files need.
+func openNetwork(network, patterns, sites, parameter string, bbox boundingBox, days daysBetween) (*networkSource, error) {
+	s := &networkSource{name: network, patterns: patterns, parameter: parameter, bbox: bbox, days: days}
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		m, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad file pattern %q: %v", p, err)
+		}
+		s.paths = append(s.paths, m...)
+	}
+	if len(s.paths) == 0 {
+		return nil, fmt.Errorf("there are no %s files matching %q (-files)", network, patterns)
+	}
+	sort.Strings(s.paths)
+
+	switch network {
+	case "aqs":
+		s.read = readAQS
+	case "airnow":
+		st, err := readAirNowSites(sites)
+		if err != nil {
+			return nil, err
+		}
+		s.read = st.read
+	case "eea":
+		st, err := readEEAStations(sites)
+		if err != nil {
+			return nil, err
+		}
+		s.read = st.read
+	case "improve":
+		s.read = readIMPROVE
+	default:
+		return nil, fmt.Errorf("unknown network %q", network)
+	}
+	return s, nil
+}
+
+// load reads every file the first time that it is needed.
+func (s *networkSource) load() error {
+	if s.byDay != nil {
+		return nil
+	}
+	byDay := make(map[time.Time][]observation)
+	keep := func(ob observation) {
+		if (s.parameter != "" && ob.parameter != s.parameter) || !s.bbox.contains(ob.lon, ob.lat) {
+			return
+		}
+		day := ob.utc.Truncate(24 * time.Hour)
+		if !s.days.includes(day) {
+			return
+		}
+		byDay[day] = append(byDay[day], ob)
+	}
+	for _, path := range s.paths {
+		fmt.Printf("Reading %s\n", path)
+		if err := s.read(path, keep); err != nil {
+			return fmt.Errorf("reading %s isn't working: %v", path, err)
+		}
+	}
+	s.byDay = byDay
+	return nil
+}
+
+func (s *networkSource) Days() ([]time.Time, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	days := make([]time.Time, 0, len(s.byDay))
+	for t := range s.byDay {
+		days = append(days, t)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+func (s *networkSource) Observations(day time.Time) ([]observation, error) {
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.byDay[day], nil
+}
+
+func (s *networkSource) Path(day time.Time) string {
+	return fmt.Sprintf("%s files %s (%s)", s.name, s.patterns, day.Format("2006-01-02"))
+}
+
+// csvColumns finds the columns of a delimited file by their header names,
+// ignoring case and surrounding spaces.
+type csvColumns map[string]int
+
+// headerReader reads the header of a delimited file, which is the first
+// line that has all the wanted columns, and returns a reader for the rows
+// after it. Files are comma, tab, pipe or semicolon delimited, whichever
+// the header line is split by.
+func headerReader(r io.Reader, want ...string) (*csv.Reader, csvColumns, error) {
+	br := bufio.NewReader(r)
+	for i := 0; i < 200; i++ {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			break
+		}
+		line = strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "\ufeff")
+		delim := ','
+		for _, d := range []rune{'\t', '|', ';'} {
+			if strings.Count(line, string(d)) > strings.Count(line, string(delim)) {
+				delim = d
+			}
+		}
+		cr := csv.NewReader(strings.NewReader(line))
+		cr.Comma = delim
+		header, perr := cr.Read()
+		if perr == nil {
+			cols := make(csvColumns)
+			for i, h := range header {
+				cols[strings.ToLower(strings.TrimSpace(h))] = i
+			}
+			if cols.has(want...) {
+				rows := csv.NewReader(br)
+				rows.Comma = delim
+				rows.FieldsPerRecord = -1
+				rows.LazyQuotes = true
+				return rows, cols, nil
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return nil, nil, fmt.Errorf("there is no header with the columns %s", strings.Join(want, ", "))
+}
+
+func (c csvColumns) has(names ...string) bool {
+	for _, n := range names {
+		if _, ok := c[strings.ToLower(n)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns the field of the first of the named columns that the file
+// has, or "" if it has none of them.
+func (c csvColumns) get(line []string, names ...string) string {
+	for _, n := range names {
+		if i, ok := c[strings.ToLower(n)]; ok && i < len(line) {
+			return strings.TrimSpace(line[i])
+		}
+	}
+	return ""
+}
+
+// float parses the field of the named column.
+func (c csvColumns) float(line []string, name string) (float64, error) {
+	return strconv.ParseFloat(c.get(line, name), 64)
+}
+
+// eachRow calls fn with every row of a file. Rows that can't be parsed, or
+// that fn returns an error for, are counted and skipped.
+func eachRow(path string, rows *csv.Reader, fn func(line []string) error) error {
+	var nBad int
+	var firstErr error
+	for {
+		line, err := rows.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if _, ok := err.(*csv.ParseError); !ok {
+				return err
+			}
+		}
+		if err == nil {
+			err = fn(line)
+		}
+		if err != nil {
+			if nBad == 0 {
+				firstErr = err
+			}
+			nBad++
+		}
+	}
+	if nBad > 0 {
+		fmt.Printf("%s: skipped %d rows that couldn't be read, the first because %v\n", path, nBad, firstErr)
+	}
+	return nil
+}
+
+// midDay returns the middle of a local day, in UTC, with the local time.
+// The time zone isn't given by the daily files, so it is estimated from
+// the longitude.
+func midDay(date time.Time, lon float64) (time.Time, string) {
+	offset := int(math.Round(lon/15)) * 3600
+	local := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.FixedZone("", offset))
+	return local.UTC(), local.Format(time.RFC3339)
+}
+
+// parseDate parses the date formats used by the network files.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "01/02/2006", "1/2/2006", "01/02/06", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q isn't a date", s)
+}
+
+func openFile(path string, fn func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+// *************************************************************************
+// *************************************************************************
+//                                 EPA AQS
+// *************************************************************************
+// *************************************************************************
+
+// aqsParameters names the AQS parameter codes.
+var aqsParameters = map[string]string{
+	"88101": "pm25", // PM2.5 FRM/FEM
+	"88502": "pm25", // PM2.5 non-FRM
+	"81102": "pm10",
+	"44201": "o3",
+	"42602": "no2",
+	"42401": "so2",
+	"42101": "co",
+	// The CSN species in the daily speciation (SPEC) files.
+	"88403": "so4",
+	"88306": "no3",
+	"88301": "nh4",
+	"88305": "oc",
+	"88307": "ec",
+	"88203": "chl",
+	"88104": "al",
+	"88165": "si",
+	"88111": "ca",
+	"88126": "fe",
+	"88161": "ti",
+}
+
+func aqsParameter(code string) string {
+	if p, ok := aqsParameters[code]; ok {
+		return p
+	}
+	return "aqs" + code
+}
+
+// readAQS reads an AQS hourly file (with Sample Measurement and the GMT
+// time of each hour) or daily file (with the Arithmetic Mean of each local
+// day). A daily file has a row for each pollutant standard, so only the
+// first row for each monitor, day and sample duration is kept.
+func readAQS(path string, fn func(observation)) error {
+	return openFile(path, func(r io.Reader) error {
+		rows, cols, err := headerReader(r, "State Code", "County Code", "Site Num", "Parameter Code", "Latitude", "Longitude", "Date Local")
+		if err != nil {
+			return err
+		}
+		hourly := cols.has("Sample Measurement", "Date GMT", "Time GMT", "Time Local")
+		if !hourly && !cols.has("Arithmetic Mean") {
+			return fmt.Errorf("there is neither a Sample Measurement nor an Arithmetic Mean column")
+		}
+		seen := make(map[string]bool)
+		return eachRow(path, rows, func(line []string) error {
+			ob := observation{
+				location:  strings.Join([]string{cols.get(line, "State Code"), cols.get(line, "County Code"), cols.get(line, "Site Num")}, "-"),
+				city:      cols.get(line, "City Name", "County Name"),
+				country:   "US",
+				parameter: aqsParameter(cols.get(line, "Parameter Code")),
+				unit:      cols.get(line, "Units of Measure"),
+			}
+			var err error
+			if ob.lat, err = cols.float(line, "Latitude"); err != nil {
+				return err
+			}
+			if ob.lon, err = cols.float(line, "Longitude"); err != nil {
+				return err
+			}
+			if hourly {
+				if ob.value, err = cols.float(line, "Sample Measurement"); err != nil {
+					return err
+				}
+				utc, err := time.Parse("2006-01-02 15:04", cols.get(line, "Date GMT")+" "+cols.get(line, "Time GMT"))
+				if err != nil {
+					return err
+				}
+				local, err := time.Parse("2006-01-02 15:04", cols.get(line, "Date Local")+" "+cols.get(line, "Time Local"))
+				if err != nil {
+					return err
+				}
+				ob.utc, ob.period = utc, time.Hour
+				ob.local = utc.In(time.FixedZone("", int(local.Sub(utc).Seconds()))).Format(time.RFC3339)
+			} else {
+				key := strings.Join([]string{ob.location, cols.get(line, "POC"), cols.get(line, "Parameter Code"), cols.get(line, "Date Local"), cols.get(line, "Sample Duration")}, "|")
+				if seen[key] {
+					return nil
+				}
+				seen[key] = true
+				if ob.value, err = cols.float(line, "Arithmetic Mean"); err != nil {
+					return err
+				}
+				date, err := parseDate(cols.get(line, "Date Local"))
+				if err != nil {
+					return err
+				}
+				ob.utc, ob.local = midDay(date, ob.lon)
+				ob.period = 24 * time.Hour
+			}
+			fn(ob)
+			return nil
+		})
+	})
+}
+
+// *************************************************************************
+// *************************************************************************
+//                                 AIRNOW
+// *************************************************************************
+// *************************************************************************
+
+// airnowSite is a monitoring site from the AirNow site locations file.
+type airnowSite struct {
+	name, city, country string
+	lat, lon            float64
+}
+
+type airnowSites map[string]airnowSite
+
+// readAirNowSites reads the AirNow site locations, either the pipe
+// delimited monitoring_site_locations.dat without a header, or the V2 file
+// with one.
+func readAirNowSites(path string) (airnowSites, error) {
+	if path == "" {
+		return nil, fmt.Errorf("AirNow files need the site locations file (-sites)")
+	}
+	sites := make(airnowSites)
+	err := openFile(path, func(r io.Reader) error {
+		br := bufio.NewReader(r)
+		first, _ := br.Peek(512)
+		if strings.Contains(strings.ToLower(string(first)), "aqsid|") {
+			rows, cols, err := headerReader(br, "AQSID", "SiteName", "Latitude", "Longitude")
+			if err != nil {
+				return err
+			}
+			return eachRow(path, rows, func(line []string) error {
+				s := airnowSite{name: cols.get(line, "SiteName"), city: cols.get(line, "CBSA_Name", "CountyName"), country: cols.get(line, "CountryFIPS", "CountryCode")}
+				var err error
+				if s.lat, err = cols.float(line, "Latitude"); err != nil {
+					return err
+				}
+				if s.lon, err = cols.float(line, "Longitude"); err != nil {
+					return err
+				}
+				sites[cols.get(line, "AQSID")] = s
+				return nil
+			})
+		}
+		rows := csv.NewReader(br)
+		rows.Comma = '|'
+		rows.FieldsPerRecord = -1
+		rows.LazyQuotes = true
+		return eachRow(path, rows, func(line []string) error {
+			if len(line) < 17 {
+				return fmt.Errorf("there are %d columns", len(line))
+			}
+			s := airnowSite{name: line[3], city: line[16], country: line[12]}
+			if s.city == "" && len(line) > 20 {
+				s.city = line[20]
+			}
+			var err error
+			if s.lat, err = strconv.ParseFloat(line[8], 64); err != nil {
+				return err
+			}
+			if s.lon, err = strconv.ParseFloat(line[9], 64); err != nil {
+				return err
+			}
+			sites[line[0]] = s
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading the AirNow sites in %s isn't working: %v", path, err)
+	}
+	return sites, nil
+}
+
+// airnowParameter names an AirNow parameter, e.g. PM2.5 is pm25.
+func airnowParameter(name string) string {
+	p := strings.ToLower(strings.Replace(name, ".", "", -1))
+	if p == "ozone" {
+		return "o3"
+	}
+	return p
+}
+
+// read reads an AirNow hourly file, with the pipe delimited columns
+// ValidDate, ValidTime, AQSID, SiteName, GMTOffset, ParameterName,
+// ReportingUnits, Value and DataSource. The times are in UTC. Sites that
+// aren't in the site locations are skipped.
+func (sites airnowSites) read(path string, fn func(observation)) error {
+	var nUnknown int
+	err := openFile(path, func(r io.Reader) error {
+		rows := csv.NewReader(r)
+		rows.Comma = '|'
+		rows.FieldsPerRecord = -1
+		rows.LazyQuotes = true
+		return eachRow(path, rows, func(line []string) error {
+			if len(line) < 8 {
+				return fmt.Errorf("there are %d columns", len(line))
+			}
+			site, ok := sites[line[2]]
+			if !ok {
+				nUnknown++
+				return nil
+			}
+			ob := observation{
+				location:  site.name,
+				city:      site.city,
+				country:   site.country,
+				parameter: airnowParameter(line[5]),
+				unit:      line[6],
+				lat:       site.lat,
+				lon:       site.lon,
+				period:    time.Hour,
+			}
+			var err error
+			if ob.utc, err = time.Parse("01/02/06 15:04", line[0]+" "+line[1]); err != nil {
+				return err
+			}
+			if ob.value, err = strconv.ParseFloat(line[7], 64); err != nil {
+				return err
+			}
+			if offset, err := strconv.ParseFloat(line[4], 64); err == nil {
+				ob.local = ob.utc.In(time.FixedZone("", int(offset*3600))).Format(time.RFC3339)
+			}
+			fn(ob)
+			return nil
+		})
+	})
+	if nUnknown > 0 {
+		fmt.Printf("%s: skipped %d measurements at sites without a location\n", path, nUnknown)
+	}
+	return err
+}
+
+// *************************************************************************
+// *************************************************************************
+//                            EEA E-REPORTING
+// *************************************************************************
+// *************************************************************************
+
+// eeaStation is a sampling point from the EEA station metadata.
+type eeaStation struct {
+	name, country string
+	lat, lon      float64
+}
+
+// eeaStations are the stations by sampling point, and by station for the
+// sampling points that aren't listed.
+type eeaStations map[string]eeaStation
+
+// readEEAStations reads the EEA station metadata csv (e.g.
+// PanEuropean_metadata.csv), which is tab or comma delimited.
+func readEEAStations(path string) (eeaStations, error) {
+	if path == "" {
+		return nil, fmt.Errorf("EEA files need the station metadata file (-sites)")
+	}
+	stations := make(eeaStations)
+	err := openFile(path, func(r io.Reader) error {
+		rows, cols, err := headerReader(r, "AirQualityStation", "Longitude", "Latitude")
+		if err != nil {
+			return err
+		}
+		return eachRow(path, rows, func(line []string) error {
+			s := eeaStation{name: cols.get(line, "AirQualityStationEoICode", "AirQualityStation"), country: cols.get(line, "Countrycode")}
+			var err error
+			if s.lat, err = cols.float(line, "Latitude"); err != nil {
+				return err
+			}
+			if s.lon, err = cols.float(line, "Longitude"); err != nil {
+				return err
+			}
+			if sp := cols.get(line, "SamplingPoint"); sp != "" {
+				stations[sp] = s
+			}
+			stations[cols.get(line, "AirQualityStation")] = s
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading the EEA stations in %s isn't working: %v", path, err)
+	}
+	return stations, nil
+}
+
+// eeaParameter names an EEA air pollutant, e.g. PM2.5 is pm25.
+func eeaParameter(name string) string {
+	return strings.ToLower(strings.Replace(name, ".", "", -1))
+}
+
+// read reads an EEA e-reporting csv file. Measurements that aren't valid
+// (Validity below 1) are skipped, as are those at unknown stations.
+func (stations eeaStations) read(path string, fn func(observation)) error {
+	var nUnknown, nInvalid int
+	err := openFile(path, func(r io.Reader) error {
+		rows, cols, err := headerReader(r, "AirQualityStation", "AirPollutant", "Concentration", "DatetimeBegin", "DatetimeEnd")
+		if err != nil {
+			return err
+		}
+		return eachRow(path, rows, func(line []string) error {
+			if v, err := strconv.Atoi(cols.get(line, "Validity")); err == nil && v < 1 {
+				nInvalid++
+				return nil
+			}
+			st, ok := stations[cols.get(line, "SamplingPoint")]
+			if !ok {
+				st, ok = stations[cols.get(line, "AirQualityStation")]
+			}
+			if !ok {
+				nUnknown++
+				return nil
+			}
+			ob := observation{
+				location:  st.name,
+				country:   st.country,
+				parameter: eeaParameter(cols.get(line, "AirPollutant")),
+				unit:      cols.get(line, "UnitOfMeasurement"),
+				lat:       st.lat,
+				lon:       st.lon,
+			}
+			if ob.country == "" {
+				ob.country = cols.get(line, "Countrycode")
+			}
+			var err error
+			if ob.value, err = cols.float(line, "Concentration"); err != nil {
+				return err
+			}
+			const layout = "2006-01-02 15:04:05 -07:00"
+			begin, err := time.Parse(layout, cols.get(line, "DatetimeBegin"))
+			if err != nil {
+				return err
+			}
+			end, err := time.Parse(layout, cols.get(line, "DatetimeEnd"))
+			if err != nil {
+				return err
+			}
+			ob.period = end.Sub(begin)
+			if ob.period <= time.Hour {
+				ob.utc, ob.local = begin.UTC(), begin.Format(time.RFC3339)
+			} else {
+				mid := begin.Add(ob.period / 2)
+				ob.utc, ob.local = mid.UTC(), mid.Format(time.RFC3339)
+			}
+			fn(ob)
+			return nil
+		})
+	})
+	if nInvalid > 0 || nUnknown > 0 {
+		fmt.Printf("%s: skipped %d invalid measurements and %d at stations without metadata\n", path, nInvalid, nUnknown)
+	}
+	return err
+}
+
+// *************************************************************************
+// *************************************************************************
+//                                 IMPROVE
+// *************************************************************************
+// *************************************************************************
+
+// improveParameters names the IMPROVE parameter codes that aren't named by
+// dropping their fine suffix, e.g. SO4f is so4.
+var improveParameters = map[string]string{
+	"MF":       "pm25",
+	"MT":       "pm10",
+	"RCFM":     "rcfm",
+	"OMCf":     "om",
+	"SOILf":    "soil",
+	"SeaSaltf": "seasalt",
+	"ammSO4f":  "amso4",
+	"ammNO3f":  "amno3",
+}
+
+func improveParameter(code string) string {
+	if p, ok := improveParameters[code]; ok {
+		return p
+	}
+	return strings.ToLower(strings.TrimSuffix(code, "f"))
+}
+
+// readIMPROVE reads IMPROVE (or other FED) data in the long format, with a
+// row for every site, day and parameter. The header is found after the
+// FED preamble. Missing values (-999) are skipped. The samples are 24 hours
+// long, from local midnight.
+func readIMPROVE(path string, fn func(observation)) error {
+	return openFile(path, func(r io.Reader) error {
+		rows, cols, err := headerReader(r, "SiteCode", "Date", "ParamCode", "Latitude", "Longitude")
+		if err != nil {
+			return err
+		}
+		if !cols.has("FactValue") && !cols.has("Value") {
+			return fmt.Errorf("there is no FactValue or Value column")
+		}
+		return eachRow(path, rows, func(line []string) error {
+			ob := observation{
+				location:  cols.get(line, "SiteCode"),
+				city:      cols.get(line, "SiteName"),
+				country:   cols.get(line, "Country"),
+				parameter: improveParameter(cols.get(line, "ParamCode")),
+				unit:      cols.get(line, "Unit"),
+				period:    24 * time.Hour,
+			}
+			if ob.country == "" {
+				ob.country = "US"
+			}
+			var err error
+			if ob.value, err = strconv.ParseFloat(cols.get(line, "FactValue", "Value"), 64); err != nil {
+				return err
+			}
+			if ob.value <= -999 {
+				return nil
+			}
+			if ob.lat, err = cols.float(line, "Latitude"); err != nil {
+				return err
+			}
+			if ob.lon, err = cols.float(line, "Longitude"); err != nil {
+				return err
+			}
+			// The date can have a midnight time after it.
+			d := cols.get(line, "Date")
+			if i := strings.IndexByte(d, ' '); i >= 0 {
+				d = d[:i]
+			}
+			date, err := parseDate(d)
+			if err != nil {
+				return err
+			}
+			ob.utc, ob.local = midDay(date, ob.lon)
+			fn(ob)
+			return nil
+		})
+	})
+}
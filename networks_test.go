@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLines writes the lines to a file in dir and returns its path.
+func writeLines(t *testing.T, dir, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNetworkParameters(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fn   func(string) string
+		in   string
+		want string
+	}{
+		{"aqs", aqsParameter, "88101", "pm25"},
+		{"aqs", aqsParameter, "88403", "so4"},
+		{"aqs", aqsParameter, "99999", "aqs99999"},
+		{"airnow", airnowParameter, "PM2.5", "pm25"},
+		{"airnow", airnowParameter, "OZONE", "o3"},
+		{"eea", eeaParameter, "PM2.5", "pm25"},
+		{"eea", eeaParameter, "NO2", "no2"},
+		{"improve", improveParameter, "SO4f", "so4"},
+		{"improve", improveParameter, "OMCf", "om"},
+		{"improve", improveParameter, "MF", "pm25"},
+	} {
+		if got := test.fn(test.in); got != test.want {
+			t.Errorf("%s: %s is named %q, not %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestNetworkReaders(t *testing.T) {
+	dir := t.TempDir()
+	utc := func(day, h, m int) time.Time { return time.Date(2015, 11, day, h, m, 0, 0, time.UTC) }
+
+	// AirNow sites, in the old format without a header: the AQSID, name,
+	// latitude, longitude, country and city are columns 0, 3, 8, 9, 12 and
+	// 16.
+	site := make([]string, 21)
+	site[0], site[3], site[8], site[9], site[12], site[16] = "060371103", "Los Angeles-N Main", "34.0664", "-118.2267", "US", "Los Angeles"
+	airnowSitesPath := writeLines(t, dir, "monitoring_site_locations.dat", strings.Join(site, "|"))
+	airnow, err := readAirNowSites(airnowSitesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eeaStationsPath := writeLines(t, dir, "PanEuropean_metadata.csv",
+		"Countrycode\tAirQualityStation\tAirQualityStationEoICode\tSamplingPoint\tLongitude\tLatitude",
+		"DE\tSTA.DE_DEBE010\tDEBE010\tSPO.DE_DEBE010_PM2_1\t13.349\t52.5437",
+	)
+	eea, err := readEEAStations(eeaStationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	la := observation{location: "06-037-1103", city: "Los Angeles", country: "US", parameter: "pm25",
+		unit: "Micrograms/cubic meter (LC)", lat: 34.06659, lon: -118.22688}
+	for _, test := range []struct {
+		name  string
+		read  func(path string, fn func(observation)) error
+		lines []string
+		want  []observation
+	}{
+		{
+			// Hourly AQS, with a row that can't be read.
+			name: "aqs hourly",
+			read: readAQS,
+			lines: []string{
+				`"State Code","County Code","Site Num","Parameter Code","POC","Latitude","Longitude","Date Local","Time Local","Date GMT","Time GMT","Sample Measurement","Units of Measure","County Name","City Name"`,
+				`"06","037","1103","88101",1,34.06659,-118.22688,"2015-11-20","16:00","2015-11-21","00:00",12.3,"Micrograms/cubic meter (LC)","Los Angeles","Los Angeles"`,
+				`"06","037","1103","88101",1,34.06659,-118.22688,"2015-11-20","17:00","2015-11-21","01:00",bad,"Micrograms/cubic meter (LC)","Los Angeles","Los Angeles"`,
+			},
+			want: []observation{func() observation {
+				ob := la
+				ob.utc, ob.local, ob.value, ob.period = utc(21, 0, 0), "2015-11-20T16:00:00-08:00", 12.3, time.Hour
+				return ob
+			}()},
+		},
+		{
+			// Daily AQS, with a row for each of two pollutant standards, at
+			// the middle of the local day.
+			name: "aqs daily",
+			read: readAQS,
+			lines: []string{
+				`"State Code","County Code","Site Num","Parameter Code","POC","Latitude","Longitude","Sample Duration","Pollutant Standard","Date Local","Units of Measure","Arithmetic Mean","County Name","City Name"`,
+				`"06","037","1103","88101",1,34.06659,-118.22688,"24 HOUR","PM25 24-hour 2006","2015-11-20","Micrograms/cubic meter (LC)",10.5,"Los Angeles","Los Angeles"`,
+				`"06","037","1103","88101",1,34.06659,-118.22688,"24 HOUR","PM25 Annual 2012","2015-11-20","Micrograms/cubic meter (LC)",10.5,"Los Angeles","Los Angeles"`,
+			},
+			want: []observation{func() observation {
+				ob := la
+				ob.utc, ob.local, ob.value, ob.period = utc(20, 20, 0), "2015-11-20T12:00:00-08:00", 10.5, 24*time.Hour
+				return ob
+			}()},
+		},
+		{
+			// AirNow times are in UTC. The second site has no location.
+			name: "airnow",
+			read: airnow.read,
+			lines: []string{
+				"11/20/15|16:00|060371103|Los Angeles-N Main|-8|PM2.5|UG/M3|12.0|SCAQMD",
+				"11/20/15|16:00|999999999|Nowhere|-8|PM2.5|UG/M3|3.0|SCAQMD",
+				"11/20/15|16:00|060371103|Los Angeles-N Main|-8|OZONE|PPB|31|SCAQMD",
+			},
+			want: []observation{
+				{location: "Los Angeles-N Main", city: "Los Angeles", country: "US", utc: utc(20, 16, 0), local: "2015-11-20T08:00:00-08:00",
+					parameter: "pm25", value: 12, unit: "UG/M3", lat: 34.0664, lon: -118.2267, period: time.Hour},
+				{location: "Los Angeles-N Main", city: "Los Angeles", country: "US", utc: utc(20, 16, 0), local: "2015-11-20T08:00:00-08:00",
+					parameter: "o3", value: 31, unit: "PPB", lat: 34.0664, lon: -118.2267, period: time.Hour},
+			},
+		},
+		{
+			// EEA hourly measurements are at the start of their hour, and
+			// longer ones at the middle. Invalid measurements, and those at
+			// unknown stations, are skipped.
+			name: "eea",
+			read: eea.read,
+			lines: []string{
+				"Countrycode,AirQualityStation,SamplingPoint,AirPollutant,Concentration,UnitOfMeasurement,DatetimeBegin,DatetimeEnd,Validity",
+				"DE,STA.DE_DEBE010,SPO.DE_DEBE010_PM2_1,PM2.5,15.2,µg/m3,2015-11-20 00:00:00 +01:00,2015-11-20 01:00:00 +01:00,1",
+				"DE,STA.DE_DEBE010,SPO.DE_DEBE010_PM2_1,PM2.5,99,µg/m3,2015-11-20 01:00:00 +01:00,2015-11-20 02:00:00 +01:00,-1",
+				"DE,STA.DE_DEBE999,SPO.DE_DEBE999_PM2_1,PM2.5,7,µg/m3,2015-11-20 00:00:00 +01:00,2015-11-20 01:00:00 +01:00,1",
+				"DE,STA.DE_DEBE010,SPO.DE_DEBE010_PM2_1,PM2.5,14,µg/m3,2015-11-20 00:00:00 +01:00,2015-11-21 00:00:00 +01:00,1",
+			},
+			want: []observation{
+				{location: "DEBE010", country: "DE", utc: utc(19, 23, 0), local: "2015-11-20T00:00:00+01:00",
+					parameter: "pm25", value: 15.2, unit: "µg/m3", lat: 52.5437, lon: 13.349, period: time.Hour},
+				{location: "DEBE010", country: "DE", utc: utc(20, 11, 0), local: "2015-11-20T12:00:00+01:00",
+					parameter: "pm25", value: 14, unit: "µg/m3", lat: 52.5437, lon: 13.349, period: 24 * time.Hour},
+			},
+		},
+		{
+			// IMPROVE data from FED, after its preamble, with a missing
+			// value.
+			name: "improve",
+			read: readIMPROVE,
+			lines: []string{
+				"Federal Land Manager Environmental Database",
+				"Report generated 2016-01-05",
+				"",
+				"Dataset,SiteCode,SiteName,Latitude,Longitude,ParamCode,Date,FactValue,Unit",
+				"IMPFSPED,ACAD1,Acadia NP,44.3771,-68.261,SO4f,11/20/2015 00:00:00,1.23,ug/m^3 LC",
+				"IMPFSPED,ACAD1,Acadia NP,44.3771,-68.261,MF,11/20/2015 00:00:00,4.5,ug/m^3 LC",
+				"IMPFSPED,ACAD1,Acadia NP,44.3771,-68.261,NO3f,11/20/2015 00:00:00,-999,ug/m^3 LC",
+			},
+			want: []observation{
+				{location: "ACAD1", city: "Acadia NP", country: "US", utc: utc(20, 17, 0), local: "2015-11-20T12:00:00-05:00",
+					parameter: "so4", value: 1.23, unit: "ug/m^3 LC", lat: 44.3771, lon: -68.261, period: 24 * time.Hour},
+				{location: "ACAD1", city: "Acadia NP", country: "US", utc: utc(20, 17, 0), local: "2015-11-20T12:00:00-05:00",
+					parameter: "pm25", value: 4.5, unit: "ug/m^3 LC", lat: 44.3771, lon: -68.261, period: 24 * time.Hour},
+			},
+		},
+	} {
+		path := writeLines(t, dir, strings.Replace(test.name, " ", "_", -1)+".txt", test.lines...)
+		var got []observation
+		if err := test.read(path, func(ob observation) { got = append(got, ob) }); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: the observations are\n%+v\nnot\n%+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                              OBSERVATIONS
+// *************************************************************************
+// *************************************************************************
+
+// observation is one measurement at a station. Every observation source
+// is read into observations, so that the pairing doesn't depend on where
+// the data came from.
+type observation struct {
+	location, city, country string
+	// utc is the time the measurement is paired at: the reported time of
+	// hourly measurements, and the middle of the averaging period of
+	// longer ones.
+	utc time.Time
+	// local is the local time of the measurement with its UTC offset, in
+	// RFC 3339 format, or empty if it isn't known.
+	local     string
+	parameter string // e.g. "pm25"
+	value     float64
+	unit      string
+	lat, lon  float64
+	// period is the averaging period, or zero if it isn't known.
+	period time.Duration
+}
+
+// ObservationSource is a set of observations that can be read a UTC day at
+// a time.
+type ObservationSource interface {
+	// Days returns the days that there are observations for, in order.
+	Days() ([]time.Time, error)
+	// Observations returns the observations of a day.
+	Observations(day time.Time) ([]observation, error)
+	// Path describes where the observations of a day are read from.
+	Path(day time.Time) string
+}
+
+// observationFlags adds the flags for choosing an observation source to
+// fs, reading the parameter given by default (or every parameter, if it is
+// empty). The returned function opens the source once the flags are parsed.
+func observationFlags(fs *flag.FlagSet, parameter string) func() (ObservationSource, error) {
+	kind := fs.String("obs", "csv", "observation source: csv (OpenAQ daily csv files), openaq (OpenAQ API cache from the fetch mode), archive (mirror of the OpenAQ bulk archive), aqs (EPA AQS hourly or daily files), airnow (AirNow hourly files), eea (EEA e-reporting csv files) or improve (IMPROVE data from FED)")
+	csvFolder := fs.String("csv", defaultCsvFolder, "folder of measurement csv files")
+	cacheDir := fs.String("cache", "openaq-cache", "OpenAQ API cache directory")
+	archiveDir := fs.String("archive", "", "directory of the OpenAQ archive mirror")
+	files := fs.String("files", "", "comma separated glob patterns of the aqs, airnow, eea or improve files")
+	sites := fs.String("sites", "", "site locations of the airnow (monitoring_site_locations.dat) or eea (station metadata csv) files")
+	param := fs.String("parameter", parameter, "parameter to read from the archive, aqs, airnow, eea or improve files")
+	bbox := fs.String("bbox", "", "bounding box to read from the archive, aqs, airnow, eea or improve files, as minlon,minlat,maxlon,maxlat")
+	from := fs.String("from", "", "first UTC day of observations to pair, as 2006-01-02")
+	to := fs.String("to", "", "last UTC day of observations to pair, as 2006-01-02")
+	return func() (ObservationSource, error) {
+		var days daysBetween
+		var err error
+		if *from != "" {
+			if days.from, err = time.Parse("2006-01-02", *from); err != nil {
+				return nil, fmt.Errorf("bad -from date: %v", err)
+			}
+		}
+		if *to != "" {
+			if days.to, err = time.Parse("2006-01-02", *to); err != nil {
+				return nil, fmt.Errorf("bad -to date: %v", err)
+			}
+		}
+		b, err := parseBoundingBox(*bbox)
+		if err != nil {
+			return nil, err
+		}
+		var src ObservationSource
+		switch *kind {
+		case "csv":
+			src, err = openOpenAQCSVFolder(*csvFolder)
+		case "openaq":
+			src, err = openOpenAQCache(*cacheDir)
+		case "archive":
+			src, err = openOpenAQArchive(*archiveDir, *param, b)
+		case "aqs", "airnow", "eea", "improve":
+			src, err = openNetwork(*kind, *files, *sites, *param, b, days)
+		default:
+			return nil, fmt.Errorf("unknown observation source %q: should be csv, openaq, archive, aqs, airnow, eea or improve", *kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if days.from.IsZero() && days.to.IsZero() {
+			return src, nil
+		}
+		days.ObservationSource = src
+		return days, nil
+	}
+}
+
+// daysBetween limits a source to the days from and to, inclusive. Zero
+// times don't limit the range.
+type daysBetween struct {
+	ObservationSource
+	from, to time.Time
+}
+
+func (d daysBetween) Days() ([]time.Time, error) {
+	all, err := d.ObservationSource.Days()
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, t := range all {
+		if d.includes(t) {
+			days = append(days, t)
+		}
+	}
+	return days, nil
+}
+
+func (d daysBetween) includes(day time.Time) bool {
+	return (d.from.IsZero() || !day.Before(d.from)) && (d.to.IsZero() || !day.After(d.to))
+}
+
+// massUnits are the factors converting mass concentrations to µg/m³, by
+// the unit as normalised by massUnit.
+var massUnits = map[string]float64{
+	"ug/m3": 1,
+	"mg/m3": 1000,
+	"ng/m3": 1e-3,
+}
+
+// massUnit normalises the spellings of mass concentration units in the
+// observation sources, e.g. µg/m³ (OpenAQ), Micrograms/cubic meter (LC)
+// (AQS), UG/M3 (AirNow) and ug/m^3 LC (IMPROVE), all to ug/m3. The
+// conditions (local or standard) aren't distinguished.
+func massUnit(unit string) string {
+	u := strings.ToLower(strings.Replace(unit, " ", "", -1))
+	for _, suffix := range []string{"(lc)", "lc", "(stp)", "stp"} {
+		u = strings.TrimSuffix(u, suffix)
+	}
+	return strings.NewReplacer("µ", "u", "μ", "u", "³", "3", "^3", "3", "micrograms/cubicmeter", "ug/m3").Replace(u)
+}
+
+// inMicrograms converts the observations to µg/m³, and leaves out those in
+// units that aren't a mass concentration, reporting how many there were.
+// Observations without a unit are taken to be in µg/m³, as every source
+// reports PM2.5.
+func inMicrograms(obs []observation, path string) []observation {
+	out := make([]observation, 0, len(obs))
+	var nOther int
+	var other string
+	for _, ob := range obs {
+		factor, ok := massUnits[massUnit(ob.unit)]
+		if ob.unit == "" {
+			factor, ok = 1, true
+		}
+		if !ok {
+			if nOther == 0 {
+				other = ob.unit
+			}
+			nOther++
+			continue
+		}
+		ob.value *= factor
+		ob.unit = "µg/m³"
+		out = append(out, ob)
+	}
+	if nOther > 0 {
+		fmt.Printf("%s: skipped %d observations in units other than µg/m³, e.g. %q\n", path, nOther, other)
+	}
+	return out
+}
+
+// openaqCSVFolder is a folder of OpenAQ daily csv files named 2006-01-02.csv.
+type openaqCSVFolder struct {
+	folder string
+	files  map[time.Time]string
+}
+
+func openOpenAQCSVFolder(folder string) (*openaqCSVFolder, error) {
+	csvList, err := listFiles(folder)
+	if err != nil {
+		return nil, err
+	}
+	f := &openaqCSVFolder{folder: folder, files: make(map[time.Time]string)}
+	for _, file := range csvList {
+		dateHyphen := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		t, err := time.Parse("2006-01-02", dateHyphen)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		f.files[t] = file
+	}
+	return f, nil
+}
+
+func (f *openaqCSVFolder) Days() ([]time.Time, error) {
+	days := make([]time.Time, 0, len(f.files))
+	for t := range f.files {
+		days = append(days, t)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+func (f *openaqCSVFolder) Path(day time.Time) string { return f.files[day] }
+
+func (f *openaqCSVFolder) Observations(day time.Time) ([]observation, error) {
+	return readOpenAQCSV(f.files[day])
+}
+
+// readOpenAQCSV reads the observations from an OpenAQ daily csv file,
+// with the columns location, city, country, utc, local, parameter, value,
+// unit, latitude, longitude and attribution. Rows that can't be read, e.g.
+// because they have no coordinates, are skipped and counted in the log.
+func readOpenAQCSV(path string) ([]observation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("The csv %s cannot be opened: %v", path, err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s isn't working: %v", path, err)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	//  We remove the header information. Ideally, we would like to use this
+	//  information to allow for differently structured data.
+	lines = lines[1:]
+	obs := make([]observation, 0, len(lines))
+	var nBad int
+	var firstErr error
+	for i, line := range lines {
+		ob, err := parseOpenAQCSV(line)
+		if err != nil {
+			if nBad == 0 {
+				firstErr = fmt.Errorf("line %d: %v", i+2, err)
+			}
+			nBad++
+			continue
+		}
+		obs = append(obs, ob)
+	}
+	if nBad > 0 {
+		log.Printf("%s: skipped %d rows that couldn't be read, the first at %v", path, nBad, firstErr)
+	}
+	return obs, nil
+}
+
+func parseOpenAQCSV(line []string) (observation, error) {
+	var ob observation
+	if len(line) < 10 {
+		return ob, fmt.Errorf("there are %d columns", len(line))
+	}
+	var err error
+	ob.location, ob.city, ob.country = line[0], line[1], line[2]
+	if ob.utc, err = time.Parse(time.RFC3339, line[3]); err != nil {
+		return ob, err
+	}
+	ob.local = line[4]
+	ob.parameter = strings.ToLower(line[5])
+	if ob.value, err = strconv.ParseFloat(line[6], 64); err != nil {
+		return ob, err
+	}
+	ob.unit = line[7]
+	if ob.lat, err = strconv.ParseFloat(line[8], 64); err != nil {
+		return ob, fmt.Errorf("The lat/lon is either absent or not parseable: %s", line[8])
+	}
+	if ob.lon, err = strconv.ParseFloat(line[9], 64); err != nil {
+		return ob, fmt.Errorf("The lat/lon is either absent or not parseable: %s", line[9])
+	}
+	return ob, nil
+}
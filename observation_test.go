@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInMicrograms(t *testing.T) {
+	for _, test := range []struct {
+		unit string
+		want float64 // the value of 2 in the unit, in µg/m³, or 0 if it is left out
+	}{
+		{"µg/m³", 2},
+		{"μg/m³", 2},
+		{"µg/m3", 2},
+		{"Micrograms/cubic meter (LC)", 2},
+		{"UG/M3", 2},
+		{"ug/m^3 LC", 2},
+		{"mg/m3", 2000},
+		{"ng/m³", 0.002},
+		{"", 2},
+		{"ppm", 0},
+		{"Micrograms/cubic meter", 2},
+		{"Parts per billion", 0},
+	} {
+		got := inMicrograms([]observation{{parameter: "pm25", value: 2, unit: test.unit}}, "test")
+		var want []observation
+		if test.want != 0 {
+			want = []observation{{parameter: "pm25", value: test.want, unit: "µg/m³"}}
+		}
+		if len(got) == 0 && len(want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("2 %s is read as %+v, not %+v", test.unit, got, want)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                          OPENAQ API JSON CACHE
+// *************************************************************************
+// *************************************************************************
+
+// The OpenAQ API responses are cached on disk as they were returned, so
+// that runs (and tests against the fixtures in testfiles/openaq) don't need
+// the network. The cache is laid out as:
+//
+//	<cache>/locations/*.json                  locations endpoint pages
+//	<cache>/measurements/2006-01-02/*.json    measurements pages for a day
+//
+// Both the v2 and the v3 API are read. v2 measurements carry their own
+// location, but v3 measurements are fetched per sensor and don't, so v3
+// measurement pages are named sensor_<id>_<page>.json and the location is
+// looked up from the sensor id in the locations pages.
+
+// openaqResponse is a page of results from any OpenAQ endpoint.
+type openaqResponse struct {
+	Results []openaqRecord `json:"results"`
+}
+
+// openaqRecord holds the fields used from the v2 and v3 measurements and
+// locations results. Fields that are a string in one version and an object
+// in the other are kept raw.
+type openaqRecord struct {
+	ID          int             `json:"id"`
+	LocationID  int             `json:"locationId"`
+	Location    string          `json:"location"`
+	Name        string          `json:"name"`
+	City        string          `json:"city"`
+	Locality    string          `json:"locality"`
+	Country     json.RawMessage `json:"country"`
+	Parameter   json.RawMessage `json:"parameter"`
+	Value       *float64        `json:"value"`
+	Unit        string          `json:"unit"`
+	Date        *openaqTime     `json:"date"`
+	Period      *openaqPeriod   `json:"period"`
+	Coordinates *openaqCoords   `json:"coordinates"`
+	Sensors     []openaqSensor  `json:"sensors"`
+}
+
+type openaqTime struct {
+	UTC   string `json:"utc"`
+	Local string `json:"local"`
+}
+
+type openaqPeriod struct {
+	DatetimeFrom openaqTime `json:"datetimeFrom"`
+	DatetimeTo   openaqTime `json:"datetimeTo"`
+}
+
+type openaqCoords struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type openaqSensor struct {
+	ID        int `json:"id"`
+	Parameter struct {
+		Name  string `json:"name"`
+		Units string `json:"units"`
+	} `json:"parameter"`
+}
+
+// country returns the country code, which is a string in v2 and an object
+// in v3.
+func (r openaqRecord) country() string {
+	var code string
+	if json.Unmarshal(r.Country, &code) == nil {
+		return code
+	}
+	var c struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(r.Country, &c)
+	return c.Code
+}
+
+// parameter returns the parameter name and units, which are a string and
+// a separate unit in v2 and an object in v3.
+func (r openaqRecord) parameter() (name, units string) {
+	if json.Unmarshal(r.Parameter, &name) == nil {
+		return strings.ToLower(name), r.Unit
+	}
+	var p struct {
+		Name  string `json:"name"`
+		Units string `json:"units"`
+	}
+	json.Unmarshal(r.Parameter, &p)
+	return strings.ToLower(p.Name), p.Units
+}
+
+// openaqLocation is a station from the locations pages.
+type openaqLocation struct {
+	name, city, country string
+	lat, lon            float64
+}
+
+// openaqCache reads observations from an OpenAQ cache directory.
+type openaqCache struct {
+	dir       string
+	locations map[int]openaqLocation
+	sensors   map[int]int // location id of each v3 sensor
+}
+
+// openOpenAQCache reads the locations pages of the cache in dir.
+func openOpenAQCache(dir string) (*openaqCache, error) {
+	c := &openaqCache{dir: dir, locations: make(map[int]openaqLocation), sensors: make(map[int]int)}
+	pages, err := filepath.Glob(filepath.Join(dir, "locations", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range pages {
+		resp, err := readOpenAQPage(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Results {
+			loc := openaqLocation{name: r.Name, city: r.City, country: r.country()}
+			if loc.city == "" {
+				loc.city = r.Locality
+			}
+			if r.Coordinates == nil {
+				continue
+			}
+			loc.lat, loc.lon = r.Coordinates.Latitude, r.Coordinates.Longitude
+			c.locations[r.ID] = loc
+			for _, s := range r.Sensors {
+				c.sensors[s.ID] = r.ID
+			}
+		}
+	}
+	return c, nil
+}
+
+func readOpenAQPage(path string) (openaqResponse, error) {
+	var resp openaqResponse
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return resp, fmt.Errorf("reading %s isn't working: %v", path, err)
+	}
+	return resp, nil
+}
+
+// Days returns the days that there are measurements for in the cache.
+func (c *openaqCache) Days() ([]time.Time, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(c.dir, "measurements"))
+	if err != nil {
+		return nil, fmt.Errorf("there are no cached measurements in %s: %v", c.dir, err)
+	}
+	var days []time.Time
+	for _, d := range dirs {
+		if t, err := time.Parse("2006-01-02", d.Name()); err == nil && d.IsDir() {
+			days = append(days, t)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// Path returns the directory of the cached measurements for a day.
+func (c *openaqCache) Path(day time.Time) string {
+	return filepath.Join(c.dir, "measurements", day.Format("2006-01-02"))
+}
+
+var sensorPage = regexp.MustCompile(`^sensor_(\d+)_`)
+
+// Observations reads the cached measurements for one day. Measurements
+// without a known location are skipped.
+func (c *openaqCache) Observations(day time.Time) ([]observation, error) {
+	pages, err := filepath.Glob(filepath.Join(c.Path(day), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var obs []observation
+	var nBad int
+	for _, path := range pages {
+		resp, err := readOpenAQPage(path)
+		if err != nil {
+			return nil, err
+		}
+		sensor := -1
+		if m := sensorPage.FindStringSubmatch(filepath.Base(path)); m != nil {
+			sensor, _ = strconv.Atoi(m[1])
+		}
+		for _, r := range resp.Results {
+			ob, err := c.observation(r, sensor)
+			if err != nil {
+				nBad++
+				continue
+			}
+			obs = append(obs, ob)
+		}
+	}
+	if nBad > 0 {
+		fmt.Printf("%s: skipped %d measurements without a time, value or location\n", c.Path(day), nBad)
+	}
+	return obs, nil
+}
+
+// observation converts a v2 measurement, or a v3 measurement of the given
+// sensor, to an observation.
+func (c *openaqCache) observation(r openaqRecord, sensor int) (observation, error) {
+	var ob observation
+	if r.Value == nil {
+		return ob, fmt.Errorf("there is no value")
+	}
+	ob.value = *r.Value
+	ob.parameter, ob.unit = r.parameter()
+
+	// v2 gives the time of the measurement, and v3 the averaging period,
+	// which is timed by its end as in v2.
+	var t openaqTime
+	switch {
+	case r.Date != nil:
+		t = *r.Date
+	case r.Period != nil:
+		t = r.Period.DatetimeTo
+	default:
+		return ob, fmt.Errorf("there is no time")
+	}
+	var err error
+	if ob.utc, err = time.Parse(time.RFC3339, t.UTC); err != nil {
+		return ob, err
+	}
+	ob.utc = ob.utc.UTC()
+	ob.local = t.Local
+
+	locID := r.LocationID
+	if sensor >= 0 {
+		locID = c.sensors[sensor]
+	}
+	loc, ok := c.locations[locID]
+	if r.Location != "" {
+		loc.name, loc.city, loc.country = r.Location, r.City, r.country()
+	}
+	if r.Coordinates != nil {
+		loc.lat, loc.lon, ok = r.Coordinates.Latitude, r.Coordinates.Longitude, true
+	}
+	if !ok {
+		return ob, fmt.Errorf("the location isn't known")
+	}
+	ob.location, ob.city, ob.country = loc.name, loc.city, loc.country
+	ob.lat, ob.lon = loc.lat, loc.lon
+	return ob, nil
+}
+
+// *************************************************************************
+// *************************************************************************
+//                        FETCHING FROM THE OPENAQ API
+// *************************************************************************
+// *************************************************************************
+
+// openaqFetcher downloads OpenAQ API pages into the cache. Pages that are
+// already cached aren't downloaded again.
+type openaqFetcher struct {
+	baseURL   string
+	key       string
+	limit     int
+	overwrite bool
+	client    *http.Client
+}
+
+// page downloads one page of endpoint with the query to path, and returns
+// the number of results in it.
+func (f openaqFetcher) page(endpoint string, query url.Values, path string) (int, error) {
+	if !f.overwrite {
+		if resp, err := readOpenAQPage(path); err == nil {
+			return len(resp.Results), nil
+		}
+	}
+	u := strings.TrimSuffix(f.baseURL, "/") + endpoint + "?" + query.Encode()
+	var b []byte
+	for try := 0; ; try++ {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return 0, err
+		}
+		if f.key != "" {
+			req.Header.Set("X-API-Key", f.key)
+		}
+		resp, err := f.client.Do(req)
+		if err != nil {
+			return 0, fmt.Errorf("fetching %s isn't working: %v", u, err)
+		}
+		b, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, fmt.Errorf("fetching %s isn't working: %v", u, err)
+		}
+		// Wait and try again if the rate limit is reached.
+		if resp.StatusCode == http.StatusTooManyRequests && try < 5 {
+			time.Sleep(time.Duration(try+1) * 10 * time.Second)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("fetching %s: %s: %s", u, resp.Status, b)
+		}
+		break
+	}
+	var resp openaqResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return 0, fmt.Errorf("the response from %s isn't working: %v", u, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	// The page is written to a temporary file first, so that an
+	// interrupted fetch doesn't leave a partial page in the cache.
+	if err := ioutil.WriteFile(path+".tmp", b, 0644); err != nil {
+		return 0, err
+	}
+	return len(resp.Results), os.Rename(path+".tmp", path)
+}
+
+// pages downloads every page of endpoint, naming the files prefix_<page>.json
+// in dir.
+func (f openaqFetcher) pages(endpoint string, query url.Values, dir, prefix string) error {
+	for page := 1; ; page++ {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("limit", strconv.Itoa(f.limit))
+		q.Set("page", strconv.Itoa(page))
+		n, err := f.page(endpoint, q, filepath.Join(dir, fmt.Sprintf("%s_%d.json", prefix, page)))
+		if err != nil {
+			return err
+		}
+		if n < f.limit {
+			return nil
+		}
+	}
+}
+
+// fetchCmd is the "fetch" mode, which downloads measurements from the
+// OpenAQ API into the cache read by "pair -obs openaq".
+func fetchCmd(args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	cacheDir := fs.String("cache", "openaq-cache", "cache directory")
+	api := fs.String("api", "v3", "API version: v2 or v3")
+	fromStr := fs.String("from", "", "first day to fetch, as 2006-01-02")
+	toStr := fs.String("to", "", "last day to fetch, as 2006-01-02 (default the first day)")
+	parameter := fs.String("parameter", "pm25", "parameter to fetch")
+	parameterID := fs.Int("parameterid", 2, "v3 parameter id of the parameter (2 is pm25)")
+	bbox := fs.String("bbox", "", "v3 bounding box to fetch stations in, as minlon,minlat,maxlon,maxlat")
+	key := fs.String("key", os.Getenv("OPENAQ_API_KEY"), "API key (default $OPENAQ_API_KEY)")
+	baseURL := fs.String("url", "https://api.openaq.org", "API address")
+	limit := fs.Int("limit", 1000, "results per page")
+	overwrite := fs.Bool("overwrite", false, "download pages that are already cached again")
+	fs.Parse(args)
+
+	from, err := time.Parse("2006-01-02", *fromStr)
+	if err != nil {
+		return fmt.Errorf("fetch: the first day (-from) is needed as 2006-01-02: %v", err)
+	}
+	to := from
+	if *toStr != "" {
+		if to, err = time.Parse("2006-01-02", *toStr); err != nil {
+			return fmt.Errorf("fetch: bad -to date: %v", err)
+		}
+	}
+	f := openaqFetcher{baseURL: *baseURL, key: *key, limit: *limit, overwrite: *overwrite, client: &http.Client{Timeout: time.Minute}}
+	locDir := filepath.Join(*cacheDir, "locations")
+	dayDir := func(t time.Time) string {
+		return filepath.Join(*cacheDir, "measurements", t.Format("2006-01-02"))
+	}
+	stamp := func(t time.Time) string { return t.Format(time.RFC3339) }
+
+	switch *api {
+	case "v2":
+		if *bbox != "" {
+			return fmt.Errorf("fetch: -bbox is only supported with the v3 API")
+		}
+		if err := f.pages("/v2/locations", url.Values{"parameter": {*parameter}}, locDir, "v2"); err != nil {
+			return err
+		}
+		for t := from; !t.After(to); t = t.AddDate(0, 0, 1) {
+			fmt.Printf("Fetching %s\n", t.Format("2006-01-02"))
+			q := url.Values{"parameter": {*parameter}, "date_from": {stamp(t)}, "date_to": {stamp(t.AddDate(0, 0, 1))}}
+			if err := f.pages("/v2/measurements", q, dayDir(t), "v2"); err != nil {
+				return err
+			}
+		}
+	case "v3":
+		q := url.Values{"parameters_id": {strconv.Itoa(*parameterID)}}
+		if *bbox != "" {
+			q.Set("bbox", *bbox)
+		}
+		if err := f.pages("/v3/locations", q, locDir, "v3"); err != nil {
+			return err
+		}
+		c, err := openOpenAQCache(*cacheDir)
+		if err != nil {
+			return err
+		}
+		sensors, err := cachedSensors(locDir, *parameter)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d %s sensors at %d locations\n", len(sensors), *parameter, len(c.locations))
+		for t := from; !t.After(to); t = t.AddDate(0, 0, 1) {
+			fmt.Printf("Fetching %s\n", t.Format("2006-01-02"))
+			q := url.Values{"datetime_from": {stamp(t)}, "datetime_to": {stamp(t.AddDate(0, 0, 1))}}
+			for _, s := range sensors {
+				endpoint := fmt.Sprintf("/v3/sensors/%d/measurements", s)
+				if err := f.pages(endpoint, q, dayDir(t), fmt.Sprintf("sensor_%d", s)); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("fetch: unknown API version %q: should be v2 or v3", *api)
+	}
+	return nil
+}
+
+// cachedSensors returns the ids of the v3 sensors of parameter in the
+// cached locations pages.
+func cachedSensors(locDir, parameter string) ([]int, error) {
+	pages, err := filepath.Glob(filepath.Join(locDir, "v3_*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var sensors []int
+	for _, path := range pages {
+		resp, err := readOpenAQPage(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Results {
+			for _, s := range r.Sensors {
+				if strings.ToLower(s.Parameter.Name) == parameter {
+					sensors = append(sensors, s.ID)
+				}
+			}
+		}
+	}
+	sort.Ints(sensors)
+	return sensors, nil
+}
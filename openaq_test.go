@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOpenAQRecord(t *testing.T) {
+	for _, test := range []struct {
+		name                 string
+		json                 string
+		country, param, unit string
+	}{
+		{"v2", `{"country": "CN", "parameter": "PM25", "unit": "µg/m³"}`, "CN", "pm25", "µg/m³"},
+		{"v3", `{"country": {"id": 3, "code": "CL"}, "parameter": {"name": "pm25", "units": "ppm"}}`, "CL", "pm25", "ppm"},
+		{"neither", `{}`, "", "", ""},
+	} {
+		var r openaqRecord
+		if err := json.Unmarshal([]byte(test.json), &r); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		param, unit := r.parameter()
+		if r.country() != test.country || param != test.param || unit != test.unit {
+			t.Errorf("%s: the record is from %q of %q in %q, not %q of %q in %q", test.name, r.country(), param, unit, test.country, test.param, test.unit)
+		}
+	}
+}
+
+func TestOpenAQLocations(t *testing.T) {
+	c, err := openOpenAQCache(filepath.Join("testfiles", "openaq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]openaqLocation{
+		225:  {name: "Escuela E-10", city: "Tocopilla", country: "CL", lat: -22.087, lon: -70.193253},
+		7321: {name: "Bukhiin urguu", city: "Ulaanbaatar", country: "MN", lat: 47.9176056, lon: 106.9373611},
+	}
+	if !reflect.DeepEqual(c.locations, want) {
+		t.Errorf("the locations are %+v, not %+v", c.locations, want)
+	}
+	if want := map[int]int{613: 225, 614: 225, 25004: 7321}; !reflect.DeepEqual(c.sensors, want) {
+		t.Errorf("the sensors are at %v, not %v", c.sensors, want)
+	}
+	days, err := c.Days()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDays := []time.Time{
+		time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC),
+		time.Date(2015, 11, 21, 0, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(days, wantDays) {
+		t.Errorf("the days are %v, not %v", days, wantDays)
+	}
+}
+
+func TestOpenAQObservations(t *testing.T) {
+	c, err := openOpenAQCache(filepath.Join("testfiles", "openaq"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := func(day, h int) time.Time { return time.Date(2015, 11, day, h, 0, 0, 0, time.UTC) }
+	ulaanbaatar := func(h int, v float64) observation {
+		return observation{location: "Bukhiin urguu", city: "Ulaanbaatar", country: "MN", utc: hour(20, h),
+			local: hour(20, h+8).Format("2006-01-02T15:04:05") + "+08:00", parameter: "pm25", value: v, unit: "µg/m³",
+			lat: 47.9176056, lon: 106.9373611}
+	}
+	tocopilla := func(h int, v float64) observation {
+		return observation{location: "Escuela E-10", city: "Tocopilla", country: "CL", utc: hour(20, h),
+			local: hour(19, h+21).Format("2006-01-02T15:04:05") + "-03:00", parameter: "pm25", value: v, unit: "µg/m³",
+			lat: -22.087, lon: -70.193253}
+	}
+	shenyang := func(h int, v float64) observation {
+		return observation{location: "Shenyang", city: "Shenyang", country: "CN", utc: hour(21, h),
+			local: hour(21, h+8).Format("2006-01-02T15:04:05") + "+08:00", parameter: "pm25", value: v, unit: "µg/m³",
+			lat: 41.78, lon: 123.42}
+	}
+	for _, test := range []struct {
+		day  time.Time
+		want []observation
+	}{
+		// v3 measurements of two sensors, timed by the end of their hour and
+		// placed by the locations of the sensors.
+		{hour(20, 0), []observation{
+			ulaanbaatar(1, 115), ulaanbaatar(2, 98), ulaanbaatar(3, 87), ulaanbaatar(4, 102), ulaanbaatar(5, 130), ulaanbaatar(6, 141),
+			tocopilla(1, 4), tocopilla(2, 6), tocopilla(3, 9), tocopilla(4, 12), tocopilla(5, 8), tocopilla(6, 5),
+		}},
+		// v2 measurements, with their own locations.
+		{hour(21, 0), []observation{
+			shenyang(0, 102),
+			{location: "Guangzhou", city: "Guangzhou", country: "CN", utc: hour(21, 1), local: "2015-11-21T09:00:00+08:00",
+				parameter: "pm25", value: 50, unit: "µg/m³", lat: 23.12, lon: 113.32},
+			shenyang(2, 96),
+		}},
+	} {
+		obs, err := c.Observations(test.day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(obs) != len(test.want) {
+			t.Errorf("%s: there are %d observations, not %d", test.day.Format("2006-01-02"), len(obs), len(test.want))
+			continue
+		}
+		for i := range obs {
+			if !reflect.DeepEqual(obs[i], test.want[i]) {
+				t.Errorf("%s: observation %d is %+v, not %+v", test.day.Format("2006-01-02"), i, obs[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestOpenAQUnknownSensor(t *testing.T) {
+	// A sensor that isn't in the locations pages has no location, so its
+	// measurements are skipped.
+	dir := t.TempDir()
+	day := filepath.Join(dir, "measurements", "2015-11-20")
+	if err := os.MkdirAll(day, 0755); err != nil {
+		t.Fatal(err)
+	}
+	page := `{"results": [{"value": 3, "parameter": {"name": "pm25", "units": "µg/m³"},
+		"period": {"datetimeTo": {"utc": "2015-11-20T01:00:00Z"}}}]}`
+	if err := os.WriteFile(filepath.Join(day, "sensor_99_1.json"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := openOpenAQCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs, err := c.Observations(time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(obs) != 0 {
+		t.Errorf("the measurements of an unknown sensor should be skipped, not read as %+v", obs)
+	}
+}
@@ -3,142 +3,216 @@ package main
 import (
 	"fmt"
 	"math"
+	"sort"
 )
 
-//Mean bias: 1/N Σ(Mi - Oi)
-func meanBias(Data []xy) (float64, error) {
+// metric is a named model performance statistic. The statistics can be
+// weighted by giving a weight for every data point, e.g. from
+// applyWeighting. With no weights, every point counts equally.
+type metric struct {
+	name string
+	f    func(Data []xy, w ...float64) (float64, error)
+}
+
+// metrics lists the statistics in this file in the order that they are
+// reported.
+var metrics = []metric{
+	{"Mean bias", meanBias},
+	{"Mean error", meanError},
+	{"RMSE", rmse},
+	{"Fractional bias", fracBias},
+	{"Fractional error", fracError},
+	{"Normalised mean bias", normMeanBias},
+	{"Normalised mean error", normMeanError},
+	{"Mean normalised bias", meanNormBias},
+	{"Mean normalised error", meanNormError},
+	{"Unpaired peak accuracy", unpairedPeakAcc},
+	{"Index of Agreement", indexOfAgr},
+	{"Coefficient of determination", coefDeterm},
+	{"KS statistic", ksStatistic},
+	{"50th percentile bias", percentileBias(50)},
+	{"90th percentile bias", percentileBias(90)},
+	{"98th percentile bias", percentileBias(98)},
+}
+
+// checkData returns an error if there is no data or if the weights don't
+// match the data or are negative, and otherwise the sum of the weights.
+func checkData(Data []xy, w []float64) (float64, error) {
 	if len(Data) == 0 {
 		return 0, fmt.Errorf("The data input is nil")
 	}
-	recip := 1 / float64(len(Data))
+	if len(w) == 0 {
+		return float64(len(Data)), nil
+	}
+	if len(w) != len(Data) {
+		return 0, fmt.Errorf("there are %d weights for %d data points", len(w), len(Data))
+	}
+	var sumW float64
+	for i, wi := range w {
+		if wi < 0 || math.IsNaN(wi) {
+			return 0, fmt.Errorf("the weight of data point %d is %f", i, wi)
+		}
+		sumW += wi
+	}
+	if sumW <= 0 {
+		return 0, fmt.Errorf("the weights sum to %f", sumW)
+	}
+	return sumW, nil
+}
+
+// weight is the weight of the ith data point, which is 1 if there are no
+// weights.
+func weight(w []float64, i int) float64 {
+	if len(w) == 0 {
+		return 1
+	}
+	return w[i]
+}
+
+// Mean bias: 1/N Σ(Mi - Oi)
+func meanBias(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
+	}
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := (xy.x - xy.y)
-		summa += arg
+		summa += weight(w, i) * arg
 	}
-	return summa * recip, nil
+	return summa / sumW, nil
 }
 
-//Mean error: 1/N Σ|Mi - Oi|
-func meanError(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+// Mean error: 1/N Σ|Mi - Oi|
+func meanError(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
-	recip := 1 / float64(len(Data))
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := math.Abs(xy.x - xy.y)
-		summa += arg
+		summa += weight(w, i) * arg
 	}
-	return summa * recip, nil
+	return summa / sumW, nil
 }
 
-//Root Mean Squared Error: √((Σ(Mi-Oi))²/N)
-func rmse(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+// Root Mean Squared Error: √(Σ(Mi-Oi)²/N)
+func rmse(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := xy.x - xy.y
-		summa += arg
+		summa += weight(w, i) * arg * arg
 	}
-	return math.Sqrt(math.Pow(summa, 2) / float64(len(Data))), nil
+	return math.Sqrt(summa / sumW), nil
 }
 
 // Fractional Bias: 100% x 2/NΣ((Mi-Oi)/(Mi+Oi))
-func fracBias(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func fracBias(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := (xy.x - xy.y) / (xy.x + xy.y)
-		summa += arg
+		summa += weight(w, i) * arg
 	}
-	return 100 * (2 / float64(len(Data))) * summa, nil
+	return 100 * (2 / sumW) * summa, nil
 }
 
 // Fractional Error: 100% x 2/NΣ(|Mi-Oi|/(Mi+Oi))
-func fracError(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func fracError(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := (math.Abs(xy.x-xy.y) / (xy.x + xy.y))
-		summa += arg
+		summa += weight(w, i) * arg
 	}
-	return 100 * (2 / float64(len(Data))) * summa, nil
+	return 100 * (2 / sumW) * summa, nil
 }
 
 // Normalised Mean Bias: 100% x Σ(Mi-Oi)/ΣOi
-func normMeanBias(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func normMeanBias(Data []xy, w ...float64) (float64, error) {
+	if _, err := checkData(Data, w); err != nil {
+		return 0, err
 	}
 	var summa float64
 	var sumOi float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := (xy.x - xy.y)
-		summa += arg
-		sumOi += xy.y
+		summa += weight(w, i) * arg
+		sumOi += weight(w, i) * xy.y
 	}
 	return 100 * summa / sumOi, nil
 }
 
 // Normalised Mean Error: 100% x Σ|Mi-Oi|/ΣOi
-func normMeanError(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func normMeanError(Data []xy, w ...float64) (float64, error) {
+	if _, err := checkData(Data, w); err != nil {
+		return 0, err
 	}
 	var summa float64
 	var sumOi float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		arg := math.Abs(xy.x - xy.y)
-		summa += arg
-		sumOi += xy.y
+		summa += weight(w, i) * arg
+		sumOi += weight(w, i) * xy.y
 	}
 	return 100 * summa / sumOi, nil
 }
 
 // Mean Normalized Bias: 100% x 1/NΣ((Mi-Oi)/Oi)
-func meanNormBias(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func meanNormBias(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		if xy.y != 0 {
 			arg := ((xy.x - xy.y) / xy.y)
-			summa += arg
+			summa += weight(w, i) * arg
 		}
 	}
-	return 100 * (1 / float64(len(Data))) * summa, nil
+	return 100 * (1 / sumW) * summa, nil
 }
 
 // Mean Normalized Error: 100% x 1/NΣ|((Mi-Oi)/Oi)|
-func meanNormError(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func meanNormError(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var summa float64
-	for _, xy := range Data {
+	for i, xy := range Data {
 		if xy.y != 0 {
 			arg := math.Abs((xy.x - xy.y) / xy.y)
-			summa += arg
+			summa += weight(w, i) * arg
 		}
 	}
-	return 100 * (1 / float64(len(Data))) * summa, nil
+	return 100 * (1 / sumW) * summa, nil
 }
 
 // Unpaired Peak Accuracy: 100% x (Mpeak - Opeak)/Opeak
-func unpairedPeakAcc(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+// The peaks don't depend on the weights, except that points with no weight
+// are left out.
+func unpairedPeakAcc(Data []xy, w ...float64) (float64, error) {
+	if _, err := checkData(Data, w); err != nil {
+		return 0, err
 	}
 	var mPeak, oPeak float64
-	for _, xy := range Data {
+	for i, xy := range Data {
+		if weight(w, i) == 0 {
+			continue
+		}
 		if xy.x > mPeak {
 			mPeak = xy.x
 		}
@@ -150,43 +224,139 @@ func unpairedPeakAcc(Data []xy) (float64, error) {
 }
 
 // Index of Agreement: 1 - Σ(Mi-Oi)²/Σ(|Mi-O*|+|Oi-O*|)
-func indexOfAgr(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func indexOfAgr(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var summa, sumDenom, oMean float64
-	for _, xy := range Data {
-		oMean += xy.y
+	for i, xy := range Data {
+		oMean += weight(w, i) * xy.y
 	}
-	oMean = oMean / float64(len(Data))
-	for _, xy := range Data {
+	oMean = oMean / sumW
+	for i, xy := range Data {
 		arg := math.Pow((xy.x - xy.y), 2)
-		summa += arg
+		summa += weight(w, i) * arg
 		denom := math.Abs(xy.x-oMean) + math.Abs(xy.y-oMean)
-		sumDenom += denom
+		sumDenom += weight(w, i) * denom
 	}
 	return 1 - (summa / sumDenom), nil
 }
 
 // Coefficient of Determination: ((Σⁿ₁((Mi-M*)x(Oi-O*)))/√(Σⁿ₁(Mi-M*)²Σⁿ(Oi-O*)²))²
-func coefDeterm(Data []xy) (float64, error) {
-	if len(Data) == 0 {
-		return 0, fmt.Errorf("The data input is nil")
+func coefDeterm(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
 	}
 	var sumNum, sumDenomM, sumDenomO, oMean, mMean float64
-	for _, xy := range Data {
-		mMean += xy.x
-		oMean += xy.y
+	for i, xy := range Data {
+		mMean += weight(w, i) * xy.x
+		oMean += weight(w, i) * xy.y
 	}
-	mMean = mMean / float64(len(Data))
-	oMean = oMean / float64(len(Data))
-	for _, xy := range Data {
+	mMean = mMean / sumW
+	oMean = oMean / sumW
+	for i, xy := range Data {
+		wi := weight(w, i)
 		numerator := (xy.x - mMean) * (xy.y - oMean)
-		sumNum += numerator
+		sumNum += wi * numerator
 		argM := math.Pow(xy.x-mMean, 2)
-		sumDenomM += argM
+		sumDenomM += wi * argM
 		argO := math.Pow(xy.y-oMean, 2)
-		sumDenomO += argO
+		sumDenomO += wi * argO
 	}
 	return math.Pow((sumNum)/math.Sqrt(sumDenomM*sumDenomO), 2), nil
 }
+
+// weightedValue is a value with its weight, for the distribution metrics.
+type weightedValue struct {
+	v, w float64
+}
+
+// sortedValues returns the simulated (model) or measured values of the
+// data with their weights, sorted by value. Points with zero weight are
+// left out.
+func sortedValues(Data []xy, w []float64, model bool) []weightedValue {
+	vals := make([]weightedValue, 0, len(Data))
+	for i, xy := range Data {
+		wi := weight(w, i)
+		if wi == 0 {
+			continue
+		}
+		v := xy.y
+		if model {
+			v = xy.x
+		}
+		vals = append(vals, weightedValue{v, wi})
+	}
+	sort.Slice(vals, func(i, j int) bool { return vals[i].v < vals[j].v })
+	return vals
+}
+
+// weightedPercentile returns the pth percentile of the sorted values. Each
+// value is placed at the middle of its share of the total weight, and the
+// percentile is interpolated between them.
+func weightedPercentile(vals []weightedValue, sumW, p float64) float64 {
+	target := p / 100 * sumW
+	var cum, prevPos float64
+	for i, v := range vals {
+		pos := cum + v.w/2
+		if target <= pos {
+			if i == 0 {
+				return v.v
+			}
+			return vals[i-1].v + (target-prevPos)/(pos-prevPos)*(v.v-vals[i-1].v)
+		}
+		cum += v.w
+		prevPos = pos
+	}
+	return vals[len(vals)-1].v
+}
+
+// Kolmogorov-Smirnov statistic: max|F_M(c) - F_O(c)|, the largest
+// difference between the cumulative distributions of the simulated and
+// measured values. It doesn't depend on the pairing.
+func ksStatistic(Data []xy, w ...float64) (float64, error) {
+	sumW, err := checkData(Data, w)
+	if err != nil {
+		return 0, err
+	}
+	m := sortedValues(Data, w, true)
+	o := sortedValues(Data, w, false)
+	var fm, fo, d float64
+	i, j := 0, 0
+	for i < len(m) || j < len(o) {
+		// Step past every value equal to the smallest value left in
+		// either distribution, so ties don't count as differences.
+		c := math.Inf(1)
+		if i < len(m) {
+			c = m[i].v
+		}
+		if j < len(o) && o[j].v < c {
+			c = o[j].v
+		}
+		for ; i < len(m) && m[i].v == c; i++ {
+			fm += m[i].w
+		}
+		for ; j < len(o) && o[j].v == c; j++ {
+			fo += o[j].w
+		}
+		d = math.Max(d, math.Abs(fm-fo)/sumW)
+	}
+	return d, nil
+}
+
+// percentileBias returns the percentile bias metric: Mp - Op, where Mp and
+// Op are the pth percentiles of the simulated and measured values. Like
+// the unpaired peak accuracy it doesn't depend on the pairing.
+func percentileBias(p float64) func(Data []xy, w ...float64) (float64, error) {
+	return func(Data []xy, w ...float64) (float64, error) {
+		sumW, err := checkData(Data, w)
+		if err != nil {
+			return 0, err
+		}
+		m := sortedValues(Data, w, true)
+		o := sortedValues(Data, w, false)
+		return weightedPercentile(m, sumW, p) - weightedPercentile(o, sumW, p), nil
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRMSE(t *testing.T) {
+	// The errors of +2 and -2 cancel in the mean bias, but not in the RMSE.
+	data := []xy{{3, 1}, {1, 3}}
+	if v, err := rmse(data); err != nil || v != 2 {
+		t.Errorf("the RMSE is %g (%v), not 2", v, err)
+	}
+	if v, err := meanBias(data); err != nil || v != 0 {
+		t.Errorf("the mean bias is %g (%v), not 0", v, err)
+	}
+
+	// Weighted, the squared errors of 1 and 4 are averaged 3:1.
+	data = []xy{{2, 1}, {1, 3}}
+	if v, err := rmse(data, 3, 1); err != nil || math.Abs(v-math.Sqrt(1.75)) > 1e-12 {
+		t.Errorf("the weighted RMSE is %g (%v), not √1.75", v, err)
+	}
+}
+
+func TestCheckData(t *testing.T) {
+	data := []xy{{1, 1}, {2, 2}, {3, 3}}
+	if sumW, err := checkData(data, []float64{1, 2, 0}); err != nil || sumW != 3 {
+		t.Errorf("the weights sum to %g (%v), not 3", sumW, err)
+	}
+	for _, w := range [][]float64{{1, 2}, {2, -1, 1}, {1, math.NaN(), 1}, {0, 0, 0}} {
+		if _, err := checkData(data, w); err == nil {
+			t.Errorf("the weights %v should be rejected", w)
+		}
+	}
+	if _, err := checkData(nil, nil); err == nil {
+		t.Error("no data should be rejected")
+	}
+}
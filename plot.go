@@ -2,26 +2,34 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"flag"
 	"fmt"
 	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/palette/moreland"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
 	"gonum.org/v1/plot/vg/draw"
 	"image/color"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
+	"time"
 )
 
 /*
 func main() {
-	xys, err := readDataConcat("/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/output")
+	xys, err := readDataConcat(datasetOptions{folder: "/home/marshall/sthakrar/go/src/github.com/SumilThakr/aqcomp/output"})
 	if err != nil {
 		log.Fatalf("could not read data.txt: %v", err)
 	}
 
-	err = plotData("out.pdf", xys)
+	err = plotData("out.pdf", xys, defaultScatterOptions, figOptions{})
 	if err != nil {
 		log.Fatalf("could not plot data: %v", err)
 	}
@@ -29,58 +37,315 @@ func main() {
 }
 */
 
-func plotData(path string, xys []xy) error {
-	// make a file to write to
-	f, err := os.Create(path)
+// scatterOptions are the settings for plotData.
+type scatterOptions struct {
+	title string
+	// Only points with both values in [min, max] are plotted. A max of 0
+	// means that there is no upper limit.
+	min, max float64
+	// logAxes uses log scales on both axes. Points that aren't positive
+	// are left out.
+	logAxes bool
+	// density colors a 2-D histogram of the points by the number of points
+	// in each bin, rather than drawing every point. It is used anyway when
+	// there are more than densityAbove points.
+	density      bool
+	densityAbove int
+	bins         int // histogram bins along each axis
+	// weighting weights the regression line and the statistics in the box
+	// (see applyWeighting). With cell weighting the points are the cell
+	// averages.
+	weighting string
+}
+
+var defaultScatterOptions = scatterOptions{
+	title:        "Simulated vs. measured PM2.5",
+	densityAbove: 20000,
+	bins:         100,
+}
+
+// plotData makes a scatter plot of the simulated (x) and measured (y)
+// values of the pairs, with 1:1, 1:2 and 2:1 lines, the regression line,
+// and the main statistics.
+func plotData(path string, pairs []pair, opts scatterOptions, fig figOptions) error {
+	xys, weights, err := applyWeighting(pairs, opts.weighting)
 	if err != nil {
-		return fmt.Errorf("could not create %s: %v", path, err)
+		return err
+	}
+	var data []xy
+	var w []float64
+	for i, xy := range xys {
+		if xy.x < opts.min || xy.y < opts.min {
+			continue
+		}
+		if opts.max > 0 && (xy.x > opts.max || xy.y > opts.max) {
+			continue
+		}
+		if opts.logAxes && (xy.x <= 0 || xy.y <= 0) {
+			continue
+		}
+		data = append(data, xy)
+		if weights != nil {
+			w = append(w, weights[i])
+		}
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("there are no points to plot in %s", path)
 	}
 
 	p, err := plot.New()
 	if err != nil {
 		return fmt.Errorf("could not create plot: %v", err)
 	}
+	p.Title.Text = opts.title
+	p.X.Label.Text = "Simulated PM2.5 (μg/m³)"
+	p.Y.Label.Text = "Measured PM2.5 (μg/m³)"
 
-	pxys := make(plotter.XYs, len(xys))
-	for i, xy := range xys {
-		if xy.x > 0 && xy.y > 0 && xy.x < 80 && xy.y < 80 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, xy := range data {
+		lo = math.Min(lo, math.Min(xy.x, xy.y))
+		hi = math.Max(hi, math.Max(xy.x, xy.y))
+	}
+	if !opts.logAxes {
+		lo = math.Min(lo, 0)
+	}
+	if hi == lo {
+		hi = lo + 1
+	}
+	if opts.logAxes {
+		p.X.Scale, p.Y.Scale = plot.LogScale{}, plot.LogScale{}
+		p.X.Tick.Marker, p.Y.Tick.Marker = plot.LogTicks{}, plot.LogTicks{}
+	}
+
+	if opts.density || len(data) > opts.densityAbove {
+		bins := opts.bins
+		if bins <= 0 {
+			bins = defaultScatterOptions.bins
+		}
+		p.Add(newDensity(data, lo, hi, bins, opts.logAxes))
+	} else {
+		pxys := make(plotter.XYs, len(data))
+		for i, xy := range data {
 			pxys[i].X = xy.x
 			pxys[i].Y = xy.y
 		}
+		s, err := plotter.NewScatter(pxys)
+		if err != nil {
+			return fmt.Errorf("could not create scatter: %v", err)
+		}
+		s.GlyphStyle.Shape = draw.CircleGlyph{}
+		s.Color = color.NRGBA{R: 255, A: 50}
+		s.Radius = vg.Points(1)
+		if len(data) < 1000 {
+			s.Color = color.NRGBA{R: 255, A: 160}
+			s.Radius = vg.Points(2)
+		}
+		p.Add(s)
 	}
 
-	s, err := plotter.NewScatter(pxys)
-	if err != nil {
-		return fmt.Errorf("could not create scatter: %v", err)
+	// The reference lines, spanning the data.
+	for _, ref := range []struct {
+		name   string
+		slope  float64
+		dashes []vg.Length
+	}{
+		{"1:1", 1, nil},
+		{"1:2", 0.5, []vg.Length{vg.Points(4), vg.Points(2)}},
+		{"2:1", 2, []vg.Length{vg.Points(4), vg.Points(2)}},
+	} {
+		l, err := plotter.NewLine(linePoints(ref.slope, 0, lo, hi, opts.logAxes))
+		if err != nil {
+			return fmt.Errorf("could not create new line: %v", err)
+		}
+		l.Color = color.Gray{Y: 100}
+		l.Dashes = ref.dashes
+		p.Add(l)
+		p.Legend.Add(ref.name, l)
 	}
-	p.Add(s)
 
-	s.GlyphStyle.Shape = draw.CircleGlyph{}
-	s.Color = color.RGBA{R: 255, A: 50}
-	s.Radius = vg.Points(1)
-
-	l, err := plotter.NewLine(plotter.XYs{
-		{0, 0}, {35, 35},
-	})
+	slope, intercept := regression(data, w...)
+	l, err := plotter.NewLine(linePoints(slope, intercept, lo, hi, opts.logAxes))
 	if err != nil {
 		return fmt.Errorf("could not create new line: %v", err)
 	}
+	l.Color = color.RGBA{B: 200, A: 255}
+	l.Width = vg.Points(1)
 	p.Add(l)
+	p.Legend.Add(fmt.Sprintf("y = %.2fx %+.2f", slope, intercept), l)
+	p.Legend.Top = true
 
-	// number of pixels and image format
-	wt, err := p.WriterTo(4096, 4096, "pdf")
+	cod, _ := coefDeterm(data, w...)
+	nmb, _ := normMeanBias(data, w...)
+	nme, _ := normMeanError(data, w...)
+	box := annotation{lines: []string{
+		fmt.Sprintf("N = %d", len(data)),
+		fmt.Sprintf("R² = %.3f", cod),
+		fmt.Sprintf("NMB = %.1f%%", nmb),
+		fmt.Sprintf("NME = %.1f%%", nme),
+	}}
+	if opts.weighting != "" && opts.weighting != "none" {
+		box.lines = append(box.lines, "Weighting: "+opts.weighting)
+	}
+	p.Add(box)
+
+	// The axis limits are set last, as adding the lines extends them.
+	p.X.Min, p.X.Max = lo, hi
+	p.Y.Min, p.Y.Max = lo, hi
+
+	return fig.savePlot(path, p, 6*vg.Inch, 6*vg.Inch)
+}
+
+// scatterCmd is the "scatter" mode, which plots the paired results in a
+// folder.
+func scatterCmd(args []string) error {
+	fs := flag.NewFlagSet("scatter", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	outFile := fs.String("out", "scatter.pdf", "output file")
+	opts := defaultScatterOptions
+	fs.StringVar(&opts.title, "title", opts.title, "plot title")
+	fs.Float64Var(&opts.min, "min", opts.min, "smallest value to plot")
+	fs.Float64Var(&opts.max, "max", opts.max, "largest value to plot, or 0 for no limit")
+	fs.BoolVar(&opts.logAxes, "log", opts.logAxes, "use log axes")
+	fs.BoolVar(&opts.density, "density", opts.density, "color a 2-D histogram of the points by density")
+	fs.IntVar(&opts.densityAbove, "densityabove", opts.densityAbove, "use density coloring when there are more points than this")
+	fs.IntVar(&opts.bins, "bins", opts.bins, "density histogram bins along each axis")
+	fs.StringVar(&opts.weighting, "weight", "none", "weighting of the regression and statistics: none, station, cell or area")
+	fig := figFlags(fs)
+	fs.Parse(args)
+
+	ds, err := dataset()
 	if err != nil {
-		return fmt.Errorf("could not create writer: %v", err)
+		return err
 	}
-	_, err2 := wt.WriteTo(f)
-	if err2 != nil {
-		return fmt.Errorf("could not write to %s: %v:", path, err)
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
 	}
+	return plotData(*outFile, pairs, opts, *fig)
+}
 
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("could not close %s: %v", path, err)
+// linePoints returns points along y = slope*x + intercept between lo and
+// hi. On log axes more points are needed, as the line is curved unless the
+// intercept is 0.
+func linePoints(slope, intercept, lo, hi float64, logAxes bool) plotter.XYs {
+	if !logAxes {
+		return plotter.XYs{{X: lo, Y: slope*lo + intercept}, {X: hi, Y: slope*hi + intercept}}
+	}
+	const n = 100
+	var pts plotter.XYs
+	for i := 0; i <= n; i++ {
+		x := lo * math.Pow(hi/lo, float64(i)/n)
+		if y := slope*x + intercept; y > 0 {
+			pts = append(pts, plotter.XY{X: x, Y: y})
+		}
+	}
+	if len(pts) < 2 {
+		return plotter.XYs{{X: lo, Y: lo}, {X: lo, Y: lo}}
+	}
+	return pts
+}
+
+// regression is the least squares fit of y on x, weighted by w if it is
+// given.
+func regression(data []xy, w ...float64) (slope, intercept float64) {
+	var xMean, yMean, n float64
+	for i, xy := range data {
+		xMean += weight(w, i) * xy.x
+		yMean += weight(w, i) * xy.y
+		n += weight(w, i)
+	}
+	xMean /= n
+	yMean /= n
+	var sxy, sxx float64
+	for i, xy := range data {
+		sxy += weight(w, i) * (xy.x - xMean) * (xy.y - yMean)
+		sxx += weight(w, i) * (xy.x - xMean) * (xy.x - xMean)
+	}
+	if sxx == 0 {
+		return 0, yMean
+	}
+	slope = sxy / sxx
+	return slope, yMean - slope*xMean
+}
+
+// density is a 2-D histogram of the points, with each bin colored by the
+// log of the number of points in it.
+type density struct {
+	edges  []float64
+	counts map[[2]int]int
+	max    int
+}
+
+func newDensity(data []xy, lo, hi float64, bins int, logAxes bool) density {
+	d := density{edges: make([]float64, bins+1), counts: make(map[[2]int]int)}
+	for i := range d.edges {
+		f := float64(i) / float64(bins)
+		if logAxes {
+			d.edges[i] = lo * math.Pow(hi/lo, f)
+		} else {
+			d.edges[i] = lo + (hi-lo)*f
+		}
+	}
+	bin := func(v float64) int {
+		i := sort.SearchFloat64s(d.edges, v) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= bins {
+			i = bins - 1
+		}
+		return i
+	}
+	for _, xy := range data {
+		k := [2]int{bin(xy.x), bin(xy.y)}
+		d.counts[k]++
+		if d.counts[k] > d.max {
+			d.max = d.counts[k]
+		}
+	}
+	return d
+}
+
+func (d density) Plot(c draw.Canvas, plt *plot.Plot) {
+	trX, trY := plt.Transforms(&c)
+	cm := moreland.ExtendedBlackBody()
+	cm.SetMin(0)
+	cm.SetMax(math.Log10(float64(d.max)) + 1e-9)
+	for k, n := range d.counts {
+		clr, err := cm.At(math.Log10(float64(n)))
+		if err != nil {
+			continue
+		}
+		x0, x1 := trX(d.edges[k[0]]), trX(d.edges[k[0]+1])
+		y0, y1 := trY(d.edges[k[1]]), trY(d.edges[k[1]+1])
+		c.FillPolygon(clr, c.ClipPolygonXY([]vg.Point{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}}))
+	}
+}
+
+// annotation is a box of text in the top left corner of the plot.
+type annotation struct {
+	lines []string
+}
+
+func (a annotation) Plot(c draw.Canvas, plt *plot.Plot) {
+	sty := draw.TextStyle{Color: color.Black, Font: plt.Legend.TextStyle.Font}
+	pad := sty.Font.Size / 2
+	var w vg.Length
+	for _, l := range a.lines {
+		if lw := sty.Font.Width(l); lw > w {
+			w = lw
+		}
+	}
+	h := sty.Font.Extents().Height
+	x0 := c.Min.X + pad
+	y1 := c.Max.Y - pad
+	y0 := y1 - h*vg.Length(len(a.lines)) - 2*pad
+	c.FillPolygon(color.NRGBA{R: 255, G: 255, B: 255, A: 220}, []vg.Point{
+		{X: x0, Y: y0}, {X: x0 + w + 2*pad, Y: y0}, {X: x0 + w + 2*pad, Y: y1}, {X: x0, Y: y1},
+	})
+	for i, l := range a.lines {
+		c.FillText(sty, vg.Point{X: x0 + pad, Y: y1 - pad - h*vg.Length(i+1)}, l)
 	}
-	return nil
 }
 
 // this is a struct for the data elements.
@@ -110,17 +375,20 @@ func readData(path string) ([]xy, error) {
 		_, err := fmt.Sscanf(s.Text(), "%f,%f", &x, &y)
 		if err != nil {
 			log.Printf("discarding bad data point: %s: %v", s.Text(), err)
+			continue
 		}
 		xys = append(xys, xy{x, y})
 		// do s.Text() or s.Bytes(), depending on what you want.
 		//fmt.Println(s.Text())
 	}
-	if s.Err() != nil {
-		return nil, fmt.Errorf("could not scan: %v", err)
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not scan %s: %v", path, err)
 	}
 	return xys, nil
 }
 
+// writeDataConcat writes the simulated and measured values to a single csv
+// file.
 func writeDataConcat(outputFile string, xys []xy) error {
 
 	var tWrt []XY
@@ -140,51 +408,167 @@ func writeDataConcat(outputFile string, xys []xy) error {
 	return nil
 }
 
-func readDataConcat(csvFolder string) ([]xy, error) {
-	var csvList []string
-	errOne := filepath.Walk(csvFolder, func(path string, info os.FileInfo, err error) error {
-		csvList = append(csvList, path)
-		return nil
-	})
-	if errOne != nil {
-		log.Fatal(errOne)
+// pair is a paired simulated (x) and measured (y) value, with the station
+// information that the results can be grouped by.
+type pair struct {
+	xy
+	time     time.Time
+	location string
+	city     string
+	country  string
+	lat, lon float64
+	// local is the local time of the measurement, if it was in the
+	// paired results.
+	local time.Time
+	// cell is the index of the model grid cell of the pair, with its
+	// centre and its area in km², from the pairing. area is 0 if the
+	// paired results don't have the cell.
+	cell             int
+	cellLat, cellLon float64
+	area             float64
+}
+
+// hasStation is whether the station information was in the paired results.
+func (p pair) hasStation() bool {
+	return !p.time.IsZero()
+}
+
+// readPairs reads the paired results written by main from every file
+// selected by opts. The columns are the simulated and measured values, the UTC
+// time, the location, city and country, the station latitude and
+// longitude, and the local time. Older outputs with only the first two
+// columns are read with empty station information.
+func readPairs(opts datasetOptions) ([]pair, error) {
+	pairs, _, skipped, err := readPairFiles(opts)
+	for _, sk := range skipped {
+		log.Printf("discarding bad data point in %s: %s", sk.source, sk.reason)
 	}
+	return pairs, err
+}
 
-	csvList = csvList[1:]
+// pairFile is where paired results were read from, so that the results
+// can be traced back to their inputs.
+type pairFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	sha256  string
+	rows    int // rows read without errors
+}
 
-	var xys []xy
+// skippedData is data that was left out of the evaluation, with the reason.
+type skippedData struct {
+	source, reason string
+}
 
-	for _, path := range csvList {
+// readPairFiles is readPairs, but also returns the files that were read
+// and the rows that couldn't be parsed.
+func readPairFiles(opts datasetOptions) ([]pair, []pairFile, []skippedData, error) {
+	csvList, err := opts.files()
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-		f, err := os.Open(path)
+	var pairs []pair
+	var files []pairFile
+	var skipped []skippedData
+	for _, path := range csvList {
+		b, err := ioutil.ReadFile(path)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
-		defer f.Close()
-
-		s := bufio.NewScanner(f)
-		for s.Scan() {
-			var x, y float64
-			// So for every line, this Sscanf will read the string as this
-			// regex of 2 floats separated by a comma. It writes these into
-			// x and y.
-			_, err := fmt.Sscanf(s.Text(), "%f,%f", &x, &y)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		r := csv.NewReader(bytes.NewReader(b))
+		r.FieldsPerRecord = -1
+		lines, err := r.ReadAll()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading %s isn't working: %v", path, err)
+		}
+		pf := pairFile{path: path, size: info.Size(), modTime: info.ModTime(), sha256: fmt.Sprintf("%x", sha256.Sum256(b))}
+		for i, line := range lines {
+			p, err := parsePair(line)
 			if err != nil {
-				log.Printf("discarding bad data point: %s: %v", s.Text(), err)
+				skipped = append(skipped, skippedData{fmt.Sprintf("%s line %d", path, i+1), fmt.Sprintf("%v: %v", line, err)})
+				continue
 			}
-			xys = append(xys, xy{x, y})
-			// do s.Text() or s.Bytes(), depending on what you want.
-			//fmt.Println(s.Text())
+			pairs = append(pairs, p)
+			pf.rows++
+		}
+		files = append(files, pf)
+	}
+	return pairs, files, skipped, nil
+}
+
+func parsePair(line []string) (pair, error) {
+	var p pair
+	if len(line) < 2 {
+		return p, fmt.Errorf("there are %d columns", len(line))
+	}
+	var err error
+	if p.x, err = strconv.ParseFloat(line[0], 64); err != nil {
+		return p, err
+	}
+	if p.y, err = strconv.ParseFloat(line[1], 64); err != nil {
+		return p, err
+	}
+	if len(line) < 8 {
+		return p, nil
+	}
+	if p.time, err = time.Parse(time.RFC3339, line[2]); err != nil {
+		return p, err
+	}
+	p.location, p.city, p.country = line[3], line[4], line[5]
+	if p.lat, err = strconv.ParseFloat(line[6], 64); err != nil {
+		return p, err
+	}
+	if p.lon, err = strconv.ParseFloat(line[7], 64); err != nil {
+		return p, err
+	}
+	if len(line) > 8 && line[8] != "" {
+		if p.local, err = time.Parse(time.RFC3339, line[8]); err != nil {
+			return p, err
 		}
-		if s.Err() != nil {
-			return nil, fmt.Errorf("could not scan: %v", err)
+	}
+	if len(line) < 13 || line[12] == "" {
+		return p, nil
+	}
+	if p.cell, err = strconv.Atoi(line[9]); err != nil {
+		return p, err
+	}
+	for k, v := range []*float64{&p.cellLat, &p.cellLon, &p.area} {
+		if *v, err = strconv.ParseFloat(line[10+k], 64); err != nil {
+			return p, err
 		}
 	}
+	return p, nil
+}
 
-	errTwo := writeDataConcat("concatResults.csv", xys)
-	if errTwo != nil {
-		return xys, errTwo
+// pairRecord is the csv record of p, in the columns read by parsePair.
+func pairRecord(p pair) XY {
+	rec := XY{strconv.FormatFloat(p.x, 'f', -1, 64), strconv.FormatFloat(p.y, 'f', -1, 64)}
+	if p.time.IsZero() {
+		return rec
+	}
+	var local string
+	if !p.local.IsZero() {
+		local = p.local.Format(time.RFC3339)
+	}
+	rec = append(rec, p.time.Format(time.RFC3339), p.location, p.city, p.country,
+		strconv.FormatFloat(p.lat, 'f', -1, 64), strconv.FormatFloat(p.lon, 'f', -1, 64), local)
+	if p.area == 0 {
+		return rec
 	}
+	return append(rec, strconv.Itoa(p.cell), ff(p.cellLat), ff(p.cellLon), ff(p.area))
+}
 
-	return xys, nil
+// pairXYs returns the simulated and measured values of pairs.
+func pairXYs(pairs []pair) []xy {
+	out := make([]xy, len(pairs))
+	for i, p := range pairs {
+		out[i] = p.xy
+	}
+	return out
 }
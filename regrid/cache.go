@@ -0,0 +1,67 @@
+package regrid
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// Cached returns the weights from src to dst, reading them from the cache
+// directory if they were computed before, and otherwise computing them and
+// writing them to the cache. The cache file is named by
+// the method and a hash of both grids, so changed grids aren't read from
+// an old file.
+func Cached(dir string, src, dst Grid, m Method) (*Weights, error) {
+	h := sha256.New()
+	h.Write([]byte(m))
+	hashGrid(h, src)
+	hashGrid(h, dst)
+	path := filepath.Join(dir, fmt.Sprintf("%s_%x.gob", m, h.Sum(nil)[:8]))
+
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		var w Weights
+		if err := gob.NewDecoder(f).Decode(&w); err != nil {
+			return nil, fmt.Errorf("regrid: reading the cached weights in %s isn't working: %v", path, err)
+		}
+		if w.NSrc != src.Len() || w.NDst != dst.Len() || w.Method != m {
+			return nil, fmt.Errorf("regrid: the cached weights in %s are for other grids", path)
+		}
+		return &w, nil
+	}
+
+	w, err := Compute(src, dst, m)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewEncoder(f).Encode(w); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, fmt.Errorf("regrid: writing the weights to %s isn't working: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return w, os.Rename(tmp, path)
+}
+
+func hashGrid(h hash.Hash, g Grid) {
+	binary.Write(h, binary.LittleEndian, int64(g.Len()))
+	for i := 0; i < g.Len(); i++ {
+		for _, p := range g.Cell(i) {
+			binary.Write(h, binary.LittleEndian, p)
+		}
+	}
+}
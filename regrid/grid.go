@@ -0,0 +1,173 @@
+// Package regrid computes and applies regridding weights between
+// rectilinear latitude-longitude grids, such as the GEOS-Chem 2x2.5 and 4x5
+// grids, and grids of polygon cells, such as InMAP's variable resolution
+// cells.
+//
+// Three methods are supported: conservative (area weighted), bilinear
+// (from a rectilinear grid only) and nearest neighbour. Areas are computed
+// on the sphere for rectilinear cells, and in the equal-area cylindrical
+// projection (longitude against the sine of latitude) for polygon cells.
+// Weights can be cached on disk, since they only depend on the grids and
+// the method.
+package regrid
+
+import (
+	"fmt"
+	"math"
+)
+
+// EarthRadius is the radius used for cell areas, in km.
+const EarthRadius = 6371.0
+
+// Grid is a set of cells on the sphere.
+type Grid interface {
+	// Len is the number of cells.
+	Len() int
+	// Cell returns the outline of cell i as longitude, latitude vertices,
+	// without repeating the first vertex at the end.
+	Cell(i int) [][2]float64
+	// Centre returns the longitude and latitude of the centre of cell i.
+	Centre(i int) (lon, lat float64)
+}
+
+// Rectilinear is a latitude-longitude grid given by its cell edges, in
+// increasing order. Cell j*(len(LonEdges)-1)+i is the cell of the j-th
+// latitude and i-th longitude, as in a (lat, lon) netCDF variable.
+type Rectilinear struct {
+	LatEdges, LonEdges []float64
+}
+
+// NewRectilinear returns the grid with the given cell centres. The edges
+// are half way between the centres, and latitude edges are limited to the
+// poles.
+func NewRectilinear(latCentres, lonCentres []float64) (*Rectilinear, error) {
+	if len(latCentres) < 2 || len(lonCentres) < 2 {
+		return nil, fmt.Errorf("regrid: a rectilinear grid needs at least two latitudes and longitudes")
+	}
+	for _, c := range [][]float64{latCentres, lonCentres} {
+		for i := 1; i < len(c); i++ {
+			if c[i] <= c[i-1] {
+				return nil, fmt.Errorf("regrid: the cell centres should be increasing")
+			}
+		}
+	}
+	g := &Rectilinear{LatEdges: edges(latCentres), LonEdges: edges(lonCentres)}
+	for i, e := range g.LatEdges {
+		g.LatEdges[i] = math.Max(-90, math.Min(90, e))
+	}
+	return g, nil
+}
+
+func edges(c []float64) []float64 {
+	n := len(c)
+	e := make([]float64, n+1)
+	for i := 1; i < n; i++ {
+		e[i] = (c[i-1] + c[i]) / 2
+	}
+	e[0] = c[0] - (c[1]-c[0])/2
+	e[n] = c[n-1] + (c[n-1]-c[n-2])/2
+	return e
+}
+
+// GEOSChem returns the global GEOS-Chem grid with the given resolution in
+// degrees, e.g. 2 by 2.5 or 4 by 5. The cells are centred on the poles
+// and on 180°W, so the polar cells are half as tall as the others.
+func GEOSChem(dlat, dlon float64) *Rectilinear {
+	g := &Rectilinear{}
+	g.LatEdges = append(g.LatEdges, -90)
+	for lat := -90 + dlat/2; lat < 90; lat += dlat {
+		g.LatEdges = append(g.LatEdges, lat)
+	}
+	g.LatEdges = append(g.LatEdges, 90)
+	for lon := -180 - dlon/2; lon < 180-dlon/2+dlon/1e6; lon += dlon {
+		g.LonEdges = append(g.LonEdges, lon)
+	}
+	return g
+}
+
+func (g *Rectilinear) nlon() int { return len(g.LonEdges) - 1 }
+func (g *Rectilinear) nlat() int { return len(g.LatEdges) - 1 }
+
+func (g *Rectilinear) Len() int { return g.nlat() * g.nlon() }
+
+func (g *Rectilinear) Cell(i int) [][2]float64 {
+	j, k := i/g.nlon(), i%g.nlon()
+	s, n := g.LatEdges[j], g.LatEdges[j+1]
+	w, e := g.LonEdges[k], g.LonEdges[k+1]
+	return [][2]float64{{w, s}, {e, s}, {e, n}, {w, n}}
+}
+
+func (g *Rectilinear) Centre(i int) (lon, lat float64) {
+	j, k := i/g.nlon(), i%g.nlon()
+	return (g.LonEdges[k] + g.LonEdges[k+1]) / 2, (g.LatEdges[j] + g.LatEdges[j+1]) / 2
+}
+
+// Centres returns the latitudes and longitudes half way between the
+// edges, as the coordinates of the cells.
+func (g *Rectilinear) Centres() (lats, lons []float64) {
+	return centres(g.LatEdges), centres(g.LonEdges)
+}
+
+// Area returns the area of cell i on the sphere, in km².
+func (g *Rectilinear) Area(i int) float64 {
+	j, k := i/g.nlon(), i%g.nlon()
+	return EarthRadius * EarthRadius * (g.LonEdges[k+1] - g.LonEdges[k]) * math.Pi / 180 *
+		(math.Sin(g.LatEdges[j+1]*math.Pi/180) - math.Sin(g.LatEdges[j]*math.Pi/180))
+}
+
+// global is whether the longitudes go all the way round.
+func (g *Rectilinear) global() bool {
+	return math.Abs(g.LonEdges[len(g.LonEdges)-1]-g.LonEdges[0]-360) < 1e-6
+}
+
+// Polygons is a grid of polygon cells, each given by its outer ring of
+// longitude, latitude vertices.
+type Polygons [][][2]float64
+
+func (p Polygons) Len() int { return len(p) }
+
+func (p Polygons) Cell(i int) [][2]float64 {
+	ring := p[i]
+	if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+		ring = ring[:n-1]
+	}
+	return ring
+}
+
+// Centre is the centroid of the cell in the equal-area projection.
+func (p Polygons) Centre(i int) (lon, lat float64) {
+	ring := project(p.Cell(i))
+	var a, cx, cy float64
+	for k := range ring {
+		x0, y0 := ring[k][0], ring[k][1]
+		x1, y1 := ring[(k+1)%len(ring)][0], ring[(k+1)%len(ring)][1]
+		c := x0*y1 - x1*y0
+		a += c
+		cx += (x0 + x1) * c
+		cy += (y0 + y1) * c
+	}
+	if a == 0 {
+		return ring[0][0], math.Asin(ring[0][1]) * 180 / math.Pi
+	}
+	cx /= 3 * a
+	cy /= 3 * a
+	return cx, math.Asin(math.Max(-1, math.Min(1, cy))) * 180 / math.Pi
+}
+
+// CellArea returns the area of cell i of g, in km², from the Area method
+// of the grid if it has one, as for the cells with great circle edges of a
+// cubed sphere.
+func CellArea(g Grid, i int) float64 {
+	if a, ok := g.(interface{ Area(i int) float64 }); ok {
+		return a.Area(i)
+	}
+	return area(g, i)
+}
+
+// area returns the area of any cell, in km².
+func area(g Grid, i int) float64 {
+	if r, ok := g.(*Rectilinear); ok {
+		return r.Area(i)
+	}
+	return math.Abs(signedArea(project(g.Cell(i)))) * EarthRadius * EarthRadius * math.Pi / 180
+}
@@ -0,0 +1,163 @@
+package regrid
+
+import (
+	"math"
+	"sort"
+)
+
+// index finds the cells whose bounding boxes overlap a longitude and
+// latitude range, from buckets of a fixed size in degrees.
+type index struct {
+	size    float64
+	buckets map[[2]int][]int
+	stamp   []int
+	queries int
+}
+
+func newIndex(g Grid) *index {
+	idx := &index{buckets: make(map[[2]int][]int), stamp: make([]int, g.Len())}
+	// The buckets are about the size of the cells.
+	var extent float64
+	boxes := make([][4]float64, g.Len())
+	for i := range boxes {
+		minLon, minLat, maxLon, maxLat := bounds(g.Cell(i))
+		boxes[i] = [4]float64{minLon, minLat, maxLon, maxLat}
+		extent += math.Max(maxLon-minLon, maxLat-minLat)
+	}
+	idx.size = math.Max(0.01, math.Min(10, extent/float64(len(boxes)+1)))
+	for i, b := range boxes {
+		x0, y0, x1, y1 := idx.cells(b[0], b[1], b[2], b[3])
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				k := [2]int{x, y}
+				idx.buckets[k] = append(idx.buckets[k], i)
+			}
+		}
+	}
+	return idx
+}
+
+func (idx *index) cells(minLon, minLat, maxLon, maxLat float64) (x0, y0, x1, y1 int) {
+	return int(math.Floor(minLon / idx.size)), int(math.Floor(minLat / idx.size)),
+		int(math.Floor(maxLon / idx.size)), int(math.Floor(maxLat / idx.size))
+}
+
+// query returns the cells that may overlap the range, each once.
+func (idx *index) query(minLon, minLat, maxLon, maxLat float64) []int {
+	idx.queries++
+	var out []int
+	x0, y0, x1, y1 := idx.cells(minLon, minLat, maxLon, maxLat)
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; y++ {
+			for _, i := range idx.buckets[[2]int{x, y}] {
+				if idx.stamp[i] != idx.queries {
+					idx.stamp[i] = idx.queries
+					out = append(out, i)
+				}
+			}
+		}
+	}
+	sort.Ints(out)
+	return out
+}
+
+// pointIndex finds the cell centre nearest to a point.
+type pointIndex struct {
+	size    float64
+	nx      int
+	buckets map[[2]int][]int
+	lon     []float64
+	lat     []float64
+}
+
+func newPointIndex(g Grid) *pointIndex {
+	n := g.Len()
+	idx := &pointIndex{buckets: make(map[[2]int][]int), lon: make([]float64, n), lat: make([]float64, n)}
+	// About one centre per bucket, on average, over the area used.
+	minLon, minLat, maxLon, maxLat := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i := 0; i < n; i++ {
+		idx.lon[i], idx.lat[i] = g.Centre(i)
+		idx.lon[i] = wrapLon(idx.lon[i])
+		minLon, maxLon = math.Min(minLon, idx.lon[i]), math.Max(maxLon, idx.lon[i])
+		minLat, maxLat = math.Min(minLat, idx.lat[i]), math.Max(maxLat, idx.lat[i])
+	}
+	idx.size = math.Max(0.01, math.Min(10, math.Sqrt((maxLon-minLon+1)*(maxLat-minLat+1)/float64(n+1))))
+	idx.nx = int(math.Ceil(360 / idx.size))
+	for i := 0; i < n; i++ {
+		k := idx.key(idx.lon[i], idx.lat[i])
+		idx.buckets[k] = append(idx.buckets[k], i)
+	}
+	return idx
+}
+
+func wrapLon(lon float64) float64 {
+	lon = math.Mod(lon+180, 360)
+	if lon < 0 {
+		lon += 360
+	}
+	return lon - 180
+}
+
+func (idx *pointIndex) key(lon, lat float64) [2]int {
+	return [2]int{int(math.Floor((lon + 180) / idx.size)), int(math.Floor((lat + 90) / idx.size))}
+}
+
+// nearest searches rings of buckets around the point until a centre is
+// found, and then one more ring, since a centre in the next ring can be
+// closer than one in a corner of the ring before.
+func (idx *pointIndex) nearest(lon, lat float64) (int, bool) {
+	lon = wrapLon(lon)
+	k := idx.key(lon, lat)
+	best, bestD := -1, math.Inf(1)
+	maxRing := idx.nx/2 + int(180/idx.size) + 1
+	foundAt := -1
+	for r := 0; r <= maxRing; r++ {
+		for dx := -r; dx <= r; dx++ {
+			for dy := -r; dy <= r; dy++ {
+				if max(abs(dx), abs(dy)) != r {
+					continue
+				}
+				x := ((k[0]+dx)%idx.nx + idx.nx) % idx.nx
+				for _, i := range idx.buckets[[2]int{x, k[1] + dy}] {
+					if d := distance(lon, lat, idx.lon[i], idx.lat[i]); d < bestD {
+						best, bestD = i, d
+					}
+				}
+			}
+		}
+		if best >= 0 && foundAt < 0 {
+			foundAt = r
+		}
+		if foundAt >= 0 && r >= foundAt+1 {
+			break
+		}
+	}
+	return best, best >= 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// distance is the great circle distance between two points, in radians.
+func distance(lon1, lat1, lon2, lat2 float64) float64 {
+	const rad = math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func sortEntries(row []Entry) {
+	sort.Slice(row, func(i, j int) bool { return row[i].Src < row[j].Src })
+}
@@ -0,0 +1,66 @@
+package regrid
+
+import "math"
+
+// Locator finds the cell of a grid that contains a point, e.g. to sample
+// a model at station locations. It isn't safe for concurrent use.
+type Locator struct {
+	g      Grid
+	idx    *index
+	points *pointIndex
+}
+
+// NewLocator indexes the cells of g.
+func NewLocator(g Grid) *Locator {
+	return &Locator{g: g, idx: newIndex(g)}
+}
+
+// Find returns the cell containing the longitude and latitude, trying the
+// longitude shifted by a full turn either way so that grids given in 0 to
+// 360° are searched too. If the point is on a shared edge, the cell with
+// the lowest index is returned.
+func (l *Locator) Find(lon, lat float64) (int, bool) {
+	for _, dlon := range []float64{0, -360, 360} {
+		x := lon + dlon
+		for _, i := range l.idx.query(x, lat, x, lat) {
+			if inside(l.g.Cell(i), x, lat) {
+				return i, true
+			}
+		}
+	}
+	return -1, false
+}
+
+// inside is whether the point is in the ring, or on its boundary.
+func inside(ring [][2]float64, x, y float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if onSegment(ring[i], ring[j], x, y) {
+			return true
+		}
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+func onSegment(a, b [2]float64, x, y float64) bool {
+	cross := (b[0]-a[0])*(y-a[1]) - (b[1]-a[1])*(x-a[0])
+	if cross > 1e-12 || cross < -1e-12 {
+		return false
+	}
+	return x >= math.Min(a[0], b[0]) && x <= math.Max(a[0], b[0]) && y >= math.Min(a[1], b[1]) && y <= math.Max(a[1], b[1])
+}
+
+// Nearest returns the cell whose centre is nearest to the point, e.g. for
+// a point that Find doesn't place because its cell can't be drawn in
+// longitude and latitude, such as a cell around a pole.
+func (l *Locator) Nearest(lon, lat float64) (int, bool) {
+	if l.points == nil {
+		l.points = newPointIndex(l.g)
+	}
+	return l.points.nearest(lon, lat)
+}
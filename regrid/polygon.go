@@ -0,0 +1,115 @@
+package regrid
+
+import "math"
+
+// project converts longitude, latitude vertices to the equal-area
+// cylindrical projection, longitude against the sine of latitude, in which
+// areas are proportional to areas on the sphere.
+func project(ring [][2]float64) [][2]float64 {
+	out := make([][2]float64, len(ring))
+	for i, p := range ring {
+		out[i] = [2]float64{p[0], math.Sin(p[1] * math.Pi / 180)}
+	}
+	return out
+}
+
+// signedArea is the area of a ring, positive if it is anticlockwise.
+func signedArea(ring [][2]float64) float64 {
+	var a float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		a += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	return a / 2
+}
+
+// convex is whether a ring is convex.
+func convex(ring [][2]float64) bool {
+	n := len(ring)
+	if n < 3 {
+		return false
+	}
+	var sign float64
+	for i := range ring {
+		a, b, c := ring[i], ring[(i+1)%n], ring[(i+2)%n]
+		cross := (b[0]-a[0])*(c[1]-b[1]) - (b[1]-a[1])*(c[0]-b[0])
+		if cross == 0 {
+			continue
+		}
+		if sign == 0 {
+			sign = cross
+		} else if sign*cross < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// clip returns the part of subject inside the convex ring clipper, by the
+// Sutherland-Hodgman algorithm.
+func clip(subject, clipper [][2]float64) [][2]float64 {
+	orient := 1.0
+	if signedArea(clipper) < 0 {
+		orient = -1
+	}
+	out := subject
+	for i := range clipper {
+		if len(out) == 0 {
+			break
+		}
+		a, b := clipper[i], clipper[(i+1)%len(clipper)]
+		inside := func(p [2]float64) bool {
+			return orient*((b[0]-a[0])*(p[1]-a[1])-(b[1]-a[1])*(p[0]-a[0])) >= 0
+		}
+		in := out
+		out = nil
+		for k := range in {
+			cur, prev := in[k], in[(k+len(in)-1)%len(in)]
+			if inside(cur) {
+				if !inside(prev) {
+					out = append(out, intersect(prev, cur, a, b))
+				}
+				out = append(out, cur)
+			} else if inside(prev) {
+				out = append(out, intersect(prev, cur, a, b))
+			}
+		}
+	}
+	return out
+}
+
+// intersect returns where the segment from p to q crosses the line
+// through a and b.
+func intersect(p, q, a, b [2]float64) [2]float64 {
+	d1x, d1y := q[0]-p[0], q[1]-p[1]
+	d2x, d2y := b[0]-a[0], b[1]-a[1]
+	den := d1x*d2y - d1y*d2x
+	if den == 0 {
+		return p
+	}
+	t := ((a[0]-p[0])*d2y - (a[1]-p[1])*d2x) / den
+	return [2]float64{p[0] + t*d1x, p[1] + t*d1y}
+}
+
+// shift moves a ring by dlon degrees of longitude.
+func shift(ring [][2]float64, dlon float64) [][2]float64 {
+	if dlon == 0 {
+		return ring
+	}
+	out := make([][2]float64, len(ring))
+	for i, p := range ring {
+		out[i] = [2]float64{p[0] + dlon, p[1]}
+	}
+	return out
+}
+
+// bounds returns the longitude and latitude range of a ring.
+func bounds(ring [][2]float64) (minLon, minLat, maxLon, maxLat float64) {
+	minLon, minLat = math.Inf(1), math.Inf(1)
+	maxLon, maxLat = math.Inf(-1), math.Inf(-1)
+	for _, p := range ring {
+		minLon, maxLon = math.Min(minLon, p[0]), math.Max(maxLon, p[0])
+		minLat, maxLat = math.Min(minLat, p[1]), math.Max(maxLat, p[1])
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package regrid
+
+import (
+	"math"
+	"sort"
+)
+
+// Accumulator regrids rectilinear grids that are too fine to keep their
+// weights, such as 0.01° satellite products, conservatively onto a
+// rectilinear grid. The source grids are added a row at a time, and each
+// source cell contributes to the destination cells it overlaps in
+// proportion to the overlapping area.
+type Accumulator struct {
+	dst          *Rectilinear
+	sum, covered []float64 // covered is in km², as the cell areas
+}
+
+// NewAccumulator returns an empty Accumulator onto dst.
+func NewAccumulator(dst *Rectilinear) *Accumulator {
+	return &Accumulator{dst: dst, sum: make([]float64, dst.Len()), covered: make([]float64, dst.Len())}
+}
+
+// AddRows adds the values of src, which rows returns a row of latitudes at
+// a time. Rows that don't overlap the destination grid aren't read, and
+// values that are NaN are left out. If sum is true the values are totals
+// (e.g. population counts) that are shared between the destination cells
+// by area, and otherwise they are averaged by area.
+func (a *Accumulator) AddRows(src *Rectilinear, rows func(j int) ([]float64, error), sum bool) error {
+	toKm2 := EarthRadius * EarthRadius * math.Pi / 180
+	lonOver := make([][]overlap, src.nlon())
+	for i := range lonOver {
+		lonOver[i] = overlaps(a.dst.LonEdges, src.LonEdges[i], src.LonEdges[i+1], 360)
+	}
+	for j := 0; j < src.nlat(); j++ {
+		latOver := sinOverlaps(a.dst.LatEdges, src.LatEdges[j], src.LatEdges[j+1])
+		if len(latOver) == 0 {
+			continue
+		}
+		row, err := rows(j)
+		if err != nil {
+			return err
+		}
+		for i, v := range row {
+			if math.IsNaN(v) {
+				continue
+			}
+			for _, la := range latOver {
+				for _, lo := range lonOver[i] {
+					w := la.length * lo.length * toKm2
+					c := la.cell*a.dst.nlon() + lo.cell
+					if sum {
+						a.sum[c] += v * w / src.Area(j*src.nlon()+i)
+					} else {
+						a.sum[c] += v * w
+					}
+					a.covered[c] += w
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Mean returns the area weighted average in each destination cell, or NaN
+// where the cell was covered by less than minCover of its area.
+func (a *Accumulator) Mean(minCover float64) []float64 {
+	out := make([]float64, len(a.sum))
+	for c := range out {
+		if a.covered[c] == 0 || a.covered[c] < minCover*a.dst.Area(c) {
+			out[c] = math.NaN()
+			continue
+		}
+		out[c] = a.sum[c] / a.covered[c]
+	}
+	return out
+}
+
+// Sum returns the totals shared out onto each destination cell.
+func (a *Accumulator) Sum() []float64 {
+	return append([]float64(nil), a.sum...)
+}
+
+// Coverage returns the fraction of each destination cell that was
+// covered.
+func (a *Accumulator) Coverage() []float64 {
+	out := make([]float64, len(a.covered))
+	for c := range out {
+		out[c] = a.covered[c] / a.dst.Area(c)
+	}
+	return out
+}
+
+// overlap is the part of an interval that lies in a cell.
+type overlap struct {
+	cell   int
+	length float64
+}
+
+// overlaps returns the cells (with increasing edges) that the interval
+// from lo to hi overlaps, and by how much. If period isn't zero (360 for
+// longitudes) the interval is also shifted by a period either way.
+func overlaps(edges []float64, lo, hi, period float64) []overlap {
+	var out []overlap
+	shifts := []float64{0}
+	if period != 0 {
+		shifts = []float64{-period, 0, period}
+	}
+	for _, s := range shifts {
+		a, b := lo+s, hi+s
+		if b <= edges[0] || a >= edges[len(edges)-1] {
+			continue
+		}
+		k := sort.SearchFloat64s(edges, a) - 1
+		if k < 0 {
+			k = 0
+		}
+		for ; k < len(edges)-1 && edges[k] < b; k++ {
+			l := math.Min(b, edges[k+1]) - math.Max(a, edges[k])
+			if l > 0 {
+				out = append(out, overlap{k, l})
+			}
+		}
+	}
+	return out
+}
+
+// sinOverlaps converts latitude overlaps to differences of the sine of
+// the latitude, to which the areas of the cells are proportional.
+func sinOverlaps(edges []float64, lo, hi float64) []overlap {
+	out := overlaps(edges, lo, hi, 0)
+	for i, o := range out {
+		a := math.Max(lo, edges[o.cell])
+		b := math.Min(hi, edges[o.cell+1])
+		out[i].length = math.Sin(b*math.Pi/180) - math.Sin(a*math.Pi/180)
+	}
+	return out
+}
@@ -0,0 +1,356 @@
+package regrid
+
+import (
+	"fmt"
+	"math"
+)
+
+// Method is a regridding method.
+type Method string
+
+const (
+	// Conservative weights each source cell by the area that it shares
+	// with the destination cell, so that the total of an extensive
+	// quantity, and the area integral of an intensive one, are kept.
+	Conservative Method = "conservative"
+	// Bilinear interpolates between the four source cell centres around
+	// each destination cell centre. The source grid has to be rectilinear.
+	Bilinear Method = "bilinear"
+	// Nearest takes the value of the source cell whose centre is closest
+	// to the destination cell centre.
+	Nearest Method = "nearest"
+)
+
+// ParseMethod returns the method with the given name.
+func ParseMethod(s string) (Method, error) {
+	switch m := Method(s); m {
+	case Conservative, Bilinear, Nearest:
+		return m, nil
+	}
+	return "", fmt.Errorf("regrid: unknown method %q: should be conservative, bilinear or nearest", s)
+}
+
+// Entry is the weight of a source cell in a destination cell.
+type Entry struct {
+	Src int
+	W   float64
+}
+
+// Weights maps values on a source grid to a destination grid. The
+// weights of each destination cell add up to one.
+type Weights struct {
+	Method     Method
+	NSrc, NDst int
+	// Rows are the weights of each destination cell.
+	Rows [][]Entry
+	// Covered is the area of each destination cell that overlaps the
+	// source grid, for conservative weights, in km².
+	Covered []float64
+	// SrcArea and DstArea are the cell areas, in km².
+	SrcArea, DstArea []float64
+}
+
+// Compute computes the weights for regridding from src to dst, and checks
+// them with Check.
+func Compute(src, dst Grid, m Method) (*Weights, error) {
+	w := &Weights{Method: m, NSrc: src.Len(), NDst: dst.Len(), Rows: make([][]Entry, dst.Len())}
+	w.SrcArea = make([]float64, src.Len())
+	for i := range w.SrcArea {
+		w.SrcArea[i] = area(src, i)
+	}
+	w.DstArea = make([]float64, dst.Len())
+	for j := range w.DstArea {
+		w.DstArea[j] = area(dst, j)
+	}
+	var err error
+	switch m {
+	case Conservative:
+		err = w.conservative(src, dst)
+	case Bilinear:
+		r, ok := src.(*Rectilinear)
+		if !ok {
+			return nil, fmt.Errorf("regrid: bilinear regridding needs a rectilinear source grid")
+		}
+		w.bilinear(r, dst)
+	case Nearest:
+		w.nearest(src, dst)
+	default:
+		return nil, fmt.Errorf("regrid: unknown method %q", m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Check(1e-6); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Weights) conservative(src, dst Grid) error {
+	rings := make([][][2]float64, src.Len())
+	convexSrc := make([]bool, src.Len())
+	for i := range rings {
+		rings[i] = project(src.Cell(i))
+		convexSrc[i] = convex(rings[i])
+	}
+	idx := newIndex(src)
+	toKm2 := EarthRadius * EarthRadius * math.Pi / 180
+	w.Covered = make([]float64, dst.Len())
+	for j := 0; j < dst.Len(); j++ {
+		cell := dst.Cell(j)
+		projected := project(cell)
+		convexDst := convex(projected)
+		var row []Entry
+		var total float64
+		for _, s := range []float64{-360, 0, 360} {
+			minLon, minLat, maxLon, maxLat := bounds(shift(cell, s))
+			for _, i := range idx.query(minLon, minLat, maxLon, maxLat) {
+				var part [][2]float64
+				switch {
+				case convexDst:
+					part = clip(rings[i], shift(projected, s))
+				case convexSrc[i]:
+					part = clip(shift(projected, s), rings[i])
+				default:
+					return fmt.Errorf("regrid: neither source cell %d nor destination cell %d is convex", i, j)
+				}
+				if len(part) < 3 {
+					continue
+				}
+				a := math.Abs(signedArea(part)) * toKm2
+				if a <= 1e-12*w.DstArea[j] {
+					continue
+				}
+				row = append(row, Entry{i, a})
+				total += a
+			}
+		}
+		for k := range row {
+			row[k].W /= total
+		}
+		w.Rows[j] = row
+		w.Covered[j] = total
+	}
+	return nil
+}
+
+func (w *Weights) bilinear(src *Rectilinear, dst Grid) {
+	latC := centres(src.LatEdges)
+	lonC := centres(src.LonEdges)
+	global := src.global()
+	nlon := len(lonC)
+	for j := 0; j < dst.Len(); j++ {
+		lon, lat := dst.Centre(j)
+		j0, j1, fy := bracket(latC, lat, false)
+		if global {
+			for lon < lonC[0] {
+				lon += 360
+			}
+			for lon >= lonC[0]+360 {
+				lon -= 360
+			}
+		}
+		i0, i1, fx := bracket(lonC, lon, global)
+		weights := map[int]float64{}
+		weights[j0*nlon+i0] += (1 - fy) * (1 - fx)
+		weights[j0*nlon+i1] += (1 - fy) * fx
+		weights[j1*nlon+i0] += fy * (1 - fx)
+		weights[j1*nlon+i1] += fy * fx
+		var row []Entry
+		for i, v := range weights {
+			if v > 0 {
+				row = append(row, Entry{i, v})
+			}
+		}
+		sortEntries(row)
+		w.Rows[j] = row
+	}
+}
+
+// bracket returns the centres either side of x and how far x is from the
+// first to the second. Outside the centres the nearest one is used, unless
+// the centres are periodic, in which case the last and first are used.
+func bracket(c []float64, x float64, periodic bool) (int, int, float64) {
+	n := len(c)
+	if x <= c[0] && !periodic {
+		return 0, 0, 0
+	}
+	if x >= c[n-1] {
+		if !periodic {
+			return n - 1, n - 1, 0
+		}
+		return n - 1, 0, (x - c[n-1]) / (c[0] + 360 - c[n-1])
+	}
+	k := 0
+	for k < n-2 && c[k+1] <= x {
+		k++
+	}
+	return k, k + 1, (x - c[k]) / (c[k+1] - c[k])
+}
+
+func centres(e []float64) []float64 {
+	c := make([]float64, len(e)-1)
+	for i := range c {
+		c[i] = (e[i] + e[i+1]) / 2
+	}
+	return c
+}
+
+func (w *Weights) nearest(src, dst Grid) {
+	idx := newPointIndex(src)
+	for j := 0; j < dst.Len(); j++ {
+		lon, lat := dst.Centre(j)
+		if i, ok := idx.nearest(lon, lat); ok {
+			w.Rows[j] = []Entry{{i, 1}}
+		}
+	}
+}
+
+// Apply regrids an intensive field, such as a concentration. Source
+// values that are NaN are left out, and destination cells without any
+// source values are NaN.
+func (w *Weights) Apply(src []float64) ([]float64, error) {
+	if len(src) != w.NSrc {
+		return nil, fmt.Errorf("regrid: the field has %d values, not %d", len(src), w.NSrc)
+	}
+	out := make([]float64, w.NDst)
+	for j, row := range w.Rows {
+		var v, sw float64
+		for _, e := range row {
+			if math.IsNaN(src[e.Src]) {
+				continue
+			}
+			v += e.W * src[e.Src]
+			sw += e.W
+		}
+		if sw == 0 {
+			out[j] = math.NaN()
+			continue
+		}
+		out[j] = v / sw
+	}
+	return out, nil
+}
+
+// ApplySum regrids an extensive field, such as emissions or population
+// counts, with conservative weights. Each source value is shared between
+// the destination cells by area.
+func (w *Weights) ApplySum(src []float64) ([]float64, error) {
+	if w.Method != Conservative {
+		return nil, fmt.Errorf("regrid: sums can only be regridded conservatively")
+	}
+	if len(src) != w.NSrc {
+		return nil, fmt.Errorf("regrid: the field has %d values, not %d", len(src), w.NSrc)
+	}
+	out := make([]float64, w.NDst)
+	for j, row := range w.Rows {
+		for _, e := range row {
+			if math.IsNaN(src[e.Src]) {
+				continue
+			}
+			out[j] += src[e.Src] * e.W * w.Covered[j] / w.SrcArea[e.Src]
+		}
+	}
+	return out, nil
+}
+
+// Coverage returns the fraction of each destination cell that overlaps
+// the source grid, for conservative weights.
+func (w *Weights) Coverage() []float64 {
+	out := make([]float64, w.NDst)
+	for j := range out {
+		if w.Covered != nil {
+			out[j] = w.Covered[j] / w.DstArea[j]
+		}
+	}
+	return out
+}
+
+// Check checks the weights, to a relative tolerance: the weights of every
+// destination cell should add up to one, and for conservative weights no
+// more than the area of any source or destination cell should be used, and
+// the mass of a field should be the same on both grids.
+func (w *Weights) Check(tol float64) error {
+	for j, row := range w.Rows {
+		if len(row) == 0 {
+			continue
+		}
+		var s float64
+		for _, e := range row {
+			s += e.W
+		}
+		if math.Abs(s-1) > tol {
+			return fmt.Errorf("regrid: the weights of destination cell %d add up to %g", j, s)
+		}
+	}
+	if w.Method != Conservative {
+		return nil
+	}
+	used := make([]float64, w.NSrc)
+	for j, row := range w.Rows {
+		if w.Covered[j] > w.DstArea[j]*(1+tol) {
+			return fmt.Errorf("regrid: %g km² of destination cell %d is covered, but its area is %g km²", w.Covered[j], j, w.DstArea[j])
+		}
+		for _, e := range row {
+			used[e.Src] += e.W * w.Covered[j]
+		}
+	}
+	for i, u := range used {
+		if u > w.SrcArea[i]*(1+tol) {
+			return fmt.Errorf("regrid: %g km² of source cell %d is used, but its area is %g km²", u, i, w.SrcArea[i])
+		}
+	}
+
+	// A field that varies from cell to cell should have the same mass,
+	// the area integral, on both grids, over the area they share.
+	field := make([]float64, w.NSrc)
+	var srcMass, srcTotal float64
+	for i := range field {
+		field[i] = 1 + float64(i%7)/7
+		srcMass += field[i] * used[i]
+		srcTotal += field[i] * used[i] / w.SrcArea[i]
+	}
+	mean, err := w.Apply(field)
+	if err != nil {
+		return err
+	}
+	sum, err := w.ApplySum(field)
+	if err != nil {
+		return err
+	}
+	var dstMass, dstTotal float64
+	for j := range mean {
+		if !math.IsNaN(mean[j]) {
+			dstMass += mean[j] * w.Covered[j]
+		}
+		dstTotal += sum[j]
+	}
+	if math.Abs(dstMass-srcMass) > tol*math.Abs(srcMass) {
+		return fmt.Errorf("regrid: the mass of an intensive field is %g on the source grid and %g on the destination grid", srcMass, dstMass)
+	}
+	if math.Abs(dstTotal-srcTotal) > tol*math.Abs(srcTotal) {
+		return fmt.Errorf("regrid: the total of an extensive field is %g on the source grid and %g on the destination grid", srcTotal, dstTotal)
+	}
+	return nil
+}
+
+// Summary describes the weights.
+func (w *Weights) Summary() string {
+	var n, empty int
+	for _, row := range w.Rows {
+		n += len(row)
+		if len(row) == 0 {
+			empty++
+		}
+	}
+	s := fmt.Sprintf("%s weights from %d to %d cells: %d entries, %d destination cells without a source", w.Method, w.NSrc, w.NDst, n, empty)
+	if w.Covered != nil {
+		var covered, total float64
+		for j := range w.Covered {
+			covered += w.Covered[j]
+			total += w.DstArea[j]
+		}
+		s += fmt.Sprintf(", %.4g%% of the destination area covered", 100*covered/total)
+	}
+	return s
+}
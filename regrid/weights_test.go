@@ -0,0 +1,364 @@
+package regrid
+
+import (
+	"encoding/gob"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// field is a smooth field that isn't uniform, at the centre of each cell.
+func field(g Grid) []float64 {
+	out := make([]float64, g.Len())
+	for i := range out {
+		lon, lat := g.Centre(i)
+		out[i] = 2 + math.Sin(lat*math.Pi/90) + math.Cos(lon*math.Pi/60)
+	}
+	return out
+}
+
+func integral(values, areas []float64) float64 {
+	var s float64
+	for i, v := range values {
+		if !math.IsNaN(v) {
+			s += v * areas[i]
+		}
+	}
+	return s
+}
+
+func total(values []float64) float64 {
+	var s float64
+	for _, v := range values {
+		s += v
+	}
+	return s
+}
+
+func near(a, b, tol float64) bool {
+	return math.Abs(a-b) <= tol*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// square is a polygon cell with the given corners.
+func square(w, s, e, n float64) [][2]float64 {
+	return [][2]float64{{w, s}, {e, s}, {e, n}, {w, n}}
+}
+
+func TestConservativeKeepsMass(t *testing.T) {
+	// Polygon cells of 10° across the date line, given with longitudes
+	// past 180 and below -180, and cells inside the grid.
+	polygons := Polygons{
+		square(175, -5, 185, 5),
+		square(-185, 5, -175, 15),
+		square(170, 20, 190, 30),
+		square(10, 40, 20, 50),
+		square(-100.3, -33.1, -91.7, -27.4),
+	}
+	for _, test := range []struct {
+		name     string
+		src, dst Grid
+	}{
+		{"4x5 to 2x2.5", GEOSChem(4, 5), GEOSChem(2, 2.5)},
+		{"2x2.5 to 4x5", GEOSChem(2, 2.5), GEOSChem(4, 5)},
+		{"polygons to 2x2.5", polygons, GEOSChem(2, 2.5)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w, err := Compute(test.src, test.dst, Conservative)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := field(test.src)
+			dst, err := w.Apply(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every source cell is in the destination grid, so the whole
+			// mass is on the covered part of the destination cells.
+			if a, b := integral(src, w.SrcArea), integral(dst, w.Covered); !near(a, b, 1e-9) {
+				t.Errorf("the mass is %g on the source grid and %g on the destination grid", a, b)
+			}
+		})
+	}
+
+	// A global grid covers the polygons, including those across the date
+	// line, entirely.
+	w, err := Compute(GEOSChem(4, 5), polygons, Conservative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, c := range w.Coverage() {
+		if !near(c, 1, 1e-9) {
+			t.Errorf("polygon %d is %g covered by a global grid", j, c)
+		}
+	}
+}
+
+func TestApplySumKeepsTotals(t *testing.T) {
+	polygons := Polygons{
+		square(175, -5, 185, 5),
+		square(-185, 5, -175, 15),
+		square(10, 40, 20, 50),
+	}
+	for _, test := range []struct {
+		name     string
+		src, dst Grid
+	}{
+		{"2x2.5 to 4x5", GEOSChem(2, 2.5), GEOSChem(4, 5)},
+		{"4x5 to 2x2.5", GEOSChem(4, 5), GEOSChem(2, 2.5)},
+		{"polygons to 4x5", polygons, GEOSChem(4, 5)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w, err := Compute(test.src, test.dst, Conservative)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := field(test.src)
+			dst, err := w.ApplySum(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a, b := total(src), total(dst); !near(a, b, 1e-9) {
+				t.Errorf("the total is %g on the source grid and %g on the destination grid", a, b)
+			}
+		})
+	}
+	if _, err := (&Weights{Method: Bilinear}).ApplySum(nil); err == nil {
+		t.Error("bilinear weights shouldn't regrid sums")
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	// A 1° source grid over 0 to 10°N and 0 to 10°E only partly covers the
+	// 2x2.5 cells around it.
+	var lats, lons []float64
+	for x := 0.5; x < 10; x++ {
+		lats = append(lats, x)
+		lons = append(lons, x)
+	}
+	src, err := NewRectilinear(lats, lons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := GEOSChem(2, 2.5)
+	w, err := Compute(src, dst, Conservative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover := w.Coverage()
+	sin := func(lat float64) float64 { return math.Sin(lat * math.Pi / 180) }
+	for _, test := range []struct {
+		lon, lat float64
+		want     float64
+	}{
+		{5, 4, 1},  // inside
+		{50, 4, 0}, // outside
+		{-2.5, 4, 0},
+		// 8.75 to 11.25°E and 9 to 11°N: half the longitudes, and 9 to
+		// 10°N of the latitudes.
+		{10, 10, 0.5 * (sin(10) - sin(9)) / (sin(11) - sin(9))},
+		// -1.25 to 1.25°E and -1 to 1°N.
+		{0, 0, 0.5 * sin(1) / (sin(1) - sin(-1))},
+	} {
+		j := cellAt(t, dst, test.lon, test.lat)
+		if !near(cover[j], test.want, 1e-9) && math.Abs(cover[j]-test.want) > 1e-12 {
+			t.Errorf("the cell at %g, %g is %g covered, not %g", test.lon, test.lat, cover[j], test.want)
+		}
+		if test.want == 0 && len(w.Rows[j]) != 0 {
+			t.Errorf("the cell at %g, %g has weights without being covered", test.lon, test.lat)
+		}
+	}
+	// The uncovered cells are NaN, and a uniform field stays uniform where
+	// it is covered at all.
+	uniform := make([]float64, src.Len())
+	for i := range uniform {
+		uniform[i] = 3
+	}
+	out, err := w.Apply(uniform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, v := range out {
+		if cover[j] == 0 && !math.IsNaN(v) || cover[j] > 0 && !near(v, 3, 1e-12) {
+			t.Fatalf("cell %d, %g covered, is %g", j, cover[j], v)
+		}
+	}
+}
+
+func cellAt(t *testing.T, g Grid, lon, lat float64) int {
+	t.Helper()
+	i, ok := NewLocator(g).Find(lon, lat)
+	if !ok {
+		t.Fatalf("%g, %g isn't in the grid", lon, lat)
+	}
+	return i
+}
+
+func TestBilinearLinearField(t *testing.T) {
+	var lats, lons []float64
+	for lat := -20.0; lat <= 20; lat += 2 {
+		lats = append(lats, lat)
+	}
+	for lon := 100.0; lon <= 140; lon += 2.5 {
+		lons = append(lons, lon)
+	}
+	src, err := NewRectilinear(lats, lons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linear := func(lon, lat float64) float64 { return 3 + 0.5*lat - 0.25*lon }
+	values := make([]float64, src.Len())
+	for i := range values {
+		values[i] = linear(src.Centre(i))
+	}
+	// The destination centres are all between the source centres.
+	var dLats, dLons []float64
+	for lat := -18.7; lat < 19; lat += 0.9 {
+		dLats = append(dLats, lat)
+	}
+	for lon := 101.1; lon < 139; lon += 1.3 {
+		dLons = append(dLons, lon)
+	}
+	dst, err := NewRectilinear(dLats, dLons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := Compute(src, dst, Bilinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := w.Apply(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j, v := range out {
+		lon, lat := dst.Centre(j)
+		if want := linear(lon, lat); math.Abs(v-want) > 1e-9 {
+			t.Fatalf("the value at %g, %g is %g, not %g", lon, lat, v, want)
+		}
+	}
+	if _, err := Compute(Polygons{square(0, 0, 1, 1)}, dst, Bilinear); err == nil {
+		t.Error("bilinear weights from polygons should be rejected")
+	}
+}
+
+func TestNearest(t *testing.T) {
+	src := GEOSChem(4, 5)
+	// Small cells around points whose nearest 4x5 centres are known,
+	// including across the date line.
+	for _, test := range []struct {
+		lon, lat         float64
+		wantLon, wantLat float64
+	}{
+		{1, 1, 0, 2},
+		{-3, 5, -5, 6},
+		{179, 10, 180, 10},
+		{-178.5, -10, -180, -10},
+		{11, 89.5, 10, 89},
+	} {
+		dst := Polygons{square(test.lon-0.01, test.lat-0.01, test.lon+0.01, test.lat+0.01)}
+		w, err := Compute(src, dst, Nearest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(w.Rows[0]) != 1 || w.Rows[0][0].W != 1 {
+			t.Fatalf("the nearest weights at %g, %g are %v", test.lon, test.lat, w.Rows[0])
+		}
+		lon, lat := src.Centre(w.Rows[0][0].Src)
+		dlon := math.Mod(lon-test.wantLon+720, 360)
+		if math.Min(dlon, 360-dlon) > 1e-9 || math.Abs(lat-test.wantLat) > 1e-9 {
+			t.Errorf("the nearest centre to %g, %g is %g, %g, not %g, %g", test.lon, test.lat, lon, lat, test.wantLon, test.wantLat)
+		}
+	}
+}
+
+func TestCached(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := GEOSChem(4, 5), GEOSChem(2, 2.5)
+	w, err := Cached(dir, src, dst, Conservative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.gob"))
+	if len(files) != 1 {
+		t.Fatalf("there are %d cache files, not 1", len(files))
+	}
+	again, err := Cached(dir, src, dst, Conservative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w, again) {
+		t.Error("the cached weights aren't the same as the computed ones")
+	}
+
+	// A cache file written for other grids is rejected.
+	stale, err := Compute(dst, src, Conservative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(stale); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := Cached(dir, src, dst, Conservative); err == nil {
+		t.Error("stale cached weights should be rejected")
+	}
+
+	// Other grids are cached in another file.
+	if _, err := Cached(dir, dst, src, Conservative); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ = filepath.Glob(filepath.Join(dir, "*.gob")); len(files) != 2 {
+		t.Fatalf("there are %d cache files, not 2", len(files))
+	}
+}
+
+func TestAccumulator(t *testing.T) {
+	// The rows of a 1° grid, accumulated onto the 4x5 grid, should match the
+	// conservative weights.
+	var latC, lonC []float64
+	for lat := -89.5; lat < 90; lat++ {
+		latC = append(latC, lat)
+	}
+	for lon := -179.5; lon < 180; lon++ {
+		lonC = append(lonC, lon)
+	}
+	src, err := NewRectilinear(latC, lonC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := GEOSChem(4, 5)
+	values := field(src)
+	rows := func(j int) ([]float64, error) { return values[j*len(lonC) : (j+1)*len(lonC)], nil }
+	mean, sum := NewAccumulator(dst), NewAccumulator(dst)
+	if err := mean.AddRows(src, rows, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sum.AddRows(src, rows, true); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Compute(src, dst, Conservative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMean, err := w.Apply(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSum, err := w.ApplySum(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotMean, gotSum, coverage := mean.Mean(0.5), sum.Sum(), mean.Coverage()
+	for j := range wantMean {
+		if !near(gotMean[j], wantMean[j], 1e-9) || !near(gotSum[j], wantSum[j], 1e-9) || !near(coverage[j], 1, 1e-9) {
+			t.Fatalf("cell %d: the mean, sum and coverage are %g, %g and %g, not %g, %g and 1",
+				j, gotMean[j], gotSum[j], coverage[j], wantMean[j], wantSum[j])
+		}
+	}
+}
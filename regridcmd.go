@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/SumilThakr/aqcomp/regrid"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                               REGRIDDING
+// *************************************************************************
+// *************************************************************************
+
+var resolution = regexp.MustCompile(`^([0-9.]+)x([0-9.]+)$`)
+
+// gridSpec returns the grid described by spec: a GEOS-Chem resolution
+// such as 2x2.5 or 4x5, a GeoJSON file of polygon cells such as InMAP's, or
+// a netCDF file with the latitude and longitude variables of a
+// rectilinear grid.
+func gridSpec(spec, latVar, lonVar string) (regrid.Grid, error) {
+	if m := resolution.FindStringSubmatch(spec); m != nil {
+		dlat, err1 := strconv.ParseFloat(m[1], 64)
+		dlon, err2 := strconv.ParseFloat(m[2], 64)
+		if err1 != nil || err2 != nil || dlat <= 0 || dlon <= 0 {
+			return nil, fmt.Errorf("bad grid resolution %q", spec)
+		}
+		return regrid.GEOSChem(dlat, dlon), nil
+	}
+	switch {
+	case strings.HasSuffix(spec, ".geojson") || strings.HasSuffix(spec, ".json"):
+		regions, err := readRegions(spec, "")
+		if err != nil {
+			return nil, err
+		}
+		cells := make(regrid.Polygons, 0, len(regions))
+		for _, r := range regions {
+			if len(r.polygons) != 1 {
+				return nil, fmt.Errorf("%s: cell %s should be a single polygon", spec, r.name)
+			}
+			cells = append(cells, r.polygons[0][0])
+		}
+		return cells, nil
+	case strings.HasSuffix(spec, ".nc"):
+		f, err := openGridFile(spec)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		la, err := f.axis(latVar)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec, err)
+		}
+		lo, err := f.axis(lonVar)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec, err)
+		}
+		return regrid.NewRectilinear(la, lo)
+	}
+	return nil, fmt.Errorf("can't make a grid from %q: should be a resolution such as 2x2.5, a .geojson file or a .nc file", spec)
+}
+
+// regridCmd is the "regrid" mode. It computes (or reads from the cache)
+// the weights between two grids and checks them, and can regrid a
+// variable from a netCDF file on the source grid.
+func regridCmd(args []string) error {
+	fs := flag.NewFlagSet("regrid", flag.ExitOnError)
+	srcSpec := fs.String("src", "4x5", "source grid: a resolution such as 4x5, a GeoJSON file of cells or a netCDF file")
+	dstSpec := fs.String("dst", "2x2.5", "destination grid, as for -src")
+	method := fs.String("method", "conservative", "method: conservative, bilinear or nearest")
+	cacheDir := fs.String("cache", "regrid-cache", "directory of cached weights")
+	latVar := fs.String("latvar", "lat", "latitude variable of netCDF grids")
+	lonVar := fs.String("lonvar", "lon", "longitude variable of netCDF grids")
+	inFile := fs.String("in", "", "optional netCDF file with a variable on the source grid to regrid")
+	inVar := fs.String("var", "", "variable to regrid, with the dimensions (lat, lon) or (time, lat, lon)")
+	inTime := fs.Int("time", 0, "time index of the variable")
+	sum := fs.Bool("sum", false, "the variable is a total, such as population or emissions, rather than a concentration")
+	outFile := fs.String("out", "regridded.csv", "output csv file of the regridded variable")
+	fs.Parse(args)
+
+	m, err := regrid.ParseMethod(*method)
+	if err != nil {
+		return err
+	}
+	src, err := gridSpec(*srcSpec, *latVar, *lonVar)
+	if err != nil {
+		return err
+	}
+	dst, err := gridSpec(*dstSpec, *latVar, *lonVar)
+	if err != nil {
+		return err
+	}
+	w, err := regrid.Cached(*cacheDir, src, dst, m)
+	if err != nil {
+		return err
+	}
+	if err := w.Check(1e-6); err != nil {
+		return err
+	}
+	fmt.Println(w.Summary())
+	if *inFile == "" {
+		return nil
+	}
+
+	f, err := openGridFile(*inFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, err := f.rows(*inVar, *inTime)
+	if err != nil {
+		return fmt.Errorf("%s: %v", *inFile, err)
+	}
+	field := make([]float64, 0, src.Len())
+	for j := 0; len(field) < src.Len(); j++ {
+		row, err := rows(j)
+		if err != nil {
+			return fmt.Errorf("%s: %v", *inFile, err)
+		}
+		field = append(field, row...)
+	}
+	if len(field) != src.Len() {
+		return fmt.Errorf("%s: %s has %d values, but the source grid has %d cells", *inFile, *inVar, len(field), src.Len())
+	}
+	var out []float64
+	if *sum {
+		out, err = w.ApplySum(field)
+	} else {
+		out, err = w.Apply(field)
+	}
+	if err != nil {
+		return err
+	}
+	cover := w.Coverage()
+	tWrt := []XY{{"cell", "lon", "lat", *inVar, "coverage"}}
+	for j, v := range out {
+		lon, lat := dst.Centre(j)
+		c := ""
+		if m == regrid.Conservative {
+			c = ff(cover[j])
+		}
+		if math.IsNaN(v) {
+			tWrt = append(tWrt, XY{strconv.Itoa(j), ff(lon), ff(lat), "", c})
+			continue
+		}
+		tWrt = append(tWrt, XY{strconv.Itoa(j), ff(lon), ff(lat), ff(v), c})
+	}
+	return csvWriter(*outFile, tWrt)
+}
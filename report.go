@@ -0,0 +1,290 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                              HTML REPORTS
+// *************************************************************************
+// *************************************************************************
+
+// reportTable is the metrics for every group of one grouping.
+type reportTable struct {
+	GroupBy string
+	Metrics []string
+	Rows    []reportRow
+}
+
+type reportRow struct {
+	Group  string
+	N      int
+	Values []string
+}
+
+// reportFigure is a figure inlined as SVG.
+type reportFigure struct {
+	Title string
+	SVG   template.HTML
+}
+
+// report is everything shown in the HTML report.
+type report struct {
+	Title     string
+	Generated string
+	NPairs    int
+	Config    [][2]string
+	Files     []pairFile
+	Figures   []reportFigure
+	Tables    []reportTable
+	Skipped   []skippedData
+}
+
+// reportTables arranges the group statistics as one table per grouping,
+// with a column for every metric. Metrics that couldn't be computed for a
+// group are left blank and added to the skipped data.
+func reportTables(stats []groupStat, groupers []grouper) ([]reportTable, []skippedData) {
+	var tables []reportTable
+	var skipped []skippedData
+	for _, g := range groupers {
+		t := reportTable{GroupBy: g.name}
+		for _, m := range metrics {
+			t.Metrics = append(t.Metrics, m.name)
+		}
+		rows := make(map[string]int)
+		for _, s := range stats {
+			if s.groupBy != g.name {
+				continue
+			}
+			i, ok := rows[s.group]
+			if !ok {
+				i = len(t.Rows)
+				rows[s.group] = i
+				t.Rows = append(t.Rows, reportRow{Group: s.group, N: s.n, Values: make([]string, len(metrics))})
+			}
+			t.Rows[i].Values[indexOf(t.Metrics, s.metric)] = fmt.Sprintf("%.4g", s.value)
+		}
+		for _, r := range t.Rows {
+			for j, v := range r.Values {
+				if v == "" {
+					skipped = append(skipped, skippedData{fmt.Sprintf("%s %s", g.name, r.Group), fmt.Sprintf("%s couldn't be computed from %d pairs", t.Metrics[j], r.N)})
+				}
+			}
+		}
+		tables = append(tables, t)
+	}
+	return tables, skipped
+}
+
+// inlineSVG reads an SVG file for inlining in HTML, without the XML
+// declaration and comments before the svg element.
+func inlineSVG(path string) (template.HTML, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s := string(b)
+	i := strings.Index(s, "<svg")
+	if i < 0 {
+		return "", fmt.Errorf("%s isn't an SVG file", path)
+	}
+	return template.HTML(s[i:]), nil
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; max-width: 1100px; }
+table { border-collapse: collapse; margin-bottom: 2em; font-size: 0.85em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #eee; }
+figure { margin: 0 0 2em 0; }
+figure svg { max-width: 100%; height: auto; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}} from {{.NPairs}} paired values.</p>
+
+<h2>Run configuration</h2>
+<table>
+{{range .Config}}<tr><td>{{index . 0}}</td><td><code>{{index . 1}}</code></td></tr>
+{{end}}</table>
+
+<h2>Figures</h2>
+{{range .Figures}}<figure>
+<figcaption><h3>{{.Title}}</h3></figcaption>
+{{.SVG}}
+</figure>
+{{end}}
+<h2>Metrics</h2>
+{{range .Tables}}<h3>By {{.GroupBy}}</h3>
+<table>
+<tr><th>{{.GroupBy}}</th><th>N</th>{{range .Metrics}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Group}}</td><td>{{.N}}</td>{{range .Values}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+<h2>Input files</h2>
+<table>
+<tr><th>File</th><th>Size (bytes)</th><th>Modified</th><th>Rows</th><th>SHA-256</th></tr>
+{{range .Files}}<tr><td>{{.Path}}</td><td>{{.Size}}</td><td>{{.Modified}}</td><td>{{.Rows}}</td><td><code>{{.SHA256}}</code></td></tr>
+{{end}}</table>
+
+<h2>Skipped data</h2>
+{{if .Skipped}}<table>
+<tr><th>Data</th><th>Reason</th></tr>
+{{range .Skipped}}<tr><td>{{.Source}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+{{else}}<p>Nothing was skipped.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// The template needs exported names, so the unexported fields are given
+// methods.
+func (f pairFile) Path() string     { return f.path }
+func (f pairFile) Size() int64      { return f.size }
+func (f pairFile) Modified() string { return f.modTime.UTC().Format(time.RFC3339) }
+func (f pairFile) Rows() int        { return f.rows }
+func (f pairFile) SHA256() string   { return f.sha256 }
+
+func (s skippedData) Source() string { return s.source }
+func (s skippedData) Reason() string { return s.reason }
+
+// reportCmd is the "report" mode. It writes a single HTML file with the
+// figures, the metrics by group, the run configuration, the input files
+// and the data that was left out, so that a run can be reviewed without
+// aqcomp.
+func reportCmd(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	outFile := fs.String("out", "report.html", "output HTML file")
+	title := fs.String("title", "PM2.5 evaluation", "report title")
+	by := fs.String("by", "all,country,season,month", "comma separated list of groupings for the metric tables")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	classFile := fs.String("classes", "", "csv file of location,class for each station")
+	bins := fs.String("bins", "0,10,25,50,100,1000", "concentration bin edges")
+	weighting := fs.String("weight", "none", "weighting: none, station, cell or area")
+	fs.Parse(args)
+
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, *classFile, *bins)
+	if err != nil {
+		return err
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, files, skipped, err := readPairFiles(ds)
+	if err != nil {
+		return err
+	}
+	var noStation int
+	for _, p := range pairs {
+		if !p.hasStation() {
+			noStation++
+		}
+	}
+	if noStation > 0 {
+		skipped = append(skipped, skippedData{"station information", fmt.Sprintf("%d pairs have no station information, so they are left out of the maps, time series, cycles and groupings other than all", noStation)})
+	}
+
+	r := report{
+		Title:     *title,
+		Generated: time.Now().UTC().Format(time.RFC3339),
+		NPairs:    len(pairs),
+		Files:     files,
+		Config: [][2]string{
+			{"Command", strings.Join(os.Args, " ")},
+			{"Paired results", ds.folder},
+			{"File pattern", ds.describePattern()},
+			{"Groupings", *by},
+			{"Weighting", *weighting},
+			{"Go version", runtime.Version()},
+		},
+	}
+	// The observation and model sources are those recorded by the pair
+	// mode with each folder of paired results.
+	prov, err := readProvenance(ds.folder)
+	if err != nil {
+		return err
+	}
+	if len(prov) == 0 {
+		skipped = append(skipped, skippedData{"provenance", fmt.Sprintf("there is no %s in %s, so the observation and model sources of the pairs aren't known", provenanceFile, ds.folder)})
+	}
+	for _, p := range prov {
+		r.Config = append(r.Config, [2]string{"Pairing of " + p.folder, p.command})
+		for _, f := range p.flags {
+			if f[1] == "" {
+				continue
+			}
+			r.Config = append(r.Config, [2]string{"Pairing " + f[0], f[1]})
+		}
+	}
+	if !ds.from.IsZero() || !ds.to.IsZero() {
+		r.Config = append(r.Config, [2]string{"Dates", fmt.Sprintf("%s to %s", ds.from.Format("2006-01-02"), ds.to.Format("2006-01-02"))})
+	}
+	if *regionFile != "" {
+		r.Config = append(r.Config, [2]string{"Regions", *regionFile})
+	}
+	if *classFile != "" {
+		r.Config = append(r.Config, [2]string{"Station classes", *classFile})
+	}
+
+	// The figures are drawn as SVG in a temporary directory and inlined.
+	dir, err := ioutil.TempDir("", "aqcomp-report")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	figGroup := byCountry()
+	for _, g := range groupers {
+		if g.name == "region" {
+			figGroup = g
+		}
+	}
+	for _, f := range renderFigures(dir, pairs, figGroup, *weighting, figOptions{format: "svg"}) {
+		if f.err != nil {
+			skipped = append(skipped, skippedData{"figure " + f.name, f.err.Error()})
+			continue
+		}
+		svg, err := inlineSVG(f.path)
+		if err != nil {
+			return err
+		}
+		r.Figures = append(r.Figures, reportFigure{Title: f.title, SVG: svg})
+	}
+
+	stats, err := stratify(pairs, groupers, *weighting)
+	if err != nil {
+		return err
+	}
+	var tableSkipped []skippedData
+	r.Tables, tableSkipped = reportTables(stats, groupers)
+	r.Skipped = append(skipped, tableSkipped...)
+
+	f, err := os.Create(*outFile)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", *outFile, err)
+	}
+	if err := reportTemplate.Execute(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write to %s: %v", *outFile, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bitbucket.org/ctessum/cdf"
+	"flag"
+	"fmt"
+	"github.com/SumilThakr/aqcomp/regrid"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                     GRIDDED REFERENCE PRODUCTS
+// *************************************************************************
+// *************************************************************************
+
+// Gridded surface PM2.5 products, such as the van Donkelaar et al. V5GL
+// satellite-derived estimates, are compared with the model cell by cell.
+// The product is read a row at a time and averaged conservatively onto the
+// model grid with a regrid.Accumulator. The products are too fine (0.01°)
+// to keep their regridding weights, so the overlaps are worked out as the
+// rows are read. The products can be netCDF-3 or netCDF-4.
+
+// gridFile is a netCDF file of a gridded product.
+type gridFile interface {
+	// axis reads a one dimensional variable, such as the latitudes.
+	axis(name string) ([]float64, error)
+	// rows returns a function that reads the rows of a gridded variable
+	// with the dimensions (lat, lon) or (time, lat, lon), at time index t.
+	// Fill values become NaN, and the scale factor and offset are applied.
+	rows(v string, t int) (func(j int) ([]float64, error), error)
+	Close() error
+}
+
+// openGridFile opens a netCDF-3 or netCDF-4 file of a gridded product.
+func openGridFile(path string) (gridFile, error) {
+	nc4, err := isNetCDF4(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s cannot be opened: %v", path, err)
+	}
+	if nc4 {
+		m, err := openNetCDF4(path)
+		if err != nil {
+			return nil, err
+		}
+		return nc4Grid{m}, nil
+	}
+	ff, f, err := openNcf(path)
+	if err != nil {
+		return nil, err
+	}
+	return cdfGrid{ff, f}, nil
+}
+
+// packing is how the values of a variable are stored: the fill and
+// missing values, and the scale factor and offset.
+type packing struct {
+	fill, missing, scale, offset float64
+	hasFill, hasMissing          bool
+}
+
+// newPacking reads the packing of a variable with its attribute function.
+func newPacking(attribute func(name string) (float64, bool)) packing {
+	var p packing
+	p.fill, p.hasFill = attribute("_FillValue")
+	p.missing, p.hasMissing = attribute("missing_value")
+	scale, hasScale := attribute("scale_factor")
+	p.offset, _ = attribute("add_offset")
+	p.scale = 1
+	if hasScale {
+		p.scale = scale
+	}
+	return p
+}
+
+// unpack converts stored values to NaN or their unpacked values.
+func (p packing) unpack(row []float64) {
+	for i, x := range row {
+		if (p.hasFill && x == p.fill) || (p.hasMissing && x == p.missing) {
+			row[i] = math.NaN()
+			continue
+		}
+		row[i] = x*p.scale + p.offset
+	}
+}
+
+// cdfGrid is a gridFile read from netCDF-3.
+type cdfGrid struct {
+	ff *os.File
+	f  *cdf.File
+}
+
+func (g cdfGrid) axis(name string) ([]float64, error) {
+	dims := g.f.Header.Lengths(name)
+	if len(dims) != 1 {
+		return nil, fmt.Errorf("%s isn't a one dimensional variable", name)
+	}
+	r := g.f.Reader(name, nil, nil)
+	buf := r.Zero(dims[0])
+	if _, err := r.Read(buf); err != nil {
+		return nil, err
+	}
+	return ncfFloats(buf)
+}
+
+func ncfFloats(buf interface{}) ([]float64, error) {
+	switch b := buf.(type) {
+	case []float64:
+		return b, nil
+	case []float32:
+		out := make([]float64, len(b))
+		for i, v := range b {
+			out[i] = float64(v)
+		}
+		return out, nil
+	case []int16:
+		out := make([]float64, len(b))
+		for i, v := range b {
+			out[i] = float64(v)
+		}
+		return out, nil
+	case []int32:
+		out := make([]float64, len(b))
+		for i, v := range b {
+			out[i] = float64(v)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("values of type %T can't be read", buf)
+}
+
+// attribute returns a numerical attribute of a variable.
+func (g cdfGrid) attribute(v, name string) (float64, bool) {
+	a, err := ncfFloats(g.f.Header.GetAttribute(v, name))
+	if err != nil || len(a) == 0 {
+		return 0, false
+	}
+	return a[0], true
+}
+
+func (g cdfGrid) rows(v string, t int) (func(j int) ([]float64, error), error) {
+	dims := g.f.Header.Lengths(v)
+	if len(dims) != 2 && len(dims) != 3 {
+		return nil, fmt.Errorf("%s should have the dimensions (lat, lon) or (time, lat, lon)", v)
+	}
+	nlon := dims[len(dims)-1]
+	p := newPacking(func(name string) (float64, bool) { return g.attribute(v, name) })
+	return func(j int) ([]float64, error) {
+		start, end := make([]int, len(dims)), make([]int, len(dims))
+		if len(dims) == 3 {
+			start[0], end[0] = t, t+1
+		}
+		start[len(dims)-2], end[len(dims)-2] = j, j+1
+		start[len(dims)-1], end[len(dims)-1] = 0, nlon
+		r := g.f.Reader(v, start, end)
+		buf := r.Zero(nlon)
+		if _, err := r.Read(buf); err != nil {
+			return nil, fmt.Errorf("reading row %d of %s isn't working: %v", j, v, err)
+		}
+		row, err := ncfFloats(buf)
+		if err != nil {
+			return nil, err
+		}
+		p.unpack(row)
+		return row, nil
+	}, nil
+}
+
+func (g cdfGrid) Close() error { return g.ff.Close() }
+
+// nc4Grid is a gridFile read from netCDF-4. go-native-netcdf reads a slice
+// of the first dimension at a time, so a (lat, lon) variable is read a row
+// at a time, but a (time, lat, lon) variable is read a whole time at once.
+type nc4Grid struct {
+	*nc4Model
+}
+
+func (g nc4Grid) axis(name string) ([]float64, error) {
+	vg, err := g.g.GetVarGetter(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't in %s: %v", name, g.path, err)
+	}
+	if len(vg.Dimensions()) != 1 {
+		return nil, fmt.Errorf("%s isn't a one dimensional variable", name)
+	}
+	values, err := vg.Values()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from %s isn't working: %v", name, g.path, err)
+	}
+	return ncfFloats(values)
+}
+
+// reflectFloat returns a number read by go-native-netcdf as a float64.
+func reflectFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		return float64(v.Int()), true
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
+
+func (g nc4Grid) rows(v string, t int) (func(j int) ([]float64, error), error) {
+	vg, err := g.g.GetVarGetter(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't in %s: %v", v, g.path, err)
+	}
+	dims := g.Lengths(v)
+	if len(dims) != 2 && len(dims) != 3 {
+		return nil, fmt.Errorf("%s should have the dimensions (lat, lon) or (time, lat, lon)", v)
+	}
+	p := newPacking(func(name string) (float64, bool) {
+		a, ok := vg.Attributes().Get(name)
+		if !ok {
+			return 0, false
+		}
+		av := reflect.ValueOf(a)
+		if av.Kind() == reflect.Slice {
+			if av.Len() == 0 {
+				return 0, false
+			}
+			av = av.Index(0)
+		}
+		return reflectFloat(av)
+	})
+	return func(j int) ([]float64, error) {
+		var s reflect.Value
+		var err error
+		if len(dims) == 2 {
+			s, err = g.slice(v, j)
+		} else if s, err = g.slice(v, t); err == nil {
+			s = s.Index(j)
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make([]float64, s.Len())
+		for i := range row {
+			x, ok := reflectFloat(s.Index(i))
+			if !ok {
+				return nil, fmt.Errorf("%s in %s is %v, not numbers", v, g.path, s.Type())
+			}
+			row[i] = x
+		}
+		p.unpack(row)
+		return row, nil
+	}, nil
+}
+
+// regridFile averages (or, if sum is true, shares out) a gridded variable
+// in a netCDF file onto the model grid dst. Products written from north
+// to south are read in the reverse order of their rows.
+func regridFile(path, v, latVar, lonVar string, t int, sum bool, dst *regrid.Rectilinear) (*regrid.Accumulator, error) {
+	f, err := openGridFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	srcLats, err := f.axis(latVar)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	srcLons, err := f.axis(lonVar)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	rows, err := f.rows(v, t)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if n := len(srcLats); n > 1 && srcLats[0] > srcLats[n-1] {
+		reversed := make([]float64, n)
+		for j := range srcLats {
+			reversed[n-1-j] = srcLats[j]
+		}
+		srcLats = reversed
+		northFirst := rows
+		rows = func(j int) ([]float64, error) { return northFirst(n - 1 - j) }
+	}
+	src, err := regrid.NewRectilinear(srcLats, srcLons)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	a := regrid.NewAccumulator(dst)
+	if err := a.AddRows(src, rows, sum); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return a, nil
+}
+
+// speciesField reads the aerosol tracers of every grid cell at a time
+// index, with the SOA tracers that the file has (see soaIn).
+func speciesField(f modelFile, hour int) ([]modelSpecies, error) {
+	tracers := append(append([]tracer(nil), aerosolTracers...), soaIn(f)...)
+	fields := make([][]float32, len(tracers))
+	for i, t := range tracers {
+		var err error
+		if fields[i], err = fieldReading(f, "IJ_AVG_S__"+t.name, hour); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]modelSpecies, len(fields[0]))
+	v := make([]float32, len(tracers))
+	for c := range out {
+		var soa float32
+		for i, t := range tracers {
+			v[i] = ppb_ugm3 * t.mw * fields[i][c]
+			if i >= len(aerosolTracers) {
+				soa += v[i]
+			}
+		}
+		out[c] = speciesOf(v, soa)
+	}
+	return out, nil
+}
+
+// meanModelField is the mean of a component of the simulated aerosol over
+// every output of the days, on the grid of the first file (see modelGrid).
+// A file holding more than one day is opened once for all of them.
+func meanModelField(days []modelDay, species string, conv speciation) ([]float64, regrid.Grid, error) {
+	var mean []float64
+	var grid regrid.Grid
+	var n int
+	var f modelFile
+	var open *modelOutput
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for _, d := range days {
+		if d.output != open {
+			if f != nil {
+				f.Close()
+				f = nil
+			}
+			fmt.Printf("Reading %s\n", d.output.paths[0])
+			var err error
+			if f, err = d.open(); err != nil {
+				return nil, nil, err
+			}
+			open = d.output
+		}
+		for _, t := range d.indices {
+			field, err := componentField(f, t, species, conv)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", d.output.paths[0], err)
+			}
+			if grid == nil {
+				v := "IJ_AVG_S__SO4"
+				if species == "pm25" && f.Lengths("PM25") != nil {
+					v = "PM25"
+				}
+				if grid, err = modelGrid(f, v); err != nil {
+					return nil, nil, fmt.Errorf("%s: %v", d.output.paths[0], err)
+				}
+				if grid.Len() != len(field) {
+					return nil, nil, fmt.Errorf("%s: the grid has %d cells, but there are %d values", d.output.paths[0], grid.Len(), len(field))
+				}
+				mean = make([]float64, len(field))
+			}
+			if len(field) != len(mean) {
+				return nil, nil, fmt.Errorf("%s has %d cells, not the %d of the first file", d.output.paths[0], len(field), len(mean))
+			}
+			for c, v := range field {
+				mean[c] += v
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil, fmt.Errorf("there are no model outputs to average")
+	}
+	for c := range mean {
+		mean[c] /= float64(n)
+	}
+	return mean, grid, nil
+}
+
+// componentField is a component of the simulated aerosol in every cell at
+// a time index. PM2.5 is the PM25 of the model if the file has it, as for
+// modelPM25.
+func componentField(f modelFile, hour int, species string, conv speciation) ([]float64, error) {
+	if species == "pm25" && f.Lengths("PM25") != nil {
+		field, err := fieldReading(f, "PM25", hour)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]float64, len(field))
+		for c, v := range field {
+			out[c] = float64(v)
+		}
+		return out, nil
+	}
+	field, err := speciesField(f, hour)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]float64, len(field))
+	for c, m := range field {
+		out[c] = conv.model(species, m)
+	}
+	return out, nil
+}
+
+// gridField is a named field on the model grid, for writing to netCDF.
+type gridField struct {
+	name, units, long string
+	values            []float64
+}
+
+// writeGridNetCDF writes fields on a latitude-longitude grid to a netCDF
+// file, with NaN where there is no value. The coordinates are the centres
+// of the cells.
+func writeGridNetCDF(path string, g *regrid.Rectilinear, fields []gridField) error {
+	lats, lons := g.Centres()
+	h := cdf.NewHeader([]string{"lat", "lon"}, []int{len(lats), len(lons)})
+	h.AddVariable("lat", []string{"lat"}, []float64{0})
+	h.AddAttribute("lat", "units", "degrees_north")
+	h.AddVariable("lon", []string{"lon"}, []float64{0})
+	h.AddAttribute("lon", "units", "degrees_east")
+	for _, f := range fields {
+		h.AddVariable(f.name, []string{"lat", "lon"}, []float32{0})
+		h.AddAttribute(f.name, "units", f.units)
+		h.AddAttribute(f.name, "long_name", f.long)
+	}
+	h.Define()
+	if errs := h.Check(); len(errs) > 0 {
+		return fmt.Errorf("the netCDF header for %s isn't valid: %v", path, errs[0])
+	}
+	ff, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", path, err)
+	}
+	if err := writeGridFields(ff, h, path, lats, lons, fields); err != nil {
+		ff.Close()
+		return err
+	}
+	return ff.Close()
+}
+
+// writeGridFields writes the coordinates and fields to the netCDF file ff
+// with the header h.
+func writeGridFields(ff *os.File, h *cdf.Header, path string, lats, lons []float64, fields []gridField) error {
+	f, err := cdf.Create(ff, h)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", path, err)
+	}
+	write := func(v string, data interface{}) error {
+		if _, err := f.Writer(v, nil, nil).Write(data); err != nil {
+			return fmt.Errorf("could not write %s to %s: %v", v, path, err)
+		}
+		return nil
+	}
+	if err := write("lat", lats); err != nil {
+		return err
+	}
+	if err := write("lon", lons); err != nil {
+		return err
+	}
+	for _, fd := range fields {
+		data := make([]float32, len(fd.values))
+		for i, v := range fd.values {
+			data[i] = float32(v)
+		}
+		if err := write(fd.name, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gridStats computes every metric for the cells of g with both values,
+// per cell, weighted by cell area and, if pop isn't nil, weighted by
+// population.
+func gridStats(g *regrid.Rectilinear, model, ref, pop []float64) [][]string {
+	var data []xy
+	var area, people []float64
+	for c := range model {
+		if math.IsNaN(model[c]) || math.IsNaN(ref[c]) {
+			continue
+		}
+		data = append(data, xy{model[c], ref[c]})
+		area = append(area, g.Area(c))
+		if pop != nil {
+			people = append(people, math.Max(0, pop[c]))
+		}
+	}
+	header := []string{"metric", "cells", "area_weighted"}
+	if pop != nil {
+		header = append(header, "population_weighted")
+	}
+	rows := [][]string{header}
+	for _, m := range metrics {
+		row := []string{m.name, "", ""}
+		if v, err := m.f(data); err == nil {
+			row[1] = ff(v)
+		}
+		if v, err := m.f(data, area...); err == nil {
+			row[2] = ff(v)
+		}
+		if pop != nil {
+			row = append(row, "")
+			if v, err := m.f(data, people...); err == nil {
+				row[3] = ff(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+	rows = append(rows, []string{"N cells", strconv.Itoa(len(data))})
+	return rows
+}
+
+// gridCmd is the "grid" mode, which compares the mean simulated PM2.5
+// with a gridded reference product, such as satellite-derived PM2.5.
+func gridCmd(args []string) error {
+	fs := flag.NewFlagSet("grid", flag.ExitOnError)
+	refFile := fs.String("ref", "", "netCDF file of the gridded reference product")
+	refVar := fs.String("var", "GWRPM25", "reference variable")
+	latVar := fs.String("latvar", "lat", "latitude variable of the reference and population files")
+	lonVar := fs.String("lonvar", "lon", "longitude variable of the reference and population files")
+	refTime := fs.Int("time", 0, "time index of the reference variable, if it has a time dimension")
+	minCover := fs.Float64("mincover", 0.5, "smallest fraction of a model cell that the reference has to cover")
+	popFile := fs.String("pop", "", "optional netCDF file of population counts, for population weighted metrics")
+	popVar := fs.String("popvar", "population", "population variable")
+	ncfFolder := fs.String("ncf", defaultNcfFolder, "folder of GEOS-Chem netCDF files")
+	from := fs.String("from", "", "first date of the GEOS-Chem files to average, as 2006-01-02")
+	to := fs.String("to", "", "last date of the GEOS-Chem files to average, as 2006-01-02")
+	outFile := fs.String("out", "griddiff.nc", "output netCDF file of the fields and their differences")
+	statsFile := fs.String("stats", "gridstats.csv", "output table of the metrics")
+	levelFlags(fs)
+	modelFileFlags(fs)
+	fs.Parse(args)
+
+	if *refFile == "" {
+		return fmt.Errorf("grid: the reference file (-ref) is required")
+	}
+	var t0, t1 time.Time
+	var err error
+	if *from != "" {
+		if t0, err = time.Parse("2006-01-02", *from); err != nil {
+			return fmt.Errorf("bad -from date: %v", err)
+		}
+	}
+	if *to != "" {
+		if t1, err = time.Parse("2006-01-02", *to); err != nil {
+			return fmt.Errorf("bad -to date: %v", err)
+		}
+	}
+	days, err := modelDays(*ncfFolder, t0, t1)
+	if err != nil {
+		return err
+	}
+	model, grid, err := meanModelField(days, "pm25", speciation{})
+	if err != nil {
+		return err
+	}
+	dst, ok := grid.(*regrid.Rectilinear)
+	if !ok {
+		return fmt.Errorf("grid: the model isn't on a latitude-longitude grid, so the product can't be averaged onto it")
+	}
+	refGrid, err := regridFile(*refFile, *refVar, *latVar, *lonVar, *refTime, false, dst)
+	if err != nil {
+		return err
+	}
+	ref := refGrid.Mean(*minCover)
+	var pop []float64
+	if *popFile != "" {
+		popGrid, err := regridFile(*popFile, *popVar, *latVar, *lonVar, 0, true, dst)
+		if err != nil {
+			return err
+		}
+		pop = popGrid.Sum()
+	}
+
+	diff := make([]float64, len(model))
+	ratio := make([]float64, len(model))
+	for c := range model {
+		diff[c] = model[c] - ref[c]
+		ratio[c] = model[c] / ref[c]
+	}
+	fields := []gridField{
+		{"model", "ug/m3", "mean simulated PM2.5", model},
+		{"reference", "ug/m3", "reference PM2.5, averaged conservatively onto the model grid", ref},
+		{"difference", "ug/m3", "simulated minus reference PM2.5", diff},
+		{"ratio", "1", "simulated over reference PM2.5", ratio},
+		{"coverage", "1", "fraction of the cell covered by the reference", refGrid.Coverage()},
+	}
+	if pop != nil {
+		fields = append(fields, gridField{"population", "1", "population in the cell", pop})
+	}
+	if err := writeGridNetCDF(*outFile, dst, fields); err != nil {
+		return err
+	}
+	rows := gridStats(dst, model, ref, pop)
+	var tWrt []XY
+	for _, r := range rows {
+		fmt.Printf("%-30s %s\n", r[0], strings.Join(r[1:], "  "))
+		tWrt = append(tWrt, r)
+	}
+	return csvWriter(*statsFile, tWrt)
+}
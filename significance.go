@@ -0,0 +1,349 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                  SIGNIFICANCE TESTING BETWEEN TWO RUNS
+// *************************************************************************
+// *************************************************************************
+
+// pairRuns pairs a baseline run (ncfA) and a sensitivity run (ncfB) with
+// the same observations from src. The two returned slices are aligned, so
+// that a[i] and b[i] share the same measured value. The days of the runs
+// are matched by their date, and the pairs of a day by their observation,
+// and it is an error for an observation to be paired with only one run.
+func pairRuns(src ObservationSource, ncfA, ncfB string) (a, b []xy, err error) {
+	mssA, err := dayMs(src, ncfA)
+	if err != nil {
+		return nil, nil, err
+	}
+	mssB, err := dayMs(src, ncfB)
+	if err != nil {
+		return nil, nil, err
+	}
+	daysB := make(map[time.Time]ms)
+	for _, m := range mssB {
+		daysB[m.date] = m
+	}
+	if len(daysB) != len(mssA) {
+		return nil, nil, fmt.Errorf("the runs have %d and %d days of observations", len(mssA), len(daysB))
+	}
+
+	for _, mA := range mssA {
+		mB, ok := daysB[mA.date]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: there is no day %s with %s", mA.obsPath, mA.date.Format("2006-01-02"), ncfB)
+		}
+		fmt.Printf("Getting results for: %s\n", mA.obsPath)
+		resA, errA := initResults(mA)
+		resB, errB := initResults(mB)
+		if errA != nil && errB != nil {
+			fmt.Println(errA)
+			continue
+		}
+		if errA != nil {
+			return nil, nil, fmt.Errorf("%s: the day can only be paired with %s: %v", mA.obsPath, ncfB, errA)
+		}
+		if errB != nil {
+			return nil, nil, fmt.Errorf("%s: the day can only be paired with %s: %v", mA.obsPath, ncfA, errB)
+		}
+		dayA, dayB, err := matchResults(resA, resB)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", mA.obsPath, err)
+		}
+		a = append(a, dayA...)
+		b = append(b, dayB...)
+	}
+	if len(a) == 0 {
+		return nil, nil, fmt.Errorf("no observations could be paired with both runs")
+	}
+	return a, b, nil
+}
+
+// matchResults pairs the results of two runs for the same observations,
+// matched by their time, station and measured value rather than their
+// order, as the runs can have different grids.
+func matchResults(resA, resB []outputComp) (a, b []xy, err error) {
+	key := func(r outputComp) string {
+		return strings.Join([]string{r.time, r.location, r.latitude, r.longitude, r.measuredPM}, "|")
+	}
+	if len(resA) != len(resB) {
+		return nil, nil, fmt.Errorf("the runs have %d and %d pairs", len(resA), len(resB))
+	}
+	// Repeated measurements are matched in order.
+	inB := make(map[string][]outputComp)
+	for _, r := range resB {
+		inB[key(r)] = append(inB[key(r)], r)
+	}
+	for _, ra := range resA {
+		k := key(ra)
+		if len(inB[k]) == 0 {
+			return nil, nil, fmt.Errorf("the observation at %s at %s isn't paired with both runs", ra.location, ra.time)
+		}
+		rb := inB[k][0]
+		inB[k] = inB[k][1:]
+		obs, errObs := strconv.ParseFloat(ra.measuredPM, 64)
+		simA, errSimA := strconv.ParseFloat(ra.simulatedPM, 64)
+		simB, errSimB := strconv.ParseFloat(rb.simulatedPM, 64)
+		if errObs != nil || errSimA != nil || errSimB != nil {
+			continue
+		}
+		a = append(a, xy{simA, obs})
+		b = append(b, xy{simB, obs})
+	}
+	return a, b, nil
+}
+
+// bootstrapResult is the difference in a metric between two runs, with the
+// 95% confidence interval and two-sided p-value from a paired bootstrap.
+type bootstrapResult struct {
+	a, b, diff float64
+	lo, hi     float64
+	p          float64
+}
+
+// pairedBootstrap resamples the paired data with replacement nboot times,
+// keeping each observation with both of its simulated values, and computes
+// the difference in m between the runs for every resample.
+func pairedBootstrap(a, b []xy, m metric, nboot int, rng *rand.Rand) (bootstrapResult, error) {
+	if len(a) != len(b) {
+		return bootstrapResult{}, fmt.Errorf("the runs have %d and %d pairs", len(a), len(b))
+	}
+	mA, err := m.f(a)
+	if err != nil {
+		return bootstrapResult{}, err
+	}
+	mB, err := m.f(b)
+	if err != nil {
+		return bootstrapResult{}, err
+	}
+	res := bootstrapResult{a: mA, b: mB, diff: mA - mB}
+
+	diffs := make([]float64, 0, nboot)
+	sa, sb := make([]xy, len(a)), make([]xy, len(b))
+	var below, above int
+	for k := 0; k < nboot; k++ {
+		for i := range sa {
+			j := rng.Intn(len(a))
+			sa[i], sb[i] = a[j], b[j]
+		}
+		ma, errA := m.f(sa)
+		mb, errB := m.f(sb)
+		if errA != nil || errB != nil {
+			continue
+		}
+		d := ma - mb
+		if math.IsNaN(d) {
+			continue
+		}
+		diffs = append(diffs, d)
+		if d <= 0 {
+			below++
+		}
+		if d >= 0 {
+			above++
+		}
+	}
+	if len(diffs) == 0 {
+		return res, fmt.Errorf("%s: none of the resamples gave a finite difference", m.name)
+	}
+	sort.Float64s(diffs)
+	res.lo = percentile(diffs, 2.5)
+	res.hi = percentile(diffs, 97.5)
+	res.p = math.Min(1, 2*float64(minInt(below, above))/float64(len(diffs)))
+	return res, nil
+}
+
+// percentile returns the pth percentile of sorted, interpolating linearly
+// between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	r := p / 100 * float64(len(sorted)-1)
+	i := int(math.Floor(r))
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (r-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// wilcoxon is the Wilcoxon signed-rank test on the differences in absolute
+// error, |Ma-O| - |Mb-O|. Zero differences are dropped, tied ranks are
+// averaged, and the p-value (two-sided) uses the normal approximation with
+// the tie correction. A negative z means that run a has smaller errors.
+func wilcoxon(a, b []xy) (w, z, p float64, err error) {
+	if len(a) != len(b) {
+		return 0, 0, 0, fmt.Errorf("the runs have %d and %d pairs", len(a), len(b))
+	}
+	var d []float64
+	for i := range a {
+		di := math.Abs(a[i].x-a[i].y) - math.Abs(b[i].x-b[i].y)
+		if di != 0 && !math.IsNaN(di) {
+			d = append(d, di)
+		}
+	}
+	n := float64(len(d))
+	if n == 0 {
+		return 0, 0, 1, fmt.Errorf("the runs have identical errors")
+	}
+	sort.Slice(d, func(i, j int) bool { return math.Abs(d[i]) < math.Abs(d[j]) })
+
+	var ties float64
+	for i := 0; i < len(d); {
+		j := i
+		for j < len(d) && math.Abs(d[j]) == math.Abs(d[i]) {
+			j++
+		}
+		// Ranks i+1 to j are shared.
+		rank := float64(i+1+j) / 2
+		for k := i; k < j; k++ {
+			if d[k] > 0 {
+				w += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	mean := n * (n + 1) / 4
+	variance := n*(n+1)*(2*n+1)/24 - ties/48
+	if variance <= 0 {
+		return w, 0, 1, nil
+	}
+	z = (w - mean) / math.Sqrt(variance)
+	return w, z, normTwoSided(z), nil
+}
+
+// dieboldMariano tests whether the two runs have equal squared errors.
+// The loss differential is d = (Ma-O)² - (Mb-O)², and its variance is the
+// long-run variance estimated from its autocovariances up to lag h-1.
+// For pooled station data the pairs aren't a single time series, so h
+// should normally be 1. A negative statistic means that run a is better.
+func dieboldMariano(a, b []xy, h int) (dm, p float64, err error) {
+	if len(a) != len(b) {
+		return 0, 0, fmt.Errorf("the runs have %d and %d pairs", len(a), len(b))
+	}
+	if h < 1 {
+		return 0, 0, fmt.Errorf("the lag must be at least 1, not %d", h)
+	}
+	d := make([]float64, len(a))
+	var dMean float64
+	for i := range a {
+		d[i] = math.Pow(a[i].x-a[i].y, 2) - math.Pow(b[i].x-b[i].y, 2)
+		dMean += d[i]
+	}
+	n := float64(len(d))
+	dMean /= n
+
+	autocov := func(k int) float64 {
+		var s float64
+		for i := k; i < len(d); i++ {
+			s += (d[i] - dMean) * (d[i-k] - dMean)
+		}
+		return s / n
+	}
+	lrv := autocov(0)
+	for k := 1; k < h && k < len(d); k++ {
+		lrv += 2 * autocov(k)
+	}
+	if lrv <= 0 {
+		return 0, 1, fmt.Errorf("the loss differential has no variance")
+	}
+	dm = dMean / math.Sqrt(lrv/n)
+	return dm, normTwoSided(dm), nil
+}
+
+// normTwoSided is the two-sided p-value of z under a standard normal
+// distribution.
+func normTwoSided(z float64) float64 {
+	return math.Erfc(math.Abs(z) / math.Sqrt2)
+}
+
+// signifCmd is the "signif" mode. It pairs a baseline and a sensitivity run
+// with the same observations and reports whether the runs differ
+// significantly.
+func signifCmd(args []string) error {
+	fs := flag.NewFlagSet("signif", flag.ExitOnError)
+	observations := observationFlags(fs, "pm25")
+	ncfA := fs.String("a", defaultNcfFolder, "folder of the baseline run")
+	ncfB := fs.String("b", "", "folder of the sensitivity run")
+	nboot := fs.Int("nboot", 1000, "number of bootstrap resamples")
+	seed := fs.Int64("seed", 1, "random seed for the bootstrap")
+	lag := fs.Int("lag", 1, "lag for the Diebold-Mariano variance")
+	outFile := fs.String("out", "", "optional csv file for the metric differences")
+	levelFlags(fs)
+	modelFileFlags(fs)
+	fs.Parse(args)
+
+	if *ncfB == "" {
+		return fmt.Errorf("signif: the sensitivity run folder (-b) is required")
+	}
+
+	src, err := observations()
+	if err != nil {
+		return err
+	}
+	a, b, err := pairRuns(src, *ncfA, *ncfB)
+	if err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(*seed))
+
+	tWrt := []XY{{"metric", "a", "b", "a-b", "ci_low", "ci_high", "p"}}
+	fmt.Printf("%d paired observations, %d bootstrap resamples\n", len(a), *nboot)
+	fmt.Printf("%-30s %12s %12s %12s %26s %8s\n", "", "a", "b", "a-b", "95% CI", "p")
+	for _, m := range metrics {
+		res, err := pairedBootstrap(a, b, m, *nboot, rng)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("%-30s %12f %12f %12f [%11f, %11f] %8.4f\n", m.name, res.a, res.b, res.diff, res.lo, res.hi, res.p)
+		tWrt = append(tWrt, XY{m.name, ff(res.a), ff(res.b), ff(res.diff), ff(res.lo), ff(res.hi), ff(res.p)})
+	}
+
+	w, z, p, err := wilcoxon(a, b)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Wilcoxon signed-rank (absolute error): W+ = %f, z = %f, p = %.4f\n", w, z, p)
+		tWrt = append(tWrt, XY{"Wilcoxon signed-rank z", "", "", ff(z), "", "", ff(p)})
+	}
+	dm, p, err := dieboldMariano(a, b, *lag)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Diebold-Mariano (squared error): DM = %f, p = %.4f\n", dm, p)
+		tWrt = append(tWrt, XY{"Diebold-Mariano", "", "", ff(dm), "", "", ff(p)})
+	}
+
+	if *outFile != "" {
+		if err := csvWriter(*outFile, tWrt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ff formats a float for csv output.
+func ff(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
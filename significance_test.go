@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMatchResults(t *testing.T) {
+	result := func(location, sim, obs string) outputComp {
+		return outputComp{time: "2015-11-20T03:00:00Z", location: location, latitude: "10", longitude: "20", simulatedPM: sim, measuredPM: obs}
+	}
+	// The pairs of the runs are matched by their observation, whatever
+	// their order.
+	a, b, err := matchResults(
+		[]outputComp{result("x", "1", "3"), result("y", "2", "4")},
+		[]outputComp{result("y", "5", "4"), result("x", "6", "3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 2 || a[0] != (xy{1, 3}) || b[0] != (xy{6, 3}) || a[1] != (xy{2, 4}) || b[1] != (xy{5, 4}) {
+		t.Errorf("the runs are paired as %v and %v", a, b)
+	}
+
+	// An observation paired with only one run is an error.
+	if _, _, err := matchResults([]outputComp{result("x", "1", "3")}, []outputComp{result("z", "1", "3")}); err == nil {
+		t.Error("observations that differ between the runs should be rejected")
+	}
+	if _, _, err := matchResults([]outputComp{result("x", "1", "3")}, nil); err == nil {
+		t.Error("runs with different numbers of pairs should be rejected")
+	}
+}
+
+func TestPairedBootstrap(t *testing.T) {
+	// Run a is 1 higher than run b everywhere, so every resample has a mean
+	// bias 1 higher.
+	b := []xy{{1, 2}, {4, 3}, {6, 8}, {9, 7}}
+	a := make([]xy, len(b))
+	for i, p := range b {
+		a[i] = xy{p.x + 1, p.y}
+	}
+	res, err := pairedBootstrap(a, b, metric{"Mean bias", meanBias}, 200, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.a != 1 || res.b != 0 || res.diff != 1 || res.lo != 1 || res.hi != 1 || res.p != 0 {
+		t.Errorf("the bootstrap result is %+v, not a difference of 1 with p = 0", res)
+	}
+
+	// Identical runs don't differ.
+	res, err = pairedBootstrap(b, b, metric{"Mean bias", meanBias}, 200, rand.New(rand.NewSource(1)))
+	if err != nil || res.diff != 0 || res.lo != 0 || res.hi != 0 || res.p != 1 {
+		t.Errorf("the bootstrap result of identical runs is %+v (%v)", res, err)
+	}
+}
+
+func TestWilcoxon(t *testing.T) {
+	// The differences in absolute error are 1, -2, 3, 4 and a tie of 0,
+	// which is dropped: W+ = 1 + 3 + 4, with n = 4.
+	a := []xy{{1, 0}, {0, 0}, {3, 0}, {4, 0}, {5, 0}}
+	b := []xy{{0, 0}, {2, 0}, {0, 0}, {0, 0}, {-5, 0}}
+	w, z, p, err := wilcoxon(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantZ := (8 - 5) / math.Sqrt(7.5)
+	if w != 8 || math.Abs(z-wantZ) > 1e-12 || math.Abs(p-math.Erfc(wantZ/math.Sqrt2)) > 1e-12 {
+		t.Errorf("W+ = %g, z = %g, p = %g, not 8, %g and %g", w, z, p, wantZ, math.Erfc(wantZ/math.Sqrt2))
+	}
+
+	// Tied ranks are averaged: 1, -1, 2 have the ranks 1.5, 1.5 and 3, and
+	// the variance is corrected for the tie.
+	a = []xy{{1, 0}, {0, 0}, {2, 0}}
+	b = []xy{{0, 0}, {1, 0}, {0, 0}}
+	w, z, _, err = wilcoxon(a, b)
+	if wantZ := 1.5 / math.Sqrt(3.5-6.0/48); err != nil || w != 4.5 || math.Abs(z-wantZ) > 1e-12 {
+		t.Errorf("with ties W+ = %g, z = %g (%v), not 4.5 and %g", w, z, err, wantZ)
+	}
+}
+
+func TestDieboldMariano(t *testing.T) {
+	// The loss differentials are 1, 4 and 9, with a mean of 14/3 and a
+	// variance of 98/9.
+	a := []xy{{1, 0}, {2, 0}, {3, 0}}
+	b := []xy{{0, 0}, {0, 0}, {0, 0}}
+	dm, p, err := dieboldMariano(a, b, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(dm-math.Sqrt(6)) > 1e-12 || math.Abs(p-math.Erfc(math.Sqrt(3))) > 1e-12 {
+		t.Errorf("DM = %g, p = %g, not √6 and %g", dm, p, math.Erfc(math.Sqrt(3)))
+	}
+	// The autocovariance at lag 1 is -4/27.
+	if dm, _, err := dieboldMariano(a, b, 2); err != nil || math.Abs(dm-42/math.Sqrt(286)) > 1e-12 {
+		t.Errorf("DM at lag 2 = %g (%v), not %g", dm, err, 42/math.Sqrt(286))
+	}
+	if _, _, err := dieboldMariano(a, a, 1); err == nil {
+		t.Error("identical runs should have no variance")
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                          SPECIATED EVALUATION
+// *************************************************************************
+// *************************************************************************
+
+// modelSpecies are the GEOS-Chem aerosol tracers at a grid cell and time,
+// in the mass units of the PM2.5 sum before its final scaling.
+type modelSpecies struct {
+	so4, nit, nh4 float32
+	bcpi, bcpo    float32
+	ocpi, ocpo    float32
+	// soa is the sum of the secondary organic aerosol tracers, which are
+	// organic matter rather than carbon (see soaTracers).
+	soa        float32
+	dst1, dst2 float32
+	sala       float32
+}
+
+// tracer is a GEOS-Chem aerosol tracer and its molecular weight.
+type tracer struct {
+	name string
+	mw   float32
+}
+
+// aerosolTracers are the tracers of modelSpecies other than the SOA, in
+// the order of speciesOf.
+var aerosolTracers = []tracer{{"SO4", MWaer[4]}, {"NIT", MWaer[3]}, {"NH4", MWaer[0]}, {"BCPI", MWaer[1]}, {"BCPO", MWaer[1]},
+	{"OCPI", MWaer[2]}, {"OCPO", MWaer[2]}, {"DST1", MWaer[5]}, {"DST2", MWaer[5]}, {"SALA", MWaer[6]}}
+
+// soaTracers are the secondary organic aerosol tracers of the complex SOA
+// scheme of GEOS-Chem before version 12, and the simple SOA and aqueous
+// isoprene SOA tracers of GEOS-Chem 12 and later. Runs have different sets
+// of them, so only those in the file are read.
+var soaTracers = []tracer{
+	{"TSOA0", MWaer[7]}, {"TSOA1", MWaer[7]}, {"TSOA2", MWaer[6]}, {"TSOA3", MWaer[6]},
+	{"ISOA1", MWaer[7]}, {"ISOA2", MWaer[7]}, {"ISOA3", MWaer[7]},
+	{"ASOA1", MWaer[7]}, {"ASOA2", MWaer[7]}, {"ASOA3", MWaer[7]},
+	{"SOAS", MWaer[7]}, {"SOAIE", 118}, {"SOAGX", 58}, {"SOAME", 102}, {"SOAMG", 72},
+	{"LVOCOA", 154}, {"INDIOL", 102}, {"ISN1OA", 226},
+}
+
+// soaIn returns the SOA tracers that f has.
+func soaIn(f modelFile) []tracer {
+	var out []tracer
+	for _, t := range soaTracers {
+		if f.Lengths("IJ_AVG_S__"+t.name) != nil {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// speciesOf returns the modelSpecies of the concentrations of the
+// aerosolTracers and of the SOA.
+func speciesOf(v []float32, soa float32) modelSpecies {
+	return modelSpecies{so4: v[0], nit: v[1], nh4: v[2], bcpi: v[3], bcpo: v[4], ocpi: v[5], ocpo: v[6],
+		dst1: v[7], dst2: v[8], sala: v[9], soa: soa}
+}
+
+// readModelSpecies reads the aerosol tracers from a GEOS-Chem file.
+func readModelSpecies(f modelFile, hour, lat, lon int) (modelSpecies, error) {
+	read := func(t tracer) (float32, error) {
+		v, err := varReading(hour, lat, lon, f, "IJ_AVG_S__"+t.name)
+		return ppb_ugm3 * t.mw * v, err
+	}
+	v := make([]float32, len(aerosolTracers))
+	for i, t := range aerosolTracers {
+		var err error
+		if v[i], err = read(t); err != nil {
+			return modelSpecies{}, err
+		}
+	}
+	var soa float32
+	for _, t := range soaIn(f) {
+		c, err := read(t)
+		if err != nil {
+			return modelSpecies{}, err
+		}
+		soa += c
+	}
+	return speciesOf(v, soa), nil
+}
+
+// modelScale converts the tracer sums to the simulated concentrations.
+const modelScale = 150 / 28.97
+
+// pm25 is the simulated PM2.5, with the growth factors of the hydrophilic
+// and inorganic aerosol.
+func (m modelSpecies) pm25() float32 {
+	simPM := 1.33*(m.nh4+m.nit+m.so4) + m.bcpi + m.bcpo + 2.1*(m.ocpo+1.16*m.ocpi) + m.dst1 + 0.38*m.dst2 + 1.86*m.sala + 1.16*m.soa
+	return simPM * modelScale
+}
+
+// add and scale are used to average the tracers over time.
+func (m modelSpecies) add(o modelSpecies) modelSpecies {
+	return modelSpecies{m.so4 + o.so4, m.nit + o.nit, m.nh4 + o.nh4, m.bcpi + o.bcpi, m.bcpo + o.bcpo,
+		m.ocpi + o.ocpi, m.ocpo + o.ocpo, m.soa + o.soa, m.dst1 + o.dst1, m.dst2 + o.dst2, m.sala + o.sala}
+}
+
+func (m modelSpecies) scale(s float32) modelSpecies {
+	return modelSpecies{m.so4 * s, m.nit * s, m.nh4 * s, m.bcpi * s, m.bcpo * s,
+		m.ocpi * s, m.ocpo * s, m.soa * s, m.dst1 * s, m.dst2 * s, m.sala * s}
+}
+
+// speciation holds the conventions for comparing the simulated components
+// with the measured species.
+type speciation struct {
+	// modelOMOC is the OM/OC ratio of the primary organic carbon tracers,
+	// 2.1 as in the PM2.5 sum. The simulated OC is the primary OC plus the
+	// secondary organic aerosol divided by this ratio.
+	modelOMOC float64
+	// obsOMOC is the OM/OC ratio applied to the measured OC, e.g. 1.8 as in
+	// the current IMPROVE equation or 1.4 as in the original one.
+	obsOMOC float64
+	// dust is "reported" to use the measured soil (IMPROVE SOILf) or
+	// "elements" to reconstruct it from the elements with dustCoef.
+	dust     string
+	dustCoef map[string]float64
+	// dst2 is the fraction of the second dust bin in PM2.5, 0.38 as in the
+	// PM2.5 sum.
+	dst2 float64
+	// saltCl is the ratio of sea salt to chloride, for networks that
+	// don't report sea salt.
+	saltCl float64
+}
+
+// speciesNames are the components that are compared, in order.
+var speciesNames = []string{"so4", "no3", "nh4", "ec", "oc", "om", "dust", "seasalt", "pm25"}
+
+// model returns the simulated component. The components are dry, as
+// measured on the filters, except for pm25, which is the PM2.5 sum.
+func (s speciation) model(species string, m modelSpecies) float64 {
+	var v float64
+	switch species {
+	case "so4":
+		v = float64(m.so4)
+	case "no3":
+		v = float64(m.nit)
+	case "nh4":
+		v = float64(m.nh4)
+	case "ec":
+		v = float64(m.bcpi + m.bcpo)
+	case "oc":
+		v = float64(m.ocpi+m.ocpo) + float64(m.soa)/s.modelOMOC
+	case "om":
+		v = s.modelOMOC*float64(m.ocpi+m.ocpo) + float64(m.soa)
+	case "dust":
+		v = float64(m.dst1) + s.dst2*float64(m.dst2)
+	case "seasalt":
+		v = float64(m.sala)
+	case "pm25":
+		return float64(m.pm25())
+	}
+	return v * modelScale
+}
+
+// measured returns the measured component from the species of a sample,
+// and whether it could be found.
+func (s speciation) measured(species string, sample map[string]float64) (float64, bool) {
+	switch species {
+	case "om":
+		oc, ok := sample["oc"]
+		return s.obsOMOC * oc, ok
+	case "dust":
+		if s.dust == "reported" {
+			v, ok := sample["soil"]
+			return v, ok
+		}
+		var v float64
+		for el, c := range s.dustCoef {
+			x, ok := sample[el]
+			if !ok {
+				return 0, false
+			}
+			v += c * x
+		}
+		return v, true
+	case "seasalt":
+		if v, ok := sample["seasalt"]; ok {
+			return v, true
+		}
+		cl, ok := sample["chl"]
+		return s.saltCl * cl, ok
+	}
+	v, ok := sample[species]
+	return v, ok
+}
+
+// parseCoefs parses a list of name=value pairs, e.g. al=2.2,si=2.49.
+func parseCoefs(s string) (map[string]float64, error) {
+	coefs := make(map[string]float64)
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q should be name=value", kv)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q should be name=value: %v", kv, err)
+		}
+		coefs[strings.ToLower(strings.TrimSpace(parts[0]))] = v
+	}
+	return coefs, nil
+}
+
+// speciesPair is a simulated component paired with the measured species.
+type speciesPair struct {
+	species string
+	pair
+}
+
+// speciatedSample is the species measured at a station in one sample.
+type speciatedSample struct {
+	ob      observation
+	species map[string]float64
+}
+
+// samples groups the observations of a day by station and time.
+func samples(obs []observation) []speciatedSample {
+	index := make(map[string]int)
+	var out []speciatedSample
+	for _, ob := range obs {
+		key := fmt.Sprintf("%s|%g|%g|%s", ob.location, ob.lat, ob.lon, ob.utc.Format(time.RFC3339))
+		i, ok := index[key]
+		if !ok {
+			i = len(out)
+			index[key] = i
+			out = append(out, speciatedSample{ob: ob, species: make(map[string]float64)})
+		}
+		out[i].species[ob.parameter] = ob.value
+	}
+	return out
+}
+
+// simulatedSpecies is the mean of the aerosol tracers in a cell over the
+// time indices, and the mean simulated PM2.5: the PM25 of the model if the
+// file has it, as for modelPM25, or else the PM2.5 sum of the tracers.
+func simulatedSpecies(f modelFile, times []int, lat, lon int) (modelSpecies, float64, error) {
+	hasPM25 := f.Lengths("PM25") != nil
+	var sum modelSpecies
+	var pm25 float64
+	for _, t := range times {
+		m, err := readModelSpecies(f, t, lat, lon)
+		if err != nil {
+			return modelSpecies{}, 0, err
+		}
+		sum = sum.add(m)
+		if hasPM25 {
+			v, err := varReading(t, lat, lon, f, "PM25")
+			if err != nil {
+				return modelSpecies{}, 0, err
+			}
+			pm25 += float64(v)
+		}
+	}
+	m := sum.scale(1 / float32(len(times)))
+	if !hasPM25 {
+		return m, float64(m.pm25()), nil
+	}
+	return m, pm25 / float64(len(times)), nil
+}
+
+// pairSpecies pairs the speciated samples of a day with the GEOS-Chem
+// file for the day. Samples of 24 hours or more are paired with the mean
+// of the day's model output, and shorter ones with the model output at
+// their time.
+func pairSpecies(mh ms, conv speciation) ([]speciesPair, error) {
+	f, err := mh.model.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cells, err := newModelCells(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", mh.model.output.paths[0], err)
+	}
+	obs, err := mh.readObs()
+	if err != nil {
+		return nil, err
+	}
+	// The cells are read in the order of the times (see byTime).
+	type job struct {
+		s    speciatedSample
+		cell modelCell
+		m    modelSpecies
+		pm25 float64
+	}
+	var jobs []job
+	var times [][]int
+	for _, s := range samples(obs) {
+		ob := s.ob
+		cell, err := cells.find(ob.lon, ob.lat)
+		if err != nil {
+			continue
+		}
+		// The daily mean is over the output of the day.
+		ts := mh.model.indices
+		if ob.period < 24*time.Hour {
+			t, err := mh.model.timeIndex(ob.utc)
+			if err != nil {
+				continue
+			}
+			ts = []int{t}
+		}
+		jobs = append(jobs, job{s: s, cell: cell})
+		times = append(times, ts)
+	}
+	err = byTime(times, func(j, t int) error {
+		m, pm25, err := simulatedSpecies(f, []int{t}, jobs[j].cell.row, jobs[j].cell.col)
+		jobs[j].m = jobs[j].m.add(m)
+		jobs[j].pm25 += pm25
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", mh.model.output.paths[0], err)
+	}
+	var out []speciesPair
+	for j, jb := range jobs {
+		s, ob := jb.s, jb.s.ob
+		n := float64(len(times[j]))
+		m, pm25 := jb.m.scale(float32(1/n)), jb.pm25/n
+		for _, sp := range speciesNames {
+			v, ok := conv.measured(sp, s.species)
+			if !ok {
+				continue
+			}
+			sim := conv.model(sp, m)
+			if sp == "pm25" {
+				sim = pm25
+			}
+			c := jb.cell
+			p := pair{xy: xy{sim, v}, time: ob.utc, location: ob.location, city: ob.city, country: ob.country, lat: ob.lat, lon: ob.lon,
+				cell: c.index, cellLat: c.lat, cellLon: c.lon, area: c.area}
+			if t, err := time.Parse(time.RFC3339, ob.local); err == nil {
+				p.local = t
+			}
+			out = append(out, speciesPair{sp, p})
+		}
+	}
+	return out, nil
+}
+
+// speciateCmd is the "speciate" mode. It pairs the simulated aerosol
+// components with the species measured by a speciation network, and writes
+// the pairs and every metric for each species.
+func speciateCmd(args []string) error {
+	fs := flag.NewFlagSet("speciate", flag.ExitOnError)
+	observations := observationFlags(fs, "")
+	ncfFolder := fs.String("ncf", defaultNcfFolder, "folder of GEOS-Chem netCDF files")
+	modelOMOC := fs.Float64("modelomoc", 2.1, "OM/OC ratio of the simulated primary organic carbon")
+	obsOMOC := fs.Float64("omoc", 1.8, "OM/OC ratio for the measured organic carbon")
+	dust := fs.String("dust", "reported", "measured dust: reported (IMPROVE SOILf) or elements (from -dustcoef)")
+	dustCoef := fs.String("dustcoef", "al=2.2,si=2.49,ca=1.63,fe=2.42,ti=1.94", "element coefficients for the reconstructed dust")
+	dst2 := fs.Float64("dst2", 0.38, "fraction of the second dust bin in PM2.5")
+	saltCl := fs.Float64("saltcl", 1.8, "sea salt to chloride ratio, for networks without sea salt")
+	by := fs.String("by", "all,season", "comma separated list of groupings for each species")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	weighting := fs.String("weight", "none", "weighting: none, station, cell or area")
+	outFile := fs.String("out", "speciated.csv", "output file of the paired species")
+	statsFile := fs.String("stats", "speciated_stats.csv", "output table of the metrics for each species")
+	levelFlags(fs)
+	modelFileFlags(fs)
+	fs.Parse(args)
+
+	conv := speciation{modelOMOC: *modelOMOC, obsOMOC: *obsOMOC, dust: *dust, dst2: *dst2, saltCl: *saltCl}
+	if conv.dust != "reported" && conv.dust != "elements" {
+		return fmt.Errorf("speciate: -dust should be reported or elements, not %q", conv.dust)
+	}
+	var err error
+	if conv.dustCoef, err = parseCoefs(*dustCoef); err != nil {
+		return fmt.Errorf("speciate: bad -dustcoef: %v", err)
+	}
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, "", "")
+	if err != nil {
+		return err
+	}
+	src, err := observations()
+	if err != nil {
+		return err
+	}
+	mss, err := dayMs(src, *ncfFolder)
+	if err != nil {
+		return err
+	}
+
+	bySpecies := make(map[string][]pair)
+	tWrt := []XY{{"species", "simulated", "measured", "utc", "location", "city", "country", "latitude", "longitude"}}
+	for _, mh := range mss {
+		fmt.Printf("Getting results for: %s\n", mh.obsPath)
+		pairs, err := pairSpecies(mh, conv)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for _, p := range pairs {
+			bySpecies[p.species] = append(bySpecies[p.species], p.pair)
+			tWrt = append(tWrt, XY{p.species, ff(p.x), ff(p.y), p.time.Format(time.RFC3339), p.location, p.city, p.country, ff(p.lat), ff(p.lon)})
+		}
+	}
+	if len(bySpecies) == 0 {
+		return fmt.Errorf("speciate: no species could be paired")
+	}
+	if err := csvWriter(*outFile, tWrt); err != nil {
+		return err
+	}
+
+	tStats := []XY{{"species", "group_by", "group", "metric", "value", "n"}}
+	var species []string
+	for sp := range bySpecies {
+		species = append(species, sp)
+	}
+	sort.Slice(species, func(i, j int) bool { return indexOf(speciesNames, species[i]) < indexOf(speciesNames, species[j]) })
+	for _, sp := range species {
+		stats, err := stratify(bySpecies[sp], groupers, *weighting)
+		if err != nil {
+			return err
+		}
+		var nmb float64
+		for _, s := range stats {
+			tStats = append(tStats, XY{sp, s.groupBy, s.group, s.metric, ff(s.value), strconv.Itoa(s.n)})
+			if s.groupBy == "all" && s.metric == "Normalised mean bias" {
+				nmb = s.value
+			}
+		}
+		fmt.Printf("%-8s %6d pairs, normalised mean bias %.3g\n", sp, len(bySpecies[sp]), nmb)
+	}
+	return csvWriter(*statsFile, tStats)
+}
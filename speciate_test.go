@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// tracerModel is a fakeModel of two outputs of a single cell, with every
+// tracer at 1 and 3 ppbv.
+func tracerModel(tracers ...string) fakeModel {
+	f := fakeModel{values: map[string][]float32{}, dims: map[string][]int{}}
+	for _, t := range tracers {
+		f.values["IJ_AVG_S__"+t] = []float32{1, 3}
+		f.dims["IJ_AVG_S__"+t] = []int{2, 1, 1}
+	}
+	return f
+}
+
+var primaryTracers = []string{"SO4", "NIT", "NH4", "BCPI", "BCPO", "OCPI", "OCPO", "DST1", "DST2", "SALA"}
+
+func TestSimulatedSpecies(t *testing.T) {
+	f := tracerModel(append(primaryTracers, "TSOA0", "TSOA1", "TSOA2", "TSOA3", "ISOA1", "ISOA2", "ISOA3", "ASOA1", "ASOA2", "ASOA3")...)
+	m, pm25, err := simulatedSpecies(f, []int{0, 1}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ppb_ugm3 * MWaer[4] * 2; math.Abs(float64(m.so4-want)) > 1e-4*float64(want) {
+		t.Errorf("the mean SO4 is %g, not %g", m.so4, want)
+	}
+	if want := float32(ppb_ugm3 * 2 * (8*MWaer[7] + 2*MWaer[6])); math.Abs(float64(m.soa-want)) > 1e-4*float64(want) {
+		t.Errorf("the mean SOA is %g, not %g", m.soa, want)
+	}
+	if want := float64(m.pm25()); pm25 != want {
+		t.Errorf("without PM25 the PM2.5 is %g, not the sum of the tracers, %g", pm25, want)
+	}
+
+	// With the PM25 of the model, as in the AerosolMass collection, the
+	// PM2.5 is its mean.
+	f.values["PM25"] = []float32{10, 20}
+	f.dims["PM25"] = []int{2, 1, 1}
+	if _, pm25, err := simulatedSpecies(f, []int{0, 1}, 0, 0); err != nil || pm25 != 15 {
+		t.Errorf("with PM25 the PM2.5 is %g (%v), not 15", pm25, err)
+	}
+	if _, pm25, err := simulatedSpecies(f, []int{1}, 0, 0); err != nil || pm25 != 20 {
+		t.Errorf("with PM25 the PM2.5 at time 1 is %g (%v), not 20", pm25, err)
+	}
+}
+
+func TestSimulatedSpeciesSOA(t *testing.T) {
+	// GEOS-Chem 12 and later have the simple SOA and none of the tracers of
+	// the complex SOA scheme.
+	f := tracerModel(append(primaryTracers, "SOAS")...)
+	m, _, err := simulatedSpecies(f, []int{0, 1}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ppb_ugm3 * MWaer[7] * 2; math.Abs(float64(m.soa-want)) > 1e-4*float64(want) {
+		t.Errorf("the mean SOA is %g, not the SOAS, %g", m.soa, want)
+	}
+	field, err := speciesField(f, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ppb_ugm3 * MWaer[7] * 3; len(field) != 1 || math.Abs(float64(field[0].soa-want)) > 1e-4*float64(want) {
+		t.Errorf("the SOA field is %+v, not the SOAS, %g", field, want)
+	}
+
+	// A missing tracer that isn't SOA is an error, not a panic.
+	f = tracerModel(primaryTracers[1:]...)
+	if _, _, err := simulatedSpecies(f, []int{0}, 0, 0); err == nil {
+		t.Error("a file without SO4 should be rejected")
+	}
+	if _, err := modelPM25(f, 0, 0, 0); err == nil {
+		t.Error("the PM2.5 of a file without SO4 should be an error")
+	}
+}
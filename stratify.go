@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                          STRATIFIED STATISTICS
+// *************************************************************************
+// *************************************************************************
+
+// grouper assigns each pair to a group, e.g. the country of the station.
+// Pairs that don't belong to any group (ok is false) are left out.
+type grouper struct {
+	name string
+	key  func(p pair) (group string, ok bool)
+}
+
+func byCountry() grouper {
+	return grouper{"country", func(p pair) (string, bool) {
+		return p.country, p.country != ""
+	}}
+}
+
+func byMonth() grouper {
+	return grouper{"month", func(p pair) (string, bool) {
+		return p.time.Format("01"), p.hasStation()
+	}}
+}
+
+func bySeason() grouper {
+	return grouper{"season", func(p pair) (string, bool) {
+		if !p.hasStation() {
+			return "", false
+		}
+		return season(int(p.time.Month())), true
+	}}
+}
+
+// season returns the meteorological season of month (1-12).
+func season(month int) string {
+	switch month {
+	case 12, 1, 2:
+		return "DJF"
+	case 3, 4, 5:
+		return "MAM"
+	case 6, 7, 8:
+		return "JJA"
+	}
+	return "SON"
+}
+
+// byHour groups by the local hour of the measurement, as in the diurnal
+// cycle: from its UTC offset if it is known, and otherwise from the
+// station longitude (see localTime).
+func byHour() grouper {
+	return grouper{"hour", func(p pair) (string, bool) {
+		if !p.hasStation() {
+			return "", false
+		}
+		t, _ := localTime(p, "auto")
+		return fmt.Sprintf("%02d", t.Hour()), true
+	}}
+}
+
+// byUTCHour groups by the UTC hour of the measurement, as for the hourly
+// model output.
+func byUTCHour() grouper {
+	return grouper{"utchour", func(p pair) (string, bool) {
+		return fmt.Sprintf("%02d", p.time.UTC().Hour()), p.hasStation()
+	}}
+}
+
+// byClass groups by a station classification, e.g. urban or rural, looked
+// up by the location name.
+func byClass(classes map[string]string) grouper {
+	return grouper{"class", func(p pair) (string, bool) {
+		c, ok := classes[p.location]
+		return c, ok
+	}}
+}
+
+// byConcBin groups by the measured concentration, with bins between the
+// given edges, which must be increasing. Values below the first edge or
+// at or above the last one are left out.
+func byConcBin(edges []float64) grouper {
+	return grouper{"bin", func(p pair) (string, bool) {
+		for i := 0; i < len(edges)-1; i++ {
+			if p.y >= edges[i] && p.y < edges[i+1] {
+				return fmt.Sprintf("[%g,%g)", edges[i], edges[i+1]), true
+			}
+		}
+		return "", false
+	}}
+}
+
+// byRegion groups by the first region polygon that contains the station.
+func byRegion(regions []region) grouper {
+	return grouper{"region", func(p pair) (string, bool) {
+		if !p.hasStation() {
+			return "", false
+		}
+		for _, r := range regions {
+			if r.contains(p.lon, p.lat) {
+				return r.name, true
+			}
+		}
+		return "", false
+	}}
+}
+
+// region is a named area made of one or more polygons. The first ring of
+// each polygon is its outer boundary and any others are holes. Points are
+// longitude, latitude.
+type region struct {
+	name     string
+	polygons [][][][2]float64
+}
+
+func (r region) contains(lon, lat float64) bool {
+	for _, poly := range r.polygons {
+		if len(poly) == 0 || !inRing(poly[0], lon, lat) {
+			continue
+		}
+		inHole := false
+		for _, hole := range poly[1:] {
+			if inRing(hole, lon, lat) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// inRing is a ray casting point in polygon test.
+func inRing(ring [][2]float64, x, y float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+// readRegions reads region polygons from a GeoJSON FeatureCollection of
+// Polygon and MultiPolygon features. The region name is taken from the
+// nameProp property of each feature.
+func readRegions(path, nameProp string) ([]region, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		return nil, fmt.Errorf("reading %s isn't working: %v", path, err)
+	}
+
+	var regions []region
+	for i, f := range fc.Features {
+		r := region{name: fmt.Sprint(f.Properties[nameProp])}
+		if f.Properties[nameProp] == nil {
+			r.name = strconv.Itoa(i)
+		}
+		switch f.Geometry.Type {
+		case "Polygon":
+			var poly [][][2]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &poly); err != nil {
+				return nil, fmt.Errorf("%s: region %s: %v", path, r.name, err)
+			}
+			r.polygons = [][][][2]float64{poly}
+		case "MultiPolygon":
+			if err := json.Unmarshal(f.Geometry.Coordinates, &r.polygons); err != nil {
+				return nil, fmt.Errorf("%s: region %s: %v", path, r.name, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: region %s is a %s, not a polygon", path, r.name, f.Geometry.Type)
+		}
+		regions = append(regions, r)
+	}
+	return regions, nil
+}
+
+// readClasses reads a csv file of location,class lines, e.g. to mark
+// each station as urban or rural.
+func readClasses(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s isn't working: %v", path, err)
+	}
+	classes := make(map[string]string)
+	for _, line := range lines {
+		if len(line) < 2 {
+			return nil, fmt.Errorf("%s: expecting location,class lines", path)
+		}
+		classes[line[0]] = line[1]
+	}
+	return classes, nil
+}
+
+// groupStat is one row of the stratified output table.
+type groupStat struct {
+	groupBy string
+	group   string
+	metric  string
+	value   float64
+	n       int
+}
+
+// groupPairs splits pairs into the groups of g, and returns the sorted
+// group names.
+func groupPairs(pairs []pair, g grouper) ([]string, map[string][]pair) {
+	groups := make(map[string][]pair)
+	for _, p := range pairs {
+		if k, ok := g.key(p); ok {
+			groups[k] = append(groups[k], p)
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, groups
+}
+
+// allPairs puts every pair in one group.
+func allPairs() grouper {
+	return grouper{"all", func(p pair) (string, bool) { return "all", true }}
+}
+
+// stratify computes every metric for every group of every grouper, with
+// the weighting scheme applied within each group.
+func stratify(pairs []pair, groupers []grouper, weighting string) ([]groupStat, error) {
+	var stats []groupStat
+	for _, g := range groupers {
+		keys, groups := groupPairs(pairs, g)
+		for _, k := range keys {
+			data, w, err := applyWeighting(groups[k], weighting)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range metrics {
+				v, err := m.f(data, w...)
+				if err != nil {
+					continue
+				}
+				stats = append(stats, groupStat{g.name, k, m.name, v, len(groups[k])})
+			}
+		}
+	}
+	return stats, nil
+}
+
+func writeGroupStats(filename string, stats []groupStat) error {
+	tWrt := []XY{{"group_by", "group", "metric", "value", "n"}}
+	for _, s := range stats {
+		tWrt = append(tWrt, XY{s.groupBy, s.group, s.metric, ff(s.value), strconv.Itoa(s.n)})
+	}
+	return csvWriter(filename, tWrt)
+}
+
+// parseFloats parses a comma separated list of numbers.
+func parseFloats(s string) ([]float64, error) {
+	var out []float64
+	for _, f := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// groupersFromFlags builds the groupers named in by (comma separated).
+// Regions, classes and bins are only needed if they are grouped by.
+func groupersFromFlags(by, regionFile, regionName, classFile, bins string) ([]grouper, error) {
+	var groupers []grouper
+	for _, name := range strings.Split(by, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "all":
+			groupers = append(groupers, allPairs())
+		case "country":
+			groupers = append(groupers, byCountry())
+		case "month":
+			groupers = append(groupers, byMonth())
+		case "season":
+			groupers = append(groupers, bySeason())
+		case "hour":
+			groupers = append(groupers, byHour())
+		case "utchour":
+			groupers = append(groupers, byUTCHour())
+		case "region":
+			if regionFile == "" {
+				return nil, fmt.Errorf("grouping by region needs a region file")
+			}
+			regions, err := readRegions(regionFile, regionName)
+			if err != nil {
+				return nil, err
+			}
+			groupers = append(groupers, byRegion(regions))
+		case "class":
+			if classFile == "" {
+				return nil, fmt.Errorf("grouping by class needs a classification file")
+			}
+			classes, err := readClasses(classFile)
+			if err != nil {
+				return nil, err
+			}
+			groupers = append(groupers, byClass(classes))
+		case "bin":
+			edges, err := parseFloats(bins)
+			if err != nil {
+				return nil, fmt.Errorf("the bin edges %q can't be parsed: %v", bins, err)
+			}
+			groupers = append(groupers, byConcBin(edges))
+		default:
+			return nil, fmt.Errorf("can't group by %q", name)
+		}
+	}
+	return groupers, nil
+}
+
+// stratifyCmd is the "stratify" mode. It reads the paired results in the
+// output folder and writes a table of every metric for every group.
+func stratifyCmd(args []string) error {
+	fs := flag.NewFlagSet("stratify", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	by := fs.String("by", "all,country,season,month,hour,bin", "comma separated list of groupings: all, country, region, month, season, hour (local), utchour, class, bin")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	classFile := fs.String("classes", "", "csv file of location,class for each station, e.g. urban or rural")
+	bins := fs.String("bins", "0,10,25,50,100,1000", "concentration bin edges")
+	weighting := fs.String("weight", "none", "weighting: none, station, cell or area")
+	outFile := fs.String("out", "stratified.csv", "output table")
+	fs.Parse(args)
+
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, *classFile, *bins)
+	if err != nil {
+		return err
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	stats, err := stratify(pairs, groupers, *weighting)
+	if err != nil {
+		return err
+	}
+	return writeGroupStats(*outFile, stats)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByHour(t *testing.T) {
+	utc := time.Date(2015, 11, 20, 23, 45, 0, 0, time.UTC)
+	// A station with its UTC offset in the measurement file, and one without
+	// at 90°W, whose offset is taken from its longitude.
+	ulaanbaatar := pair{time: utc, location: "a", lat: 47.9, lon: 106.9, local: utc.In(time.FixedZone("", 8*3600))}
+	minneapolis := pair{time: utc, location: "b", lat: 44.98, lon: -93.26}
+	for _, test := range []struct {
+		g          grouper
+		p          pair
+		want, name string
+	}{
+		{byHour(), ulaanbaatar, "07", "the local hour with the offset"},
+		{byHour(), minneapolis, "17", "the local hour from the longitude"},
+		{byUTCHour(), ulaanbaatar, "23", "the UTC hour"},
+	} {
+		if got, ok := test.g.key(test.p); !ok || got != test.want {
+			t.Errorf("%s is %q (%v), not %q", test.name, got, ok, test.want)
+		}
+	}
+	if _, ok := byHour().key(pair{xy: xy{1, 2}}); ok {
+		t.Error("a pair without station information should be left out")
+	}
+}
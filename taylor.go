@@ -0,0 +1,317 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                             TAYLOR DIAGRAMS
+// *************************************************************************
+// *************************************************************************
+
+// taylorPoint is the position of one model and group on a Taylor diagram.
+// The standard deviation and the centred RMSE are normalised by the
+// standard deviation of the observations, so that the observations are at
+// (1, 0).
+type taylorPoint struct {
+	model, group string
+	r            float64 // correlation coefficient
+	sd           float64 // normalised standard deviation
+	crmse        float64 // normalised centred root mean square error
+}
+
+// taylorStats returns the correlation, normalised standard deviation and
+// normalised centred RMSE of the data.
+func taylorStats(Data []xy) (r, sd, crmse float64, err error) {
+	if len(Data) < 2 {
+		return 0, 0, 0, fmt.Errorf("there are only %d data points", len(Data))
+	}
+	var mMean, oMean float64
+	for _, xy := range Data {
+		mMean += xy.x
+		oMean += xy.y
+	}
+	n := float64(len(Data))
+	mMean /= n
+	oMean /= n
+	var cov, varM, varO, sumSq float64
+	for _, xy := range Data {
+		dm, do := xy.x-mMean, xy.y-oMean
+		cov += dm * do
+		varM += dm * dm
+		varO += do * do
+		sumSq += (dm - do) * (dm - do)
+	}
+	if varO == 0 || varM == 0 {
+		return 0, 0, 0, fmt.Errorf("the data have no variance")
+	}
+	sdO := math.Sqrt(varO / n)
+	r = cov / math.Sqrt(varM*varO)
+	sd = math.Sqrt(varM/n) / sdO
+	crmse = math.Sqrt(sumSq/n) / sdO
+	return r, sd, crmse, nil
+}
+
+// taylorGrid draws the standard deviation arcs, correlation rays and
+// centred RMSE contours of a Taylor diagram. If negative is true the
+// diagram covers negative correlations as well.
+type taylorGrid struct {
+	maxSD    float64
+	negative bool
+}
+
+func (g taylorGrid) Plot(c draw.Canvas, plt *plot.Plot) {
+	trX, trY := plt.Transforms(&c)
+	pt := func(x, y float64) vg.Point { return vg.Point{X: trX(x), Y: trY(y)} }
+	maxAngle := math.Pi / 2
+	if g.negative {
+		maxAngle = math.Pi
+	}
+	// arc returns the points of an arc around (cx, 0) with radius rad
+	// that are inside the diagram.
+	arc := func(cx, rad float64) [][]vg.Point {
+		var lines [][]vg.Point
+		var line []vg.Point
+		const n = 200
+		for i := 0; i <= n; i++ {
+			a := math.Pi * float64(i) / n
+			x, y := cx+rad*math.Cos(a), rad*math.Sin(a)
+			if math.Hypot(x, y) <= g.maxSD*1.0001 && math.Atan2(y, x) <= maxAngle+1e-9 {
+				line = append(line, pt(x, y))
+			} else if len(line) > 0 {
+				lines = append(lines, line)
+				line = nil
+			}
+		}
+		if len(line) > 1 {
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	gridStyle := draw.LineStyle{Color: color.Gray{Y: 180}, Width: vg.Points(0.5)}
+	refStyle := draw.LineStyle{Color: color.Black, Width: vg.Points(0.75), Dashes: []vg.Length{vg.Points(4), vg.Points(2)}}
+	rmseStyle := draw.LineStyle{Color: color.RGBA{G: 140, A: 255}, Width: vg.Points(0.5), Dashes: []vg.Length{vg.Points(2), vg.Points(2)}}
+	labelStyle := draw.TextStyle{Color: color.Gray{Y: 80}, Font: plt.X.Tick.Label.Font}
+
+	// Standard deviation arcs around the origin.
+	for _, t := range plt.X.Tick.Marker.Ticks(0, g.maxSD) {
+		if t.Label == "" || t.Value <= 0 {
+			continue
+		}
+		c.StrokeLines(gridStyle, c.ClipLinesXY(arc(0, t.Value)...)...)
+	}
+	c.StrokeLines(gridStyle, c.ClipLinesXY(arc(0, g.maxSD)...)...)
+	c.StrokeLines(refStyle, c.ClipLinesXY(arc(0, 1)...)...)
+
+	// Correlation rays, labelled outside the outer arc.
+	rs := []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 0.95, 0.99, 1}
+	if g.negative {
+		for _, r := range rs[1:] {
+			rs = append(rs, -r)
+		}
+	}
+	labelStyle.XAlign = draw.XCenter
+	labelStyle.YAlign = draw.YCenter
+	for _, r := range rs {
+		a := math.Acos(r)
+		x, y := math.Cos(a), math.Sin(a)
+		c.StrokeLines(gridStyle, c.ClipLinesXY([]vg.Point{pt(0, 0), pt(g.maxSD*x, g.maxSD*y)})...)
+		lpt := pt(g.maxSD*x, g.maxSD*y)
+		lpt.X += labelStyle.Font.Size * vg.Length(x)
+		lpt.Y += labelStyle.Font.Size * vg.Length(y)
+		c.FillText(labelStyle, lpt, fmt.Sprintf("%g", r))
+	}
+	c.FillText(labelStyle, pt(g.maxSD*0.8, g.maxSD*0.8), "Correlation")
+
+	// Centred RMSE contours around the observations.
+	for _, rad := range []float64{0.25, 0.5, 0.75, 1, 1.25, 1.5, 2, 3, 4} {
+		if rad >= g.maxSD+1 {
+			break
+		}
+		lines := c.ClipLinesXY(arc(1, rad)...)
+		c.StrokeLines(rmseStyle, lines...)
+	}
+
+	// The observations.
+	c.DrawGlyph(draw.GlyphStyle{Color: color.Black, Radius: vg.Points(3), Shape: draw.PyramidGlyph{}}, pt(1, 0))
+}
+
+// taylorDiagram makes a Taylor diagram of the points. Each model has its
+// own glyph shape and each group its own color.
+func taylorDiagram(points []taylorPoint) (*plot.Plot, error) {
+	p, err := plot.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not create plot: %v", err)
+	}
+	p.Title.Text = "Taylor diagram"
+	p.X.Label.Text = "Normalised standard deviation"
+	p.Y.Label.Text = "Normalised standard deviation"
+
+	g := taylorGrid{maxSD: 1.5}
+	var models, groups []string
+	for _, tp := range points {
+		g.maxSD = math.Max(g.maxSD, math.Ceil(tp.sd*1.1*4)/4)
+		if tp.r < 0 {
+			g.negative = true
+		}
+		models = appendUnique(models, tp.model)
+		groups = appendUnique(groups, tp.group)
+	}
+	// Leave room for the correlation labels outside the outer arc.
+	const pad = 1.12
+	p.X.Min, p.X.Max = 0, g.maxSD*pad
+	if g.negative {
+		p.X.Min = -g.maxSD * pad
+	}
+	p.Y.Min, p.Y.Max = 0, g.maxSD*pad
+	p.Add(g)
+
+	glyph := func(model, group string) draw.GlyphStyle {
+		return draw.GlyphStyle{
+			Shape:  plotutil.Shape(indexOf(models, model)),
+			Color:  plotutil.Color(indexOf(groups, group)),
+			Radius: vg.Points(4),
+		}
+	}
+	for _, tp := range points {
+		a := math.Acos(tp.r)
+		s, err := plotter.NewScatter(plotter.XYs{{X: tp.sd * math.Cos(a), Y: tp.sd * math.Sin(a)}})
+		if err != nil {
+			return nil, fmt.Errorf("could not create scatter: %v", err)
+		}
+		s.GlyphStyle = glyph(tp.model, tp.group)
+		p.Add(s)
+	}
+
+	// The legend shows the model glyphs in black, and the group colors
+	// if there is more than one group.
+	for i, m := range models {
+		s, err := plotter.NewScatter(plotter.XYs{{}})
+		if err != nil {
+			return nil, fmt.Errorf("could not create scatter: %v", err)
+		}
+		s.GlyphStyle = draw.GlyphStyle{Shape: plotutil.Shape(i), Color: color.Black, Radius: vg.Points(4)}
+		p.Legend.Add(m, s)
+	}
+	if len(groups) > 1 {
+		for i, grp := range groups {
+			s, err := plotter.NewScatter(plotter.XYs{{}})
+			if err != nil {
+				return nil, fmt.Errorf("could not create scatter: %v", err)
+			}
+			s.GlyphStyle = draw.GlyphStyle{Shape: draw.CircleGlyph{}, Color: plotutil.Color(i), Radius: vg.Points(4)}
+			p.Legend.Add(grp, s)
+		}
+	}
+	p.Legend.Top = true
+	return p, nil
+}
+
+func appendUnique(list []string, s string) []string {
+	if indexOf(list, s) < 0 {
+		return append(list, s)
+	}
+	return list
+}
+
+func indexOf(list []string, s string) int {
+	for i, l := range list {
+		if l == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// taylorPoints computes the Taylor diagram points for every group of the
+// paired results of one model.
+func taylorPoints(model string, pairs []pair, g grouper) []taylorPoint {
+	var points []taylorPoint
+	keys, groups := groupPairs(pairs, g)
+	for _, k := range keys {
+		r, sd, crmse, err := taylorStats(pairXYs(groups[k]))
+		if err != nil {
+			fmt.Printf("%s, %s: %v\n", model, k, err)
+			continue
+		}
+		points = append(points, taylorPoint{model: model, group: k, r: r, sd: sd, crmse: crmse})
+	}
+	return points
+}
+
+// taylorCmd is the "taylor" mode. The models to compare are given as
+// label=folder arguments, where each folder holds paired results.
+func taylorCmd(args []string) error {
+	fs := flag.NewFlagSet("taylor", flag.ExitOnError)
+	by := fs.String("by", "all", "grouping: all, country, region, month, season, hour (local), utchour, class or bin")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	classFile := fs.String("classes", "", "csv file of location,class for each station")
+	bins := fs.String("bins", "0,10,25,50,100,1000", "concentration bin edges")
+	outFile := fs.String("out", "taylor.pdf", "output file")
+	statsFile := fs.String("stats", "", "optional csv file for the diagram statistics")
+	dataset := datasetFlags(fs)
+	fig := figFlags(fs)
+	fs.Parse(args)
+
+	groupers, err := groupersFromFlags(*by, *regionFile, *regionName, *classFile, *bins)
+	if err != nil {
+		return err
+	}
+	if len(groupers) != 1 {
+		return fmt.Errorf("taylor: a single grouping is needed, not %q", *by)
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	models := fs.Args()
+	if len(models) == 0 {
+		models = []string{"GEOS-Chem=" + ds.folder}
+	}
+
+	var points []taylorPoint
+	for _, m := range models {
+		i := strings.Index(m, "=")
+		if i < 0 {
+			return fmt.Errorf("taylor: models should be given as label=folder, not %q", m)
+		}
+		ds.folder = m[i+1:]
+		pairs, err := readPairs(ds)
+		if err != nil {
+			return err
+		}
+		points = append(points, taylorPoints(m[:i], pairs, groupers[0])...)
+	}
+	if len(points) == 0 {
+		return fmt.Errorf("taylor: there is nothing to plot")
+	}
+
+	if *statsFile != "" {
+		tWrt := []XY{{"model", "group", "correlation", "normalised_sd", "normalised_crmse"}}
+		for _, tp := range points {
+			tWrt = append(tWrt, XY{tp.model, tp.group, ff(tp.r), ff(tp.sd), ff(tp.crmse)})
+		}
+		if err := csvWriter(*statsFile, tWrt); err != nil {
+			return err
+		}
+	}
+
+	p, err := taylorDiagram(points)
+	if err != nil {
+		return err
+	}
+	return fig.savePlot(*outFile, p, 6*vg.Inch, 6*vg.Inch)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/color"
+	"sort"
+	"time"
+
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/vg"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                              TIME SERIES
+// *************************************************************************
+// *************************************************************************
+
+// selection picks out the pairs at one station, city, country or region.
+// Empty fields match everything.
+type selection struct {
+	location, city, country string
+	region                  *region
+}
+
+func (s selection) match(p pair) bool {
+	if !p.hasStation() {
+		return false
+	}
+	if s.location != "" && p.location != s.location {
+		return false
+	}
+	if s.city != "" && p.city != s.city {
+		return false
+	}
+	if s.country != "" && p.country != s.country {
+		return false
+	}
+	if s.region != nil && !s.region.contains(p.lon, p.lat) {
+		return false
+	}
+	return true
+}
+
+func (s selection) String() string {
+	var name string
+	for _, n := range []string{s.location, s.city, s.country} {
+		if n != "" {
+			if name != "" {
+				name += ", "
+			}
+			name += n
+		}
+	}
+	if s.region != nil {
+		if name != "" {
+			name += ", "
+		}
+		name += s.region.name
+	}
+	if name == "" {
+		return "all stations"
+	}
+	return name
+}
+
+func (s selection) filter(pairs []pair) []pair {
+	var out []pair
+	for _, p := range pairs {
+		if s.match(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// selectionFlags adds the flags for choosing a selection to fs. The
+// returned function builds the selection once the flags are parsed.
+func selectionFlags(fs *flag.FlagSet) func() (selection, error) {
+	location := fs.String("station", "", "only use this station (location)")
+	city := fs.String("city", "", "only use this city")
+	country := fs.String("country", "", "only use this country")
+	regionFile := fs.String("regions", "", "GeoJSON file of region polygons")
+	regionName := fs.String("regionname", "name", "GeoJSON property holding the region name")
+	regionSel := fs.String("region", "", "only use this region from the region file")
+	return func() (selection, error) {
+		s := selection{location: *location, city: *city, country: *country}
+		if *regionSel == "" {
+			return s, nil
+		}
+		if *regionFile == "" {
+			return s, fmt.Errorf("selecting a region needs a region file")
+		}
+		regions, err := readRegions(*regionFile, *regionName)
+		if err != nil {
+			return s, err
+		}
+		for i := range regions {
+			if regions[i].name == *regionSel {
+				s.region = &regions[i]
+				return s, nil
+			}
+		}
+		return s, fmt.Errorf("there is no region %q in %s", *regionSel, *regionFile)
+	}
+}
+
+// period returns the start of the aggregation period that t is in. The
+// aggregation is "month", or a time window as in parseWindow.
+func period(t time.Time, agg string) (time.Time, error) {
+	t = t.UTC()
+	if agg == "month" {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	window, err := parseWindow(agg)
+	if err != nil {
+		return t, err
+	}
+	return t.Truncate(window), nil
+}
+
+// seriesPoint is the mean measured and simulated value in one period, with
+// the interquartile range of the measurements.
+type seriesPoint struct {
+	time           time.Time
+	obs, sim       float64
+	obsLo, obsHigh float64
+	n              int
+}
+
+// timeSeries aggregates the pairs into periods.
+func timeSeries(pairs []pair, agg string) ([]seriesPoint, error) {
+	groups := make(map[time.Time][]pair)
+	for _, p := range pairs {
+		t, err := period(p.time, agg)
+		if err != nil {
+			return nil, err
+		}
+		groups[t] = append(groups[t], p)
+	}
+	series := make([]seriesPoint, 0, len(groups))
+	for t, g := range groups {
+		sp := seriesPoint{time: t, n: len(g)}
+		obs := make([]float64, len(g))
+		for i, p := range g {
+			sp.obs += p.y
+			sp.sim += p.x
+			obs[i] = p.y
+		}
+		sp.obs /= float64(len(g))
+		sp.sim /= float64(len(g))
+		sort.Float64s(obs)
+		sp.obsLo, sp.obsHigh = percentile(obs, 25), percentile(obs, 75)
+		series = append(series, sp)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].time.Before(series[j].time) })
+	return series, nil
+}
+
+// plotTimeSeries plots the measured and simulated means, with the
+// interquartile range of the measurements shaded.
+func plotTimeSeries(title string, series []seriesPoint) (*plot.Plot, error) {
+	if len(series) == 0 {
+		return nil, fmt.Errorf("there is no data for %s", title)
+	}
+	p, err := plot.New()
+	if err != nil {
+		return nil, fmt.Errorf("could not create plot: %v", err)
+	}
+	p.Title.Text = title
+	p.Y.Label.Text = "PM2.5 (μg/m³)"
+	p.X.Tick.Marker = plot.TimeTicks{Format: "2006-01-02"}
+
+	obs := make(plotter.XYs, len(series))
+	sim := make(plotter.XYs, len(series))
+	band := make(plotter.XYs, 0, 2*len(series))
+	for i, sp := range series {
+		t := float64(sp.time.Unix())
+		obs[i] = plotter.XY{X: t, Y: sp.obs}
+		sim[i] = plotter.XY{X: t, Y: sp.sim}
+		band = append(band, plotter.XY{X: t, Y: sp.obsLo})
+	}
+	for i := len(series) - 1; i >= 0; i-- {
+		band = append(band, plotter.XY{X: float64(series[i].time.Unix()), Y: series[i].obsHigh})
+	}
+
+	spread, err := plotter.NewPolygon(band)
+	if err != nil {
+		return nil, fmt.Errorf("could not create polygon: %v", err)
+	}
+	spread.Color = color.Gray{Y: 220}
+	spread.LineStyle.Width = 0
+	p.Add(spread)
+	p.Legend.Add("Measured interquartile range", spread)
+
+	for _, l := range []struct {
+		name string
+		xys  plotter.XYs
+		clr  color.Color
+	}{
+		{"Measured", obs, color.Black},
+		{"Simulated", sim, color.RGBA{R: 200, A: 255}},
+	} {
+		line, points, err := plotter.NewLinePoints(l.xys)
+		if err != nil {
+			return nil, fmt.Errorf("could not create new line: %v", err)
+		}
+		line.Color = l.clr
+		points.Color = l.clr
+		points.Radius = vg.Points(1.5)
+		p.Add(line, points)
+		p.Legend.Add(l.name, line, points)
+	}
+	p.Legend.Top = true
+	return p, nil
+}
+
+// timeseriesCmd is the "timeseries" mode, which plots the measured and
+// simulated concentrations over time at a station, city, country or region.
+func timeseriesCmd(args []string) error {
+	fs := flag.NewFlagSet("timeseries", flag.ExitOnError)
+	dataset := datasetFlags(fs)
+	agg := fs.String("agg", "day", "aggregation period: hour, 3h, day or month")
+	outFile := fs.String("out", "timeseries.pdf", "output file")
+	sel := selectionFlags(fs)
+	fig := figFlags(fs)
+	fs.Parse(args)
+
+	s, err := sel()
+	if err != nil {
+		return err
+	}
+	ds, err := dataset()
+	if err != nil {
+		return err
+	}
+	pairs, err := readPairs(ds)
+	if err != nil {
+		return err
+	}
+	series, err := timeSeries(s.filter(pairs), *agg)
+	if err != nil {
+		return err
+	}
+	p, err := plotTimeSeries(s.String(), series)
+	if err != nil {
+		return err
+	}
+	return fig.savePlot(*outFile, p, 10*vg.Inch, 4*vg.Inch)
+}
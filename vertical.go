@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                              MODEL LEVELS
+// *************************************************************************
+// *************************************************************************
+
+// The midpoint of the lowest GEOS-Chem layer is about 60 m above the
+// ground, so the concentration there can be lower than at the inlet of a
+// monitor for primary aerosol emitted near the surface. The levels read as
+// the surface concentration can be chosen, and the result can be corrected
+// to the surface with a fixed factor and with a model diagnostic, in one of
+// three modes (-surfacemode):
+//
+//	factor:  -surfacevar is the ratio of the concentration near the
+//	         surface (e.g. at 10 m) to that of the lowest layer.
+//	ratio:   -surfacevar is the near-surface concentration of a species,
+//	         and -lowestvar its concentration in the layers, e.g.
+//	         SpeciesConcALT1_SO4 and SpeciesConc_SO4. Their ratio, in the
+//	         lowest layer, corrects every tracer.
+//	replace: -surfacevar names the near-surface concentration of each
+//	         variable, with {tracer} for the tracer of the variable, e.g.
+//	         SpeciesConcALT1_{tracer}. It is read instead of the layers.
+
+// levelOptions choose the model levels taken as the surface concentration.
+type levelOptions struct {
+	// level is the index of the lowest level read; 0 is the surface
+	// layer.
+	level int
+	// n is the number of levels averaged, from level upwards.
+	n int
+	// scale multiplies the concentration, e.g. to correct it from the
+	// lowest layer midpoint to the surface.
+	scale float64
+	// factorVar is an optional variable, on the same grid and times as
+	// the tracers, that corrects the concentration in each cell as set by
+	// mode.
+	factorVar string
+	// mode is how factorVar is used: "factor", "ratio" or "replace".
+	mode string
+	// lowestVar is the layer concentration of the species of factorVar,
+	// for the ratio mode.
+	lowestVar string
+}
+
+// vertical is the choice of levels used when reading the model. It is set
+// from the flags of each mode, before anything is read.
+var vertical = levelOptions{n: 1, scale: 1, mode: "factor"}
+
+// levelFlags adds the flags choosing the model levels to fs.
+func levelFlags(fs *flag.FlagSet) {
+	fs.IntVar(&vertical.level, "level", 0, "model level taken as the surface, from 0 for the lowest layer")
+	fs.IntVar(&vertical.n, "nlevels", 1, "number of levels to average, from -level upwards")
+	fs.Float64Var(&vertical.scale, "surfacescale", 1, "factor correcting the model concentration to the surface")
+	fs.StringVar(&vertical.factorVar, "surfacevar", "", "optional model variable correcting the concentration to the surface, as set by -surfacemode")
+	fs.StringVar(&vertical.mode, "surfacemode", "factor", "use of -surfacevar: factor (a ratio of the near-surface to the lowest layer concentration), ratio (a near-surface concentration, divided by -lowestvar in the lowest layer) or replace (the near-surface concentration of each variable, with {tracer} in the name)")
+	fs.StringVar(&vertical.lowestVar, "lowestvar", "", "layer concentration of the species of -surfacevar, for -surfacemode ratio")
+}
+
+// source returns the variable read for pol and the options to read it
+// with. In the replace mode it is the near-surface variable of pol, read
+// at its only (or lowest) level, in the units of pol; otherwise it is pol
+// itself.
+func (o levelOptions) source(f modelFile, pol string) (string, levelOptions, error) {
+	switch o.mode {
+	case "factor", "ratio":
+		if o.mode == "ratio" && (o.factorVar == "" || o.lowestVar == "") {
+			return "", o, fmt.Errorf("the ratio surface correction needs both -surfacevar and -lowestvar")
+		}
+		return pol, o, nil
+	case "replace":
+		if o.factorVar == "" {
+			return "", o, fmt.Errorf("the replace surface correction needs -surfacevar")
+		}
+	default:
+		return "", o, fmt.Errorf("unknown surface correction %q: should be factor, ratio or replace", o.mode)
+	}
+	tracer := pol
+	if i := strings.LastIndex(pol, "__"); i >= 0 {
+		tracer = pol[i+2:]
+	}
+	v := strings.Replace(o.factorVar, "{tracer}", tracer, -1)
+	if f.Lengths(v) == nil {
+		return "", o, fmt.Errorf("the near-surface concentration %s of %s isn't on file", v, pol)
+	}
+	scale := o.scale
+	// GEOS-Chem 12+ concentrations are in mol mol-1 dry air, and the bpch
+	// tracers in ppbv.
+	if strings.HasPrefix(strings.ToLower(f.Units(pol)), "ppb") && strings.HasPrefix(strings.ToLower(f.Units(v)), "mol") {
+		scale *= 1e9
+	}
+	return v, levelOptions{n: 1, scale: scale, mode: "factor"}, nil
+}
+
+// levels returns the level indices to average for a variable with the
+// dimensions dims: (time, lev, lat, lon), or (time, lat, lon) with only a
+// surface level.
+func (o levelOptions) levels(pol string, dims []int) ([]int, error) {
+	if o.n < 1 || o.level < 0 {
+		return nil, fmt.Errorf("the levels should be at least 0 and the number of levels at least 1")
+	}
+	nlev := 1
+	if len(dims) == 4 {
+		nlev = dims[1]
+	} else if len(dims) != 3 {
+		return nil, fmt.Errorf("%s has %d dimensions, not (time, lev, lat, lon) or (time, lat, lon)", pol, len(dims))
+	}
+	if o.level+o.n > nlev {
+		return nil, fmt.Errorf("%s has %d levels, so levels %d to %d can't be read", pol, nlev, o.level, o.level+o.n-1)
+	}
+	levs := make([]int, o.n)
+	for i := range levs {
+		levs[i] = o.level + i
+	}
+	return levs, nil
+}
+
+// factor is the surface correction of a cell at a time index.
+func (o levelOptions) factor(f modelFile, hour, lat, lon int) (float32, error) {
+	if o.factorVar == "" {
+		return float32(o.scale), nil
+	}
+	v, err := cellValue(f, o.factorVar, hour, lat, lon)
+	if err != nil {
+		return 0, err
+	}
+	if o.mode != "ratio" {
+		return float32(o.scale) * v, nil
+	}
+	lowest, err := cellValue(f, o.lowestVar, hour, lat, lon)
+	if err != nil {
+		return 0, err
+	}
+	return float32(o.scale) * surfaceRatio(v, lowest), nil
+}
+
+// surfaceRatio is the ratio of the near-surface to the lowest layer
+// concentration, or 1 where there is nothing in the lowest layer.
+func surfaceRatio(near, lowest float32) float32 {
+	if lowest == 0 {
+		return 1
+	}
+	return near / lowest
+}
+
+// cellValue reads v in a cell at a time index, at its lowest level.
+func cellValue(f modelFile, v string, hour, lat, lon int) (float32, error) {
+	dims := f.Lengths(v)
+	if len(dims) < 3 {
+		return 0, fmt.Errorf("the surface correction %s isn't on file as a gridded variable", v)
+	}
+	start, end := make([]int, len(dims)), make([]int, len(dims))
+	start[0] = hour
+	start[len(dims)-2], start[len(dims)-1] = lat, lon
+	for i := range end {
+		end[i] = start[i] + 1
+	}
+	values, err := f.Read(v, start, end)
+	if err != nil {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// factorField is factor for every one of the n cells of a field read by
+// levelField.
+func (o levelOptions) factorField(f modelFile, hour, n int) ([]float32, error) {
+	out := make([]float32, n)
+	for c := range out {
+		out[c] = float32(o.scale)
+	}
+	if o.factorVar == "" {
+		return out, nil
+	}
+	read := func(v string) ([]float32, error) {
+		field, err := levelField(f, v, hour, levelOptions{n: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(field) != n {
+			return nil, fmt.Errorf("the surface correction %s has %d cells, not %d", v, len(field), n)
+		}
+		return field, nil
+	}
+	factors, err := read(o.factorVar)
+	if err != nil {
+		return nil, err
+	}
+	var lowest []float32
+	if o.mode == "ratio" {
+		if lowest, err = read(o.lowestVar); err != nil {
+			return nil, err
+		}
+	}
+	for c := range out {
+		if lowest != nil {
+			out[c] *= surfaceRatio(factors[c], lowest[c])
+		} else {
+			out[c] *= factors[c]
+		}
+	}
+	return out, nil
+}
+
+// levelField reads pol at the given time index on its grid (see
+// modelGrid), averaged over the levels chosen by o. The surface correction
+// isn't applied.
+func levelField(f modelFile, pol string, hour int, o levelOptions) ([]float32, error) {
+	dims := f.Lengths(pol)
+	if len(dims) < 3 {
+		return nil, fmt.Errorf("%v isn't on file as a gridded variable", pol)
+	}
+	nlat, nlon := dims[len(dims)-2], dims[len(dims)-1]
+	levs, err := o.levels(pol, dims)
+	if err != nil {
+		return nil, err
+	}
+	// Only the levels needed are read.
+	start, end := make([]int, len(dims)), make([]int, len(dims))
+	start[0], end[0] = hour, hour+1
+	if len(dims) == 4 {
+		start[1], end[1] = levs[0], levs[len(levs)-1]+1
+	}
+	end[len(dims)-2], end[len(dims)-1] = nlat, nlon
+	values, err := f.Read(pol, start, end)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]float32, nlat*nlon)
+	for l := range levs {
+		for c := range out {
+			out[c] += values[l*nlat*nlon+c]
+		}
+	}
+	for c := range out {
+		out[c] /= float32(len(levs))
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSurfaceModes(t *testing.T) {
+	// Two cells, with two layers of SO4 in ppbv, and the 10 m SO4 in mol
+	// mol-1 and its ratio to the lowest layer.
+	f := fakeModel{
+		values: map[string][]float32{
+			"IJ_AVG_S__SO4":       {2, 4, 3, 5},
+			"SpeciesConcALT1_SO4": {1e-9, 6e-9},
+			"SpeciesConc_SO4":     {2e-9, 4e-9},
+			"ratio":               {0.5, 1.5},
+		},
+		dims: map[string][]int{
+			"IJ_AVG_S__SO4":       {1, 2, 1, 2},
+			"SpeciesConcALT1_SO4": {1, 1, 2},
+			"SpeciesConc_SO4":     {1, 1, 1, 2},
+			"ratio":               {1, 1, 2},
+		},
+		units: map[string]string{
+			"IJ_AVG_S__SO4":       "ppbv",
+			"SpeciesConcALT1_SO4": "mol mol-1 dry",
+			"SpeciesConc_SO4":     "mol mol-1 dry",
+		},
+	}
+	defer func(o levelOptions) { vertical = o }(vertical)
+	for _, test := range []struct {
+		name    string
+		o       levelOptions
+		want    []float32
+		wantErr bool
+	}{
+		{"lowest layer", levelOptions{n: 1, scale: 1, mode: "factor"}, []float32{2, 4}, false},
+		{"two layers", levelOptions{n: 2, scale: 1, mode: "factor"}, []float32{2.5, 4.5}, false},
+		{"scale", levelOptions{n: 1, scale: 0.5, mode: "factor"}, []float32{1, 2}, false},
+		{"factor", levelOptions{n: 1, scale: 2, mode: "factor", factorVar: "ratio"}, []float32{2, 12}, false},
+		{"ratio", levelOptions{n: 1, scale: 1, mode: "ratio", factorVar: "SpeciesConcALT1_SO4", lowestVar: "SpeciesConc_SO4"}, []float32{1, 6}, false},
+		{"replace", levelOptions{n: 2, scale: 1, mode: "replace", factorVar: "SpeciesConcALT1_{tracer}"}, []float32{1, 6}, false},
+		{"ratio without lowestvar", levelOptions{n: 1, scale: 1, mode: "ratio", factorVar: "SpeciesConcALT1_SO4"}, nil, true},
+		{"replace without a variable", levelOptions{n: 1, scale: 1, mode: "replace", factorVar: "{tracer}_10m"}, nil, true},
+		{"unknown mode", levelOptions{n: 1, scale: 1, mode: "other"}, nil, true},
+	} {
+		vertical = test.o
+		got, err := fieldReading(f, "IJ_AVG_S__SO4", 0)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: the error is %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for c := range got {
+			got[c] = float32(int(got[c]*1e4+0.5)) / 1e4
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: the field is %v, not %v", test.name, got, test.want)
+		}
+		// A cell is read as in the field.
+		if v, err := varReading(0, 0, 1, f, "IJ_AVG_S__SO4"); err != nil || v < test.want[1]*0.9999 || v > test.want[1]*1.0001 {
+			t.Errorf("%s: the cell is %g (%v), not %g", test.name, v, err, test.want[1])
+		}
+	}
+}
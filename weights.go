@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// *************************************************************************
+// *************************************************************************
+//                            WEIGHTED STATISTICS
+// *************************************************************************
+// *************************************************************************
+
+// The pooled statistics are dominated by places with dense monitoring
+// networks. The weighting schemes below are:
+//
+//	none:    every pair counts equally.
+//	station: every station counts equally, however many measurements it
+//	         has.
+//	cell:    the pairs in each grid cell and hour are averaged before the
+//	         statistics are computed, so that every cell and hour counts
+//	         equally.
+//	area:    every model grid cell is weighted by its area, which is
+//	         shared equally between the pairs in it. The cells and their
+//	         areas are those recorded at pairing time.
+var weightings = []string{"none", "station", "cell", "area"}
+
+// applyWeighting returns the data and weights to pass to the metrics for
+// the given weighting scheme.
+func applyWeighting(pairs []pair, scheme string) ([]xy, []float64, error) {
+	switch scheme {
+	case "", "none":
+		return pairXYs(pairs), nil, nil
+	case "station":
+		w, err := stationWeights(pairs)
+		return pairXYs(pairs), w, err
+	case "cell":
+		data, err := cellAverage(pairs)
+		return data, nil, err
+	case "area":
+		w, err := areaWeights(pairs)
+		return pairXYs(pairs), w, err
+	}
+	return nil, nil, fmt.Errorf("unknown weighting %q: should be one of %v", scheme, weightings)
+}
+
+// stationKey identifies a station by its name and position, as different
+// stations can share a name.
+func stationKey(p pair) string {
+	return fmt.Sprintf("%s|%g|%g", p.location, p.lat, p.lon)
+}
+
+// stationWeights gives every pair a weight of 1/n, where n is the number of
+// pairs at its station.
+func stationWeights(pairs []pair) ([]float64, error) {
+	n := make(map[string]int)
+	for _, p := range pairs {
+		if !p.hasStation() {
+			return nil, fmt.Errorf("station weighting needs the station information in the paired results")
+		}
+		n[stationKey(p)]++
+	}
+	w := make([]float64, len(pairs))
+	for i, p := range pairs {
+		w[i] = 1 / float64(n[stationKey(p)])
+	}
+	return w, nil
+}
+
+// cellAverage averages the simulated and measured values of the pairs in
+// each grid cell and hour.
+func cellAverage(pairs []pair) ([]xy, error) {
+	cells, err := cellPairs(pairs, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return cellXYs(cells), nil
+}
+
+// areaWeights gives the pairs in each model grid cell an equal share of
+// the cell area.
+func areaWeights(pairs []pair) ([]float64, error) {
+	n := make(map[int]int)
+	for _, p := range pairs {
+		if p.area <= 0 {
+			return nil, errNoCell
+		}
+		n[p.cell]++
+	}
+	w := make([]float64, len(pairs))
+	for i, p := range pairs {
+		w[i] = p.area / float64(n[p.cell])
+	}
+	return w, nil
+}
+
+// errNoCell is the error for paired results without their model cell.
+var errNoCell = fmt.Errorf("the model grid cells aren't in the paired results, which have to be paired again to record them")
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAreaWeights(t *testing.T) {
+	// Two stations share a cell of 100 km², and a third has a cell of 60
+	// km² to itself, whatever the latitudes of the stations.
+	pairs := []pair{
+		{location: "a", lat: 10, cell: 7, area: 100},
+		{location: "b", lat: 10.4, cell: 7, area: 100},
+		{location: "c", lat: 60, cell: 12, area: 60},
+	}
+	w, err := areaWeights(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w[0] != 50 || w[1] != 50 || w[2] != 60 {
+		t.Errorf("the area weights are %v, not [50 50 60]", w)
+	}
+
+	// Results paired without the cells can't be weighted by area.
+	pairs = append(pairs, pair{location: "d", lat: 10})
+	if _, err := areaWeights(pairs); err == nil {
+		t.Error("a pair without its cell should be rejected")
+	}
+}
+
+func TestPairRecordCell(t *testing.T) {
+	p := pair{xy: xy{12.5, 10}, time: time.Date(2015, 11, 20, 3, 0, 0, 0, time.UTC), location: "a", city: "b", country: "US",
+		lat: 44.98, lon: -93.26, cell: 2469, cellLat: 44, cellLon: -92.5, area: 49613.5}
+	got, err := parsePair(pairRecord(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != p {
+		t.Errorf("the pair is read back as %+v, not %+v", got, p)
+	}
+
+	// The files written before the cells were recorded are still read.
+	got, err = parsePair(pairRecord(p)[:9])
+	if err != nil || got.area != 0 || got.lat != p.lat {
+		t.Errorf("a pair without its cell is read as %+v (%v)", got, err)
+	}
+}